@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	actionsFileName = "hf_actions.json"
+	actionsEnv      = "HIGGSFIELD_ACTIONS_FILE"
+	actionsVersion  = 1
+)
+
+// RunActions are directives the training code gives invoker about its run.
+// The higgsfield python side writes them as a json object to the file in
+// HIGGSFIELD_ACTIONS_FILE, e.g.
+//
+//	{"version": 1, "restartable": false, "max_restarts": 3, "notify_channel": "#training"}
+//
+// Unset directives leave invoker's defaults alone.
+type RunActions struct {
+	// Restartable false keeps watch from restarting the run when it fails.
+	Restartable *bool `json:"restartable,omitempty"`
+	// MaxRestarts replaces --max_restarts of watch for the run.
+	MaxRestarts *int `json:"max_restarts,omitempty"`
+	// NotifyChannel is passed on to hooks with the state, for notification
+	// plugins to route by.
+	NotifyChannel string `json:"notify_channel,omitempty"`
+}
+
+// parseRunActions decodes the actions file leniently: keys may use dashes
+// and the hf_action_ prefix, and values may be strings holding a bool or
+// a number. Unknown directives are returned as warnings rather than
+// failing, so older invokers keep working with newer training code.
+func parseRunActions(data []byte) (RunActions, []string, error) {
+	var actions RunActions
+	var raw map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return actions, nil, errors.WithMessage(err, "actions are not a json object")
+	}
+
+	warnings := make([]string, 0)
+	for _, key := range sortedKeys(raw) {
+		value := raw[key]
+		name := strings.TrimPrefix(strings.ReplaceAll(strings.ToLower(strings.TrimSpace(key)), "-", "_"), "hf_action_")
+
+		switch name {
+		case "version":
+			if v, err := actionInt(value); err != nil || v != actionsVersion {
+				warnings = append(warnings, fmt.Sprintf("actions have version %v, reading them as version %d", value, actionsVersion))
+			}
+		case "restartable":
+			v, err := actionBool(value)
+			if err != nil {
+				return actions, warnings, errors.WithMessagef(err, "invalid %s", key)
+			}
+			actions.Restartable = &v
+		case "max_restarts":
+			v, err := actionInt(value)
+			if err == nil && v < 0 {
+				err = errors.New("it can't be negative")
+			}
+			if err != nil {
+				return actions, warnings, errors.WithMessagef(err, "invalid %s", key)
+			}
+			actions.MaxRestarts = &v
+		case "notify_channel":
+			v, ok := value.(string)
+			if !ok {
+				return actions, warnings, errors.Errorf("invalid %s: expected a string, got %v", key, value)
+			}
+			actions.NotifyChannel = strings.TrimSpace(v)
+		default:
+			warnings = append(warnings, fmt.Sprintf("unknown action %s", key))
+		}
+	}
+
+	return actions, warnings, nil
+}
+
+func actionBool(value any) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(v))
+	case json.Number:
+		return strconv.ParseBool(v.String())
+	}
+
+	return false, errors.Errorf("expected a bool, got %v", value)
+}
+
+func actionInt(value any) (int, error) {
+	switch v := value.(type) {
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err
+	case string:
+		return strconv.Atoi(strings.TrimSpace(v))
+	}
+
+	return 0, errors.Errorf("expected an integer, got %v", value)
+}
+
+// actionsFile is where the actions of the run are on this host.
+func actionsFile(state ExperimentState) (string, error) {
+	_, runDir, err := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(runDir, actionsFileName), nil
+}
+
+// refreshActions reads the actions of the run and records them in its
+// state. The file may be read while it's being written, so if it doesn't
+// parse the last recorded actions stay in effect.
+func (m *InnerStateManager) refreshActions(state ExperimentState) ExperimentState {
+	file, err := actionsFile(state)
+	if err != nil {
+		return state
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state
+	} else if err != nil {
+		warnf("failed to read actions of %s: %v\n", state.ContainerName, err)
+		return state
+	}
+
+	actions, warnings, err := parseRunActions(data)
+	for _, w := range warnings {
+		warnf("%s: %s\n", state.ContainerName, w)
+	}
+	if err != nil {
+		warnf("ignoring actions of %s: %v\n", state.ContainerName, err)
+		return state
+	}
+
+	previous, _ := json.Marshal(state.Actions)
+	next, _ := json.Marshal(actions)
+	if bytes.Equal(previous, next) {
+		return state
+	}
+
+	state.Actions = actions
+	if err := m.putActions(state.ContainerName, actions); err != nil {
+		warnf("failed to record actions of %s: %v\n", state.ContainerName, err)
+	}
+
+	return state
+}
+
+func (m *InnerStateManager) putActions(containerName string, actions RunActions) error {
+	unlock, err := m.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := m.Get(containerName)
+	if err != nil || current == nil {
+		return err
+	}
+
+	current.Actions = actions
+	return m.Put(*current)
+}
@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// AutoscaleConfig lets `experiment watch` request gpu nodes from a
+// provisioner while runs wait for resources on this host, and release them
+// once nothing has run or waited for the cooldown. It's read from
+// ~/.config/higgsfield/autoscale.json.
+//
+// The provisioner is a plugin, see PluginConfig, that gets requests of kind
+// provisioner. For the action scale_up it gets the pending runs and count,
+// the number of nodes wanted, and answers with {"nodes": ["id", ...]}, the
+// ids of the nodes it added. For scale_down it gets the nodes to release.
+// It may wrap terraform apply, a cloud api or a cluster autoscaler.
+type AutoscaleConfig struct {
+	Provisioner string `json:"provisioner"`
+	// MinPending is how many runs have to wait before nodes are requested,
+	// 1 if 0.
+	MinPending int `json:"min_pending"`
+	// PendingFor is how long they have to wait first, and how long after a
+	// request the next one may be made, so new nodes get time to join. 5m
+	// if empty.
+	PendingFor string `json:"pending_for"`
+	// Cooldown is how long nothing has to run or wait before the nodes are
+	// released, 30m if empty.
+	Cooldown string `json:"cooldown"`
+	// MaxNodes caps the nodes requested and not yet released, 1 if 0.
+	MaxNodes int `json:"max_nodes"`
+}
+
+const (
+	defaultPendingFor = 5 * time.Minute
+	defaultCooldown   = 30 * time.Minute
+
+	provisionerScaleUp   = "scale_up"
+	provisionerScaleDown = "scale_down"
+)
+
+func LoadAutoscaleConfig() (AutoscaleConfig, error) {
+	var config AutoscaleConfig
+	if err := loadConfigFile("autoscale.json", &config); err != nil {
+		return AutoscaleConfig{}, err
+	}
+
+	return config, nil
+}
+
+func (c AutoscaleConfig) durations() (pendingFor, cooldown time.Duration, err error) {
+	parse := func(name, value string, fallback time.Duration) (time.Duration, error) {
+		if value == "" {
+			return fallback, nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return 0, errors.Errorf("invalid %s %q in autoscale.json, expected a duration like 10m", name, value)
+		}
+		return d, nil
+	}
+
+	if pendingFor, err = parse("pending_for", c.PendingFor, defaultPendingFor); err != nil {
+		return 0, 0, err
+	}
+	cooldown, err = parse("cooldown", c.Cooldown, defaultCooldown)
+	return pendingFor, cooldown, err
+}
+
+// PendingRun is a launch waiting for resources on this host, recorded while
+// it waits so the autoscaler can see the queue.
+type PendingRun struct {
+	ContainerName string      `json:"container_name"`
+	ProjectName   string      `json:"project_name"`
+	Team          string      `json:"team"`
+	Reservation   Reservation `json:"reservation"`
+	LauncherPID   int         `json:"launcher_pid"`
+	Since         time.Time   `json:"since"`
+	// Reason is why it can't start yet.
+	Reason string `json:"reason"`
+}
+
+// ProvisionedNode is a node the provisioner added and invoker hasn't
+// released yet.
+type ProvisionedNode struct {
+	ID          string    `json:"id"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// autoscaleState is what the autoscaler remembers between passes.
+type autoscaleState struct {
+	Nodes       []ProvisionedNode `json:"nodes"`
+	LastScaleUp time.Time         `json:"last_scale_up"`
+	// IdleSince is when nothing ran or waited anymore, zero while
+	// something does.
+	IdleSince time.Time `json:"idle_since"`
+}
+
+func (m *InnerStateManager) pendingDir() string {
+	return filepath.Join(filepath.Dir(m.dir), "pending")
+}
+
+func (m *InnerStateManager) autoscaleFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "autoscale.json")
+}
+
+// markPending records the run as waiting, keeping when it started to.
+func (m *InnerStateManager) markPending(state ExperimentState, reason string) error {
+	if err := files.MkdirAll(m.pendingDir(), 0o755); err != nil {
+		return errors.WithMessage(err, "failed to create pending directory")
+	}
+
+	name := filepath.Join(m.pendingDir(), state.ContainerName+".json")
+	pending := PendingRun{
+		ContainerName: state.ContainerName,
+		ProjectName:   state.ProjectName,
+		Team:          state.Team,
+		Reservation:   state.Reservation,
+		LauncherPID:   os.Getpid(),
+		Since:         clock.Now().UTC(),
+		Reason:        reason,
+	}
+	if data, err := files.ReadFile(name); err == nil {
+		var previous PendingRun
+		if json.Unmarshal(data, &previous) == nil && previous.LauncherPID == pending.LauncherPID {
+			pending.Since = previous.Since
+		}
+	}
+
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode pending run")
+	}
+
+	return errors.WithMessage(files.WriteFile(name, data, 0o644), "failed to write pending run")
+}
+
+func (m *InnerStateManager) clearPending(containerName string) {
+	err := files.Remove(filepath.Join(m.pendingDir(), containerName+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		warnf("failed to clear pending run %s: %v\n", containerName, err)
+	}
+}
+
+// Pending are the runs waiting for resources, oldest first. Records of
+// launchers that died while waiting are dropped.
+func (m *InnerStateManager) Pending() ([]PendingRun, error) {
+	entries, err := files.ReadDir(m.pendingDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to list pending runs")
+	}
+
+	pending := make([]PendingRun, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := files.ReadFile(filepath.Join(m.pendingDir(), entry.Name()))
+		if err != nil {
+			continue
+		}
+		var p PendingRun
+		if err := json.Unmarshal(data, &p); err != nil {
+			continue
+		}
+		if !processAlive(p.LauncherPID) {
+			m.clearPending(p.ContainerName)
+			continue
+		}
+		pending = append(pending, p)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Since.Before(pending[j].Since) })
+
+	return pending, nil
+}
+
+func (m *InnerStateManager) autoscaleState() (autoscaleState, error) {
+	var state autoscaleState
+
+	data, err := files.ReadFile(m.autoscaleFile())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, errors.WithMessage(err, "failed to read autoscale state")
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.WithMessage(err, "failed to parse autoscale state")
+	}
+
+	return state, nil
+}
+
+func (m *InnerStateManager) putAutoscaleState(state autoscaleState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode autoscale state")
+	}
+
+	tmp := m.autoscaleFile() + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write autoscale state")
+	}
+
+	return errors.WithMessage(files.Rename(tmp, m.autoscaleFile()), "failed to write autoscale state")
+}
+
+// autoscaleOnce is a pass of the autoscaler, run by `experiment watch`.
+// Nothing happens without a provisioner.
+func autoscaleOnce(sm *InnerStateManager, states []ExperimentState) error {
+	config, err := LoadAutoscaleConfig()
+	if err != nil || config.Provisioner == "" {
+		return err
+	}
+	pendingFor, cooldown, err := config.durations()
+	if err != nil {
+		return err
+	}
+	minPending, maxNodes := config.MinPending, config.MaxNodes
+	if minPending <= 0 {
+		minPending = 1
+	}
+	if maxNodes <= 0 {
+		maxNodes = 1
+	}
+
+	pending, err := sm.Pending()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := sm.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	scaler, err := sm.autoscaleState()
+	if err != nil {
+		return err
+	}
+	now := clock.Now().UTC()
+
+	switch {
+	case len(pending) > 0 || len(states) > 0:
+		scaler.IdleSince = time.Time{}
+	case scaler.IdleSince.IsZero():
+		scaler.IdleSince = now
+	}
+
+	waiting := make([]PendingRun, 0, len(pending))
+	for _, p := range pending {
+		if now.Sub(p.Since) >= pendingFor {
+			waiting = append(waiting, p)
+		}
+	}
+
+	switch {
+	case len(waiting) >= minPending && len(scaler.Nodes) < maxNodes && now.Sub(scaler.LastScaleUp) >= pendingFor:
+		count := min(len(waiting), maxNodes-len(scaler.Nodes))
+		var response struct {
+			Nodes []string `json:"nodes"`
+		}
+		request := pluginRequest{Kind: "provisioner", Action: provisionerScaleUp, Pending: waiting, Count: count}
+		// a failed request is only retried after pending_for, like a
+		// successful one
+		scaler.LastScaleUp = now
+		if err := callPlugin(config.Provisioner, request, &response); err != nil {
+			if err := sm.putAutoscaleState(scaler); err != nil {
+				warnf("%v\n", err)
+			}
+			return err
+		}
+		for _, id := range response.Nodes {
+			scaler.Nodes = append(scaler.Nodes, ProvisionedNode{ID: id, RequestedAt: now})
+		}
+		infof("requested %d nodes for %d waiting runs, got %s\n", count, len(waiting), orNone(strings.Join(response.Nodes, ", ")))
+
+	case len(scaler.Nodes) > 0 && !scaler.IdleSince.IsZero() && now.Sub(scaler.IdleSince) >= cooldown:
+		ids := make([]string, 0, len(scaler.Nodes))
+		for _, n := range scaler.Nodes {
+			ids = append(ids, n.ID)
+		}
+		request := pluginRequest{Kind: "provisioner", Action: provisionerScaleDown, Nodes: ids}
+		if err := callPlugin(config.Provisioner, request, nil); err != nil {
+			return err
+		}
+		infof("released %s after %s idle\n", strings.Join(ids, ", "), units.HumanDuration(now.Sub(scaler.IdleSince)))
+		scaler.Nodes = nil
+	}
+
+	return sm.putAutoscaleState(scaler)
+}
+
+// AutoscaleStatus prints the runs waiting for resources on this host and
+// the nodes the provisioner added for them.
+func AutoscaleStatus() {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	pending, err := sm.Pending()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	scaler, err := sm.autoscaleState()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	now := clock.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PENDING\tPROJECT\tTEAM\tWAITING\tREASON")
+	for _, p := range pending {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.ContainerName, p.ProjectName, p.Team, units.HumanDuration(now.Sub(p.Since)), p.Reason)
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tREQUESTED")
+	for _, n := range scaler.Nodes {
+		fmt.Fprintf(w, "%s\t%s ago\n", n.ID, units.HumanDuration(now.Sub(n.RequestedAt)))
+	}
+	w.Flush()
+	if !scaler.IdleSince.IsZero() {
+		fmt.Printf("idle for %s\n", units.HumanDuration(now.Sub(scaler.IdleSince)))
+	}
+}
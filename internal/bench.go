@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	runKindBench        = "bench"
+	benchNCCLExperiment = "bench_nccl"
+)
+
+// allReducePerf times all_reduce over doubling message sizes and prints
+// what nccl-tests' all_reduce_perf prints, taking the slowest rank like it
+// does. It runs under torchrun, so it rendezvouses and talks over the
+// network exactly like a training run in the same container.
+const allReducePerf = `
+import os, sys, time
+import torch
+import torch.distributed as dist
+
+min_bytes, max_bytes, iters = int(sys.argv[1]), int(sys.argv[2]), int(sys.argv[3])
+torch.cuda.set_device(int(os.environ["LOCAL_RANK"]))
+dist.init_process_group("nccl")
+rank, n = dist.get_rank(), dist.get_world_size()
+
+if rank == 0:
+    print("# all_reduce float32 sum, %d ranks, %d iterations" % (n, iters))
+    print("%12s %12s %12s %12s %12s" % ("size(B)", "count", "time(us)", "algbw(GB/s)", "busbw(GB/s)"), flush=True)
+
+size, total, sizes = min_bytes, 0.0, 0
+while size <= max_bytes:
+    count = max(size // 4, 1)
+    x = torch.ones(count, dtype=torch.float32, device="cuda")
+    for _ in range(5):
+        dist.all_reduce(x)
+    torch.cuda.synchronize()
+    dist.barrier()
+
+    start = time.perf_counter()
+    for _ in range(iters):
+        dist.all_reduce(x)
+    torch.cuda.synchronize()
+    elapsed = torch.tensor([(time.perf_counter() - start) / iters], device="cuda")
+    dist.all_reduce(elapsed, op=dist.ReduceOp.MAX)
+    elapsed = elapsed.item()
+
+    algbw = count * 4 / elapsed / 1e9
+    busbw = algbw * 2 * (n - 1) / n
+    total, sizes = total + busbw, sizes + 1
+    if rank == 0:
+        print("%12d %12d %12.1f %12.2f %12.2f" % (count * 4, count, elapsed * 1e6, algbw, busbw), flush=True)
+    size *= 2
+
+if rank == 0:
+    print("# avg bus bandwidth: %.2f GB/s" % (total / max(sizes, 1)), flush=True)
+dist.destroy_process_group()
+`
+
+type BenchNCCLArgs struct {
+	ProjectName  string        `validate:"required,varname"`
+	Hosts        []string      `validate:"required,min=1"`
+	NProcPerNode int           `validate:"required,min=1"`
+	Port         int           `validate:"required,min=1"`
+	GPUs         []int         `validate:"unique,dive,min=0"`
+	MinBytes     string        `validate:"required"`
+	MaxBytes     string        `validate:"required"`
+	Iters        int           `validate:"required,min=1"`
+	Timeout      time.Duration `validate:"required"`
+	// Image runs an existing image instead of building the project.
+	Image         string
+	ProjectPath   string
+	DockerContext string
+	// Local benchmarks as the node of this host, instead of starting every
+	// host over ssh.
+	Local bool
+}
+
+func (args BenchNCCLArgs) remoteFlags() []string {
+	flags := []string{
+		"bench", "nccl", "--local",
+		"--project_name", args.ProjectName,
+		"--hosts", strings.Join(args.Hosts, ","),
+		"--nproc_per_node", fmt.Sprint(args.NProcPerNode),
+		"--port", fmt.Sprint(args.Port),
+		"--min_bytes", args.MinBytes,
+		"--max_bytes", args.MaxBytes,
+		"--iters", fmt.Sprint(args.Iters),
+		"--timeout", args.Timeout.String(),
+		"--project_path", args.ProjectPath,
+	}
+	if args.Image != "" {
+		flags = append(flags, "--image", args.Image)
+	}
+
+	return append(flags, namespaceFlags()...)
+}
+
+// benchEntrypoint is the torchrun command of the benchmark for the node.
+func benchEntrypoint(args BenchNCCLArgs, master string, rank int, minBytes, maxBytes int64) []string {
+	entrypoint := []string{
+		"torchrun",
+		"--nnodes", fmt.Sprint(len(args.Hosts)),
+		"--node_rank", fmt.Sprint(rank),
+		"--nproc_per_node", fmt.Sprint(args.NProcPerNode),
+	}
+	if master != "localhost" {
+		entrypoint = append(entrypoint, "--master_addr", master, "--master_port", fmt.Sprint(args.Port))
+	}
+
+	return append(entrypoint, "--no_python", "python", "-c", allReducePerf,
+		fmt.Sprint(minBytes), fmt.Sprint(maxBytes), fmt.Sprint(args.Iters))
+}
+
+// benchNode runs the benchmark container of this host to completion, like
+// the smoke test, and returns its output.
+func benchNode(ctx context.Context, args BenchNCCLArgs, master string, rank int, minBytes, maxBytes int64) (string, error) {
+	run := RunArgs{
+		ProjectName:    args.ProjectName,
+		Hosts:          args.Hosts,
+		NProcPerNode:   args.NProcPerNode,
+		ExperimentName: benchNCCLExperiment,
+		Kind:           runKindBench,
+		Port:           args.Port,
+		RunName:        clock.Now().UTC().Format("run_20060102_150405"),
+		MaxRepeats:     -1,
+		GPUs:           args.GPUs,
+		Image:          args.Image,
+		ProjectPath:    args.ProjectPath,
+		DockerContext:  args.DockerContext,
+		Namespace:      namespace,
+	}
+	containerName := nameFromRunArgs(run)
+
+	plan := launchPlan{Master: master, Rank: rank, Entrypoint: benchEntrypoint(args, master, rank, minBytes, maxBytes)}
+	if err := launch(ctx, run, plan); err != nil {
+		return "", errors.WithMessage(err, "failed to launch benchmark")
+	}
+
+	dr, err := NewDockerRun(ctx, run.DockerContext, run.ProjectName, run.ProjectPath, "")
+	if err != nil {
+		return "", err
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to open state")
+	}
+
+	exitCode, waitErr := dr.Wait(containerName, args.Timeout)
+	if waitErr == nil && exitCode != 0 {
+		waitErr = errors.Errorf("benchmark exited with code %d", exitCode)
+	}
+
+	output, err := dr.tailLogs(containerName, 200)
+	if err != nil {
+		warnf("%v\n", err)
+	}
+
+	state, err := sm.Get(containerName)
+	if err != nil {
+		return output, err
+	}
+	finishedAt := dr.finishedAt(containerName)
+
+	if err := dr.Kill(containerName); err != nil {
+		return output, err
+	}
+
+	if state != nil {
+		if waitErr != nil {
+			state.Outcome, state.OutcomeReason = outcomeFailed, waitErr.Error()
+		}
+		if err := sm.Retire(*state, finishedAt); err != nil {
+			return output, err
+		}
+	}
+
+	return output, waitErr
+}
+
+// BenchNCCL measures the all_reduce bus bandwidth between the hosts with
+// the container setup of the project, to validate the fabric before a long
+// run. Every host is started over ssh and the first one reports.
+func BenchNCCL(args BenchNCCLArgs) {
+	validateArgs(args)
+
+	minBytes, err := units.RAMInBytes(args.MinBytes)
+	if err == nil && minBytes < 1 {
+		err = errors.Errorf("min_bytes has to be positive")
+	}
+	if err != nil {
+		errorf("invalid min_bytes: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+	maxBytes, err := units.RAMInBytes(args.MaxBytes)
+	if err != nil || maxBytes < minBytes {
+		errorf("invalid max_bytes %s, it has to be at least min_bytes\n", args.MaxBytes)
+		os.Exit(ExitValidation)
+	}
+
+	hosts, err := normalizeHosts(args.Hosts)
+	if err != nil {
+		errorf("invalid hosts: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+	args.Hosts = hosts
+
+	if args.ProjectPath == "" {
+		if args.ProjectPath, err = os.Getwd(); err != nil {
+			errorf("failed to get the working directory: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+	}
+
+	single := len(args.Hosts) == 1 && isLoopback(args.Hosts[0])
+	if !args.Local && !single {
+		fmt.Printf("benchmarking all_reduce across %d hosts\n", len(args.Hosts))
+		failed := runOnHosts(context.Background(), args.Hosts, args.remoteFlags()...)
+		if len(failed) == 0 {
+			return
+		}
+
+		for _, host := range sortedKeys(failed) {
+			fmt.Printf("%s: %v\n", host, failed[host])
+		}
+		os.Exit(ExitInfra)
+	}
+
+	master, rank := "localhost", 0
+	if len(args.Hosts) > 1 {
+		master, rank = rankAndMasterElseExit(args.Hosts)
+	}
+
+	if !isPortAvailable(args.Port) {
+		errorf("port %d is not available\n", args.Port)
+		os.Exit(ExitInfra)
+	}
+
+	output, err := benchNode(context.Background(), args, master, rank, minBytes, maxBytes)
+	if err != nil {
+		fmt.Printf("last output of the benchmark:\n%s\n", output)
+		errorf("benchmark failed: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	// every rank reports the same numbers, the first one prints them
+	if rank == 0 {
+		fmt.Print(output)
+	}
+}
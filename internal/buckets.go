@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BucketMount mounts an object store bucket into the container through
+// FUSE, configured under buckets in invoker.yaml.
+type BucketMount struct {
+	Name string `yaml:"name"`
+	// URL is s3://bucket/prefix for s3fs or gs://bucket/prefix for gcsfuse.
+	URL string `yaml:"url"`
+	// Mount is where the bucket appears in the container, /data/<name> if
+	// empty.
+	Mount string `yaml:"mount"`
+	// Writable mounts the bucket read-write, it's read-only by default.
+	Writable bool `yaml:"writable"`
+	// Options are passed to the FUSE client as -o options, e.g. the
+	// endpoint of an s3 compatible store.
+	Options []string `yaml:"options"`
+}
+
+// isMountPoint tells whether dir is a mount point according to
+// /proc/mounts.
+func isMountPoint(dir string) bool {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == dir {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fuseCommand is the client invocation mounting the bucket at dir.
+func (b BucketMount) fuseCommand(dir string) (string, []string, error) {
+	scheme, rest, ok := strings.Cut(b.URL, "://")
+	if !ok {
+		return "", nil, errors.Errorf("invalid bucket url %s, expected s3://bucket/prefix or gs://bucket/prefix", b.URL)
+	}
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	prefix = strings.Trim(prefix, "/")
+
+	// the docker daemon runs as another user, which FUSE locks out without
+	// allow_other
+	options := append([]string{"allow_other"}, b.Options...)
+	if !b.Writable {
+		options = append(options, "ro")
+	}
+
+	switch scheme {
+	case "s3":
+		source := bucket
+		if prefix != "" {
+			source += ":/" + prefix
+		}
+		return "s3fs", []string{source, dir, "-o", strings.Join(options, ",")}, nil
+	case "gs":
+		args := []string{"--implicit-dirs", "-o", strings.Join(options, ",")}
+		if prefix != "" {
+			args = append(args, "--only-dir", prefix)
+		}
+		return "gcsfuse", append(args, bucket, dir), nil
+	default:
+		return "", nil, errors.Errorf("unsupported bucket url %s, expected s3:// or gs://", b.URL)
+	}
+}
+
+// mountBuckets mounts every bucket on the host under
+// ~/.cache/higgsfield/mounts and returns the binds into the container.
+// Buckets that are mounted already are reused by later runs.
+func mountBuckets(buckets []BucketMount, cacheDir string) ([]string, error) {
+	binds := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		if b.Name == "" {
+			return nil, errors.Errorf("bucket %s has no name", b.URL)
+		}
+
+		dir := Path{path: filepath.Join(cacheDir, "higgsfield", "mounts", b.Name)}
+		if !isMountPoint(dir.path) {
+			if err := dir.mkdirIfNotExists(); err != nil {
+				return nil, errors.WithMessagef(err, "failed to create mount point of bucket %s", b.Name)
+			}
+
+			name, args, err := b.fuseCommand(dir.path)
+			if err != nil {
+				return nil, err
+			}
+
+			fmt.Printf("mounting %s at %s\n", b.URL, dir.path)
+			if _, err := runIn("", name, args...); err != nil {
+				return nil, errors.WithMessagef(err, "failed to mount bucket %s", b.Name)
+			}
+		}
+
+		mount := b.Mount
+		if mount == "" {
+			mount = path.Join("/data", b.Name)
+		}
+
+		bind := dir.path + ":" + mount
+		if !b.Writable {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
+	}
+
+	return binds, nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// envCacheDir overrides the cache directory, which is mounted into the
+	// containers and holds invoker's own files under higgsfield.
+	envCacheDir = "INVOKER_CACHE_DIR"
+	// envCheckpointDir moves the run directories, say to a data disk,
+	// when the home partition is too small for checkpoints.
+	envCheckpointDir = "INVOKER_CHECKPOINT_DIR"
+)
+
+// cacheRoot is $INVOKER_CACHE_DIR, else $XDG_CACHE_HOME, else ~/.cache.
+// Like the XDG spec says, a relative XDG_CACHE_HOME is ignored.
+func cacheRoot() (string, error) {
+	if dir := os.Getenv(envCacheDir); dir != "" {
+		return filepath.Abs(dir)
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Clean(dir), nil
+	}
+
+	home, err := files.UserHomeDir()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to get user home directory")
+	}
+
+	return filepath.Join(home, ".cache"), nil
+}
+
+// configRoot is $XDG_CONFIG_HOME, else ~/.config, like cacheRoot.
+func configRoot() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Clean(dir), nil
+	}
+
+	home, err := files.UserHomeDir()
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to get user home directory")
+	}
+
+	return filepath.Join(home, ".config"), nil
+}
+
+// invokerCacheDir is the path of elem in invoker's part of the cache.
+func invokerCacheDir(elem ...string) (string, error) {
+	root, err := cacheRoot()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(append([]string{root, "higgsfield"}, elem...)...), nil
+}
+
+// checkpointRoot holds the run directories of every project, by project,
+// $INVOKER_CHECKPOINT_DIR or else higgsfield in the cache directory.
+func checkpointRoot() (string, error) {
+	if dir := os.Getenv(envCheckpointDir); dir != "" {
+		return filepath.Abs(dir)
+	}
+
+	return invokerCacheDir()
+}
+
+// SetCacheDirs overrides the cache and checkpoint directories for this
+// invocation and whatever it starts, empty ones are left as they are.
+func SetCacheDirs(cacheDir, checkpointDir string) error {
+	for env, dir := range map[string]string{envCacheDir: cacheDir, envCheckpointDir: checkpointDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid directory %s", dir)
+		}
+		os.Setenv(env, abs)
+	}
+
+	return nil
+}
+
+// SetCacheDirsOrExit is SetCacheDirs for the command line.
+func SetCacheDirsOrExit(cacheDir, checkpointDir string) {
+	if err := SetCacheDirs(cacheDir, checkpointDir); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+}
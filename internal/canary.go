@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type CanaryArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	Image          string `validate:"required_without=Rebuild"`
+	Rebuild        bool
+	Steps          int           `validate:"required,min=1"`
+	Timeout        time.Duration `validate:"required"`
+	// MaxLoss fails the canary if its last loss is higher, unchecked if 0.
+	MaxLoss float64 `validate:"min=0"`
+}
+
+// canaryPasses smoke tests the recorded run of this host on a new image and
+// checks the loss it reached.
+func canaryPasses(ctx context.Context, state ExperimentState, args CanaryArgs) error {
+	runArgs := state.RunArgs
+	if args.Rebuild {
+		runArgs.Image = ""
+	}
+	if args.Image != "" {
+		runArgs.Image = args.Image
+	}
+
+	points, err := smokeTest(ctx, runArgs, args.Steps, args.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if args.MaxLoss == 0 {
+		return nil
+	}
+
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Loss == nil {
+			continue
+		}
+
+		loss := float64(*points[i].Loss)
+		if math.IsNaN(loss) || loss > args.MaxLoss {
+			return errors.Errorf("canary loss %g at step %d is above %g", loss, points[i].Step, args.MaxLoss)
+		}
+		return nil
+	}
+
+	return errors.New("canary reported no loss to check")
+}
+
+// Canary runs the experiment of this host as a smoke test on a new image,
+// exiting non-zero if it fails.
+func Canary(args CanaryArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containerName := nameFromRestartArgs(RestartArgs{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		ContainerName:  args.ContainerName,
+	})
+	state, err := sm.Get(containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if state == nil {
+		errorf("no recorded run for %s on this host\n", containerName)
+		os.Exit(ExitValidation)
+	}
+
+	if err := canaryPasses(context.Background(), *state, args); err != nil {
+		errorf("canary of %s failed: %v\n", containerName, err)
+		os.Exit(ExitTraining)
+	}
+
+	fmt.Printf("canary of %s passed\n", containerName)
+}
+
+type RolloutArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	Hosts          []string `validate:"required,min=1"`
+	Image          string   `validate:"required_without=Rebuild"`
+	Rebuild        bool
+	// CanaryHost runs the canary, the first host if empty.
+	CanaryHost    string
+	CanarySteps   int           `validate:"required,min=1"`
+	CanaryTimeout time.Duration `validate:"required"`
+	CanaryMaxLoss float64       `validate:"min=0"`
+}
+
+func (args RolloutArgs) experimentFlags() []string {
+	flags := []string{"--project_name", args.ProjectName, "--experiment_name", args.ExperimentName}
+	if args.ContainerName != nil && *args.ContainerName != "" {
+		flags = append(flags, "--container_name", *args.ContainerName)
+	}
+	if args.Image != "" {
+		flags = append(flags, "--image", args.Image)
+	}
+	if args.Rebuild {
+		flags = append(flags, "--rebuild")
+	}
+
+	return append(flags, namespaceFlags()...)
+}
+
+// Rollout moves an experiment onto a new image: a canary runs on one host
+// first and only if it passes are all hosts restarted onto the new image.
+// The hosts are driven over ssh.
+func Rollout(args RolloutArgs) {
+	validateArgs(args)
+
+	canaryHost := args.CanaryHost
+	if canaryHost == "" {
+		canaryHost = args.Hosts[0]
+	}
+
+	ctx := context.Background()
+
+	fmt.Printf("running canary on %s\n", canaryHost)
+	canary := append([]string{"experiment", "canary"}, args.experimentFlags()...)
+	canary = append(canary,
+		"--steps", strconv.Itoa(args.CanarySteps),
+		"--timeout", args.CanaryTimeout.String(),
+		"--max_loss", strconv.FormatFloat(args.CanaryMaxLoss, 'g', -1, 64),
+	)
+	if err := runOnHost(ctx, canaryHost, canary...); err != nil {
+		errorf("canary failed, %s stays on its current image: %v\n", args.ExperimentName, err)
+		os.Exit(ExitTraining)
+	}
+
+	fmt.Printf("canary passed, restarting %d hosts\n", len(args.Hosts))
+	restart := append([]string{"experiment", "restart"}, args.experimentFlags()...)
+	failed := runOnHosts(ctx, args.Hosts, restart...)
+	if len(failed) == 0 {
+		fmt.Printf("rolled out %s to %d hosts\n", args.ExperimentName, len(args.Hosts))
+		return
+	}
+
+	for _, host := range sortedKeys(failed) {
+		fmt.Printf("%s: %v\n", host, failed[host])
+	}
+	os.Exit(ExitInfra)
+}
@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// cgroupRoot is where the cgroup file systems are mounted, the unified
+// hierarchy of v2 or a directory per controller with v1.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// sessionLimits are what invoker itself may use when it runs in a
+// container or a cgroup limited session, as on managed nodes, rather than
+// what the host has.
+type sessionLimits struct {
+	// CPUs is the cpu quota, 0 without one.
+	CPUs float64
+	// Cpuset are the cpus invoker may run on, empty if those are all the
+	// cpus of the host.
+	Cpuset []int
+	// MemoryBytes is the memory limit, 0 without one.
+	MemoryBytes int64
+}
+
+func (l sessionLimits) limited() bool {
+	return l.CPUs > 0 || len(l.Cpuset) > 0 || l.MemoryBytes > 0
+}
+
+func (l sessionLimits) String() string {
+	parts := make([]string, 0, 3)
+	if l.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("%g cpus", l.CPUs))
+	}
+	if len(l.Cpuset) > 0 {
+		parts = append(parts, "cpus "+formatCPUList(l.Cpuset))
+	}
+	if l.MemoryBytes > 0 {
+		parts = append(parts, units.BytesSize(float64(l.MemoryBytes))+" of memory")
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// parseCPUList parses lists like 0-3,8,10-11 of /sys and /proc.
+func parseCPUList(list string) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, errors.Errorf("invalid cpu list %q", list)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(to); err != nil || last < first {
+				return nil, errors.Errorf("invalid cpu list %q", list)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// formatCPUList is the inverse of parseCPUList, as docker takes cpusets.
+func formatCPUList(cpus []int) string {
+	sorted := append([]int(nil), cpus...)
+	sort.Ints(sorted)
+
+	parts := make([]string, 0)
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// cgroupPaths are the cgroups of invoker by controller, from
+// /proc/self/cgroup. The unified hierarchy of v2 is under "".
+func cgroupPaths() (map[string]string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read /proc/self/cgroup")
+	}
+
+	paths := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// 0::/user.slice/user-1000.slice/session-3.scope
+		// 4:memory:/docker/0123abcd
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			paths[controller] = fields[2]
+		}
+	}
+
+	return paths, nil
+}
+
+// cgroupDirs are the directories of the cgroup and its parents under the
+// mount, innermost first. In a container with its own cgroup namespace the
+// path is relative to the container's cgroup, which is the mount itself.
+func cgroupDirs(mount, path string) []string {
+	dirs := make([]string, 0)
+	for {
+		dir := filepath.Join(mount, path)
+		if _, err := os.Stat(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+		if path == "/" || path == "." || path == "" {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	if len(dirs) == 0 {
+		dirs = append(dirs, mount)
+	}
+
+	return dirs
+}
+
+func readCgroupFile(dir, name string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", false
+	}
+
+	return strings.TrimSpace(string(data)), true
+}
+
+// cgroupLimits reads the cpu and memory limits of the cgroups of invoker,
+// the tightest of the cgroup and its parents.
+func cgroupLimits() (sessionLimits, error) {
+	paths, err := cgroupPaths()
+	if err != nil {
+		return sessionLimits{}, err
+	}
+
+	var limits sessionLimits
+	tighten := func(cpus float64, memory int64) {
+		if cpus > 0 && (limits.CPUs == 0 || cpus < limits.CPUs) {
+			limits.CPUs = cpus
+		}
+		if memory > 0 && (limits.MemoryBytes == 0 || memory < limits.MemoryBytes) {
+			limits.MemoryBytes = memory
+		}
+	}
+
+	// hybrid hosts list the unified hierarchy too, without its controllers
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+		path := paths[""]
+		for _, dir := range cgroupDirs(cgroupRoot, path) {
+			var cpus float64
+			var memory int64
+			// 200000 100000, or max 100000
+			if value, ok := readCgroupFile(dir, "cpu.max"); ok {
+				if fields := strings.Fields(value); len(fields) == 2 && fields[0] != "max" {
+					quota, _ := strconv.ParseFloat(fields[0], 64)
+					period, _ := strconv.ParseFloat(fields[1], 64)
+					if period > 0 {
+						cpus = quota / period
+					}
+				}
+			}
+			if value, ok := readCgroupFile(dir, "memory.max"); ok && value != "max" {
+				memory, _ = strconv.ParseInt(value, 10, 64)
+			}
+			tighten(cpus, memory)
+		}
+		return limits, nil
+	}
+
+	if path, ok := paths["cpu"]; ok {
+		for _, dir := range cgroupDirs(filepath.Join(cgroupRoot, "cpu"), path) {
+			quota, okQuota := readCgroupFile(dir, "cpu.cfs_quota_us")
+			period, okPeriod := readCgroupFile(dir, "cpu.cfs_period_us")
+			if !okQuota || !okPeriod {
+				continue
+			}
+			q, _ := strconv.ParseFloat(quota, 64)
+			p, _ := strconv.ParseFloat(period, 64)
+			if q > 0 && p > 0 {
+				tighten(q/p, 0)
+			}
+		}
+	}
+	if path, ok := paths["memory"]; ok {
+		for _, dir := range cgroupDirs(filepath.Join(cgroupRoot, "memory"), path) {
+			// no limit is a huge number rounded to the page size
+			if value, ok := readCgroupFile(dir, "memory.limit_in_bytes"); ok {
+				if memory, err := strconv.ParseInt(value, 10, 64); err == nil && memory < math.MaxInt64/2 {
+					tighten(0, memory)
+				}
+			}
+		}
+	}
+
+	return limits, nil
+}
+
+// allowedCPUs are the cpus invoker may run on, narrowed by cpusets and
+// affinity, and whether that's fewer than the host has online.
+func allowedCPUs() ([]int, bool, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return nil, false, errors.WithMessage(err, "failed to read /proc/self/status")
+	}
+	defer file.Close()
+
+	var allowed []int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if list, ok := strings.CutPrefix(scanner.Text(), "Cpus_allowed_list:"); ok {
+			if allowed, err = parseCPUList(list); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if allowed == nil {
+		return nil, false, errors.New("Cpus_allowed_list not found in /proc/self/status")
+	}
+
+	data, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return allowed, false, nil
+	}
+	online, err := parseCPUList(string(data))
+	if err != nil {
+		return allowed, false, nil
+	}
+
+	return allowed, len(allowed) < len(online), nil
+}
+
+// currentSessionLimits are the limits invoker runs under, with the memory
+// limit left out when it's no lower than the memory of the host.
+func currentSessionLimits() (sessionLimits, error) {
+	limits, err := cgroupLimits()
+	if err != nil {
+		return sessionLimits{}, err
+	}
+	if limits.MemoryBytes > 0 {
+		if hostMemory, err := hostMemoryBytes(); err == nil && limits.MemoryBytes >= hostMemory {
+			limits.MemoryBytes = 0
+		}
+	}
+
+	cpus, narrowed, err := allowedCPUs()
+	if err != nil {
+		return limits, err
+	}
+	if narrowed {
+		limits.Cpuset = cpus
+	}
+	if limits.CPUs >= float64(len(cpus)) {
+		limits.CPUs = 0
+	}
+
+	return limits, nil
+}
+
+// availableMemoryBytes is the memory of the host, or the memory limit of
+// invoker's cgroup if that's lower.
+func availableMemoryBytes() (int64, error) {
+	hostMemory, err := hostMemoryBytes()
+	if err != nil {
+		return 0, err
+	}
+	if limits, err := cgroupLimits(); err == nil && limits.MemoryBytes > 0 && limits.MemoryBytes < hostMemory {
+		return limits.MemoryBytes, nil
+	}
+
+	return hostMemory, nil
+}
+
+// numaNodesOf are the numa nodes the cpus belong to, as docker takes
+// cpuset mems, so the memory of a pinned container stays local to its
+// cpus. It's empty if the host has a single node or doesn't tell.
+func numaNodesOf(cpus []int) string {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil || len(dirs) < 2 {
+		return ""
+	}
+
+	pinned := make(map[int]bool, len(cpus))
+	for _, cpu := range cpus {
+		pinned[cpu] = true
+	}
+
+	nodes := make([]int, 0)
+	for _, dir := range dirs {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return ""
+		}
+		list, err := parseCPUList(string(data))
+		if err != nil {
+			return ""
+		}
+		for _, cpu := range list {
+			if pinned[cpu] {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	if len(nodes) == 0 || len(nodes) == len(dirs) {
+		return ""
+	}
+
+	return formatCPUList(nodes)
+}
+
+// applySessionLimits keeps a container within what invoker may use itself,
+// rather than what the host has: on its cpus, with memory of their numa
+// nodes, and within its cpu and memory limits unless --memory was given.
+func applySessionLimits(spec *ContainerSpec) {
+	limits, err := currentSessionLimits()
+	if err != nil {
+		warnf("failed to read the cgroup limits, the container isn't limited: %v\n", err)
+		return
+	}
+	if !limits.limited() {
+		return
+	}
+
+	infof("invoker is limited to %s, the container is too\n", limits)
+	if len(limits.Cpuset) > 0 {
+		spec.CpusetCpus = formatCPUList(limits.Cpuset)
+		spec.CpusetMems = numaNodesOf(limits.Cpuset)
+	}
+	if limits.CPUs > 0 {
+		spec.NanoCPUs = int64(limits.CPUs * 1e9)
+	}
+	if spec.MemoryBytes == 0 {
+		spec.MemoryBytes = limits.MemoryBytes
+	}
+}
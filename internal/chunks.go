@@ -0,0 +1,562 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	// syncChunkSize is what files are split into, so a change to a large
+	// file only sends the chunks around it.
+	syncChunkSize     = 8 << 20
+	syncManifestEntry = "manifest.json"
+	syncObjectPrefix  = "objects/"
+)
+
+// syncFile is a file of a pushed project, with its content as the hashes
+// of its chunks.
+type syncFile struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size"`
+	Link   string      `json:"link,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+func (f syncFile) same(other syncFile) bool {
+	return f.Mode == other.Mode && f.Size == other.Size && f.Link == other.Link &&
+		strings.Join(f.Chunks, ",") == strings.Join(other.Chunks, ",")
+}
+
+// syncManifest is the tree of a pushed project.
+type syncManifest struct {
+	Files []syncFile `json:"files"`
+}
+
+// chunks are the chunks of the tree, each once.
+func (m syncManifest) chunks() []string {
+	seen := make(map[string]bool)
+	chunks := make([]string, 0)
+	for _, f := range m.Files {
+		for _, c := range f.Chunks {
+			if !seen[c] {
+				seen[c] = true
+				chunks = append(chunks, c)
+			}
+		}
+	}
+
+	return chunks
+}
+
+// hashCacheEntry saves hashing a file again as long as it's unchanged.
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Chunks  []string  `json:"chunks"`
+}
+
+// chunkLocation is where a chunk of the local project is.
+type chunkLocation struct {
+	path   string
+	offset int64
+	size   int
+}
+
+func pathKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+func objectStore() (string, error) {
+	return invokerCacheDir("objects")
+}
+
+func objectPath(store, hash string) string {
+	return filepath.Join(store, hash[:2], hash)
+}
+
+// manifestPath is where the manifest last applied to dest is kept.
+func manifestPath(store, dest string) string {
+	return filepath.Join(store, "manifests", pathKey(dest)+".json")
+}
+
+func hashFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunks := make([]string, 0)
+	buf := make([]byte, syncChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			chunks = append(chunks, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// buildManifest hashes the project at root, leaving out what rules ignore.
+// Files whose size and modification time are the same as on the last push
+// aren't read again.
+func buildManifest(root string, rules ignoreRules) (syncManifest, map[string]chunkLocation, error) {
+	cacheDir, err := invokerCacheDir("push")
+	if err != nil {
+		return syncManifest{}, nil, err
+	}
+	cacheFile := filepath.Join(cacheDir, pathKey(root)+".json")
+	cache := make(map[string]hashCacheEntry)
+	if data, err := files.ReadFile(cacheFile); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+
+	manifest := syncManifest{Files: make([]syncFile, 0)}
+	locations := make(map[string]chunkLocation)
+	hashed := make(map[string]hashCacheEntry)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == invokerIgnoreFile || rules.ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := syncFile{Path: rel, Mode: info.Mode()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if file.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			file.Size = info.Size()
+			entry, ok := cache[rel]
+			if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+				chunks, err := hashFile(path)
+				if err != nil {
+					return errors.WithMessagef(err, "failed to hash %s", rel)
+				}
+				entry = hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), Chunks: chunks}
+			}
+			hashed[rel] = entry
+			file.Chunks = entry.Chunks
+			for i, c := range entry.Chunks {
+				offset := int64(i) * syncChunkSize
+				locations[c] = chunkLocation{path: path, offset: offset, size: int(min(syncChunkSize, info.Size()-offset))}
+			}
+		default:
+			// sockets, devices and pipes aren't project files
+			return nil
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if err != nil {
+		return syncManifest{}, nil, errors.WithMessage(err, "failed to read the project")
+	}
+
+	if data, err := json.Marshal(hashed); err == nil {
+		if err := files.MkdirAll(cacheDir, 0o755); err == nil {
+			files.WriteFile(cacheFile, data, 0o644)
+		}
+	}
+
+	return manifest, locations, nil
+}
+
+func (l chunkLocation) read() ([]byte, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, l.size)
+	if _, err := f.ReadAt(data, l.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// sendManifest brings dest on host to the tree of the manifest, asking the
+// host which chunks it's missing first and sending only those, read with
+// source. It returns how much was sent and what the host did.
+func sendManifest(ctx context.Context, host, dest string, manifest syncManifest, source func(string) ([]byte, error), delete bool) (int64, string, error) {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, "", errors.WithMessage(err, "failed to encode the manifest")
+	}
+	out, err := pipeToHost(ctx, host, bytes.NewReader(body), "push", "--receive", "missing", "--dest", dest)
+	if err != nil {
+		return 0, "", err
+	}
+	var missing []string
+	if err := json.Unmarshal([]byte(lastLine(out)), &missing); err != nil {
+		return 0, "", errors.WithMessagef(err, "failed to parse the missing chunks of %s", host)
+	}
+
+	r, w := io.Pipe()
+	done := make(chan int64, 1)
+	go func() {
+		var sent int64
+		defer func() { done <- sent }()
+		tw := tar.NewWriter(w)
+		for _, hash := range missing {
+			data, err := source(hash)
+			if err == nil {
+				err = tw.WriteHeader(&tar.Header{Name: syncObjectPrefix + hash, Mode: 0o644, Size: int64(len(data))})
+			}
+			if err == nil {
+				_, err = tw.Write(data)
+			}
+			if err != nil {
+				w.CloseWithError(errors.WithMessagef(err, "failed to send chunk %s", hash))
+				return
+			}
+			sent += int64(len(data))
+		}
+		err := tw.WriteHeader(&tar.Header{Name: syncManifestEntry, Mode: 0o644, Size: int64(len(body))})
+		if err == nil {
+			_, err = tw.Write(body)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	args := []string{"push", "--receive", "apply", "--dest", dest}
+	if delete {
+		args = append(args, "--delete")
+	}
+	out, err = pipeToHost(ctx, host, r, args...)
+	// stops the writer if the host gave up reading
+	r.Close()
+
+	return <-done, lastLine(out), err
+}
+
+// receiveMissing reads a manifest from stdin and prints the chunks of it
+// the object store of this host doesn't have.
+func receiveMissing() error {
+	store, err := objectStore()
+	if err != nil {
+		return err
+	}
+	var manifest syncManifest
+	if err := json.NewDecoder(os.Stdin).Decode(&manifest); err != nil {
+		return errors.WithMessage(err, "failed to read the manifest")
+	}
+
+	missing := make([]string, 0)
+	for _, hash := range manifest.chunks() {
+		if _, err := files.Stat(objectPath(store, hash)); err != nil {
+			missing = append(missing, hash)
+		}
+	}
+	data, err := json.Marshal(missing)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// receiveApply reads the missing chunks and the manifest from stdin as a
+// tar, stores the chunks and brings dest to the tree of the manifest.
+// Files are only written if they changed since the last push to dest, and
+// only files of that push are deleted, so whatever else is in dest, like
+// ignored files, stays.
+func receiveApply(dest string, delete bool) error {
+	store, err := objectStore()
+	if err != nil {
+		return err
+	}
+	if err := files.MkdirAll(filepath.Join(store, "manifests"), 0o755); err != nil {
+		return errors.WithMessage(err, "failed to create the object store")
+	}
+	unlock, err := files.Lock(filepath.Join(store, "lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var manifest *syncManifest
+	tr := tar.NewReader(os.Stdin)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.WithMessage(err, "failed to receive the chunks")
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.WithMessage(err, "failed to receive the chunks")
+		}
+
+		if header.Name == syncManifestEntry {
+			manifest = &syncManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return errors.WithMessage(err, "failed to read the manifest")
+			}
+			continue
+		}
+		hash, ok := strings.CutPrefix(header.Name, syncObjectPrefix)
+		if sum := sha256.Sum256(data); !ok || hex.EncodeToString(sum[:]) != hash {
+			return errors.Errorf("received chunk %s doesn't match its hash", header.Name)
+		}
+		path := objectPath(store, hash)
+		if err := files.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return errors.WithMessage(err, "failed to store chunk")
+		}
+		if err := files.WriteFile(path+".tmp", data, 0o644); err != nil {
+			return errors.WithMessage(err, "failed to store chunk")
+		}
+		if err := files.Rename(path+".tmp", path); err != nil {
+			return errors.WithMessage(err, "failed to store chunk")
+		}
+	}
+	if manifest == nil {
+		return errors.New("no manifest received")
+	}
+
+	previous := make(map[string]syncFile)
+	if data, err := files.ReadFile(manifestPath(store, dest)); err == nil {
+		var last syncManifest
+		if json.Unmarshal(data, &last) == nil {
+			for _, f := range last.Files {
+				previous[f.Path] = f
+			}
+		}
+	}
+
+	placed, unchanged, deleted := 0, 0, 0
+	current := make(map[string]bool, len(manifest.Files))
+	for _, f := range manifest.Files {
+		current[f.Path] = true
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return errors.Errorf("refusing to write %s outside of %s", f.Path, dest)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(f.Path))
+		if last, ok := previous[f.Path]; ok && last.same(f) {
+			if info, err := os.Lstat(target); err == nil && (f.Link != "" || info.Size() == f.Size) {
+				unchanged++
+				continue
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if f.Link != "" {
+			os.Remove(target)
+			if err := os.Symlink(f.Link, target); err != nil {
+				return err
+			}
+			placed++
+			continue
+		}
+
+		var content bytes.Buffer
+		for _, hash := range f.Chunks {
+			data, err := files.ReadFile(objectPath(store, hash))
+			if err != nil {
+				return errors.WithMessagef(err, "missing chunk of %s", f.Path)
+			}
+			content.Write(data)
+		}
+		tmp := target + ".invoker-tmp"
+		if err := os.WriteFile(tmp, content.Bytes(), f.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, f.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, target); err != nil {
+			return err
+		}
+		placed++
+	}
+	if delete {
+		for path := range previous {
+			if current[path] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dest, filepath.FromSlash(path))); err == nil {
+				deleted++
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := files.WriteFile(manifestPath(store, dest)+".tmp", data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to record the manifest")
+	}
+	if err := files.Rename(manifestPath(store, dest)+".tmp", manifestPath(store, dest)); err != nil {
+		return errors.WithMessage(err, "failed to record the manifest")
+	}
+	if err := pruneObjects(store); err != nil {
+		warnf("%v\n", err)
+	}
+
+	fmt.Printf("%d files written, %d unchanged, %d deleted\n", placed, unchanged, deleted)
+	return nil
+}
+
+// pruneObjects removes the chunks no recorded manifest needs anymore.
+func pruneObjects(store string) error {
+	manifests, err := files.ReadDir(filepath.Join(store, "manifests"))
+	if err != nil {
+		return errors.WithMessage(err, "failed to prune the object store")
+	}
+	referenced := make(map[string]bool)
+	for _, e := range manifests {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := files.ReadFile(filepath.Join(store, "manifests", e.Name()))
+		if err != nil {
+			return errors.WithMessage(err, "failed to prune the object store")
+		}
+		var m syncManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			// its chunks can't be told apart, so nothing is pruned
+			return nil
+		}
+		for _, c := range m.chunks() {
+			referenced[c] = true
+		}
+	}
+
+	dirs, err := files.ReadDir(store)
+	if err != nil {
+		return errors.WithMessage(err, "failed to prune the object store")
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		objects, err := files.ReadDir(filepath.Join(store, dir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, o := range objects {
+			if !referenced[o.Name()] {
+				files.Remove(filepath.Join(store, dir.Name(), o.Name()))
+			}
+		}
+	}
+
+	return nil
+}
+
+// relayManifest is the manifest last applied to dest on this host with its
+// chunks from the object store, for passing a push on to other hosts.
+func relayManifest(dest string) (syncManifest, func(string) ([]byte, error), error) {
+	store, err := objectStore()
+	if err != nil {
+		return syncManifest{}, nil, err
+	}
+	data, err := files.ReadFile(manifestPath(store, dest))
+	if err != nil {
+		return syncManifest{}, nil, errors.WithMessagef(err, "nothing was pushed to %s on this host", dest)
+	}
+	var manifest syncManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return syncManifest{}, nil, errors.WithMessage(err, "failed to read the manifest")
+	}
+
+	return manifest, func(hash string) ([]byte, error) { return files.ReadFile(objectPath(store, hash)) }, nil
+}
+
+// pushChunks pushes the manifest to every host. With peers, the hosts that
+// have it pass it on, so the number of hosts that have it doubles every
+// round instead of all of them being fed from here.
+func pushChunks(hosts []string, dest string, manifest syncManifest, source func(string) ([]byte, error), args PushArgs) map[string]error {
+	send := func(host string) error {
+		sent, summary, err := sendManifest(context.Background(), host, dest, manifest, source, args.Delete)
+		if err == nil {
+			successf("pushed %s to %s:%s, %s\n", units.HumanSize(float64(sent)), host, dest, summary)
+		}
+		return err
+	}
+	if !args.Peers {
+		return syncHosts(hosts, send)
+	}
+
+	failed := make(map[string]error)
+	// "" is this host
+	seeders, pending := []string{""}, hosts
+	for len(pending) > 0 {
+		n := min(len(seeders), len(pending))
+		pairs := make(map[string]string, n)
+		for i := 0; i < n; i++ {
+			pairs[pending[i]] = seeders[i]
+		}
+		round := syncHosts(pending[:n], func(host string) error {
+			seeder := pairs[host]
+			if seeder == "" {
+				return send(host)
+			}
+			relay := []string{"push", "--relay", "--hosts", host, "--dest", dest}
+			if args.Delete {
+				relay = append(relay, "--delete")
+			}
+			return runOnHost(context.Background(), seeder, relay...)
+		})
+		for _, host := range pending[:n] {
+			if err, ok := round[host]; ok {
+				failed[host] = err
+			} else {
+				seeders = append(seeders, host)
+			}
+		}
+		pending = pending[n:]
+	}
+
+	return failed
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits. Backoff, scheduling, jitter and expiry
+// go through clock instead of the time package, so tests can replace it
+// with a ManualClock and run them without waiting.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// Rand is the source of jitter and random choices, like ports.
+type Rand interface {
+	Int63n(n int64) int64
+	Intn(n int) int
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// systemRand is the shared source of math/rand, which is safe for
+// concurrent use unlike a rand.Rand of its own.
+type systemRand struct{}
+
+func (systemRand) Int63n(n int64) int64 { return rand.Int63n(n) }
+func (systemRand) Intn(n int) int       { return rand.Intn(n) }
+
+var (
+	clock  Clock = systemClock{}
+	random Rand  = systemRand{}
+)
+
+// SetClock replaces the clock of the package until the returned func
+// restores the previous one.
+func SetClock(c Clock) (restore func()) {
+	previous := clock
+	clock = c
+	return func() { clock = previous }
+}
+
+// SetRand replaces the randomness of the package until the returned func
+// restores the previous one. rand.New(rand.NewSource(seed)) makes it
+// deterministic, if only one goroutine draws from it.
+func SetRand(r Rand) (restore func()) {
+	previous := random
+	random = r
+	return func() { random = previous }
+}
+
+// ManualClock only moves when it's told to. Sleep and After return once
+// Advance has moved the clock past their deadline.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, manualWaiter{at: c.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Advance moves the clock forward, waking the waiters whose deadline it
+// passed in the order of their deadlines.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// Waiters is how many Sleep and After calls are waiting, for tests to
+// know when the code under test got to its next wait.
+func (c *ManualClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
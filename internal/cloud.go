@@ -0,0 +1,639 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CloudConfig configures the managed backends a run can be submitted to
+// with --backend instead of being started on hosts, read from
+// ~/.config/higgsfield/cloud.json.
+type CloudConfig struct {
+	// Registry is the repository the images of cloud runs are pushed to,
+	// tagged with the container name, unless --image names one there.
+	Registry  string          `json:"registry"`
+	AWSBatch  AWSBatchConfig  `json:"aws_batch"`
+	SageMaker SageMakerConfig `json:"sagemaker"`
+	Vertex    VertexConfig    `json:"vertex"`
+	AzureML   AzureMLConfig   `json:"azureml"`
+}
+
+func LoadCloudConfig() (CloudConfig, error) {
+	var config CloudConfig
+	if err := loadConfigFile("cloud.json", &config); err != nil {
+		return CloudConfig{}, err
+	}
+
+	return config, nil
+}
+
+// CloudJob is the job a run was submitted as, kept in its state instead of
+// a container.
+type CloudJob struct {
+	Backend string `json:"backend"`
+	// ID is what the backend knows the job by.
+	ID     string `json:"id"`
+	Region string `json:"region,omitempty"`
+	// Status is the last status the backend reported, in its own words.
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Logs is the file the output of the job was last pulled into, see
+	// CloudLogs.
+	Logs string `json:"logs,omitempty"`
+}
+
+// cloudJobSpec is a run translated for a backend.
+type cloudJobSpec struct {
+	// Name is the container name of the run, backends with stricter names
+	// derive theirs from it.
+	Name         string
+	Project      string
+	Image        string
+	Nodes        int
+	NProcPerNode int
+	CPUOnly      bool
+	Port         int
+	// WorkDir is where the project is in the image.
+	WorkDir string
+	// Args are the arguments of hf.py run.
+	Args []string
+	// Rest are the arguments passed on to the experiment, see
+	// hyperparameters.
+	Rest []string
+	// Env are NAME=value pairs.
+	Env          []string
+	MaxRestarts  int
+	RdzvTimeout  time.Duration
+	StartStagger time.Duration
+}
+
+// torchrunScript starts the node in a shell, with the rank and master
+// address as shell expressions of the backend, like environment variables
+// it sets on every node.
+func (s cloudJobSpec) torchrunScript(rank, master string) string {
+	args := []string{"torchrun", "--nnodes", fmt.Sprint(s.Nodes), "--nproc_per_node", fmt.Sprint(s.NProcPerNode)}
+	options := torchrunOptions{MaxRestarts: s.MaxRestarts, RdzvTimeout: s.RdzvTimeout, StartStagger: s.StartStagger}
+	args = append(args, options.args(s.Nodes)...)
+	args = append(args, "hf.py", "run")
+	args = append(args, s.Args...)
+
+	quoted := make([]string, 0, len(args))
+	for _, a := range args {
+		quoted = append(quoted, shellQuote(a))
+	}
+
+	return fmt.Sprintf(`cd %s && exec %s --node_rank "%s" --master_addr "%s" --master_port %d %s`,
+		shellQuote(s.WorkDir), quoted[0], rank, master, s.Port, strings.Join(quoted[1:], " "))
+}
+
+// hyperparameters are the --name value and --name=value pairs of Rest, for
+// backends that record them with the job. Flags without a value are true.
+func (s cloudJobSpec) hyperparameters() map[string]string {
+	params := make(map[string]string)
+	for i := 0; i < len(s.Rest); i++ {
+		name, ok := strings.CutPrefix(s.Rest[i], "--")
+		if !ok || name == "" {
+			continue
+		}
+		if name, value, ok := strings.Cut(name, "="); ok {
+			params[name] = value
+			continue
+		}
+		if i+1 < len(s.Rest) && !strings.HasPrefix(s.Rest[i+1], "--") {
+			params[name] = s.Rest[i+1]
+			i++
+			continue
+		}
+		params[name] = "true"
+	}
+
+	return params
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./=:,@+-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// cloudStatus is the status of a job in invoker's terms.
+type cloudStatus struct {
+	// Status and Reason are the backend's own words.
+	Status string
+	Reason string
+	// Done jobs ended, Failed ones unsuccessfully.
+	Done   bool
+	Failed bool
+}
+
+type cloudBackend interface {
+	// entrypoint is the command every node runs.
+	entrypoint(spec cloudJobSpec) []string
+	submit(spec cloudJobSpec) (CloudJob, error)
+	status(job CloudJob) (cloudStatus, error)
+	cancel(job CloudJob) error
+}
+
+// cloudLogStreamer is a backend that can stream the output of a job, from
+// the start until it ends.
+type cloudLogStreamer interface {
+	streamLogs(job CloudJob, w io.Writer) error
+}
+
+// cloudBackends are the values of --backend.
+var cloudBackends = map[string]func(CloudConfig) cloudBackend{
+	backendAWSBatch:  func(c CloudConfig) cloudBackend { return awsBatch{c.AWSBatch} },
+	backendSageMaker: func(c CloudConfig) cloudBackend { return sageMaker{c.SageMaker} },
+	backendVertex:    func(c CloudConfig) cloudBackend { return vertex{c.Vertex} },
+	backendAzureML:   func(c CloudConfig) cloudBackend { return azureML{c.AzureML} },
+}
+
+func newCloudBackend(name string) (cloudBackend, error) {
+	backend, ok := cloudBackends[name]
+	if !ok {
+		return nil, errors.Errorf("unknown backend %s, expected one of %s", name, strings.Join(sortedKeys(cloudBackends), ", "))
+	}
+	config, err := LoadCloudConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return backend(config), nil
+}
+
+// cloudCLI runs the command line tool of a cloud and decodes its json
+// output into v, unless v is nil.
+func cloudCLI(v any, name string, args ...string) error {
+	out, err := runIn("", name, args...)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+
+	return errors.WithMessagef(json.Unmarshal(out, v), "failed to parse the output of %s", name)
+}
+
+// writeCLIInput writes v as json to a temporary file only the user can
+// read, for the clis to take jobs and secrets from instead of arguments,
+// which anyone on the host sees. remove deletes the file again.
+func writeCLIInput(v any, pattern string) (name string, remove func(), err error) {
+	data, err := cliInputJSON(v)
+	if err != nil {
+		return "", nil, err
+	}
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "failed to write the cli input")
+	}
+	remove = func() { os.Remove(file.Name()) }
+	_, err = file.WriteString(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, errors.WithMessage(err, "failed to write the cli input")
+	}
+
+	return file.Name(), remove, nil
+}
+
+// envVars are the variables of the env file, kept in the secret store of
+// the backend as one json object instead of in the job, where anyone who
+// can describe it would read them.
+func (s cloudJobSpec) envVars() map[string]string {
+	vars := make(map[string]string, len(s.Env))
+	for _, e := range s.Env {
+		name, value, _ := strings.Cut(e, "=")
+		vars[name] = value
+	}
+
+	return vars
+}
+
+// exportEnvJSON prints the exports of the json object on its stdin.
+const exportEnvJSON = `python3 -c 'import json, shlex, sys; print("".join("export %s=%s\n" % (k, shlex.quote(v)) for k, v in json.load(sys.stdin).items()))'`
+
+// withSecrets prefixes the script of a node with exporting the env file,
+// which fetch prints as json. The node fails when fetching does, rather
+// than training without its secrets.
+func withSecrets(fetch, script string) string {
+	return `env_json="$(` + fetch + `)" && eval "$(printf %s "$env_json" | ` + exportEnvJSON + `)" && ` + script
+}
+
+// cloudImage is the image a cloud run starts from: the given one, or the
+// project built and pushed to the registry.
+func cloudImage(ctx context.Context, args RunArgs, containerName string) (string, error) {
+	if args.Image != "" {
+		return args.Image, nil
+	}
+
+	config, err := LoadCloudConfig()
+	if err != nil {
+		return "", err
+	}
+	if config.Registry == "" {
+		return "", errors.New("no registry to push the image of the run to, set registry in ~/.config/higgsfield/cloud.json or pass --image")
+	}
+
+	// the image has to contain the project, nothing is mounted
+	if err := writeRunScript(args.ProjectPath, 0); err != nil {
+		return "", err
+	}
+
+	dr, err := NewDockerRun(ctx, args.DockerContext, args.ProjectName, args.ProjectPath, "")
+	if err != nil {
+		return "", err
+	}
+	dr.imageTag = namespacedName(args.Namespace, imageTag)
+	if err := dr.Build(); err != nil {
+		return "", err
+	}
+
+	image := config.Registry + ":" + containerName
+	ctx, cancel := dr.deadline(dockerOpInspect)
+	err = dr.timedOut(ctx, dockerOpInspect, dr.client.ImageTag(ctx, dr.imageTag, image))
+	cancel()
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to tag image %s", image)
+	}
+
+	// the docker cli knows the credential helpers of registries
+	push := []string{"push", image}
+	if args.DockerContext != "" {
+		push = append([]string{"--context", args.DockerContext}, push...)
+	}
+	infof("pushing %s\n", image)
+	cmd := exec.Command("docker", push...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.WithMessagef(err, "failed to push %s", image)
+	}
+
+	return image, nil
+}
+
+// submitCloud submits the run to its backend and records it in the state
+// of this host, where `invoker cloud status` and `experiment watch`
+// follow it.
+func submitCloud(ctx context.Context, args RunArgs) error {
+	backend, err := newCloudBackend(args.Backend)
+	if err != nil {
+		return err
+	}
+
+	if args.ProjectPath == "" {
+		if args.ProjectPath, err = os.Getwd(); err != nil {
+			return errors.WithMessage(err, "failed to get current working directory")
+		}
+	}
+
+	containerName := nameFromRunArgs(args)
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open state")
+	}
+	previous, err := sm.Get(containerName)
+	if err != nil {
+		return err
+	}
+	if err := checkUnprotected(previous); err != nil {
+		return errors.WithMessage(err, "refusing to replace it")
+	}
+	if previous != nil && previous.Cloud != nil {
+		if status, err := backend.status(*previous.Cloud); err == nil && !status.Done {
+			return errors.Errorf("%s is still %s as %s job %s, stop it first", containerName, status.Status, previous.Cloud.Backend, previous.Cloud.ID)
+		}
+	}
+
+	image, err := cloudImage(ctx, args, containerName)
+	if err != nil {
+		return err
+	}
+
+	var env []string
+	if args.EnvFile != "" {
+		if env, err = readEnvFile(args.EnvFile); err != nil {
+			return err
+		}
+	}
+
+	config, err := LoadProjectConfig(args.ProjectPath)
+	if err != nil {
+		return err
+	}
+	workDir := config.Guest.RootPath
+	if args.GuestRootPath != "" {
+		workDir = args.GuestRootPath
+	}
+
+	spec := cloudJobSpec{
+		Name:         containerName,
+		Project:      args.ProjectName,
+		Image:        image,
+		Nodes:        len(args.Hosts),
+		NProcPerNode: args.NProcPerNode,
+		CPUOnly:      args.CPUOnly,
+		Port:         args.Port,
+		WorkDir:      path.Clean(workDir),
+		Args:         experimentArgs(args.ExperimentName, args.RunName, args.MaxRepeats, args.Rest),
+		Rest:         args.Rest,
+		Env:          env,
+		MaxRestarts:  args.MaxRestarts,
+		RdzvTimeout:  args.RdzvTimeout,
+		StartStagger: args.StartStagger,
+	}
+	job, err := backend.submit(spec)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to submit %s to %s", containerName, args.Backend)
+	}
+	job.CheckedAt = clock.Now().UTC()
+
+	if args.Team == "" {
+		args.Team = args.ProjectName
+	}
+	// checked by Run already
+	tags, _ := parseTags(args.Tags)
+	state := ExperimentState{
+		ContainerName:  containerName,
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		RunName:        args.RunName,
+		Team:           args.Team,
+		User:           currentUser(),
+		Identity:       userIdentity(),
+		RunArgs:        args,
+		Entrypoint:     backend.entrypoint(spec),
+		ImageID:        image,
+		Cloud:          &job,
+		LauncherPID:    os.Getpid(),
+		StartedAt:      clock.Now().UTC(),
+		Tags:           tags,
+		Sweep:          args.Sweep,
+	}
+	if err := sm.Put(state); err != nil {
+		return err
+	}
+
+	successf("submitted %s to %s as job %s\n", containerName, args.Backend, job.ID)
+	return nil
+}
+
+// refreshCloudRun asks the backend about the job of the run and records the
+// answer, retiring the run once the job is done.
+func refreshCloudRun(sm *InnerStateManager, state ExperimentState) (ExperimentState, error) {
+	backend, err := newCloudBackend(state.Cloud.Backend)
+	if err != nil {
+		return state, err
+	}
+	status, err := backend.status(*state.Cloud)
+	if err != nil {
+		return state, errors.WithMessagef(err, "failed to get the status of %s job %s", state.Cloud.Backend, state.Cloud.ID)
+	}
+	// the output of a finished job goes to the history with it
+	logs := ""
+	if streamer, ok := backend.(cloudLogStreamer); ok && status.Done {
+		if logs, err = pullCloudLogs(streamer, state, nil); err != nil {
+			warnf("%v\n", err)
+		}
+	}
+
+	unlock, err := sm.Lock()
+	if err != nil {
+		return state, err
+	}
+	defer unlock()
+
+	current, err := sm.Get(state.ContainerName)
+	if err != nil || current == nil || current.Cloud == nil || current.Cloud.ID != state.Cloud.ID {
+		return state, err
+	}
+	state = *current
+	job := *state.Cloud
+	job.Status, job.Reason, job.CheckedAt = status.Status, status.Reason, clock.Now().UTC()
+	if logs != "" {
+		job.Logs = logs
+	}
+	state.Cloud = &job
+
+	if !status.Done {
+		return state, sm.Put(state)
+	}
+	if status.Failed && state.Outcome == "" {
+		state.Outcome, state.OutcomeReason = outcomeFailed, strings.ToLower(status.Status)
+		if status.Reason != "" {
+			state.OutcomeReason += ": " + status.Reason
+		}
+	}
+	return state, sm.Retire(state, job.CheckedAt)
+}
+
+// pullCloudLogs streams the output of the job into a file in the cache
+// directory, and to w too unless it's nil.
+func pullCloudLogs(streamer cloudLogStreamer, state ExperimentState, w io.Writer) (string, error) {
+	dir, err := invokerCacheDir("cloud")
+	if err != nil {
+		return "", err
+	}
+	if err := files.MkdirAll(dir, 0o755); err != nil {
+		return "", errors.WithMessage(err, "failed to create the directory of cloud logs")
+	}
+
+	name := filepath.Join(dir, state.ContainerName+".log")
+	file, err := os.Create(name)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to create the log file")
+	}
+	defer file.Close()
+
+	out := io.Writer(file)
+	if w != nil {
+		out = io.MultiWriter(w, file)
+	}
+	if err := streamer.streamLogs(*state.Cloud, out); err != nil {
+		return "", err
+	}
+
+	return name, file.Close()
+}
+
+// cancelCloudRun cancels the job of the run for good and retires it.
+func cancelCloudRun(sm *InnerStateManager, state ExperimentState) error {
+	backend, err := newCloudBackend(state.Cloud.Backend)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("cancelling %s job %s\n", state.Cloud.Backend, state.Cloud.ID)
+	if err := backend.cancel(*state.Cloud); err != nil {
+		return errors.WithMessagef(err, "failed to cancel %s job %s", state.Cloud.Backend, state.Cloud.ID)
+	}
+
+	state.Outcome, state.OutcomeReason = outcomeStopped, "stopped by "+currentUser()
+	return sm.Retire(state, clock.Now().UTC())
+}
+
+// refreshCloudRuns follows the cloud runs of this host, for `experiment
+// watch`.
+func refreshCloudRuns(sm *InnerStateManager, states []ExperimentState) {
+	for _, state := range states {
+		if state.Cloud == nil {
+			continue
+		}
+		before := state.Cloud.Status
+		state, err := refreshCloudRun(sm, state)
+		if err != nil {
+			warnf("%v\n", err)
+		} else if state.Cloud.Status != before {
+			fmt.Printf("%s job %s of %s is %s\n", state.Cloud.Backend, state.Cloud.ID, state.ContainerName, strings.ToLower(state.Cloud.Status))
+		}
+	}
+}
+
+type CloudStatusArgs struct {
+	ProjectName    string `validate:"omitempty,varname"`
+	ExperimentName string `validate:"omitempty,varname"`
+}
+
+// CloudStatus asks the backends about the cloud runs of this host and
+// records the answers. Runs whose jobs are done move to the history.
+func CloudStatus(args CloudStatusArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tBACKEND\tJOB\tNODES\tSTATUS\tREASON")
+	for _, state := range states {
+		if state.Cloud == nil || (args.ProjectName != "" && state.ProjectName != args.ProjectName) ||
+			(args.ExperimentName != "" && state.ExperimentName != args.ExperimentName) {
+			continue
+		}
+
+		state, err := refreshCloudRun(sm, state)
+		if err != nil {
+			errorf("%v\n", err)
+			failed = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", state.ContainerName, state.Cloud.Backend, state.Cloud.ID,
+			len(state.RunArgs.Hosts), strings.ToLower(orNone(state.Cloud.Status)), orNone(state.Cloud.Reason))
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(ExitInfra)
+	}
+}
+
+type CloudLogsArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	ContainerName  *string
+}
+
+// CloudLogs streams the output of the job of a cloud run, which is saved
+// in the cache directory and recorded with the run. Finished runs are
+// looked up in the history.
+func CloudLogs(args CloudLogsArgs) {
+	validateArgs(args)
+
+	containerName := nameFromRestartArgs(RestartArgs{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		ContainerName:  args.ContainerName,
+	})
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	state, err := sm.Get(containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	var job *CloudJob
+	if state != nil {
+		job = state.Cloud
+	} else {
+		records, err := sm.History()
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		for _, r := range records {
+			if r.ContainerName == containerName && r.Cloud != nil {
+				job = r.Cloud
+			}
+		}
+	}
+	if job == nil {
+		errorf("%s is not a cloud run of this host\n", containerName)
+		os.Exit(ExitValidation)
+	}
+
+	backend, err := newCloudBackend(job.Backend)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	streamer, ok := backend.(cloudLogStreamer)
+	if !ok {
+		errorf("invoker can't pull the output of %s jobs, it's in the console of the service\n", job.Backend)
+		os.Exit(ExitValidation)
+	}
+
+	logs, err := pullCloudLogs(streamer, ExperimentState{ContainerName: containerName, Cloud: job}, os.Stdout)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	infof("saved the output to %s\n", logs)
+
+	if state == nil {
+		return
+	}
+	unlock, err := sm.Lock()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	defer unlock()
+	if current, err := sm.Get(containerName); err == nil && current != nil && current.Cloud != nil && current.Cloud.ID == job.ID {
+		current.Cloud.Logs = logs
+		if err := sm.Put(*current); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	backendAWSBatch  = "aws-batch"
+	backendSageMaker = "sagemaker"
+)
+
+// AWSBatchConfig submits runs as multi-node parallel jobs. Every submission
+// registers a revision of the job definition with the image and command of
+// the run, since jobs can't override the image.
+type AWSBatchConfig struct {
+	Region   string `json:"region"`
+	JobQueue string `json:"job_queue"`
+	// JobDefinition is the name the revisions are registered under,
+	// invoker if empty.
+	JobDefinition string `json:"job_definition"`
+	// VCPUs and MemoryMiB are the resources of every node, the gpus are
+	// --nproc_per_node.
+	VCPUs      int    `json:"vcpus"`
+	MemoryMiB  int    `json:"memory_mib"`
+	JobRoleARN string `json:"job_role_arn"`
+	// ExecutionRoleARN reads the env file of the run from Secrets Manager
+	// for the containers, runs without one don't need it.
+	ExecutionRoleARN string `json:"execution_role_arn"`
+}
+
+// SageMakerConfig submits runs as training jobs, with the hyperparameters
+// parsed from the arguments of the experiment.
+type SageMakerConfig struct {
+	Region       string `json:"region"`
+	RoleARN      string `json:"role_arn"`
+	InstanceType string `json:"instance_type"`
+	// OutputPath is the s3 uri sagemaker uploads /opt/ml/model to.
+	OutputPath string `json:"output_path"`
+	// VolumeSizeGB is the disk of every instance, 100 if 0.
+	VolumeSizeGB int `json:"volume_size_gb"`
+	// MaxRuntime is a duration like 72h, 24h if empty.
+	MaxRuntime string `json:"max_runtime"`
+}
+
+// awsCLI runs the aws cli in the region, its default one if empty.
+func awsCLI(v any, region string, args ...string) error {
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+
+	return cloudCLI(v, "aws", append(args, "--output", "json")...)
+}
+
+// awsPutSecret keeps the env file of a run in Secrets Manager under
+// invoker/<name>, a new version of it for every submission, and returns the
+// arn of the secret.
+func awsPutSecret(region, name string, vars map[string]string) (string, error) {
+	file, remove, err := writeCLIInput(vars, "invoker-secret-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer remove()
+
+	id := "invoker/" + cloudJobName(name, regexp.MustCompile(`[^A-Za-z0-9/_+=.@-]+`), 256)
+	var stored struct {
+		ARN string `json:"ARN"`
+	}
+	err = awsCLI(&stored, region, "secretsmanager", "create-secret", "--name", id, "--secret-string", "file://"+file)
+	if err != nil && strings.Contains(err.Error(), "ResourceExistsException") {
+		err = awsCLI(&stored, region, "secretsmanager", "put-secret-value", "--secret-id", id, "--secret-string", "file://"+file)
+	}
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to store the env file in secrets manager")
+	}
+
+	return stored.ARN, nil
+}
+
+// awsCLIInput runs the aws cli with the json input of a command, read from
+// a file rather than passed as an argument.
+func awsCLIInput(v any, region string, input any, args ...string) error {
+	file, remove, err := writeCLIInput(input, "invoker-aws-*.json")
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	return awsCLI(v, region, append(args, "--cli-input-json", "file://"+file)...)
+}
+
+func cliInputJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to encode the job")
+	}
+
+	return string(data), nil
+}
+
+// cloudJobName fits the container name into the names a backend allows,
+// replacing other characters with dashes.
+func cloudJobName(name string, invalid *regexp.Regexp, maxLength int) string {
+	name = strings.Trim(invalid.ReplaceAllString(name, "-"), "-")
+	if len(name) > maxLength {
+		name = strings.TrimRight(name[:maxLength], "-")
+	}
+
+	return name
+}
+
+type awsBatch struct {
+	config AWSBatchConfig
+}
+
+// awsBatchMaster is the private address of the main node, which AWS Batch
+// only tells the other nodes.
+const awsBatchMaster = `${AWS_BATCH_JOB_MAIN_NODE_PRIVATE_IPV4_ADDRESS:-$(hostname -i | awk '{print $1}')}`
+
+func (b awsBatch) entrypoint(spec cloudJobSpec) []string {
+	return []string{"sh", "-c", spec.torchrunScript("$AWS_BATCH_JOB_NODE_INDEX", awsBatchMaster)}
+}
+
+func (b awsBatch) submit(spec cloudJobSpec) (CloudJob, error) {
+	if b.config.JobQueue == "" {
+		return CloudJob{}, errors.New("no job queue, set job_queue under aws_batch in ~/.config/higgsfield/cloud.json")
+	}
+	definition := b.config.JobDefinition
+	if definition == "" {
+		definition = "invoker"
+	}
+
+	resources := []map[string]string{}
+	if b.config.VCPUs > 0 {
+		resources = append(resources, map[string]string{"type": "VCPU", "value": fmt.Sprint(b.config.VCPUs)})
+	}
+	if b.config.MemoryMiB > 0 {
+		resources = append(resources, map[string]string{"type": "MEMORY", "value": fmt.Sprint(b.config.MemoryMiB)})
+	}
+	if !spec.CPUOnly {
+		resources = append(resources, map[string]string{"type": "GPU", "value": fmt.Sprint(spec.NProcPerNode)})
+	}
+	container := map[string]any{
+		"image":                spec.Image,
+		"command":              b.entrypoint(spec),
+		"resourceRequirements": resources,
+	}
+	if b.config.JobRoleARN != "" {
+		container["jobRoleArn"] = b.config.JobRoleARN
+	}
+	// the job definition only references the secrets, batch reads every
+	// variable from its json key when a container starts
+	if len(spec.Env) > 0 {
+		if b.config.ExecutionRoleARN == "" {
+			return CloudJob{}, errors.New("no execution role to read the env file of the run, set execution_role_arn under aws_batch in ~/.config/higgsfield/cloud.json")
+		}
+		vars := spec.envVars()
+		arn, err := awsPutSecret(b.config.Region, spec.Name, vars)
+		if err != nil {
+			return CloudJob{}, err
+		}
+		secrets := make([]map[string]string, 0, len(vars))
+		for _, name := range sortedKeys(vars) {
+			secrets = append(secrets, map[string]string{"name": name, "valueFrom": arn + ":" + name + "::"})
+		}
+		container["secrets"] = secrets
+		container["executionRoleArn"] = b.config.ExecutionRoleARN
+	}
+
+	var registered struct {
+		JobDefinitionArn string `json:"jobDefinitionArn"`
+	}
+	err := awsCLIInput(&registered, b.config.Region, map[string]any{
+		"jobDefinitionName": definition,
+		"type":              "multinode",
+		"nodeProperties": map[string]any{
+			"numNodes": spec.Nodes,
+			"mainNode": 0,
+			"nodeRangeProperties": []map[string]any{
+				{"targetNodes": "0:", "container": container},
+			},
+		},
+	}, "batch", "register-job-definition")
+	if err != nil {
+		return CloudJob{}, errors.WithMessage(err, "failed to register the job definition")
+	}
+
+	var submitted struct {
+		JobID string `json:"jobId"`
+	}
+	err = awsCLIInput(&submitted, b.config.Region, map[string]any{
+		"jobName":       cloudJobName(spec.Name, regexp.MustCompile(`[^A-Za-z0-9_-]+`), 128),
+		"jobQueue":      b.config.JobQueue,
+		"jobDefinition": registered.JobDefinitionArn,
+	}, "batch", "submit-job")
+	if err != nil {
+		return CloudJob{}, err
+	}
+
+	return CloudJob{Backend: backendAWSBatch, ID: submitted.JobID, Region: b.config.Region, Status: "SUBMITTED"}, nil
+}
+
+func (b awsBatch) status(job CloudJob) (cloudStatus, error) {
+	var described struct {
+		Jobs []struct {
+			Status       string `json:"status"`
+			StatusReason string `json:"statusReason"`
+		} `json:"jobs"`
+	}
+	if err := awsCLI(&described, job.Region, "batch", "describe-jobs", "--jobs", job.ID); err != nil {
+		return cloudStatus{}, err
+	}
+	if len(described.Jobs) == 0 {
+		return cloudStatus{}, errors.Errorf("job %s doesn't exist", job.ID)
+	}
+
+	j := described.Jobs[0]
+	return cloudStatus{
+		Status: j.Status,
+		Reason: j.StatusReason,
+		Done:   j.Status == "SUCCEEDED" || j.Status == "FAILED",
+		Failed: j.Status == "FAILED",
+	}, nil
+}
+
+func (b awsBatch) cancel(job CloudJob) error {
+	// terminate also cancels jobs that haven't started yet
+	return awsCLI(nil, job.Region, "batch", "terminate-job", "--job-id", job.ID, "--reason", "stopped with invoker")
+}
+
+type sageMaker struct {
+	config SageMakerConfig
+}
+
+// sageMakerHosts reads the hosts of the job, which sagemaker names algo-1
+// and up, the first one is the master.
+const sageMakerHosts = `import json; c = json.load(open("/opt/ml/input/config/resourceconfig.json")); `
+
+// sageMakerSecret prints the secret with boto3, which the images of
+// training jobs come with, in the region of its arn.
+func sageMakerSecret(arn string) string {
+	var region string
+	if parts := strings.Split(arn, ":"); len(parts) > 3 {
+		region = parts[3]
+	}
+
+	return `python3 -c 'import boto3, sys; sys.stdout.write(boto3.client("secretsmanager", region_name="` + region + `").get_secret_value(SecretId="` + arn + `")["SecretString"])'`
+}
+
+func (s sageMaker) entrypoint(spec cloudJobSpec) []string {
+	rank := fmt.Sprintf(`$(python3 -c '%sprint(c["hosts"].index(c["current_host"]))')`, sageMakerHosts)
+	master := fmt.Sprintf(`$(python3 -c '%sprint(c["hosts"][0])')`, sageMakerHosts)
+
+	return []string{"sh", "-c", spec.torchrunScript(rank, master)}
+}
+
+func (s sageMaker) submit(spec cloudJobSpec) (CloudJob, error) {
+	if s.config.RoleARN == "" || s.config.InstanceType == "" || s.config.OutputPath == "" {
+		return CloudJob{}, errors.New("role_arn, instance_type and output_path have to be set under sagemaker in ~/.config/higgsfield/cloud.json")
+	}
+	volume := s.config.VolumeSizeGB
+	if volume == 0 {
+		volume = 100
+	}
+	maxRuntime := 24 * time.Hour
+	if s.config.MaxRuntime != "" {
+		var err error
+		if maxRuntime, err = time.ParseDuration(s.config.MaxRuntime); err != nil || maxRuntime <= 0 {
+			return CloudJob{}, errors.Errorf("invalid max_runtime %q under sagemaker in cloud.json, expected a duration like 72h", s.config.MaxRuntime)
+		}
+	}
+
+	entrypoint := s.entrypoint(spec)
+	// training jobs have no secrets, so the nodes fetch the env file
+	// themselves, with the role of the job
+	if len(spec.Env) > 0 {
+		arn, err := awsPutSecret(s.config.Region, spec.Name, spec.envVars())
+		if err != nil {
+			return CloudJob{}, err
+		}
+		entrypoint[2] = withSecrets(sageMakerSecret(arn), entrypoint[2])
+	}
+
+	// names are unique for good, so every submission gets its own
+	name := cloudJobName(spec.Name, regexp.MustCompile(`[^A-Za-z0-9]+`), 47) + "-" + clock.Now().UTC().Format("20060102-150405")
+	err := awsCLIInput(nil, s.config.Region, map[string]any{
+		"TrainingJobName": name,
+		"AlgorithmSpecification": map[string]any{
+			"TrainingImage":       spec.Image,
+			"TrainingInputMode":   "File",
+			"ContainerEntrypoint": entrypoint[:2],
+			"ContainerArguments":  entrypoint[2:],
+		},
+		"RoleArn":          s.config.RoleARN,
+		"OutputDataConfig": map[string]string{"S3OutputPath": s.config.OutputPath},
+		"ResourceConfig": map[string]any{
+			"InstanceType":   s.config.InstanceType,
+			"InstanceCount":  spec.Nodes,
+			"VolumeSizeInGB": volume,
+		},
+		"StoppingCondition": map[string]int64{"MaxRuntimeInSeconds": int64(maxRuntime.Seconds())},
+		"HyperParameters":   spec.hyperparameters(),
+	}, "sagemaker", "create-training-job")
+	if err != nil {
+		return CloudJob{}, err
+	}
+
+	return CloudJob{Backend: backendSageMaker, ID: name, Region: s.config.Region, Status: "InProgress"}, nil
+}
+
+func (s sageMaker) status(job CloudJob) (cloudStatus, error) {
+	var described struct {
+		TrainingJobStatus string `json:"TrainingJobStatus"`
+		SecondaryStatus   string `json:"SecondaryStatus"`
+		FailureReason     string `json:"FailureReason"`
+	}
+	if err := awsCLI(&described, job.Region, "sagemaker", "describe-training-job", "--training-job-name", job.ID); err != nil {
+		return cloudStatus{}, err
+	}
+
+	reason := described.FailureReason
+	if reason == "" {
+		reason = described.SecondaryStatus
+	}
+	switch described.TrainingJobStatus {
+	case "Completed":
+		return cloudStatus{Status: described.TrainingJobStatus, Reason: reason, Done: true}, nil
+	case "Failed", "Stopped":
+		return cloudStatus{Status: described.TrainingJobStatus, Reason: reason, Done: true, Failed: true}, nil
+	}
+
+	return cloudStatus{Status: described.TrainingJobStatus, Reason: reason}, nil
+}
+
+func (s sageMaker) cancel(job CloudJob) error {
+	return awsCLI(nil, job.Region, "sagemaker", "stop-training-job", "--training-job-name", job.ID)
+}
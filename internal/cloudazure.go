@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const backendAzureML = "azureml"
+
+// AzureMLConfig submits runs as Azure ML command jobs with pytorch
+// distribution, one torchrun per node.
+type AzureMLConfig struct {
+	// Subscription is the az cli's default one if empty.
+	Subscription  string `json:"subscription"`
+	ResourceGroup string `json:"resource_group"`
+	Workspace     string `json:"workspace"`
+	// Compute is the cluster the nodes come from, its vms have the gpus.
+	Compute string `json:"compute"`
+	// ExperimentName groups the jobs in the studio, the project name if
+	// empty.
+	ExperimentName string `json:"experiment_name"`
+	// KeyVault keeps the env files of the runs, the managed identity of
+	// the cluster has to be able to get its secrets.
+	KeyVault string `json:"key_vault"`
+}
+
+// cli runs az in the workspace.
+func (a azureML) cli(v any, args ...string) error {
+	args = append(args, "--resource-group", a.config.ResourceGroup, "--workspace-name", a.config.Workspace)
+	if a.config.Subscription != "" {
+		args = append(args, "--subscription", a.config.Subscription)
+	}
+
+	return cloudCLI(v, "az", append(args, "--output", "json")...)
+}
+
+type azureML struct {
+	config AzureMLConfig
+}
+
+// putSecret keeps the env file of a run in the key vault as a new version
+// of invoker-<name> and returns the id of the version.
+func (a azureML) putSecret(name string, vars map[string]string) (string, error) {
+	if a.config.KeyVault == "" {
+		return "", errors.New("no key vault to keep the env file of the run in, set key_vault under azureml in ~/.config/higgsfield/cloud.json")
+	}
+	file, remove, err := writeCLIInput(vars, "invoker-secret-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer remove()
+
+	// the vault isn't part of the workspace, a.cli would pass it
+	args := []string{"keyvault", "secret", "set", "--vault-name", a.config.KeyVault,
+		"--name", "invoker-" + cloudJobName(name, regexp.MustCompile(`[^A-Za-z0-9-]+`), 119), "--file", file}
+	if a.config.Subscription != "" {
+		args = append(args, "--subscription", a.config.Subscription)
+	}
+	var stored struct {
+		ID string `json:"id"`
+	}
+	if err := cloudCLI(&stored, "az", append(args, "--output", "json")...); err != nil {
+		return "", errors.WithMessage(err, "failed to store the env file in the key vault")
+	}
+
+	return stored.ID, nil
+}
+
+// azureMLSecret prints the version of a secret, with the token of the
+// managed identity of the node from the instance metadata service.
+func azureMLSecret(id string) string {
+	return `python3 -c 'import json, sys, urllib.request as u; ` +
+		`t = json.load(u.urlopen(u.Request("http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https://vault.azure.net", headers={"Metadata": "true"})))["access_token"]; ` +
+		`sys.stdout.write(json.load(u.urlopen(u.Request("` + id + `?api-version=7.4", headers={"Authorization": "Bearer " + t})))["value"])'`
+}
+
+func (a azureML) entrypoint(spec cloudJobSpec) []string {
+	// azure ml sets these on every node of a pytorch job
+	return []string{"sh", "-c", spec.torchrunScript("${NODE_RANK:-0}", "${MASTER_ADDR:-localhost}")}
+}
+
+func (a azureML) submit(spec cloudJobSpec) (CloudJob, error) {
+	if a.config.ResourceGroup == "" || a.config.Workspace == "" || a.config.Compute == "" {
+		return CloudJob{}, errors.New("resource_group, workspace and compute have to be set under azureml in ~/.config/higgsfield/cloud.json")
+	}
+	experiment := a.config.ExperimentName
+	if experiment == "" {
+		experiment = spec.Project
+	}
+
+	command := a.entrypoint(spec)[2]
+	// command jobs have no secrets, so the nodes fetch the env file
+	// themselves, as the managed identity of the cluster
+	if len(spec.Env) > 0 {
+		id, err := a.putSecret(spec.Name, spec.envVars())
+		if err != nil {
+			return CloudJob{}, err
+		}
+		command = withSecrets(azureMLSecret(id), command)
+	}
+	// torchrun starts the processes of a node, so azure ml starts one
+	job := map[string]any{
+		"$schema":         "https://azuremlschemas.azureedge.net/latest/commandJob.schema.json",
+		"type":            "command",
+		"display_name":    spec.Name,
+		"experiment_name": experiment,
+		"command":         command,
+		"environment":     map[string]string{"image": spec.Image},
+		"compute":         "azureml:" + a.config.Compute,
+		"resources":       map[string]int{"instance_count": spec.Nodes},
+		"distribution":    map[string]any{"type": "pytorch", "process_count_per_instance": 1},
+	}
+
+	// az only takes the job from a file, json being yaml
+	file, remove, err := writeCLIInput(job, "invoker-azureml-*.yml")
+	if err != nil {
+		return CloudJob{}, errors.WithMessage(err, "failed to write the job")
+	}
+	defer remove()
+
+	// names are unique in the workspace for good
+	name := cloudJobName(spec.Name, regexp.MustCompile(`[^A-Za-z0-9_-]+`), 200) + "-" + clock.Now().UTC().Format("20060102-150405")
+	var created struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+	if err := a.cli(&created, "ml", "job", "create", "--file", file, "--name", name); err != nil {
+		return CloudJob{}, err
+	}
+
+	return CloudJob{Backend: backendAzureML, ID: created.Name, Status: created.Status}, nil
+}
+
+func (a azureML) status(job CloudJob) (cloudStatus, error) {
+	var described struct {
+		Status string `json:"status"`
+	}
+	if err := a.cli(&described, "ml", "job", "show", "--name", job.ID); err != nil {
+		return cloudStatus{}, err
+	}
+
+	status := cloudStatus{Status: described.Status}
+	switch described.Status {
+	case "Completed":
+		status.Done = true
+	case "Failed", "Canceled":
+		status.Done, status.Failed = true, true
+		// the reason is only in the output of the job
+		status.Reason = "see invoker cloud logs"
+	}
+
+	return status, nil
+}
+
+func (a azureML) cancel(job CloudJob) error {
+	return a.cli(nil, "ml", "job", "cancel", "--name", job.ID)
+}
+
+func (a azureML) streamLogs(job CloudJob, w io.Writer) error {
+	args := []string{"ml", "job", "stream", "--name", job.ID, "--resource-group", a.config.ResourceGroup, "--workspace-name", a.config.Workspace}
+	if a.config.Subscription != "" {
+		args = append(args, "--subscription", a.config.Subscription)
+	}
+	if _, err := exec.LookPath("az"); err != nil {
+		return errors.New("az is not installed")
+	}
+
+	cmd := exec.Command("az", args...)
+	cmd.Stdout, cmd.Stderr = w, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.WithMessagef(err, "failed to stream the output of %s job %s", job.Backend, job.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const backendVertex = "vertex"
+
+// VertexConfig submits runs as Vertex AI custom jobs, the master in the
+// first worker pool and the other nodes in the second.
+type VertexConfig struct {
+	// Project is the gcp project, gcloud's default one if empty.
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	// MachineType is the machine of every node, like a2-highgpu-8g, with
+	// --nproc_per_node gpus of AcceleratorType like NVIDIA_TESLA_A100.
+	MachineType     string `json:"machine_type"`
+	AcceleratorType string `json:"accelerator_type"`
+	ServiceAccount  string `json:"service_account"`
+	// BaseOutputDirectory is the gs uri the job's AIP_MODEL_DIR and
+	// AIP_CHECKPOINT_DIR are under, optional.
+	BaseOutputDirectory string `json:"base_output_directory"`
+	// BootDiskSizeGB is the disk of every node, 100 if 0.
+	BootDiskSizeGB int `json:"boot_disk_size_gb"`
+}
+
+// gcloudCLI runs gcloud in the project and region, the configured ones if
+// empty.
+func gcloudCLI(v any, project, region string, args ...string) error {
+	if project != "" {
+		args = append(args, "--project", project)
+	}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+
+	return cloudCLI(v, "gcloud", append(args, "--format", "json", "--quiet")...)
+}
+
+type vertex struct {
+	config VertexConfig
+}
+
+// putSecret keeps the env file of a run in Secret Manager as a new version
+// of invoker-<name> and returns the name of the version.
+func (g vertex) putSecret(name string, vars map[string]string) (string, error) {
+	file, remove, err := writeCLIInput(vars, "invoker-secret-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer remove()
+
+	// secrets aren't regional, gcloudCLI would pass the region
+	gcloud := func(v any, args ...string) error {
+		if g.config.Project != "" {
+			args = append(args, "--project", g.config.Project)
+		}
+		return cloudCLI(v, "gcloud", append(args, "--format", "json", "--quiet")...)
+	}
+	id := "invoker-" + cloudJobName(name, regexp.MustCompile(`[^A-Za-z0-9_-]+`), 240)
+	err = gcloud(nil, "secrets", "create", id, "--replication-policy", "automatic")
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return "", errors.WithMessage(err, "failed to store the env file in secret manager")
+	}
+	var version struct {
+		Name string `json:"name"`
+	}
+	if err := gcloud(&version, "secrets", "versions", "add", id, "--data-file", file); err != nil {
+		return "", errors.WithMessage(err, "failed to store the env file in secret manager")
+	}
+
+	return version.Name, nil
+}
+
+// vertexSecret prints the version of a secret, with the token of the
+// service account of the job from the metadata server.
+func vertexSecret(version string) string {
+	return `python3 -c 'import base64, json, sys, urllib.request as u; ` +
+		`t = json.load(u.urlopen(u.Request("http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", headers={"Metadata-Flavor": "Google"})))["access_token"]; ` +
+		`r = json.load(u.urlopen(u.Request("https://secretmanager.googleapis.com/v1/` + version + `:access", headers={"Authorization": "Bearer " + t}))); ` +
+		`sys.stdout.write(base64.b64decode(r["payload"]["data"]).decode())'`
+}
+
+// vertexClusterSpec reads the CLUSTER_SPEC vertex sets on the nodes of
+// jobs with more than one replica, the master is the first replica of the
+// first pool.
+const vertexClusterSpec = `import json, os; c = json.loads(os.environ["CLUSTER_SPEC"]); t = c["task"]; `
+
+func (g vertex) entrypoint(spec cloudJobSpec) []string {
+	if spec.Nodes == 1 {
+		return []string{"sh", "-c", spec.torchrunScript("0", "localhost")}
+	}
+
+	rank := `$(python3 -c '` + vertexClusterSpec + `print(0 if t["type"] == "workerpool0" else t["index"] + 1)')`
+	master := `$(python3 -c '` + vertexClusterSpec + `print(c["cluster"]["workerpool0"][0].split(":")[0])')`
+
+	return []string{"sh", "-c", spec.torchrunScript(rank, master)}
+}
+
+func (g vertex) submit(spec cloudJobSpec) (CloudJob, error) {
+	if g.config.Region == "" || g.config.MachineType == "" {
+		return CloudJob{}, errors.New("region and machine_type have to be set under vertex in ~/.config/higgsfield/cloud.json")
+	}
+	if !spec.CPUOnly && g.config.AcceleratorType == "" {
+		return CloudJob{}, errors.New("no accelerator_type under vertex in ~/.config/higgsfield/cloud.json, set one or pass --cpu_only")
+	}
+	disk := g.config.BootDiskSizeGB
+	if disk == 0 {
+		disk = 100
+	}
+
+	machine := map[string]any{"machineType": g.config.MachineType}
+	if !spec.CPUOnly {
+		machine["acceleratorType"] = g.config.AcceleratorType
+		machine["acceleratorCount"] = spec.NProcPerNode
+	}
+	entrypoint := g.entrypoint(spec)
+	// custom jobs have no secrets, so the nodes fetch the env file
+	// themselves, as the service account of the job
+	if len(spec.Env) > 0 {
+		version, err := g.putSecret(spec.Name, spec.envVars())
+		if err != nil {
+			return CloudJob{}, err
+		}
+		entrypoint[2] = withSecrets(vertexSecret(version), entrypoint[2])
+	}
+	pool := func(replicas int) map[string]any {
+		return map[string]any{
+			"machineSpec":  machine,
+			"replicaCount": replicas,
+			"diskSpec":     map[string]any{"bootDiskType": "pd-ssd", "bootDiskSizeGb": disk},
+			"containerSpec": map[string]any{
+				"imageUri": spec.Image,
+				"command":  entrypoint[:2],
+				"args":     entrypoint[2:],
+			},
+		}
+	}
+
+	// the second pool has to have the same machines for torchrun
+	pools := []map[string]any{pool(1)}
+	if spec.Nodes > 1 {
+		pools = append(pools, pool(spec.Nodes-1))
+	}
+	jobSpec := map[string]any{"workerPoolSpecs": pools}
+	if g.config.ServiceAccount != "" {
+		jobSpec["serviceAccount"] = g.config.ServiceAccount
+	}
+	if g.config.BaseOutputDirectory != "" {
+		jobSpec["baseOutputDirectory"] = map[string]string{"outputUriPrefix": g.config.BaseOutputDirectory}
+	}
+
+	// gcloud only takes the spec from a file, json being yaml
+	file, remove, err := writeCLIInput(jobSpec, "invoker-vertex-*.json")
+	if err != nil {
+		return CloudJob{}, errors.WithMessage(err, "failed to write the job spec")
+	}
+	defer remove()
+
+	var created struct {
+		Name  string `json:"name"`
+		State string `json:"state"`
+	}
+	err = gcloudCLI(&created, g.config.Project, g.config.Region, "ai", "custom-jobs", "create",
+		"--display-name", cloudJobName(spec.Name, regexp.MustCompile(`[^A-Za-z0-9_-]+`), 128), "--config", file)
+	if err != nil {
+		return CloudJob{}, err
+	}
+	if created.Name == "" {
+		return CloudJob{}, errors.New("gcloud didn't return the name of the job")
+	}
+
+	// the name is the full resource name, which has the project in it
+	return CloudJob{Backend: backendVertex, ID: path.Base(created.Name), Region: g.config.Region, Status: strings.TrimPrefix(created.State, "JOB_STATE_")}, nil
+}
+
+func (g vertex) status(job CloudJob) (cloudStatus, error) {
+	var described struct {
+		State string `json:"state"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := gcloudCLI(&described, g.config.Project, job.Region, "ai", "custom-jobs", "describe", job.ID); err != nil {
+		return cloudStatus{}, err
+	}
+
+	status := cloudStatus{Status: strings.TrimPrefix(described.State, "JOB_STATE_"), Reason: described.Error.Message}
+	switch status.Status {
+	case "SUCCEEDED":
+		status.Done = true
+	case "FAILED", "CANCELLED", "EXPIRED":
+		status.Done, status.Failed = true, true
+	}
+
+	return status, nil
+}
+
+func (g vertex) cancel(job CloudJob) error {
+	return gcloudCLI(nil, g.config.Project, job.Region, "ai", "custom-jobs", "cancel", job.ID)
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const projectConfigFile = "invoker.yaml"
+
+// GuestPaths are where the project and the cache end up inside the
+// container. The defaults match the hf-torch image.
+type GuestPaths struct {
+	RootPath  string `yaml:"root_path"`
+	CachePath string `yaml:"cache_path"`
+	// CacheAliases are extra mount points of the host cache, e.g. the cache
+	// of root when the image switches users.
+	CacheAliases []string `yaml:"cache_aliases"`
+}
+
+const (
+	networkModeHost    = "host"
+	networkModeBridge  = "bridge"
+	networkModeMacvlan = "macvlan"
+	networkModeIpvlan  = "ipvlan"
+)
+
+// NetworkConfig picks how the experiment container is networked. Host
+// networking is the default, the other modes attach the container to the
+// docker network Name. In bridge mode the master port and NCCLPortRange are
+// published on the host, for macvlan and ipvlan the network has to be
+// created beforehand since it depends on the cluster's interfaces.
+type NetworkConfig struct {
+	Mode          string `yaml:"mode"`
+	Name          string `yaml:"name"`
+	NCCLPortRange string `yaml:"nccl_port_range"`
+}
+
+// DNSConfig is passed to the container's resolv.conf. Docker ignores it
+// with host networking, where the host's resolver is used.
+type DNSConfig struct {
+	Servers []string `yaml:"servers"`
+	Search  []string `yaml:"search"`
+	Options []string `yaml:"options"`
+}
+
+// ProjectConfig is read from invoker.yaml in the project root.
+type ProjectConfig struct {
+	Guest   GuestPaths    `yaml:"guest"`
+	Network NetworkConfig `yaml:"network"`
+	// ExtraHosts maps host names to addresses in the container's /etc/hosts,
+	// on top of the resolved hosts of the run.
+	ExtraHosts map[string]string `yaml:"extra_hosts"`
+	DNS        DNSConfig         `yaml:"dns"`
+	// Timezone is "host" to follow the host clock settings, or a zone
+	// name such as UTC or Europe/Berlin.
+	Timezone string `yaml:"timezone"`
+	// Locale sets LANG and LC_ALL, the image's own are kept if empty.
+	Locale string `yaml:"locale"`
+	// ReadOnlyRootfs hardens the container: only the mounts, /tmp and the
+	// scratch directories stay writable.
+	ReadOnlyRootfs bool `yaml:"read_only_rootfs"`
+	// Scratch directories are mounted as tmpfs.
+	Scratch []string `yaml:"scratch"`
+	// Metrics tells how training metrics are parsed from the output.
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	EarlyStop EarlyStopPolicy `yaml:"early_stop"`
+	Restart   RestartPolicy   `yaml:"restart"`
+	// Datasets are resolved to exact versions and recorded with every run.
+	Datasets []DatasetConfig `yaml:"datasets"`
+	// Buckets are mounted into the container through FUSE.
+	Buckets     []BucketMount     `yaml:"buckets"`
+	NVMeScratch NVMeScratchConfig `yaml:"nvme_scratch"`
+	// ImagePolicy is checked before every run.
+	ImagePolicy ImagePolicy     `yaml:"image_policy"`
+	HugePages   HugePagesConfig `yaml:"hugepages"`
+	Serving     ServingConfig   `yaml:"serving"`
+	Export      ExportConfig    `yaml:"export"`
+	Retention   RetentionPolicy `yaml:"retention"`
+	// GPUPreflight checks the gpus for memory in use before a run starts.
+	GPUPreflight GPUPreflightConfig `yaml:"gpu_preflight"`
+	// DiskPreflight checks the free disk space before a run builds and
+	// starts.
+	DiskPreflight DiskPreflightConfig `yaml:"disk_preflight"`
+	// Init runs the experiment under docker's init (tini), true if unset.
+	Init *bool `yaml:"init"`
+	// SweepPolicy stops the runs of a sweep that fall behind the others.
+	SweepPolicy SweepPolicy `yaml:"sweep_policy"`
+	// InheritLimits gives the container the cpu and memory limits invoker
+	// runs under in a container or a limited cgroup, true if unset.
+	InheritLimits *bool `yaml:"inherit_limits"`
+	// Resume tells how `experiment resume` hands the checkpoint over.
+	Resume ResumeConfig `yaml:"resume"`
+}
+
+func defaultProjectConfig() ProjectConfig {
+	return ProjectConfig{
+		Guest: GuestPaths{
+			RootPath:     guestRootPath,
+			CachePath:    guestCachePath,
+			CacheAliases: []string{guestRootCachePath},
+		},
+		Network: NetworkConfig{
+			Mode:          networkModeHost,
+			Name:          "higgsfield",
+			NCCLPortRange: "30000-30100",
+		},
+		Timezone: timezoneHost,
+		Metrics:  defaultMetricsConfig(),
+		Init:     PtrTo(true),
+	}
+}
+
+// LoadProjectConfig reads invoker.yaml from the project directory, values
+// missing from the file keep their defaults.
+func LoadProjectConfig(projectPath string) (ProjectConfig, error) {
+	config := defaultProjectConfig()
+
+	path := filepath.Join(projectPath, projectConfigFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// constraintGPU matches gpus whose name contains the value, like H100.
+	constraintGPU = "gpu"
+	// constraintZone, constraintLabel, constraintInstanceType and
+	// constraintPreemptible match the host metadata.
+	constraintZone         = "zone"
+	constraintLabel        = "label"
+	constraintInstanceType = "instance_type"
+	constraintPreemptible  = "preemptible"
+)
+
+// HostMetadata describes this host to the constraints of runs, read from
+// ~/.config/higgsfield/host.json. What it leaves out is filled in from the
+// metadata service of the cloud, see hostInventory. The gpu models come
+// from nvidia-smi.
+type HostMetadata struct {
+	Zone         string   `json:"zone"`
+	Labels       []string `json:"labels"`
+	Cloud        string   `json:"cloud,omitempty"`
+	InstanceType string   `json:"instance_type,omitempty"`
+	Preemptible  *bool    `json:"preemptible,omitempty"`
+	// GPUModel and GPUCount are only reported, the gpu constraint checks
+	// the claimed gpus.
+	GPUModel string `json:"gpu_model,omitempty"`
+	GPUCount int    `json:"gpu_count,omitempty"`
+}
+
+func LoadHostMetadata() (HostMetadata, error) {
+	var metadata HostMetadata
+	if err := loadConfigFile("host.json", &metadata); err != nil {
+		return HostMetadata{}, err
+	}
+
+	return metadata, nil
+}
+
+// parseConstraints splits key=value constraints, rejecting unknown keys.
+func parseConstraints(constraints []string) ([][2]string, error) {
+	parsed := make([][2]string, 0, len(constraints))
+	for _, c := range constraints {
+		key, value, ok := strings.Cut(c, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, errors.Errorf("invalid constraint %q, expected key=value", c)
+		}
+		switch key {
+		case constraintGPU, constraintZone, constraintLabel, constraintInstanceType:
+		case constraintPreemptible:
+			if value != "true" && value != "false" {
+				return nil, errors.Errorf("invalid constraint %q, expected preemptible=true or preemptible=false", c)
+			}
+		default:
+			return nil, errors.Errorf("unknown constraint %s, expected %s, %s, %s, %s or %s", key,
+				constraintGPU, constraintZone, constraintLabel, constraintInstanceType, constraintPreemptible)
+		}
+		parsed = append(parsed, [2]string{key, value})
+	}
+
+	return parsed, nil
+}
+
+// hostGPUNames are the models of the gpus, by index.
+func hostGPUNames() ([]string, error) {
+	records, err := nvidiaSMICSV("--query-gpu=name")
+	if err != nil {
+		return nil, err
+	}
+
+	// nvidia-smi lists the gpus in the order of their index
+	names := make([]string, 0, len(records))
+	for _, r := range records {
+		if len(r) > 0 {
+			names = append(names, strings.TrimSpace(r[0]))
+		}
+	}
+
+	return names, nil
+}
+
+// checkConstraints fails unless this host meets every constraint, with
+// the claimed gpus, or all of them if none are claimed, matching gpu ones.
+func checkConstraints(constraints []string, gpus []int) error {
+	parsed, err := parseConstraints(constraints)
+	if err != nil || len(parsed) == 0 {
+		return err
+	}
+
+	metadata, err := LoadHostMetadata()
+	if err != nil {
+		return err
+	}
+	// the metadata service is only asked for what host.json can't answer
+	for _, c := range parsed {
+		if c[0] == constraintInstanceType || c[0] == constraintPreemptible || (c[0] == constraintZone && metadata.Zone == "") {
+			if metadata, err = hostInventory(cloudMetadataTTL); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var names []string
+	unmet := make([]string, 0)
+	for _, c := range parsed {
+		key, value := c[0], c[1]
+		switch key {
+		case constraintGPU:
+			if names == nil {
+				if names, err = hostGPUNames(); err != nil {
+					return errors.WithMessage(err, "failed to check the gpu constraint")
+				}
+			}
+			if len(names) == 0 {
+				unmet = append(unmet, fmt.Sprintf("gpu=%s (no gpus)", value))
+				continue
+			}
+			indices := gpus
+			if len(indices) == 0 {
+				for i := range names {
+					indices = append(indices, i)
+				}
+			}
+			for _, i := range indices {
+				name := "missing"
+				if i < len(names) {
+					name = names[i]
+				}
+				if !strings.Contains(strings.ToLower(name), strings.ToLower(value)) {
+					unmet = append(unmet, fmt.Sprintf("gpu=%s (gpu %d is %s)", value, i, name))
+					break
+				}
+			}
+		case constraintZone:
+			if metadata.Zone != value {
+				unmet = append(unmet, fmt.Sprintf("zone=%s (the zone is %s)", value, orNone(metadata.Zone)))
+			}
+		case constraintLabel:
+			if !slices.Contains(metadata.Labels, value) {
+				unmet = append(unmet, fmt.Sprintf("label=%s (the labels are %s)", value, orNone(strings.Join(metadata.Labels, ", "))))
+			}
+		case constraintInstanceType:
+			if metadata.InstanceType != value {
+				unmet = append(unmet, fmt.Sprintf("instance_type=%s (the instance type is %s)", value, orNone(metadata.InstanceType)))
+			}
+		case constraintPreemptible:
+			preemptible := metadata.Preemptible != nil && *metadata.Preemptible
+			if fmt.Sprint(preemptible) != value {
+				unmet = append(unmet, fmt.Sprintf("preemptible=%s (the host is preemptible=%t)", value, preemptible))
+			}
+		}
+	}
+	if len(unmet) > 0 {
+		return errors.Errorf("this host doesn't meet the constraints %s", strings.Join(unmet, ", "))
+	}
+
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+
+	return s
+}
+
+// orDash is - for empty table cells.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
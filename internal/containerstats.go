@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// containerStats is what a running container uses of the host, the way
+// `docker stats` reports it.
+type containerStats struct {
+	CPUPercent  float64
+	MemoryBytes uint64
+	MemoryLimit uint64
+	// Network is false for containers on the host network, which have no
+	// counters of their own.
+	Network bool
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// Stats samples the usage of a running container. The daemon takes about
+// a second, since cpu usage is measured between two reads.
+func (d *DockerRun) Stats(containerName string) (containerStats, error) {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	response, err := d.client.ContainerStats(ctx, containerName, false)
+	if err != nil {
+		return containerStats{}, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to get stats of %s", containerName)
+	}
+	defer response.Body.Close()
+
+	var v types.StatsJSON
+	if err := json.NewDecoder(response.Body).Decode(&v); err != nil {
+		return containerStats{}, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to read stats of %s", containerName)
+	}
+	if v.Read.IsZero() {
+		return containerStats{}, errors.Errorf("%s is not running", containerName)
+	}
+
+	stats := containerStats{MemoryBytes: v.MemoryStats.Usage, MemoryLimit: v.MemoryStats.Limit}
+
+	cpuDelta := float64(v.CPUStats.CPUUsage.TotalUsage) - float64(v.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(v.CPUStats.SystemUsage) - float64(v.PreCPUStats.SystemUsage)
+	cpus := float64(v.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(v.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// the page cache counts as usage, but the kernel takes it back under
+	// pressure, so like docker stats leave out the inactive part, cgroup
+	// v1 and v2 name it differently
+	for _, key := range []string{"total_inactive_file", "inactive_file"} {
+		if inactive, ok := v.MemoryStats.Stats[key]; ok && inactive < stats.MemoryBytes {
+			stats.MemoryBytes -= inactive
+			break
+		}
+	}
+
+	for _, n := range v.Networks {
+		stats.Network = true
+		stats.RxBytes += n.RxBytes
+		stats.TxBytes += n.TxBytes
+	}
+
+	return stats, nil
+}
+
+// statsOf samples the running containers concurrently, leaving out the
+// ones that fail.
+func (d *DockerRun) statsOf(containerNames []string) map[string]containerStats {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	all := make(map[string]containerStats, len(containerNames))
+	for _, name := range containerNames {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			stats, err := d.Stats(name)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			all[name] = stats
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	return all
+}
+
+func (s containerStats) columns() (string, string, string) {
+	memory := units.BytesSize(float64(s.MemoryBytes))
+	if s.MemoryLimit > 0 {
+		memory += " / " + units.BytesSize(float64(s.MemoryLimit))
+	}
+	network := "host"
+	if s.Network {
+		network = fmt.Sprintf("%s / %s", units.HumanSize(float64(s.RxBytes)), units.HumanSize(float64(s.TxBytes)))
+	}
+
+	return fmt.Sprintf("%.1f%%", s.CPUPercent), memory, network
+}
+
+// liveStats samples the containers of the runs, by the daemon each runs
+// on.
+func liveStats(ctx context.Context, states []ExperimentState) map[string]containerStats {
+	byContext := make(map[string][]string)
+	for _, state := range states {
+		if state.Cloud != nil {
+			continue
+		}
+		byContext[state.RunArgs.DockerContext] = append(byContext[state.RunArgs.DockerContext], state.ContainerName)
+	}
+
+	all := make(map[string]containerStats, len(states))
+	for dockerContext, names := range byContext {
+		dr, err := NewDockerRun(ctx, dockerContext, "", "", "")
+		if err != nil {
+			warnf("failed to get container stats: %v\n", err)
+			continue
+		}
+		for name, stats := range dr.statsOf(names) {
+			all[name] = stats
+		}
+	}
+
+	return all
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CostConfig tells which class this host belongs to and how much a gpu
+// hour costs per class, read from ~/.config/higgsfield/cost.json.
+type CostConfig struct {
+	HostClass    string             `json:"host_class"`
+	GPUHourRates map[string]float64 `json:"gpu_hour_rates"`
+}
+
+func LoadCostConfig() (CostConfig, error) {
+	var config CostConfig
+	if err := loadConfigFile("cost.json", &config); err != nil {
+		return CostConfig{}, err
+	}
+
+	return config, nil
+}
+
+type CostArgs struct {
+	By     string `validate:"required,oneof=project experiment user team"`
+	Since  string
+	Format string `validate:"required,oneof=table csv"`
+	// Tags only account the runs that have every one of these key=value
+	// tags.
+	Tags []string
+}
+
+type costLine struct {
+	Key      string
+	GPUHours float64
+	Cost     float64
+}
+
+func costKey(by string, r RunRecord) string {
+	switch by {
+	case "experiment":
+		return r.ProjectName + "/" + r.ExperimentName
+	case "user":
+		if r.Identity != "" {
+			return r.Identity
+		}
+		return r.User
+	case "team":
+		return r.Team
+	default:
+		return r.ProjectName
+	}
+}
+
+// costLines sums gpu hours per key, counting only the part of each run that
+// falls after since.
+func costLines(records []RunRecord, config CostConfig, by string, since time.Time) []costLine {
+	lines := make(map[string]*costLine)
+	for _, r := range records {
+		start := r.StartedAt
+		if start.Before(since) {
+			start = since
+		}
+		if !r.FinishedAt.After(start) {
+			continue
+		}
+
+		key := costKey(by, r)
+		if lines[key] == nil {
+			lines[key] = &costLine{Key: key}
+		}
+
+		gpuHours := r.FinishedAt.Sub(start).Hours() * float64(r.GPUs)
+		lines[key].GPUHours += gpuHours
+		lines[key].Cost += gpuHours * config.GPUHourRates[r.HostClass]
+	}
+
+	result := make([]costLine, 0, len(lines))
+	for _, l := range lines {
+		result = append(result, *l)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Cost > result[j].Cost })
+
+	return result
+}
+
+// usageRecords is the finished runs from the history plus the live ones,
+// accounted up to now or until their container stopped. Runs whose
+// container is gone are accounted until it was found missing, or else
+// until their state was last updated, not for as long as they stay
+// recorded.
+func usageRecords(dr *DockerRun, sm *InnerStateManager, config CostConfig) ([]RunRecord, error) {
+	records, err := sm.History()
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := dr.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	now := clock.Now().UTC()
+	for _, s := range states {
+		finishedAt := now
+		c, found := byName[s.ContainerName]
+		switch {
+		case found && (c.State == "exited" || c.State == "dead"):
+			finishedAt = c.FinishedAt
+		case found || s.Cloud != nil:
+		case !s.VanishedAt.IsZero():
+			finishedAt = s.VanishedAt
+		default:
+			finishedAt = s.UpdatedAt
+		}
+		records = append(records, recordFromState(s, config.HostClass, finishedAt))
+	}
+
+	return records, nil
+}
+
+func Cost(args CostArgs) {
+	validateArgs(args)
+
+	since, err := parseSince(args.Since)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	tags, err := parseTags(args.Tags)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	config, err := LoadCostConfig()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), "", "", cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	records, err := usageRecords(dr, sm, config)
+	if err != nil {
+		errorf("failed to collect usage: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	tagged := records[:0]
+	for _, r := range records {
+		if matchTags(r.Tags, tags) {
+			tagged = append(tagged, r)
+		}
+	}
+	lines := costLines(tagged, config, args.By, since)
+
+	if args.Format == "csv" {
+		if err := writeCostCSV(lines, args.By); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tGPU HOURS\tCOST\n", args.By)
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\t%.2f\t%.2f\n", l.Key, l.GPUHours, l.Cost)
+	}
+	w.Flush()
+}
+
+func writeCostCSV(lines []costLine, by string) error {
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write([]string{by, "gpu_hours", "cost"}); err != nil {
+		return errors.WithMessage(err, "failed to write csv")
+	}
+
+	for _, l := range lines {
+		row := []string{l.Key, fmt.Sprintf("%.4f", l.GPUHours), fmt.Sprintf("%.4f", l.Cost)}
+		if err := w.Write(row); err != nil {
+			return errors.WithMessage(err, "failed to write csv")
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// DatasetConfig pins a dataset the experiment trains on, configured under
+// datasets in invoker.yaml. Exactly one of DVC and LakeFS is set.
+type DatasetConfig struct {
+	Name string `yaml:"name"`
+	// DVC is the .dvc file of the dataset inside the project.
+	DVC string `yaml:"dvc"`
+	// LakeFS is a lakefs://repository/ref/path uri.
+	LakeFS string `yaml:"lakefs"`
+	// Rev pins the git revision of the .dvc file, the checked out one if
+	// empty. For lakeFS the ref of the uri is resolved to a commit instead.
+	Rev string `yaml:"rev"`
+	// Mount is where a downloaded dataset appears in the container,
+	// /data/<name> if empty.
+	Mount string `yaml:"mount"`
+}
+
+// DatasetVersion is the resolved version of a dataset a run used.
+type DatasetVersion struct {
+	Name    string `json:"name"`
+	Source  string `json:"source"`
+	Version string `json:"version"`
+}
+
+// resolvedDataset is a dataset version plus the host directory holding its
+// data, empty when the data already lives in the mounted project.
+type resolvedDataset struct {
+	DatasetVersion
+	hostPath  string
+	guestPath string
+}
+
+// resolveDatasets resolves every dataset to an exact version and makes the
+// data available on this host.
+func resolveDatasets(datasets []DatasetConfig, projectPath, cacheDir string) ([]resolvedDataset, error) {
+	resolved := make([]resolvedDataset, 0, len(datasets))
+	for _, d := range datasets {
+		var r resolvedDataset
+		var err error
+
+		switch {
+		case d.DVC != "" && d.LakeFS != "":
+			return nil, errors.Errorf("dataset %s sets both dvc and lakefs", d.Name)
+		case d.DVC != "":
+			r, err = resolveDVC(d, projectPath, cacheDir)
+		case d.LakeFS != "":
+			r, err = resolveLakeFS(d, cacheDir)
+		default:
+			return nil, errors.Errorf("dataset %s sets neither dvc nor lakefs", d.Name)
+		}
+		if err != nil {
+			return nil, errors.WithMessagef(err, "failed to resolve dataset %s", d.Name)
+		}
+
+		if r.hostPath != "" {
+			r.guestPath = d.Mount
+			if r.guestPath == "" {
+				r.guestPath = path.Join("/data", d.Name)
+			}
+		}
+
+		resolved = append(resolved, r)
+	}
+
+	return resolved, nil
+}
+
+func runIn(dir, name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, errors.Errorf("%s is not installed", name)
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// the arguments may carry credentials, like the url of a remote
+		return nil, errors.Errorf("%s %s: %v: %s", name, strings.Join(redactArgs(args), " "), err, redactText(strings.TrimSpace(stderr.String())))
+	}
+
+	return out, nil
+}
+
+// dvcOut is the tracked path and md5 of a .dvc file.
+func dvcOut(data []byte) (string, string, error) {
+	var file struct {
+		Outs []struct {
+			MD5  string `yaml:"md5"`
+			Path string `yaml:"path"`
+		} `yaml:"outs"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return "", "", errors.WithMessage(err, "failed to parse dvc file")
+	}
+	if len(file.Outs) != 1 {
+		return "", "", errors.Errorf("expected a single out in the dvc file, got %d", len(file.Outs))
+	}
+
+	return file.Outs[0].Path, file.Outs[0].MD5, nil
+}
+
+// resolveDVC versions a dataset by the md5 of its .dvc file. An unpinned
+// dataset is pulled into the project, a pinned one is fetched at its
+// revision into the cache.
+func resolveDVC(d DatasetConfig, projectPath, cacheDir string) (resolvedDataset, error) {
+	var data []byte
+	var err error
+	if d.Rev == "" {
+		data, err = os.ReadFile(filepath.Join(projectPath, d.DVC))
+	} else {
+		data, err = runIn(projectPath, "git", "show", d.Rev+":"+d.DVC)
+	}
+	if err != nil {
+		return resolvedDataset{}, err
+	}
+
+	out, md5, err := dvcOut(data)
+	if err != nil {
+		return resolvedDataset{}, err
+	}
+
+	r := resolvedDataset{DatasetVersion: DatasetVersion{Name: d.Name, Source: "dvc:" + d.DVC, Version: md5}}
+	if d.Rev == "" {
+		_, err = runIn(projectPath, "dvc", "pull", d.DVC)
+		return r, err
+	}
+
+	r.hostPath = filepath.Join(cacheDir, "higgsfield", "datasets", d.Name, md5)
+	if _, err := os.Stat(r.hostPath); err == nil {
+		return r, nil
+	}
+
+	target := filepath.Join(filepath.Dir(d.DVC), out)
+	if _, err := runIn(projectPath, "dvc", "get", ".", target, "--rev", d.Rev, "-o", r.hostPath); err != nil {
+		os.RemoveAll(r.hostPath)
+		return r, err
+	}
+
+	return r, nil
+}
+
+// resolveLakeFS pins a lakefs uri to the commit its ref points at and
+// downloads the data of that commit into the cache.
+func resolveLakeFS(d DatasetConfig, cacheDir string) (resolvedDataset, error) {
+	repo, rest, ok := strings.Cut(strings.TrimPrefix(d.LakeFS, "lakefs://"), "/")
+	if !strings.HasPrefix(d.LakeFS, "lakefs://") || !ok {
+		return resolvedDataset{}, errors.Errorf("invalid lakefs uri %s, expected lakefs://repository/ref/path", d.LakeFS)
+	}
+	ref, objectPath, _ := strings.Cut(rest, "/")
+
+	out, err := runIn("", "lakectl", "log", "--amount", "1", "lakefs://"+repo+"/"+ref)
+	if err != nil {
+		return resolvedDataset{}, err
+	}
+
+	var commit string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if id, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "ID:"); ok {
+			commit = strings.TrimSpace(id)
+			break
+		}
+	}
+	if commit == "" {
+		return resolvedDataset{}, errors.Errorf("failed to resolve lakefs ref %s of %s", ref, repo)
+	}
+
+	r := resolvedDataset{
+		DatasetVersion: DatasetVersion{Name: d.Name, Source: "lakefs:" + d.LakeFS, Version: commit},
+		hostPath:       filepath.Join(cacheDir, "higgsfield", "datasets", d.Name, commit),
+	}
+	if _, err := os.Stat(r.hostPath); err == nil {
+		return r, nil
+	}
+
+	uri := "lakefs://" + repo + "/" + commit + "/" + objectPath
+	if _, err := runIn("", "lakectl", "fs", "download", "--recursive", uri, r.hostPath); err != nil {
+		os.RemoveAll(r.hostPath)
+		return r, err
+	}
+
+	return r, nil
+}
+
+// datasetBinds mounts the downloaded datasets read-only.
+func datasetBinds(datasets []resolvedDataset) []string {
+	binds := make([]string, 0, len(datasets))
+	for _, d := range datasets {
+		if d.hostPath != "" {
+			binds = append(binds, d.hostPath+":"+d.guestPath+":ro")
+		}
+	}
+
+	return binds
+}
+
+func datasetVersions(datasets []resolvedDataset) []DatasetVersion {
+	versions := make([]DatasetVersion, 0, len(datasets))
+	for _, d := range datasets {
+		versions = append(versions, d.DatasetVersion)
+	}
+
+	return versions
+}
@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ncclDebugDirName is the directory in the run directory that NCCL writes
+// its debug output to with --nccl_debug.
+const ncclDebugDirName = "nccl_debug"
+
+// ncclDebugEnv makes NCCL log at INFO level into a file per node rank and
+// process in dir.
+func ncclDebugEnv(dir string, rank int) []string {
+	return []string{
+		"NCCL_DEBUG=INFO",
+		// NCCL replaces %h with the host name and %p with the pid
+		fmt.Sprintf("NCCL_DEBUG_FILE=%s/rank%d-%%h-%%p.log", dir, rank),
+	}
+}
+
+// debugBundle is a tar.gz of everything needed to look into a failed run.
+type debugBundle struct {
+	gz  *gzip.Writer
+	tar *tar.Writer
+}
+
+func newDebugBundle(w io.Writer) *debugBundle {
+	gz := gzip.NewWriter(w)
+	return &debugBundle{gz: gz, tar: tar.NewWriter(gz)}
+}
+
+func (b *debugBundle) addBytes(name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: clock.Now()}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return errors.WithMessagef(err, "failed to add %s to the bundle", name)
+	}
+
+	_, err := b.tar.Write(data)
+	return errors.WithMessagef(err, "failed to add %s to the bundle", name)
+}
+
+func (b *debugBundle) addFile(name, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	return b.addBytes(name, data)
+}
+
+// addDir adds the files below dir under prefix.
+func (b *debugBundle) addDir(prefix, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return b.addFile(prefix+filepath.ToSlash(rel), path)
+	})
+}
+
+// addBundle copies the entries of another bundle under prefix.
+func (b *debugBundle) addBundle(prefix string, data []byte) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return errors.WithMessage(err, "failed to read bundle")
+	}
+	r := tar.NewReader(gz)
+
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.WithMessage(err, "failed to read bundle")
+		}
+
+		entry, err := io.ReadAll(r)
+		if err != nil {
+			return errors.WithMessage(err, "failed to read bundle")
+		}
+		if err := b.addBytes(prefix+header.Name, entry); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *debugBundle) Close() error {
+	if err := b.tar.Close(); err != nil {
+		return err
+	}
+
+	return b.gz.Close()
+}
+
+// logf reports progress on stderr, since the bundle itself may go to
+// stdout.
+func logf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+type DebugBundleArgs struct {
+	ExperimentName string `validate:"required"`
+	ProjectName    string `validate:"omitempty,varname"`
+	// Hosts to collect from, the recorded hosts of the run if empty.
+	Hosts []string
+	// Output is the file to write, - for stdout.
+	Output string
+	// Local only bundles this host, it's how the other hosts are asked.
+	Local bool
+	// LogLines is how much of the container output to include.
+	LogLines int `validate:"min=1"`
+}
+
+// runDirs are the run directories of the experiment on this host, only
+// the one of state if there is one.
+func runDirs(state *ExperimentState, projectName, experimentName string) ([]string, error) {
+	if state != nil {
+		_, dir, err := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+		return []string{dir}, err
+	}
+
+	_, dir, err := defaultDirectories(projectName, experimentName, "*")
+	if err != nil {
+		return nil, err
+	}
+
+	return filepath.Glob(dir)
+}
+
+// bundleHost adds what this host knows about the run under prefix. What
+// can't be collected is listed in errors.txt, a bundle with gaps is still
+// worth sharing.
+func bundleHost(b *debugBundle, prefix string, state *ExperimentState, args DebugBundleArgs) error {
+	problems := make([]string, 0)
+	problem := func(what string, err error) {
+		problems = append(problems, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	add := func(name string, data []byte, err error) error {
+		if err != nil {
+			problem(name, err)
+			return nil
+		}
+		return b.addBytes(prefix+name, data)
+	}
+
+	if err := add("version.txt", []byte(Version+"\n"), nil); err != nil {
+		return err
+	}
+
+	dirs, err := runDirs(state, args.ProjectName, args.ExperimentName)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		ncclDir := filepath.Join(dir, ncclDebugDirName)
+		if _, err := os.Stat(ncclDir); err != nil {
+			continue
+		}
+		if err := b.addDir(prefix+"nccl/"+filepath.Base(dir)+"/", ncclDir); err != nil {
+			return err
+		}
+	}
+
+	containerName := DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
+	if state != nil {
+		containerName = state.ContainerName
+		data, err := json.MarshalIndent(state.redacted(), "", "  ")
+		if err := add("state.json", data, err); err != nil {
+			return err
+		}
+
+		for _, f := range state.Failures {
+			data, err := os.ReadFile(f.File)
+			if err := add("failures/"+filepath.Base(f.File), []byte(redactText(string(data))), err); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := experimentHistory(args.ProjectName, args.ExperimentName)
+	if err := add("history.jsonl", data, err); err != nil {
+		return err
+	}
+
+	if dr, err := dockerRunOf(context.Background(), containerName); err != nil {
+		problem("docker", err)
+	} else {
+		inspect, env, err := dr.inspectForBundle(containerName)
+		if err := add("inspect.json", inspect, err); err != nil {
+			return err
+		}
+		if err := add("nccl_env.txt", env, err); err != nil {
+			return err
+		}
+
+		logs, err := dr.tailLogs(containerName, args.LogLines)
+		if err := add("logs.txt", []byte(redactText(logs)), err); err != nil {
+			return err
+		}
+	}
+
+	data, err = exec.Command("nvidia-smi", "-q").CombinedOutput()
+	if err := add("nvidia-smi.txt", data, err); err != nil {
+		return err
+	}
+
+	data, err = gpuKernelMessages()
+	if err := add("dmesg.txt", data, err); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return b.addBytes(prefix+"errors.txt", []byte(strings.Join(problems, "\n")+"\n"))
+	}
+	return nil
+}
+
+// experimentHistory are the history records of the experiment on this host.
+func experimentHistory(projectName, experimentName string) ([]byte, error) {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := sm.History()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		if r.ProjectName != projectName || r.ExperimentName != experimentName {
+			continue
+		}
+		data, err := json.Marshal(r.redacted())
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bundleEnvPrefixes are the environment variables whose values go into the
+// bundle, the values of all others may be secrets.
+var bundleEnvPrefixes = []string{"NCCL_", "CUDA_", "TORCH_", "HIGGSFIELD_", "PYTORCH_"}
+
+func keepEnvValue(name string) bool {
+	for _, prefix := range bundleEnvPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inspectForBundle returns the inspect output of the container with the
+// values of secret-looking environment variables redacted, and the NCCL
+// environment on its own.
+func (d *DockerRun) inspectForBundle(containerName string) ([]byte, []byte, error) {
+	inspect, err := d.client.ContainerInspect(d.ctx, containerName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ncclEnv bytes.Buffer
+	if inspect.Config != nil {
+		for i, kv := range inspect.Config.Env {
+			name, _, _ := strings.Cut(kv, "=")
+			if !keepEnvValue(name) {
+				inspect.Config.Env[i] = name + "=" + redactedValue
+			} else if strings.HasPrefix(name, "NCCL_") {
+				ncclEnv.WriteString(kv + "\n")
+			}
+		}
+		inspect.Config.Cmd = redactArgs(inspect.Config.Cmd)
+		inspect.Config.Entrypoint = redactArgs(inspect.Config.Entrypoint)
+	}
+	if inspect.ContainerJSONBase != nil {
+		inspect.Args = redactArgs(inspect.Args)
+	}
+
+	data, err := json.MarshalIndent(inspect, "", "  ")
+	return data, ncclEnv.Bytes(), err
+}
+
+// gpuKernelMessages are the kernel messages of the nvidia driver, Xid
+// errors included.
+func gpuKernelMessages() ([]byte, error) {
+	out, err := exec.Command("dmesg", "--time-format", "iso").Output()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read kernel messages, this may need root")
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "NVRM") || strings.Contains(line, "Xid") || strings.Contains(strings.ToLower(line), "nvidia") {
+			buf.WriteString(line + "\n")
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// findLiveState returns the state of the experiment on this host, matched
+// by experiment or container name, nil if there is none.
+func findLiveState(sm *InnerStateManager, projectName, name string) (*ExperimentState, error) {
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range states {
+		if projectName != "" && s.ProjectName != projectName {
+			continue
+		}
+		if s.ExperimentName == name || s.ContainerName == name {
+			return &s, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// DebugBundle collects the debug output of a run from all of its hosts into
+// a single tar.gz to share.
+func DebugBundle(args DebugBundleArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		logf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	state, err := findLiveState(sm, args.ProjectName, args.ExperimentName)
+	if err != nil {
+		logf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if state == nil && args.ProjectName == "" {
+		logf("no recorded run of %s on this host, pass --project_name\n", args.ExperimentName)
+		os.Exit(ExitValidation)
+	}
+	if state != nil {
+		args.ProjectName = state.ProjectName
+	}
+
+	output := args.Output
+	if output == "" {
+		output = fmt.Sprintf("%s-debug-%s.tar.gz", args.ExperimentName, clock.Now().Format("20060102-150405"))
+	}
+
+	var w io.Writer = os.Stdout
+	if output == "-" {
+		// whatever gets printed along the way must not end up in the bundle
+		os.Stdout = os.Stderr
+	} else {
+		f, err := os.Create(output)
+		if err != nil {
+			logf("failed to create %s: %v\n", output, err)
+			os.Exit(ExitInfra)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	b := newDebugBundle(w)
+	if args.Local {
+		if err := bundleHost(b, "", state, args); err != nil {
+			logf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+	} else if err := bundleHosts(b, state, args); err != nil {
+		logf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if err := b.Close(); err != nil {
+		logf("failed to write %s: %v\n", output, err)
+		os.Exit(ExitInfra)
+	}
+
+	if output != "-" {
+		logf("wrote %s\n", output)
+	}
+}
+
+// bundleHosts adds this host and asks every other host of the run for its
+// part over ssh. Hosts that fail get an error.txt instead.
+func bundleHosts(b *debugBundle, state *ExperimentState, args DebugBundleArgs) error {
+	hosts := args.Hosts
+	self := ""
+	if state != nil {
+		if len(hosts) == 0 {
+			hosts = state.RunArgs.Hosts
+		}
+		if state.Rank < len(state.RunArgs.Hosts) {
+			self = state.RunArgs.Hosts[state.Rank]
+		}
+	}
+	if self == "" {
+		self, _ = os.Hostname()
+	}
+
+	logf("collecting %s\n", self)
+	if err := bundleHost(b, self+"/", state, args); err != nil {
+		return err
+	}
+
+	remote := []string{"debug-bundle", args.ExperimentName, "--project_name", args.ProjectName,
+		"--log_lines", fmt.Sprint(args.LogLines), "--local", "--output", "-"}
+	for _, host := range hosts {
+		if host == self || isLoopback(host) {
+			continue
+		}
+
+		logf("collecting %s\n", host)
+		data, err := outputOnHost(context.Background(), host, remote...)
+		if err == nil {
+			err = b.addBundle(host+"/", []byte(data))
+		}
+		if err != nil {
+			logf("%s: %v\n", host, err)
+			if err := b.addBytes(host+"/error.txt", []byte(err.Error()+"\n")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
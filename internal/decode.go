@@ -2,7 +2,6 @@ package internal
 
 import (
 	"encoding/base64"
-	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -10,26 +9,27 @@ import (
 func DecodeSecrets(secrets string) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		fmt.Printf("failed to get current working directory: %v\n", err)
-		os.Exit(1)
+		errorf("failed to get current working directory: %v\n", err)
+		os.Exit(ExitInfra)
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(secrets)
 
 	if err != nil {
-		fmt.Printf("failed to decode base64 string: %v\n", err)
+		errorf("failed to decode base64 string: %v\n", err)
+		os.Exit(ExitValidation)
 	}
 
-	f, err := os.Create(filepath.Join(cwd, "env"))
+	// written back plainly, so the python side reads what was meant
+	vars, err := parseEnvFile(decoded)
 	if err != nil {
-		fmt.Printf("failed to create env file: %v\n", err)
-		os.Exit(1)
+		errorf("failed to parse secrets: %v\n", err)
+		os.Exit(ExitValidation)
 	}
-	defer f.Close()
+	decoded = formatEnvFile(vars)
 
-	_, err = f.Write(decoded)
-	if err != nil {
-		fmt.Printf("failed to write to env file: %v\n", err)
-		os.Exit(1)
+	if err := files.WriteFile(filepath.Join(cwd, "env"), decoded, 0o600); err != nil {
+		errorf("failed to write to env file: %v\n", err)
+		os.Exit(ExitInfra)
 	}
 }
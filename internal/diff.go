@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type DiffArgs struct {
+	RunA string `validate:"required"`
+	RunB string `validate:"required"`
+}
+
+// findRun returns the latest run on this host whose container, run or
+// experiment name is name, live runs included.
+func findRun(records []RunRecord, name string) (RunRecord, bool) {
+	var found RunRecord
+	ok := false
+	for _, r := range records {
+		if r.ContainerName != name && r.RunName != name && r.ExperimentName != name {
+			continue
+		}
+		if !ok || r.StartedAt.After(found.StartedAt) {
+			found, ok = r, true
+		}
+	}
+
+	return found, ok
+}
+
+// incomparable returns why two runs can't be compared, empty if they can.
+// Runs that trained on different data are never comparable.
+func incomparable(a, b RunRecord) []string {
+	versions := make(map[string]string, len(a.Datasets))
+	for _, d := range a.Datasets {
+		versions[d.Name] = d.Version
+	}
+
+	reasons := make([]string, 0)
+	seen := make(map[string]bool, len(b.Datasets))
+	for _, d := range b.Datasets {
+		seen[d.Name] = true
+		version, ok := versions[d.Name]
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("dataset %s is only used by %s", d.Name, b.ContainerName))
+		} else if version != d.Version {
+			reasons = append(reasons, fmt.Sprintf("dataset %s differs: %s vs %s", d.Name, version, d.Version))
+		}
+	}
+	for _, d := range a.Datasets {
+		if !seen[d.Name] {
+			reasons = append(reasons, fmt.Sprintf("dataset %s is only used by %s", d.Name, a.ContainerName))
+		}
+	}
+
+	return reasons
+}
+
+// Diff compares what two runs executed and exits non-zero if they aren't
+// comparable.
+func Diff(args DiffArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	records, err := sm.History()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	for _, s := range states {
+		records = append(records, recordFromState(s, "", time.Time{}))
+	}
+
+	runs := make([]RunRecord, 0, 2)
+	for _, name := range []string{args.RunA, args.RunB} {
+		run, ok := findRun(records, name)
+		if !ok {
+			errorf("no run %s on this host\n", name)
+			os.Exit(ExitValidation)
+		}
+		runs = append(runs, run)
+	}
+	a, b := runs[0], runs[1]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "\t%s\t%s\n", args.RunA, args.RunB)
+	row := func(name, va, vb string) {
+		mark := ""
+		if va != vb {
+			mark = " *"
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\n", name, mark, va, vb)
+	}
+	row("container", a.ContainerName, b.ContainerName)
+	row("image", a.ImageID, b.ImageID)
+	row("command", strings.Join(redactArgs(a.Entrypoint), " "), strings.Join(redactArgs(b.Entrypoint), " "))
+
+	datasets := make(map[string][2]string)
+	names := make([]string, 0)
+	for i, run := range runs {
+		for _, d := range run.Datasets {
+			if _, ok := datasets[d.Name]; !ok {
+				names = append(names, d.Name)
+			}
+			v := datasets[d.Name]
+			v[i] = d.Version
+			datasets[d.Name] = v
+		}
+	}
+	for _, name := range names {
+		row("dataset "+name, datasets[name][0], datasets[name][1])
+	}
+	w.Flush()
+
+	if reasons := incomparable(a, b); len(reasons) > 0 {
+		fmt.Printf("\nnot comparable:\n")
+		for _, r := range reasons {
+			fmt.Printf("  %s\n", r)
+		}
+		os.Exit(ExitValidation)
+	}
+
+	fmt.Printf("\ncomparable\n")
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDiskWarnBelow  = "50g"
+	defaultDiskAbortBelow = "5g"
+)
+
+// DiskPreflightConfig checks the free space of the filesystems a run
+// writes to before the image is built and the container started: the
+// cache directory, the run directory and docker's data root, which takes
+// the build context and the layers. Running out of space while writing a
+// checkpoint leaves a corrupt one behind without failing the run.
+type DiskPreflightConfig struct {
+	// WarnBelow and AbortBelow are sizes like 50g, 50g and 5g if empty.
+	// 0 turns the check off.
+	WarnBelow  string `yaml:"warn_below"`
+	AbortBelow string `yaml:"abort_below"`
+}
+
+func (c DiskPreflightConfig) thresholds() (warnBelow, abortBelow int64, err error) {
+	parse := func(name, value, fallback string) (int64, error) {
+		if value == "" {
+			value = fallback
+		}
+		bytes, err := units.RAMInBytes(value)
+		if err != nil {
+			return 0, errors.WithMessagef(err, "invalid disk_preflight %s %q in %s", name, value, projectConfigFile)
+		}
+		return bytes, nil
+	}
+
+	if warnBelow, err = parse("warn_below", c.WarnBelow, defaultDiskWarnBelow); err != nil {
+		return 0, 0, err
+	}
+	abortBelow, err = parse("abort_below", c.AbortBelow, defaultDiskAbortBelow)
+	return warnBelow, abortBelow, err
+}
+
+// diskFilesystem is a filesystem and what of the run is on it.
+type diskFilesystem struct {
+	names []string
+	free  int64
+}
+
+// dockerRootDir is where the daemon keeps images and containers, empty if
+// it can't tell.
+func (d *DockerRun) dockerRootDir() string {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	info, err := d.client.Info(ctx)
+	if err != nil {
+		return ""
+	}
+
+	return info.DockerRootDir
+}
+
+// checkDiskSpace runs the preflight on the cache and run directories and
+// the data root of a local daemon. Paths that can't be checked, like a data
+// root this user can't see, are skipped.
+func checkDiskSpace(d *DockerRun, config DiskPreflightConfig, cacheDir, runDir string) error {
+	warnBelow, abortBelow, err := config.thresholds()
+	if err != nil {
+		return err
+	}
+	if warnBelow == 0 && abortBelow == 0 {
+		return nil
+	}
+
+	paths := [][2]string{{"cache directory", cacheDir}, {"run directory", runDir}}
+	if root := d.dockerRootDir(); root != "" {
+		paths = append(paths, [2]string{"docker data root", root})
+	}
+
+	// paths on the same filesystem share its free space, some
+	// filesystems don't report an id though
+	type filesystemKey struct {
+		id   syscall.Fsid
+		path string
+	}
+	filesystems := make(map[filesystemKey]*diskFilesystem)
+	order := make([]filesystemKey, 0, len(paths))
+	for _, p := range paths {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(p[1], &stat); err != nil {
+			continue
+		}
+		key := filesystemKey{id: stat.Fsid}
+		if stat.Fsid == (syscall.Fsid{}) {
+			key.path = p[1]
+		}
+		fs, ok := filesystems[key]
+		if !ok {
+			fs = &diskFilesystem{free: int64(stat.Bavail) * stat.Bsize}
+			filesystems[key] = fs
+			order = append(order, key)
+		}
+		fs.names = append(fs.names, fmt.Sprintf("%s %s", p[0], p[1]))
+	}
+
+	low := make([]string, 0)
+	for _, key := range order {
+		fs := filesystems[key]
+		message := fmt.Sprintf("only %s free for the %s", units.BytesSize(float64(fs.free)), strings.Join(fs.names, " and the "))
+		switch {
+		case abortBelow > 0 && fs.free < abortBelow:
+			low = append(low, message)
+		case warnBelow > 0 && fs.free < warnBelow:
+			warnf("%s, checkpoints may fail to save once it's full\n", message)
+		}
+	}
+	if len(low) > 0 {
+		return errors.Errorf("%s, below disk_preflight abort_below of %s in %s", strings.Join(low, "; "),
+			units.BytesSize(float64(abortBelow)), projectConfigFile)
+	}
+
+	return nil
+}
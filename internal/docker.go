@@ -6,7 +6,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -24,11 +29,19 @@ type DockerRun struct {
 	guestRootPath         string
 	guestCachePath        string
 	guestProjectCachePath string
+	guestCacheAliases     []string
 	imageTag              string
 	hostRootPath          string
 	hostCachePath         string
-	hostGID               int
-	hostUID               int
+	// hostCheckpointPath holds the run directories of the project if
+	// they're outside the cache directory, see checkpointRoot.
+	hostCheckpointPath string
+	hostGID            int
+	hostUID            int
+	// remote daemons can't see this machine's paths and devices
+	remote   bool
+	timeouts map[string]time.Duration
+	images   ImageRetention
 }
 
 const (
@@ -36,6 +49,7 @@ const (
 	guestRootPath      = "/srv/"
 	guestCachePath     = "/home/nonroot/.cache/"
 	guestRootCachePath = "/root/.cache/"
+	remoteCacheVolume  = "higgsfield-cache"
 )
 
 func isCos() (bool, error) {
@@ -61,21 +75,59 @@ func isCos() (bool, error) {
 	return false, nil
 }
 
+const (
+	pingAttempts = 5
+	pingBackoff  = time.Second
+)
+
+// NewDockerRun connects to the daemon of dockerContext, or the one from the
+// environment if it's empty, retrying for a while if it's not up yet.
 func NewDockerRun(
 	ctx context.Context,
+	dockerContext,
 	projectName,
 	hostRootPath,
 	hostCachePath string,
-) *DockerRun {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+) (*DockerRun, error) {
+	endpoint, err := resolveDockerEndpoint(dockerContext)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := endpoint.clientOpts()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	config, err := LoadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	timeouts, err := config.Timeouts.durations()
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to create docker client")
+	}
+
+	if err := pingDaemon(ctx, cli, timeouts[dockerOpInspect]); err != nil {
+		cli.Close()
+		return nil, err
 	}
-	defer cli.Close()
 
 	hostGID := os.Getgid()
 	hostUID := os.Getuid()
 
+	var hostCheckpointPath string
+	if root, err := checkpointRoot(); err == nil && projectName != "" && hostCachePath != "" {
+		if _, inCache := relativeTo(hostCachePath, root); !inCache {
+			hostCheckpointPath = filepath.Join(root, projectName)
+		}
+	}
+
 	return &DockerRun{
 		client:                cli,
 		ctx:                   ctx,
@@ -83,45 +135,239 @@ func NewDockerRun(
 		guestRootPath:         guestRootPath,
 		guestCachePath:        guestCachePath,
 		guestProjectCachePath: guestCachePath + projectName,
-		imageTag:              imageTag,
+		guestCacheAliases:     []string{guestRootCachePath},
+		imageTag:              ImageTag(),
 		hostRootPath:          hostRootPath,
 		hostCachePath:         hostCachePath,
+		hostCheckpointPath:    hostCheckpointPath,
 		hostGID:               hostGID,
 		hostUID:               hostUID,
+		remote:                endpoint.remote(),
+		timeouts:              timeouts,
+		images:                config.Images,
+	}, nil
+}
+
+// pingDaemon waits for the daemon with exponential backoff, permission
+// problems are reported right away since waiting won't fix them.
+func pingDaemon(ctx context.Context, cli *client.Client, timeout time.Duration) error {
+	backoff := pingBackoff
+
+	var err error
+	for attempt := 1; attempt <= pingAttempts; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		_, err = cli.Ping(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if strings.Contains(err.Error(), "permission denied") {
+			return errors.WithMessagef(err,
+				"no permission to talk to the docker daemon at %s, are you in the docker group?", cli.DaemonHost())
+		}
+
+		if attempt < pingAttempts {
+			fmt.Printf("docker daemon at %s is not reachable, retrying in %s\n", cli.DaemonHost(), backoff)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-clock.After(backoff):
+			}
+			backoff *= 2
+		}
 	}
+
+	return errors.WithMessagef(err,
+		"docker daemon at %s is not reachable after %d attempts, is docker running?", cli.DaemonHost(), pingAttempts)
+}
+
+func (d *DockerRun) SetGuestPaths(paths GuestPaths) {
+	d.guestRootPath = paths.RootPath
+	d.guestCachePath = paths.CachePath
+	d.guestProjectCachePath = path.Join(paths.CachePath, d.projectName)
+	d.guestCacheAliases = paths.CacheAliases
 }
 
 func DefaultProjExpContainerName(projectName, experimentName string) string {
+	return namespacedName(namespace, projExpName(projectName, experimentName))
+}
+
+func projExpName(projectName, experimentName string) string {
 	return fmt.Sprintf("%s-%s", projectName, experimentName)
 }
 
 func (d *DockerRun) Kill(containerName string) error {
-	options := types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("name", containerName))}
+	// the name filter is a regular expression matching anywhere in the
+	// name, which would also kill my-run-2 for my-run
+	options := types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("name", "^/"+regexp.QuoteMeta(containerName)+"$"))}
 
-	containers, err := d.client.ContainerList(d.ctx, options)
+	listCtx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+	listed, err := d.client.ContainerList(listCtx, options)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to list containers with name %s", containerName)
+		return errors.WithMessagef(d.timedOut(listCtx, dockerOpInspect, err), "failed to list containers with name %s", containerName)
+	}
+	containers := make([]types.Container, 0, len(listed))
+	for _, c := range listed {
+		if slices.Contains(c.Names, "/"+containerName) {
+			containers = append(containers, c)
+		}
 	}
 
 	fmt.Printf("found %d containers with name %s\n", len(containers), containerName)
 
 	for _, c := range containers {
-		if c.Status == "running" {
-			fmt.Printf("stopping container %s\n", c.ID)
-			if err := d.client.ContainerStop(d.ctx, c.ID, container.StopOptions{Timeout: PtrTo(0)}); err != nil {
-				fmt.Printf("failed to stop container %s, reason: %v", c.ID, err)
-			}
+		if err := d.removeContainer(c); err != nil {
+			return err
 		}
+	}
 
-		fmt.Printf("removing container %s\n", c.ID)
-		if err := d.client.ContainerRemove(d.ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-			return errors.WithMessagef(err, "failed to remove container %s", c.ID)
+	return nil
+}
+
+func (d *DockerRun) removeContainer(c types.Container) error {
+	ctx, cancel := d.deadline(dockerOpRemove)
+	defer cancel()
+
+	if c.Status == "running" {
+		fmt.Printf("stopping container %s\n", c.ID)
+		if err := d.client.ContainerStop(ctx, c.ID, container.StopOptions{Timeout: PtrTo(0)}); err != nil {
+			warnf("failed to stop container %s, reason: %v\n", c.ID, d.timedOut(ctx, dockerOpRemove, err))
 		}
 	}
 
+	fmt.Printf("removing container %s\n", c.ID)
+	if err := d.client.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpRemove, err), "failed to remove container %s", c.ID)
+	}
+
 	return nil
 }
 
+// ExperimentContainer is the runtime view of a container started by invoker.
+type ExperimentContainer struct {
+	Name           string    `json:"name"`
+	Namespace      string    `json:"namespace,omitempty"`
+	ProjectName    string    `json:"project_name"`
+	ExperimentName string    `json:"experiment_name"`
+	RunName        string    `json:"run_name"`
+	User           string    `json:"user"`
+	Identity       string    `json:"identity,omitempty"`
+	State          string    `json:"state"`
+	Health         string    `json:"health"`
+	ExitCode       int       `json:"exit_code"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	// Tags are read from the labels, see RunArgs.Tags.
+	Tags  map[string]string `json:"tags,omitempty"`
+	Sweep string            `json:"sweep,omitempty"`
+}
+
+// List returns containers started by invoker, optionally narrowed down to
+// a single project.
+func (d *DockerRun) List(projectName string) ([]ExperimentContainer, error) {
+	args := filters.NewArgs(filters.Arg("label", labelProject))
+	if projectName != "" {
+		args = filters.NewArgs(filters.Arg("label", labelProject+"="+projectName))
+	}
+
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	containers, err := d.client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, errors.WithMessage(d.timedOut(ctx, dockerOpInspect, err), "failed to list experiment containers")
+	}
+
+	result := make([]ExperimentContainer, 0, len(containers))
+	for _, c := range containers {
+		inspect, err := d.client.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to inspect container %s", c.ID)
+		}
+
+		health := types.NoHealthcheck
+		if inspect.State.Health != nil {
+			health = inspect.State.Health.Status
+		}
+
+		// zero values are reported as 0001-01-01T00:00:00Z, which parses fine
+		startedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+		finishedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+
+		result = append(result, ExperimentContainer{
+			Name:           strings.TrimPrefix(inspect.Name, "/"),
+			Namespace:      c.Labels[labelNamespace],
+			ProjectName:    c.Labels[labelProject],
+			ExperimentName: c.Labels[labelExperiment],
+			RunName:        c.Labels[labelRun],
+			User:           c.Labels[labelUser],
+			Identity:       c.Labels[labelIdentity],
+			State:          inspect.State.Status,
+			Health:         health,
+			ExitCode:       inspect.State.ExitCode,
+			StartedAt:      startedAt,
+			FinishedAt:     finishedAt,
+			Tags:           tagsFromLabels(c.Labels),
+			Sweep:          c.Labels[labelSweep],
+		})
+	}
+
+	return result, nil
+}
+
+// finishedAt is when the container stopped, or now if it's still running
+// or doesn't exist.
+func (d *DockerRun) finishedAt(containerName string) time.Time {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	inspect, err := d.client.ContainerInspect(ctx, containerName)
+	if err != nil || inspect.State.Running {
+		return clock.Now().UTC()
+	}
+
+	finishedAt, err := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+	if err != nil || finishedAt.IsZero() {
+		return clock.Now().UTC()
+	}
+
+	return finishedAt
+}
+
+// guestPath maps a path under the host cache directory to the path the
+// container sees it at. Run directories outside the cache directory are
+// seen where they'd be in it.
+func (d *DockerRun) guestPath(hostPath string) (string, error) {
+	if rel, ok := relativeTo(d.hostCheckpointPath, hostPath); ok && d.hostCheckpointPath != "" {
+		return path.Join(d.guestCheckpointPath(d.guestCachePath), filepath.ToSlash(rel)), nil
+	}
+
+	rel, ok := relativeTo(d.hostCachePath, hostPath)
+	if !ok {
+		return "", errors.Errorf("%s is not under %s", hostPath, d.hostCachePath)
+	}
+
+	return path.Join(d.guestCachePath, filepath.ToSlash(rel)), nil
+}
+
+// guestCheckpointPath is where the run directories of the project are in
+// a container's cache directory.
+func (d *DockerRun) guestCheckpointPath(guestCachePath string) string {
+	return path.Join(guestCachePath, "higgsfield", d.projectName)
+}
+
+// relativeTo is path relative to base, if it's under base.
+func relativeTo(base, path string) (string, bool) {
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+
+	return rel, true
+}
+
 var otherNvidiaDevices = []string{
 	"/dev/nvidia-uvm",
 	"/dev/nvidiactl",
@@ -131,6 +377,23 @@ var otherNvidiaDevices = []string{
 	"/dev/nvidia-uvm-tools",
 }
 
+// rdmaDevicesDir holds the infiniband and RoCE devices NCCL uses between
+// hosts, which unprivileged containers only get when mapped.
+const rdmaDevicesDir = "/dev/infiniband"
+
+func listRDMADevices() []string {
+	entries, err := os.ReadDir(rdmaDevicesDir)
+	if err != nil {
+		return nil
+	}
+
+	devices := make([]string, 0, len(entries))
+	for _, e := range entries {
+		devices = append(devices, filepath.Join(rdmaDevicesDir, e.Name()))
+	}
+	return devices
+}
+
 func listOtherNvidiaDevices() []string {
 	devices := make([]string, 0, len(otherNvidiaDevices))
 	for _, path := range otherNvidiaDevices {
@@ -142,16 +405,28 @@ func listOtherNvidiaDevices() []string {
 	return devices
 }
 
-func listNvidiaGPUs() []string {
-	gpus := make([]string, 0, 32)
+func nvidiaGPUIndices() []int {
+	indices := make([]int, 0, 32)
 	// we just need to check whether /dev/nvidia%d exists
 	for i := 0; i < 32; i++ {
-		path := fmt.Sprintf("/dev/nvidia%d", i)
-		if _, err := os.Stat(path); err == nil {
-			gpus = append(gpus, path)
+		if _, err := os.Stat(nvidiaGPUPath(i)); err == nil {
+			indices = append(indices, i)
 		}
 	}
 
+	return indices
+}
+
+func nvidiaGPUPath(index int) string {
+	return fmt.Sprintf("/dev/nvidia%d", index)
+}
+
+func listNvidiaGPUs(indices []int) []string {
+	gpus := make([]string, 0, len(indices))
+	for _, i := range indices {
+		gpus = append(gpus, nvidiaGPUPath(i))
+	}
+
 	return gpus
 }
 
@@ -167,21 +442,79 @@ func createDeviceMapping(devices []string) []container.DeviceMapping {
 	return mappings
 }
 
-func (d *DockerRun) Run(
-	containerName string,
-	runCommand string,
-	runCommandArgs []string,
-	exposePort int,
-) error {
+func gpuDeviceRequest(gpus []int) container.DeviceRequest {
+	if len(gpus) == 0 {
+		return container.DeviceRequest{
+			Count:        -1,
+			Capabilities: [][]string{{"gpu"}},
+		}
+	}
 
-	fmt.Printf("killing container %s\n", containerName)
-	if err := d.Kill(containerName); err != nil {
-		return errors.WithMessagef(err, "failed to kill container %s", containerName)
+	ids := make([]string, 0, len(gpus))
+	for _, gpu := range gpus {
+		ids = append(ids, fmt.Sprint(gpu))
+	}
+
+	return container.DeviceRequest{
+		DeviceIDs:    ids,
+		Capabilities: [][]string{{"gpu"}},
+	}
+}
+
+// ContainerSpec describes the experiment container to be created.
+type ContainerSpec struct {
+	Name        string
+	Image       string
+	Command     string
+	Args        []string
+	ExposePort  int
+	Env         []string
+	Labels      map[string]string
+	Healthcheck *container.HealthConfig
+	// GPUs are the indices of the devices handed to the container, all of
+	// the host's gpus when empty.
+	GPUs        []int
+	MemoryBytes int64
+	// Entrypoint wraps the command, which is then passed to it as arguments.
+	Entrypoint []string
+	WorkingDir string
+	User       string
+	// ReadOnlyRootfs makes everything but mounts and Tmpfs read-only.
+	ReadOnlyRootfs bool
+	Tmpfs          map[string]string
+	Network        NetworkConfig
+	ExtraHosts     []string
+	DNS            DNSConfig
+	// Binds are mounted next to the project and cache directories.
+	Binds       []string
+	ImagePolicy ImagePolicy
+	// CPUOnly hands no gpus to the container.
+	CPUOnly bool
+	// Init runs the command under docker's init, which reaps the zombies
+	// crashed workers leave behind.
+	Init bool
+	// CpusetCpus and CpusetMems pin the container to cpus and numa nodes,
+	// NanoCPUs caps its cpu time. Unset they're not limited.
+	CpusetCpus string
+	CpusetMems string
+	NanoCPUs   int64
+}
+
+// initEnv makes docker's init a subreaper. The container shares the pid
+// namespace of the host, so the init isn't pid 1 there, and without it the
+// orphans of the worker processes would go to the host's init instead.
+func initEnv(init bool, env []string) []string {
+	if !init {
+		return env
 	}
 
+	return concat(env, []string{"TINI_SUBREAPER=1"})
+}
+
+func (d *DockerRun) Build() error {
 	buildCtx, err := archive.TarWithOptions(d.hostRootPath, &archive.TarOptions{})
 	if err != nil {
-		panic(err)
+		return errors.WithMessagef(err, "failed to archive %s for the build", d.hostRootPath)
 	}
 	defer buildCtx.Close()
 
@@ -194,18 +527,63 @@ func (d *DockerRun) Run(
 		},
 		Remove:      true, // Remove intermediate containers after the build
 		ForceRemove: true, // Force removal of the image if it exists
+		Labels:      d.imageLabels(),
 	}
 
-	buildResponse, err := d.client.ImageBuild(d.ctx, buildCtx, buildOptions)
+	// the deadline covers streaming the output too, cancelling it makes
+	// the daemon abort the build and remove its intermediate containers
+	ctx, cancel := d.deadline(dockerOpBuild)
+	defer cancel()
+
+	buildResponse, err := d.client.ImageBuild(ctx, buildCtx, buildOptions)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to build image %s", d.imageTag)
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpBuild, err), "failed to build image %s", d.imageTag)
 	}
 
 	defer buildResponse.Body.Close()
 
 	fmt.Printf("building image %s\n", d.imageTag)
 	if _, err := io.Copy(os.Stdout, buildResponse.Body); err != nil {
-		return errors.WithMessagef(err, "failed to build image %s", d.imageTag)
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpBuild, err), "failed to build image %s", d.imageTag)
+	}
+
+	d.pruneAfterBuild()
+	return nil
+}
+
+// Run (re)creates and starts the container, returning the id of the image
+// it runs. Unless spec.Image is set the image is rebuilt first.
+func (d *DockerRun) Run(spec ContainerSpec) (string, error) {
+	containerName := spec.Name
+
+	// build and check the image before touching the running container, so
+	// a restart from a pruned image, a failed build or an image the policy
+	// rejects doesn't leave us with nothing
+	image := spec.Image
+	if image != "" {
+		ctx, cancel := d.deadline(dockerOpInspect)
+		_, _, err := d.client.ImageInspectWithRaw(ctx, image)
+		err = d.timedOut(ctx, dockerOpInspect, err)
+		cancel()
+		if err != nil {
+			return "", errors.WithMessagef(err, "image %s is not available", image)
+		}
+	} else {
+		if err := d.Build(); err != nil {
+			return "", err
+		}
+		image = d.imageTag
+	}
+
+	if spec.ImagePolicy.enabled() {
+		if err := d.checkImage(image, spec.ImagePolicy); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Printf("killing container %s\n", containerName)
+	if err := d.Kill(containerName); err != nil {
+		return "", errors.WithMessagef(err, "failed to kill container %s", containerName)
 	}
 
 	// check if host has gpu
@@ -216,50 +594,127 @@ func (d *DockerRun) Run(
 	dr := make([]container.DeviceRequest, 0, 1)
 	cos, _ := isCos()
 	dm := make([]container.DeviceMapping, 0, 1)
-	if _, err := os.Stat("/dev/nvidia0"); err == nil {
+	if spec.CPUOnly {
+		fmt.Printf("no gpus requested\n")
+	} else if d.remote {
+		// we can't look at the devices of a remote host, so leave it to the
+		// nvidia runtime there
+		fmt.Printf("remote docker daemon, requesting gpus from its runtime\n")
+		cos = false
+		dr = append(dr, gpuDeviceRequest(spec.GPUs))
+	} else if _, err := os.Stat("/dev/nvidia0"); err == nil {
 		fmt.Printf("host has gpu, adding gpu to device requests\n")
 		if cos {
 			fmt.Printf("host is cos, not adding gpu to device requests\n")
 		} else {
-			dr = append(dr, container.DeviceRequest{
-				Count:        -1,
-				Capabilities: [][]string{{"gpu"}},
-			})
+			dr = append(dr, gpuDeviceRequest(spec.GPUs))
 		}
 		// usually there's no need to add additional devices on bare-metal
 		// but with tcpx setup we need to add other nvidia-ish devices
-		dm = append(dm, createDeviceMapping(listNvidiaGPUs())...)
+		gpus := spec.GPUs
+		if len(gpus) == 0 {
+			gpus = nvidiaGPUIndices()
+		}
+		dm = append(dm, createDeviceMapping(listNvidiaGPUs(gpus))...)
 		dm = append(dm, createDeviceMapping(listOtherNvidiaDevices())...)
 	} else {
 		fmt.Printf("host does not have gpu, not adding gpu to device requests\n")
 	}
 
-	binds := []string{
-		fmt.Sprintf("%s:%s", d.hostRootPath, d.guestRootPath),
-		fmt.Sprintf("%s:%s", d.hostCachePath, d.guestCachePath),
-		fmt.Sprintf("%s:%s", d.hostCachePath, guestRootCachePath),
+	// a hardened container isn't privileged, so it only gets the devices
+	// mapped here and the capabilities it needs
+	privileged := !spec.ReadOnlyRootfs
+	capAdd := []string{"NET_ADMIN"}
+	if !privileged {
+		if !d.remote {
+			dm = append(dm, createDeviceMapping(listRDMADevices())...)
+		}
+		// RDMA registers pinned memory
+		capAdd = append(capAdd, "IPC_LOCK")
+	}
+
+	hostCachePath := d.hostCachePath
+	binds := []string{fmt.Sprintf("%s:%s", d.hostRootPath, d.guestRootPath)}
+	if d.remote {
+		// the project only reaches a remote host through the build context,
+		// and the cache lives in a volume there
+		fmt.Printf("remote docker daemon, the project is not mounted, the image has to contain it\n")
+		hostCachePath = remoteCacheVolume
+		binds = binds[:0]
 	}
+	binds = append(binds, fmt.Sprintf("%s:%s", hostCachePath, d.guestCachePath))
+	for _, alias := range d.guestCacheAliases {
+		binds = append(binds, fmt.Sprintf("%s:%s", hostCachePath, alias))
+	}
+	if d.hostCheckpointPath != "" && !d.remote {
+		// mounted over the cache, so the container finds the run
+		// directories where they usually are
+		for _, guest := range append([]string{d.guestCachePath}, d.guestCacheAliases...) {
+			binds = append(binds, fmt.Sprintf("%s:%s", d.hostCheckpointPath, d.guestCheckpointPath(guest)))
+		}
+	}
+	binds = append(binds, spec.Binds...)
 
 	if _, err := os.Stat("/run/tcpx"); cos && err == nil {
 		fmt.Printf("host is cos, adding /run/tcpx to binds\n")
 		binds = append(binds, "/run/tcpx:/run/tcpx")
 	}
 
+	entrypoint := append([]string{spec.Command}, spec.Args...)
+	var cmd []string
+	if len(spec.Entrypoint) > 0 {
+		entrypoint, cmd = spec.Entrypoint, entrypoint
+	}
+
+	workingDir := d.guestRootPath
+	if spec.WorkingDir != "" {
+		workingDir = spec.WorkingDir
+	}
+
+	network, err := d.setupNetwork(spec.Network, spec.ExposePort)
+	if err != nil {
+		return "", err
+	}
+
+	dns := spec.DNS
+	if network.Mode.IsHost() && (len(dns.Servers) > 0 || len(dns.Search) > 0 || len(dns.Options) > 0) {
+		// docker refuses dns options together with host networking
+		fmt.Printf("host networking uses the host's resolver, ignoring dns options\n")
+		dns = DNSConfig{}
+	}
+
 	fmt.Printf("creating container %s\n", containerName)
 	createOptions := types.ContainerCreateConfig{
 		Name: containerName,
 		Config: &container.Config{
-			Image:      d.imageTag,
-			Entrypoint: append([]string{runCommand}, runCommandArgs...),
+			Image:        image,
+			WorkingDir:   workingDir,
+			Entrypoint:   entrypoint,
+			Cmd:          cmd,
+			User:         spec.User,
+			Env:          initEnv(spec.Init, spec.Env),
+			Labels:       spec.Labels,
+			Healthcheck:  spec.Healthcheck,
+			ExposedPorts: network.ExposedPorts,
 		},
 		HostConfig: &container.HostConfig{
-			Binds:       binds,
-			IpcMode:     container.IPCModeHost,
-			PidMode:     container.PidMode("host"),
-			NetworkMode: container.NetworkMode("host"),
-			CapAdd:      []string{"NET_ADMIN"},
+			Binds:        binds,
+			IpcMode:      container.IPCModeHost,
+			PidMode:      container.PidMode("host"),
+			NetworkMode:  network.Mode,
+			PortBindings: network.PortBindings,
+			Sysctls:      network.Sysctls,
+			ExtraHosts:   spec.ExtraHosts,
+			DNS:          dns.Servers,
+			DNSSearch:    dns.Search,
+			DNSOptions:   dns.Options,
+			CapAdd:       capAdd,
 			Resources: container.Resources{
 				DeviceRequests: dr,
+				Memory:         spec.MemoryBytes,
+				CpusetCpus:     spec.CpusetCpus,
+				CpusetMems:     spec.CpusetMems,
+				NanoCPUs:       spec.NanoCPUs,
 				Ulimits: []*units.Ulimit{
 					{
 						Name: "memlock",
@@ -274,23 +729,42 @@ func (d *DockerRun) Run(
 				},
 				Devices: dm,
 			},
-			Privileged: true,
+			Init:           PtrTo(spec.Init),
+			Privileged:     privileged,
+			ReadonlyRootfs: spec.ReadOnlyRootfs,
+			Tmpfs:          spec.Tmpfs,
 		},
 	}
 
-	resp, err := d.client.ContainerCreate(d.ctx, createOptions.Config, createOptions.HostConfig, nil, nil, containerName)
+	ctx, cancel := d.deadline(dockerOpCreate)
+	defer cancel()
+
+	resp, err := d.client.ContainerCreate(ctx, createOptions.Config, createOptions.HostConfig, nil, nil, containerName)
 	if err != nil {
-		return errors.WithMessagef(err, "failed to create container %s", containerName)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// the daemon may still create it after we stopped waiting
+			d.removeLeftover(containerName)
+		}
+		return "", errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to create container %s", containerName)
 	}
 
 	fmt.Printf("starting container %s\n", containerName)
-	if err := d.client.ContainerStart(d.ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return errors.WithMessagef(err, "failed to start container %s", containerName)
+	if err := d.client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		// a created container would keep claiming its gpus in the ledger
+		d.removeLeftover(containerName)
+		return "", errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to start container %s", containerName)
 	}
 
 	fmt.Printf("started container %s\n", containerName)
 
-	return nil
+	inspectCtx, inspectCancel := d.deadline(dockerOpInspect)
+	defer inspectCancel()
+	inspect, err := d.client.ContainerInspect(inspectCtx, resp.ID)
+	if err != nil {
+		return "", errors.WithMessagef(d.timedOut(inspectCtx, dockerOpInspect, err), "failed to inspect container %s", containerName)
+	}
+
+	return inspect.Image, nil
 }
 
 func PtrTo[T any](e T) *T {
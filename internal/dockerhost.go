@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// dockerEndpoint is where the docker daemon listens, resolved from a docker
+// context or the environment.
+type dockerEndpoint struct {
+	Host          string
+	TLSDir        string
+	SkipTLSVerify bool
+}
+
+// remote is true for daemons that don't run on this machine, where local
+// paths and devices mean nothing.
+func (e dockerEndpoint) remote() bool {
+	return e.Host != "" && !strings.HasPrefix(e.Host, "unix://") && !strings.HasPrefix(e.Host, "npipe://")
+}
+
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// currentDockerContext is the context `docker context use` picked, from
+// the cli's config.json, empty if there is none.
+func currentDockerContext() (string, error) {
+	path := filepath.Join(dockerConfigDir(), "config.json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return config.CurrentContext, nil
+}
+
+// resolveDockerEndpoint picks the daemon the same way the docker cli does:
+// an explicit context, then DOCKER_HOST, then DOCKER_CONTEXT, then the
+// current context of the cli's config.
+func resolveDockerEndpoint(dockerContext string) (dockerEndpoint, error) {
+	if dockerContext == "" {
+		if host := os.Getenv(client.EnvOverrideHost); host != "" {
+			return dockerEndpoint{Host: host}, nil
+		}
+		dockerContext = os.Getenv("DOCKER_CONTEXT")
+	}
+	if dockerContext == "" {
+		current, err := currentDockerContext()
+		if err != nil {
+			return dockerEndpoint{}, err
+		}
+		dockerContext = current
+	}
+
+	if dockerContext == "" || dockerContext == "default" {
+		return dockerEndpoint{}, nil
+	}
+
+	// contexts are stored by the sha256 of their name
+	sum := sha256.Sum256([]byte(dockerContext))
+	id := hex.EncodeToString(sum[:])
+
+	metaPath := filepath.Join(dockerConfigDir(), "contexts", "meta", id, "meta.json")
+	data, err := os.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return dockerEndpoint{}, errors.Errorf("docker context %s does not exist", dockerContext)
+	} else if err != nil {
+		return dockerEndpoint{}, errors.WithMessagef(err, "failed to read docker context %s", dockerContext)
+	}
+
+	var meta struct {
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return dockerEndpoint{}, errors.WithMessagef(err, "failed to parse docker context %s", dockerContext)
+	}
+
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return dockerEndpoint{}, errors.Errorf("docker context %s has no docker endpoint", dockerContext)
+	}
+
+	return dockerEndpoint{
+		Host:          endpoint.Host,
+		TLSDir:        filepath.Join(dockerConfigDir(), "contexts", "tls", id, "docker"),
+		SkipTLSVerify: endpoint.SkipTLSVerify,
+	}, nil
+}
+
+func (e dockerEndpoint) clientOpts() ([]client.Opt, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if e.Host == "" {
+		return opts, nil
+	}
+
+	if strings.HasPrefix(e.Host, "ssh://") {
+		u, err := neturl.Parse(e.Host)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid docker host %s", e.Host)
+		}
+
+		// the host is only used to build request urls, ssh does the dialing
+		return append(opts, client.WithHost("http://docker.example.com"), client.WithDialContext(sshDialer(u))), nil
+	}
+
+	opts = append(opts, client.WithHost(e.Host))
+	if e.TLSDir != "" {
+		ca := filepath.Join(e.TLSDir, "ca.pem")
+		if _, err := os.Stat(ca); err == nil && !e.SkipTLSVerify {
+			opts = append(opts, client.WithTLSClientConfig(ca, filepath.Join(e.TLSDir, "cert.pem"), filepath.Join(e.TLSDir, "key.pem")))
+		}
+	}
+
+	return opts, nil
+}
+
+// sshDialer tunnels the docker api through `docker system dial-stdio` on
+// the remote host, which is how the docker cli talks to ssh:// hosts. The
+// process is killed when the dial is cancelled, when a deadline of the
+// connection passes and when ssh stops hearing from the host.
+func sshDialer(u *neturl.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10", "-o", "ServerAliveInterval=10", "-o", "ServerAliveCountMax=3"}
+		if u.User != nil {
+			args = append(args, "-l", u.User.Username())
+		}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+		args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+		// the connection is pooled beyond the request that dialed it, so
+		// the dial's ctx only kills ssh while the dial is going on
+		procCtx, kill := context.WithCancel(context.Background())
+		stop := context.AfterFunc(ctx, kill)
+		cmd := exec.CommandContext(procCtx, "ssh", args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			kill()
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			kill()
+			return nil, err
+		}
+		cmd.Stderr = &bytes.Buffer{}
+		// the pipes may be held by children of ssh, like a ProxyCommand
+		cmd.WaitDelay = time.Second
+
+		if err := cmd.Start(); err != nil {
+			kill()
+			return nil, errors.WithMessagef(err, "failed to run ssh to %s", u.Hostname())
+		}
+		if !stop() {
+			cmd.Wait()
+			return nil, ctx.Err()
+		}
+
+		return &cmdConn{cmd: cmd, kill: kill, stdin: stdin, stdout: stdout}, nil
+	}
+}
+
+// cmdConn is a net.Conn over the stdio of a command. Deadlines kill the
+// command when they pass, the connection is unusable after that.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	kill   context.CancelFunc
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	mu        sync.Mutex
+	deadlines [2]*time.Timer
+}
+
+const (
+	readDeadline = iota
+	writeDeadline
+)
+
+func (c *cmdConn) setDeadline(which int, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deadlines[which] != nil {
+		c.deadlines[which].Stop()
+		c.deadlines[which] = nil
+	}
+	if !t.IsZero() {
+		// the os knows no deadlines of a pipe, they're wall clock times
+		c.deadlines[which] = time.AfterFunc(time.Until(t), c.expire)
+	}
+}
+
+// expire kills the command and closes its pipes, so pending reads and
+// writes return.
+func (c *cmdConn) expire() {
+	c.kill()
+	c.stdin.Close()
+	c.stdout.Close()
+}
+
+func (c *cmdConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err == io.EOF {
+		if stderr := c.cmd.Stderr.(*bytes.Buffer).String(); stderr != "" {
+			return n, errors.Errorf("ssh: %s", strings.TrimSpace(stderr))
+		}
+	}
+	return n, err
+}
+
+func (c *cmdConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *cmdConn) Close() error {
+	c.setDeadline(readDeadline, time.Time{})
+	c.setDeadline(writeDeadline, time.Time{})
+	c.expire()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr  { return dummyAddr{} }
+func (c *cmdConn) RemoteAddr() net.Addr { return dummyAddr{} }
+
+func (c *cmdConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(readDeadline, t)
+	return nil
+}
+
+func (c *cmdConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(writeDeadline, t)
+	return nil
+}
+
+func (c *cmdConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "ssh" }
+func (dummyAddr) String() string  { return "ssh" }
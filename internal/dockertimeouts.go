@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+// DockerConfig is read from ~/.config/higgsfield/docker.json.
+type DockerConfig struct {
+	// Timeouts are durations like 90s or 2h by operation, the defaults
+	// apply to the ones left out.
+	Timeouts DockerTimeouts `json:"timeouts"`
+	Images   ImageRetention `json:"images"`
+}
+
+// DockerTimeouts bound the calls to the daemon, so a wedged daemon fails
+// the command instead of hanging it forever.
+type DockerTimeouts struct {
+	Build string `json:"build"`
+	Pull  string `json:"pull"`
+	// Create covers creating and starting a container.
+	Create string `json:"create"`
+	// Remove covers stopping and removing a container.
+	Remove string `json:"remove"`
+	// Inspect covers listing and inspecting containers, images and
+	// networks.
+	Inspect string `json:"inspect"`
+}
+
+const (
+	dockerOpBuild   = "build"
+	dockerOpPull    = "pull"
+	dockerOpCreate  = "create"
+	dockerOpRemove  = "remove"
+	dockerOpInspect = "inspect"
+)
+
+var defaultDockerTimeouts = map[string]time.Duration{
+	dockerOpBuild:   2 * time.Hour,
+	dockerOpPull:    time.Hour,
+	dockerOpCreate:  2 * time.Minute,
+	dockerOpRemove:  2 * time.Minute,
+	dockerOpInspect: 30 * time.Second,
+}
+
+func LoadDockerConfig() (DockerConfig, error) {
+	var config DockerConfig
+	if err := loadConfigFile("docker.json", &config); err != nil {
+		return DockerConfig{}, err
+	}
+
+	return config, nil
+}
+
+// durations are the timeouts by operation with the defaults filled in.
+func (t DockerTimeouts) durations() (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(defaultDockerTimeouts))
+	for op, d := range defaultDockerTimeouts {
+		durations[op] = d
+	}
+
+	configured := map[string]string{
+		dockerOpBuild:   t.Build,
+		dockerOpPull:    t.Pull,
+		dockerOpCreate:  t.Create,
+		dockerOpRemove:  t.Remove,
+		dockerOpInspect: t.Inspect,
+	}
+	for op, value := range configured {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("invalid %s timeout %q in docker.json, expected a duration like 90s", op, value)
+		}
+		durations[op] = d
+	}
+
+	return durations, nil
+}
+
+// deadline bounds one call of the operation to the daemon.
+func (d *DockerRun) deadline(op string) (context.Context, context.CancelFunc) {
+	timeout, ok := d.timeouts[op]
+	if !ok {
+		timeout = defaultDockerTimeouts[op]
+	}
+
+	return context.WithTimeout(d.ctx, timeout)
+}
+
+// timedOut explains an error caused by the deadline of the operation, other
+// errors are returned as they are.
+func (d *DockerRun) timedOut(ctx context.Context, op string, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	return errors.Errorf("docker %s timed out after %s, the daemon at %s may be stuck, the limit is set under timeouts in ~/.config/higgsfield/docker.json",
+		op, d.timeouts[op], d.client.DaemonHost())
+}
+
+// removeLeftover force-removes a container that a failed or timed out
+// create or start may have left behind. It gets a fresh deadline, since the
+// one of the failed call is usually spent.
+func (d *DockerRun) removeLeftover(containerName string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(d.ctx), d.timeouts[dockerOpRemove])
+	defer cancel()
+
+	if _, err := d.client.ContainerInspect(ctx, containerName); err != nil {
+		return
+	}
+
+	fmt.Printf("removing partially created container %s\n", containerName)
+	if err := d.client.ContainerStop(ctx, containerName, container.StopOptions{Timeout: PtrTo(0)}); err != nil {
+		warnf("failed to stop container %s: %v\n", containerName, err)
+	}
+	if err := d.client.ContainerRemove(ctx, containerName, types.ContainerRemoveOptions{Force: true}); err != nil {
+		warnf("failed to remove container %s: %v\n", containerName, err)
+	}
+}
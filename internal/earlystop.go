@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+const (
+	outcomeFailed    = "failed"
+	outcomeConverged = "converged"
+	// outcomeStopped is a run stopped by hand, see Stop.
+	outcomeStopped = "stopped"
+	// outcomePreempted is a run killed for a run of a team within its
+	// quota.
+	outcomePreempted = "preempted"
+	// outcomePruned is a run of a sweep stopped for falling behind the
+	// others, see SweepPolicy.
+	outcomePruned = "pruned"
+)
+
+// EarlyStopPolicy declares when `invoker experiment watch` stops a run
+// based on its parsed metrics, configured under early_stop in invoker.yaml.
+type EarlyStopPolicy struct {
+	// NaNLoss fails the run once the loss is NaN or infinite.
+	NaNLoss bool `yaml:"nan_loss" json:"nan_loss"`
+	// Patience is the number of steps without the loss improving by more
+	// than MinDelta after which the run has converged.
+	Patience int64   `yaml:"patience" json:"patience"`
+	MinDelta float64 `yaml:"min_delta" json:"min_delta"`
+	// MinTokensPerSec fails the run once the throughput drops below it.
+	MinTokensPerSec float64 `yaml:"min_tokens_per_sec" json:"min_tokens_per_sec"`
+	// GraceSteps are ignored by the throughput check, while the run warms up.
+	GraceSteps int64 `yaml:"grace_steps" json:"grace_steps"`
+	// StopTimeout is how long the run gets to exit after SIGTERM.
+	StopTimeout time.Duration `yaml:"stop_timeout" json:"stop_timeout"`
+}
+
+func (p EarlyStopPolicy) enabled() bool {
+	return p.NaNLoss || p.Patience > 0 || p.MinTokensPerSec > 0
+}
+
+// evaluate returns the outcome of the run and why, or an empty outcome if
+// it should keep going.
+func (p EarlyStopPolicy) evaluate(points []MetricPoint) (string, string) {
+	if len(points) == 0 {
+		return "", ""
+	}
+	last := points[len(points)-1]
+
+	if p.NaNLoss && last.Loss != nil {
+		if loss := float64(*last.Loss); math.IsNaN(loss) || math.IsInf(loss, 0) {
+			return outcomeFailed, fmt.Sprintf("loss is %v at step %d", loss, last.Step)
+		}
+	}
+
+	if p.MinTokensPerSec > 0 && last.TokensPerSec != nil && last.Step >= p.GraceSteps {
+		if tps := float64(*last.TokensPerSec); tps < p.MinTokensPerSec {
+			return outcomeFailed, fmt.Sprintf("throughput %.0f tokens/s is below %.0f at step %d", tps, p.MinTokensPerSec, last.Step)
+		}
+	}
+
+	if p.Patience > 0 {
+		best, bestStep, seen := math.Inf(1), int64(0), false
+		for _, point := range points {
+			if point.Loss == nil {
+				continue
+			}
+			if loss := float64(*point.Loss); !seen || loss < best-p.MinDelta {
+				best, bestStep, seen = loss, point.Step, true
+			}
+		}
+
+		if seen && last.Step-bestStep >= p.Patience {
+			return outcomeConverged, fmt.Sprintf("loss did not improve on %g for %d steps", best, last.Step-bestStep)
+		}
+	}
+
+	return "", ""
+}
+
+// Stop asks the container to exit with SIGTERM, killing it after timeout.
+// Unlike Kill the container is kept, so its output stays around.
+func (d *DockerRun) Stop(containerName string, timeout time.Duration) error {
+	// the daemon waits out the grace period before it answers
+	ctx, cancel := context.WithTimeout(d.ctx, timeout+d.timeouts[dockerOpRemove])
+	defer cancel()
+
+	seconds := int(timeout.Seconds())
+	if err := d.client.ContainerStop(ctx, containerName, container.StopOptions{Timeout: &seconds}); err != nil {
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpRemove, err), "failed to stop container %s", containerName)
+	}
+
+	return nil
+}
+
+// watchHeartbeat is written by every check of `invoker experiment watch`,
+// so run can tell whether anything enforces the early stop policy.
+type watchHeartbeat struct {
+	At       time.Time     `json:"at"`
+	Interval time.Duration `json:"interval"`
+}
+
+func (m *InnerStateManager) watchHeartbeatFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "watch_heartbeat.json")
+}
+
+func (m *InnerStateManager) putWatchHeartbeat(interval time.Duration) error {
+	data, err := json.Marshal(watchHeartbeat{At: clock.Now().UTC(), Interval: interval})
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode the watch heartbeat")
+	}
+
+	tmp := m.watchHeartbeatFile() + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write the watch heartbeat")
+	}
+
+	return errors.WithMessage(files.Rename(tmp, m.watchHeartbeatFile()), "failed to write the watch heartbeat")
+}
+
+// watching tells whether `invoker experiment watch` checked the runs of
+// this host within two of its intervals, allowing for a slow check.
+func (m *InnerStateManager) watching() bool {
+	var heartbeat watchHeartbeat
+	data, err := files.ReadFile(m.watchHeartbeatFile())
+	if err != nil || json.Unmarshal(data, &heartbeat) != nil {
+		return false
+	}
+
+	return clock.Now().Sub(heartbeat.At) <= 2*heartbeat.Interval+time.Minute
+}
+
+// earlyStop scrapes the run and stops it if its policy says so, moving it
+// to the history with the outcome. It returns true if the run was stopped.
+func earlyStop(dr *DockerRun, sm *InnerStateManager, store *MetricsStore, state ExperimentState) (bool, error) {
+	if err := dr.ScrapeMetrics(store, state); err != nil {
+		return false, err
+	}
+
+	points, err := store.Series(state.ContainerName)
+	if err != nil {
+		return false, err
+	}
+
+	outcome, reason := state.EarlyStop.evaluate(points)
+	if outcome == "" {
+		return false, nil
+	}
+
+	return stopWithOutcome(dr, sm, state, outcome, reason, state.EarlyStop.StopTimeout)
+}
+
+// stopWithOutcome stops the run, waiting timeout or 30s for it to exit, and
+// moves it to the history with the outcome. It returns true if the run was
+// stopped.
+func stopWithOutcome(dr *DockerRun, sm *InnerStateManager, state ExperimentState, outcome, reason string, timeout time.Duration) (bool, error) {
+	fmt.Printf("stopping %s as %s: %s\n", state.ContainerName, outcome, reason)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	if err := dr.Stop(state.ContainerName, timeout); err != nil {
+		return false, err
+	}
+
+	state.Outcome, state.OutcomeReason = outcome, reason
+	if err := sm.Retire(state, dr.finishedAt(state.ContainerName)); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func metric(v float64) *metricValue {
+	m := metricValue(v)
+	return &m
+}
+
+// scraped is a series of one point a minute from the clock, a loss per
+// step.
+func scraped(c *ManualClock, losses ...float64) []MetricPoint {
+	points := make([]MetricPoint, 0, len(losses))
+	for i, loss := range losses {
+		points = append(points, MetricPoint{Time: c.Now(), Step: int64(i) * 100, Loss: metric(loss)})
+		c.Advance(time.Minute)
+	}
+
+	return points
+}
+
+func TestEarlyStopPolicyEvaluate(t *testing.T) {
+	c := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer SetClock(c)()
+
+	withThroughput := func(points []MetricPoint, tps float64) []MetricPoint {
+		points[len(points)-1].TokensPerSec = metric(tps)
+		return points
+	}
+
+	tests := []struct {
+		name    string
+		policy  EarlyStopPolicy
+		points  []MetricPoint
+		outcome string
+	}{
+		{"no points", EarlyStopPolicy{NaNLoss: true, Patience: 1}, nil, ""},
+		{"nan loss", EarlyStopPolicy{NaNLoss: true}, scraped(c, 2, 1, math.NaN()), outcomeFailed},
+		{"infinite loss", EarlyStopPolicy{NaNLoss: true}, scraped(c, 2, math.Inf(1)), outcomeFailed},
+		{"nan loss not checked", EarlyStopPolicy{}, scraped(c, 2, math.NaN()), ""},
+		{"improving", EarlyStopPolicy{Patience: 200}, scraped(c, 4, 3, 2, 1), ""},
+		{"plateau", EarlyStopPolicy{Patience: 200}, scraped(c, 4, 1, 1, 1), outcomeConverged},
+		{"plateau shorter than patience", EarlyStopPolicy{Patience: 300}, scraped(c, 4, 1, 1, 1), ""},
+		{"improvements below min delta", EarlyStopPolicy{Patience: 200, MinDelta: 0.5}, scraped(c, 2, 1.9, 1.8, 1.7), outcomeConverged},
+		{"slow", EarlyStopPolicy{MinTokensPerSec: 1000}, withThroughput(scraped(c, 2, 1), 500), outcomeFailed},
+		{"fast enough", EarlyStopPolicy{MinTokensPerSec: 1000}, withThroughput(scraped(c, 2, 1), 1500), ""},
+		{"slow during grace", EarlyStopPolicy{MinTokensPerSec: 1000, GraceSteps: 200}, withThroughput(scraped(c, 2, 1), 500), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcome, reason := tt.policy.evaluate(tt.points)
+			if outcome != tt.outcome {
+				t.Errorf("outcome = %q (%s), want %q", outcome, reason, tt.outcome)
+			}
+			if (outcome == "") != (reason == "") {
+				t.Errorf("outcome %q came with reason %q", outcome, reason)
+			}
+		})
+	}
+}
+
+func TestWatching(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		since    time.Duration
+		want     bool
+	}{
+		{"just checked", time.Minute, 0, true},
+		{"slow check", time.Minute, 3 * time.Minute, true},
+		{"stopped", time.Minute, 4 * time.Minute, false},
+		{"long interval", time.Hour, time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envCacheDir, "")
+			t.Setenv("XDG_CACHE_HOME", "")
+			c := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer SetClock(c)()
+			defer SetFileSystem(NewMemFileSystem("/home/me"))()
+
+			sm, err := NewInnerStateManager()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sm.watching() {
+				t.Fatal("watching without a heartbeat")
+			}
+			if err := sm.putWatchHeartbeat(tt.interval); err != nil {
+				t.Fatal(err)
+			}
+			c.Advance(tt.since)
+			if got := sm.watching(); got != tt.want {
+				t.Errorf("watching = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
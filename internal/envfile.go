@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	envKey     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	envVarRefs = regexp.MustCompile(`\\?\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+)
+
+// envVar is a variable of an env file, in the order of the file.
+type envVar struct {
+	Key   string
+	Value string
+}
+
+// parseEnvFile reads env files the way they come from shells and editors:
+// a byte order mark and CRLF line endings are dropped, lines may start with
+// export, values may be quoted and refer to earlier variables or the
+// environment as ${NAME} or $NAME. Single quoted values are taken as they
+// are. Lines that aren't assignments fail with their line number instead of
+// being skipped.
+func parseEnvFile(data []byte) ([]envVar, error) {
+	data = bytes.TrimPrefix(data, utf8BOM)
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	vars := make([]envVar, 0)
+	values := make(map[string]string)
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export"); ok && (strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "\t")) {
+			line = strings.TrimSpace(rest)
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !envKey.MatchString(key) {
+			return nil, errors.Errorf("line %d: expected KEY=value, got %q", number, truncate(line, 40))
+		}
+		value = strings.TrimSpace(value)
+
+		quote := byte(0)
+		if value != "" && (value[0] == '"' || value[0] == '\'') {
+			quote = value[0]
+			// quoted values may span lines
+			for closingQuote(value, quote) < 0 && i+1 < len(lines) {
+				i++
+				value += "\n" + lines[i]
+			}
+			end := closingQuote(value, quote)
+			if end < 0 {
+				return nil, errors.Errorf("line %d: %s has no closing %c", number, key, quote)
+			}
+			value = value[1:end]
+		} else if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		switch quote {
+		case '\'':
+		case '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value)
+			fallthrough
+		default:
+			value = interpolateEnv(value, values)
+		}
+
+		values[key] = value
+		vars = append(vars, envVar{Key: key, Value: value})
+	}
+
+	return vars, nil
+}
+
+func closingQuote(value string, quote byte) int {
+	for i := 1; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+			continue
+		}
+		if value[i] == quote {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// interpolateEnv replaces ${NAME} and $NAME with earlier variables of the
+// file or the environment, \$ keeps the dollar.
+func interpolateEnv(value string, values map[string]string) string {
+	return envVarRefs.ReplaceAllStringFunc(value, func(ref string) string {
+		if strings.HasPrefix(ref, `\`) {
+			return ref[1:]
+		}
+		match := envVarRefs.FindStringSubmatch(ref)
+		name := match[1] + match[2]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	})
+}
+
+// readEnvFile parses the env file at path into NAME=value pairs.
+func readEnvFile(path string) ([]string, error) {
+	data, err := files.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read env file %s", path)
+	}
+
+	vars, err := parseEnvFile(data)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse env file %s", path)
+	}
+
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, v.Key+"="+v.Value)
+	}
+
+	return env, nil
+}
+
+// formatEnvFile writes the variables back in the plain KEY=value form,
+// quoting the values that need it. Single quotes keep values as they are,
+// values with newlines or single quotes are double quoted and escaped.
+func formatEnvFile(vars []envVar) []byte {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		value := v.Value
+		if strings.ContainsAny(value, "'\n") {
+			value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+		} else if strings.ContainsAny(value, " \t#\"$\\") {
+			value = "'" + value + "'"
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", v.Key, value)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// envSysctls are the kernel settings that differ between hosts set up by
+// hand and affect multi-node runs: numa balancing and swapping stall
+// workers, socket buffers bound NCCL over tcp, map and file limits break
+// large dataloaders.
+var envSysctls = []string{
+	"kernel.numa_balancing",
+	"vm.swappiness",
+	"vm.overcommit_memory",
+	"vm.max_map_count",
+	"fs.file-max",
+	"net.core.rmem_max",
+	"net.core.wmem_max",
+	"net.ipv4.tcp_mtu_probing",
+}
+
+// envFacts are the rows of the report, in order.
+var envFacts = append([]string{"invoker", "os", "kernel", "docker", "nvidia_driver", "cuda", "gpus", "nvidia_container_toolkit", "transparent_hugepages"}, envSysctls...)
+
+var cudaVersion = regexp.MustCompile(`CUDA Version:\s*([0-9.]+)`)
+
+// HostEnv is what env-report found on a host. Facts that couldn't be read
+// are missing.
+type HostEnv struct {
+	Host  string            `json:"host"`
+	Facts map[string]string `json:"facts"`
+	// Error is why the host couldn't report.
+	Error string `json:"error,omitempty"`
+}
+
+type EnvReportArgs struct {
+	// Hosts are asked over ssh, only this host if empty.
+	Hosts []string
+	// Local only reports this host as json, it's how the other hosts are
+	// asked.
+	Local bool
+	JSON  bool
+}
+
+func commandOutput(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func readProcFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return strings.Join(strings.Fields(string(data)), " ")
+}
+
+// localHostEnv collects the facts of this host. Whatever isn't installed
+// is left out.
+func localHostEnv() HostEnv {
+	env := HostEnv{Facts: make(map[string]string)}
+	env.Host, _ = os.Hostname()
+
+	set := func(name, value string) {
+		if value != "" {
+			env.Facts[name] = value
+		}
+	}
+
+	set("invoker", Version)
+	set("kernel", readProcFile("/proc/sys/kernel/osrelease"))
+	for _, line := range strings.Split(readFileOrEmpty("/etc/os-release"), "\n") {
+		if name, ok := strings.CutPrefix(line, "PRETTY_NAME="); ok {
+			set("os", strings.Trim(name, `"`))
+		}
+	}
+
+	// the cli, as connecting a client retries while the daemon is down
+	set("docker", commandOutput("docker", "version", "--format", "{{.Server.Version}}"))
+
+	if records, err := nvidiaSMICSV("--query-gpu=driver_version,name"); err == nil && len(records) > 0 && len(records[0]) >= 2 {
+		set("nvidia_driver", strings.TrimSpace(records[0][0]))
+		// mixed gpus show up as their own groups
+		counts := make(map[string]int)
+		for _, r := range records {
+			if len(r) >= 2 {
+				counts[strings.TrimSpace(r[1])]++
+			}
+		}
+		gpus := make([]string, 0, len(counts))
+		for _, name := range sortedKeys(counts) {
+			gpus = append(gpus, fmt.Sprintf("%dx %s", counts[name], name))
+		}
+		set("gpus", strings.Join(gpus, ", "))
+	}
+	if match := cudaVersion.FindStringSubmatch(commandOutput("nvidia-smi")); match != nil {
+		set("cuda", match[1])
+	}
+	if version := commandOutput("nvidia-ctk", "--version"); version != "" {
+		set("nvidia_container_toolkit", strings.Split(version, "\n")[0])
+	}
+
+	// the active one is in brackets, like always [madvise] never
+	if match := regexp.MustCompile(`\[(\w+)\]`).FindStringSubmatch(readProcFile("/sys/kernel/mm/transparent_hugepage/enabled")); match != nil {
+		set("transparent_hugepages", match[1])
+	}
+	for _, name := range envSysctls {
+		set(name, readProcFile("/proc/sys/"+strings.ReplaceAll(name, ".", "/")))
+	}
+
+	return env
+}
+
+func readFileOrEmpty(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+// hostEnvs asks every host for its facts at once, this one directly.
+func hostEnvs(hosts []string) []HostEnv {
+	self, _ := os.Hostname()
+
+	envs := make([]HostEnv, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			if host == self || isLoopback(host) {
+				envs[i] = localHostEnv()
+				envs[i].Host = host
+				return
+			}
+
+			env := HostEnv{Host: host}
+			out, err := outputOnHost(context.Background(), host, "env-report", "--local")
+			if err == nil {
+				err = json.Unmarshal([]byte(out), &env)
+			}
+			if err != nil {
+				env.Error = err.Error()
+			}
+			env.Host = host
+			envs[i] = env
+		}(i, host)
+	}
+	wg.Wait()
+
+	return envs
+}
+
+// differingFacts are the facts that aren't the same on every host that
+// reported. A fact missing on some hosts differs too.
+func differingFacts(envs []HostEnv) map[string]bool {
+	differ := make(map[string]bool)
+	for _, fact := range envFacts {
+		values := make(map[string]bool)
+		for _, env := range envs {
+			if env.Error == "" {
+				values[env.Facts[fact]] = true
+			}
+		}
+		if len(values) > 1 {
+			differ[fact] = true
+		}
+	}
+
+	return differ
+}
+
+// EnvReport prints the versions and kernel settings of the hosts side by
+// side, with the ones that differ marked. Mismatched drivers are the most
+// common cause of multi-node runs failing on some hosts only.
+func EnvReport(args EnvReportArgs) {
+	if args.Local {
+		data, err := json.Marshal(localHostEnv())
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	envs := hostEnvs(hosts)
+
+	if args.JSON {
+		data, err := json.MarshalIndent(envs, "", "  ")
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	differ := differingFacts(envs)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := []string{paint(ansiYellow, " "), "FACT"}
+	for _, env := range envs {
+		header = append(header, env.Host)
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, fact := range envFacts {
+		row := []string{" ", fact}
+		if differ[fact] {
+			row[0] = "*"
+		}
+		for _, env := range envs {
+			value := env.Facts[fact]
+			if env.Error != "" {
+				value = "?"
+			} else if value == "" {
+				value = "-"
+			}
+			row = append(row, value)
+		}
+		// every row has the marker column painted, or the colors would
+		// throw off the alignment
+		row[0] = paint(ansiYellow, row[0])
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	for _, env := range envs {
+		if env.Error != "" {
+			warnf("%s couldn't report: %s\n", env.Host, env.Error)
+		}
+	}
+	if len(differ) > 0 {
+		warnf("%d of %d facts differ between the hosts, marked with *\n", len(differ), len(envFacts))
+	}
+}
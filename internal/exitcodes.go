@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"os"
+	"time"
+)
+
+// Exit codes of invoker, for scripts wrapping it to tell failures apart.
+const (
+	ExitOK = 0
+	// ExitValidation is invalid arguments, flags or input files, a run
+	// that doesn't exist, or a confirmation that was declined or couldn't
+	// be asked without --yes. Trying again as it is won't help.
+	ExitValidation = 2
+	// ExitInfra is invoker failing to do its job: docker, ssh, the network,
+	// the state or the resources of the host.
+	ExitInfra = 3
+	// ExitTraining is the training itself failing, including smoke tests
+	// and canaries.
+	ExitTraining = 4
+	// ExitPreempted is the run being killed for a run of a team with a
+	// guaranteed quota.
+	ExitPreempted = 5
+)
+
+// validateArgs exits with ExitValidation if args break their validate tags.
+func validateArgs(args any) {
+	if err := Validator().Struct(args); err != nil {
+		errorf("invalid arguments: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+}
+
+// runExitCode is the exit code of invoker for how a run ended, given the
+// outcome invoker recorded for it.
+func runExitCode(result ExitResult, outcome string) int {
+	switch {
+	case outcome == outcomePreempted:
+		return ExitPreempted
+	// early stopping ends converged runs with a signal
+	case outcome == outcomeConverged:
+		return ExitOK
+	case result.Succeeded() && outcome != outcomeFailed:
+		return ExitOK
+	default:
+		return ExitTraining
+	}
+}
+
+// outcomeOf is the outcome invoker recorded for the run, from its state or,
+// once it's retired, from the history record of the attempt started at
+// startedAt.
+func (m *InnerStateManager) outcomeOf(containerName string, startedAt time.Time) string {
+	if state, err := m.Get(containerName); err == nil && state != nil {
+		return state.Outcome
+	}
+	if startedAt.IsZero() {
+		return ""
+	}
+
+	records, _ := m.History()
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].ContainerName == containerName && records[i].StartedAt.Equal(startedAt) {
+			return records[i].Outcome
+		}
+	}
+
+	return ""
+}
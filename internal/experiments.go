@@ -0,0 +1,430 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// ExperimentParam is a parameter an experiment declares with
+// @param("name", ...), it's passed to the experiment as --name.
+type ExperimentParam struct {
+	Name string `json:"name" yaml:"name"`
+	// Type is int, float, bool or str, guessed from the default if the
+	// declaration leaves it out. Empty if unknown.
+	Type        string   `json:"type,omitempty" yaml:"type"`
+	Default     string   `json:"default,omitempty" yaml:"default"`
+	Required    bool     `json:"required,omitempty" yaml:"required"`
+	Options     []string `json:"options,omitempty" yaml:"options"`
+	Description string   `json:"description,omitempty" yaml:"description"`
+}
+
+// ExperimentInfo is an experiment of the project with its parameters.
+type ExperimentInfo struct {
+	Name   string            `json:"name"`
+	Params []ExperimentParam `json:"params"`
+}
+
+var (
+	experimentDecorator = regexp.MustCompile(`^@experiment\(\s*(?:name\s*=\s*)?["']([^"']+)["']`)
+	paramDecorator      = regexp.MustCompile(`^@param\((.*)\)$`)
+	pyDef               = regexp.MustCompile(`^(async\s+)?def\s`)
+)
+
+// skippedDirs aren't searched for experiments.
+var skippedDirs = map[string]bool{"__pycache__": true, "node_modules": true, "venv": true, "site-packages": true}
+
+// discoverExperiments finds the experiments declared with the higgsfield
+// @experiment decorator in the python files of the project, with the
+// @param decorators stacked on the same function. The files are read, not
+// run, so parameters built from anything but literals have no type or
+// default.
+func discoverExperiments(projectPath string) ([]ExperimentInfo, error) {
+	experiments := make([]ExperimentInfo, 0)
+	err := filepath.WalkDir(projectPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != projectPath && (strings.HasPrefix(d.Name(), ".") || skippedDirs[d.Name()]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".py" {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		experiments = append(experiments, parseExperiments(string(data))...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to look for experiments")
+	}
+
+	return experiments, nil
+}
+
+// parseExperiments reads the decorator stacks of a python file.
+func parseExperiments(source string) []ExperimentInfo {
+	experiments := make([]ExperimentInfo, 0)
+	decorators := make([]string, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "@"):
+			// decorator arguments may span lines until their parenthesis closes
+			for strings.Count(line, "(") > strings.Count(line, ")") && scanner.Scan() {
+				line += " " + stripPyComment(scanner.Text())
+			}
+			decorators = append(decorators, stripPyComment(line))
+			continue
+		case pyDef.MatchString(line):
+			if info, ok := experimentFromDecorators(decorators); ok {
+				experiments = append(experiments, info)
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+		decorators = decorators[:0]
+	}
+
+	return experiments
+}
+
+func experimentFromDecorators(decorators []string) (ExperimentInfo, bool) {
+	info := ExperimentInfo{Params: make([]ExperimentParam, 0)}
+	found := false
+	for _, d := range decorators {
+		if match := experimentDecorator.FindStringSubmatch(d); match != nil {
+			info.Name, found = match[1], true
+		} else if match := paramDecorator.FindStringSubmatch(d); match != nil {
+			if param, ok := parseParam(match[1]); ok {
+				info.Params = append(info.Params, param)
+			}
+		}
+	}
+
+	return info, found
+}
+
+// parseParam reads the arguments of @param, e.g.
+// "lr", default=3e-4, type=float, description="learning rate".
+func parseParam(arguments string) (ExperimentParam, bool) {
+	var param ExperimentParam
+	for i, argument := range splitPyArgs(arguments) {
+		key, value, keyword := strings.Cut(argument, "=")
+		if !keyword || strings.ContainsAny(key, `"'`) {
+			key, value = "", argument
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" && i == 0 {
+			key = "name"
+		}
+
+		switch key {
+		case "name":
+			param.Name, _ = pyString(value)
+		case "default":
+			param.Default = pyLiteral(value)
+			if param.Type == "" {
+				param.Type = pyLiteralType(value)
+			}
+		case "type":
+			param.Type = value
+		case "required":
+			param.Required = value == "True"
+		case "options", "choices":
+			if options, err := pyStrings(value); err == nil {
+				param.Options = options
+			} else {
+				for _, option := range splitPyArgs(strings.Trim(value, "[]()")) {
+					param.Options = append(param.Options, pyLiteral(option))
+				}
+			}
+		case "description", "help":
+			param.Description, _ = pyString(value)
+		}
+	}
+
+	return param, param.Name != ""
+}
+
+// splitPyArgs splits at the commas outside of brackets and strings.
+func splitPyArgs(s string) []string {
+	args := make([]string, 0)
+	depth, quote, start := 0, rune(0), 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case strings.ContainsRune("([{", r):
+			depth++
+		case strings.ContainsRune(")]}", r):
+			depth--
+		case r == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		args = append(args, last)
+	}
+
+	return args
+}
+
+// pyLiteral is the value of a literal as it's given on the command line.
+func pyLiteral(value string) string {
+	if s, err := pyString(value); err == nil {
+		return s
+	}
+
+	return value
+}
+
+func pyLiteralType(value string) string {
+	if _, err := pyString(value); err == nil {
+		return "str"
+	}
+	if value == "True" || value == "False" {
+		return "bool"
+	}
+	if _, err := strconv.Atoi(strings.ReplaceAll(value, "_", "")); err == nil {
+		return "int"
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); err == nil {
+		return "float"
+	}
+
+	return ""
+}
+
+// projectExperiments are the experiments of the project in the working
+// directory, with the parameters declared in its config filled in.
+func projectExperiments() ([]ExperimentInfo, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to get current working directory")
+	}
+
+	project, err := LoadHiggsfieldProject(cwd)
+	if err != nil {
+		return nil, err
+	}
+	if project == nil {
+		return nil, errors.Errorf("%s has no %s or %s", cwd, hfProjectYAML, strings.Join(hfConfigPaths, " or "))
+	}
+
+	return project.experimentInfos(), nil
+}
+
+// ExperimentNames are the experiments of the project in the working
+// directory, for shell completion. Errors leave it empty.
+func ExperimentNames() []string {
+	experiments, err := projectExperiments()
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(experiments))
+	for _, e := range experiments {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+type ExperimentsListArgs struct {
+	JSON bool
+}
+
+// ExperimentsList prints the experiments of the project in the working
+// directory and their parameters.
+func ExperimentsList(args ExperimentsListArgs) {
+	validateArgs(args)
+
+	experiments, err := projectExperiments()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.JSON {
+		data, err := json.MarshalIndent(experiments, "", "  ")
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(experiments) == 0 {
+		fmt.Println("no experiments found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "EXPERIMENT\tPARAM\tTYPE\tDEFAULT\tOPTIONS\tDESCRIPTION")
+	for _, e := range experiments {
+		if len(e.Params) == 0 {
+			fmt.Fprintf(w, "%s\t-\t\t\t\t\n", e.Name)
+		}
+		for _, p := range e.Params {
+			def := p.Default
+			if p.Required {
+				def = "required"
+			}
+			fmt.Fprintf(w, "%s\t--%s\t%s\t%s\t%s\t%s\n", e.Name, p.Name, p.Type, def, strings.Join(p.Options, ","), truncate(p.Description, 60))
+		}
+	}
+	w.Flush()
+}
+
+// pickExperiment asks which experiment to run, if there's a terminal to
+// ask on.
+func pickExperiment(experiments []string) (string, bool) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 || len(experiments) == 0 {
+		return "", false
+	}
+
+	for i, e := range experiments {
+		fmt.Printf("  %d) %s\n", i+1, e)
+	}
+	fmt.Printf("experiment to run [1-%d]: ", len(experiments))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.TrimSpace(answer)
+
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(experiments) {
+		return experiments[n-1], true
+	}
+	for _, e := range experiments {
+		if e == answer {
+			return e, true
+		}
+	}
+
+	return "", false
+}
+
+// builtinParams are passed to every experiment by higgsfield itself.
+var builtinParams = map[string]bool{"max_steps": true}
+
+// checkExperimentArgs checks the arguments for the experiment against its
+// declared parameters, so a typo fails here rather than in argparse after
+// the image is built. Experiments without declared parameters aren't
+// checked, since parameters that couldn't be read are missing from them.
+func checkExperimentArgs(params []ExperimentParam, rest []string) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	byName := make(map[string]ExperimentParam, len(params))
+	for _, p := range params {
+		byName[p.Name] = p
+	}
+
+	problems := make([]string, 0)
+	given := make(map[string]bool)
+	for i := 0; i < len(rest); i++ {
+		arg := rest[i]
+		if !strings.HasPrefix(arg, "--") {
+			problems = append(problems, fmt.Sprintf("unexpected argument %s", arg))
+			continue
+		}
+
+		name, value, inline := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		name = strings.ReplaceAll(name, "-", "_")
+		hasValue := inline
+		if !inline && i+1 < len(rest) && !strings.HasPrefix(rest[i+1], "--") {
+			value, hasValue = rest[i+1], true
+			i++
+		}
+		given[name] = true
+
+		if builtinParams[name] {
+			continue
+		}
+		param, ok := byName[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown parameter --%s%s", name, didYouMean(name, params)))
+			continue
+		}
+		if !hasValue {
+			if param.Type != "bool" {
+				problems = append(problems, fmt.Sprintf("--%s needs a value", name))
+			}
+			continue
+		}
+		if err := checkParamValue(param, value); err != nil {
+			problems = append(problems, fmt.Sprintf("--%s: %v", name, err))
+		}
+	}
+
+	for _, p := range params {
+		if p.Required && !given[p.Name] {
+			problems = append(problems, fmt.Sprintf("missing required parameter --%s", p.Name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkParamValue(param ExperimentParam, value string) error {
+	var err error
+	switch param.Type {
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return errors.Errorf("expected %s, got %s", param.Type, value)
+	}
+
+	if len(param.Options) > 0 {
+		for _, option := range param.Options {
+			if option == value {
+				return nil
+			}
+		}
+		return errors.Errorf("expected one of %s, got %s", strings.Join(param.Options, ", "), value)
+	}
+
+	return nil
+}
+
+func didYouMean(name string, params []ExperimentParam) string {
+	for _, p := range params {
+		if strings.Contains(p.Name, name) || strings.Contains(name, p.Name) {
+			return fmt.Sprintf(", did you mean --%s?", p.Name)
+		}
+	}
+
+	return ""
+}
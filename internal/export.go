@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	runKindExport = "export"
+	// exportIn and exportOut are where the checkpoint and the output
+	// directory appear in the conversion container.
+	exportIn  = "/export/in"
+	exportOut = "/export/out"
+)
+
+// ExportConfig names the scripts that convert checkpoints of the project,
+// by format. They're run in the project image as
+// `python <script> <checkpoint> <output dir>`. Safetensors has a built-in
+// conversion for torch.save files, ONNX needs the model code and so always
+// a script. It's configured under export in invoker.yaml.
+type ExportConfig struct {
+	ONNX        string `yaml:"onnx"`
+	Safetensors string `yaml:"safetensors"`
+}
+
+// safetensorsExport converts a torch.save file holding a module, a state
+// dict or a dict with the state dict under state_dict, model or module.
+const safetensorsExport = `
+import os, sys
+import torch
+
+src, dst = sys.argv[1], sys.argv[2]
+try:
+    from safetensors.torch import save_file
+except ImportError:
+    import subprocess
+    subprocess.check_call([sys.executable, "-m", "pip", "install", "-q", "safetensors"])
+    from safetensors.torch import save_file
+
+try:
+    ckpt = torch.load(src, map_location="cpu", weights_only=False)
+except TypeError:
+    ckpt = torch.load(src, map_location="cpu")
+if isinstance(ckpt, torch.nn.Module):
+    ckpt = ckpt.state_dict()
+for key in ("state_dict", "model", "module"):
+    if isinstance(ckpt, dict) and isinstance(ckpt.get(key), dict):
+        ckpt = ckpt[key]
+        break
+
+tensors = {k: v.detach().clone().contiguous() for k, v in ckpt.items() if isinstance(v, torch.Tensor)}
+if not tensors:
+    sys.exit("no tensors found in %s" % src)
+save_file(tensors, os.path.join(dst, "model.safetensors"), metadata={"format": "pt"})
+print("wrote %d tensors" % len(tensors))
+`
+
+// exportCommand converts the checkpoint at guestCheckpoint into exportOut.
+func exportCommand(config ExportConfig, format, guestCheckpoint string, extra []string) ([]string, error) {
+	script := config.Safetensors
+	if format == "onnx" {
+		script = config.ONNX
+	}
+
+	switch {
+	case script != "":
+		return append([]string{"python", script, guestCheckpoint, exportOut}, extra...), nil
+	case format == "safetensors":
+		return append([]string{"python", "-c", safetensorsExport, guestCheckpoint, exportOut}, extra...), nil
+	}
+
+	return nil, errors.New("onnx export needs the model code, set export.onnx in invoker.yaml to a script run as `python <script> <checkpoint> <output dir>`")
+}
+
+var checkpointExtensions = []string{".pt", ".pth", ".ckpt", ".bin", ".safetensors"}
+
+// latestRun is the most recently written run directory of the experiment.
+func latestRun(projectName, experimentName string) (string, error) {
+	_, pattern, err := defaultDirectories(projectName, experimentName, "*")
+	if err != nil {
+		return "", err
+	}
+
+	dirs, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	latest, latestTime := "", time.Time{}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if info.ModTime().After(latestTime) {
+			latest, latestTime = dir, info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", errors.Errorf("no runs of %s on this host", experimentName)
+	}
+
+	return latest, nil
+}
+
+// latestCheckpoint is the most recently written checkpoint file in the run
+// directory.
+func latestCheckpoint(runDir string) (string, error) {
+	latest, latestTime := "", time.Time{}
+	err := filepath.WalkDir(runDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "export" {
+			return filepath.SkipDir
+		}
+
+		matches := false
+		for _, ext := range checkpointExtensions {
+			matches = matches || strings.HasSuffix(d.Name(), ext)
+		}
+		if d.IsDir() || !matches {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err == nil && info.ModTime().After(latestTime) {
+			latest, latestTime = path, info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to look for checkpoints in %s", runDir)
+	}
+	if latest == "" {
+		return "", errors.Errorf("no checkpoints in %s, pass --checkpoint", runDir)
+	}
+
+	return latest, nil
+}
+
+// uploadExport copies the exported files to an s3:// or gs:// url with the
+// cli of the store.
+func uploadExport(dir, url string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(url, "s3://"):
+		_, err = runIn(dir, "aws", "s3", "sync", dir, url)
+	case strings.HasPrefix(url, "gs://"):
+		_, err = runIn(dir, "gcloud", "storage", "rsync", "--recursive", dir, url)
+	default:
+		return errors.Errorf("unsupported output %s, expected a directory, s3:// or gs://", url)
+	}
+
+	return errors.WithMessagef(err, "failed to upload to %s", url)
+}
+
+func isObjectStoreURL(output string) bool {
+	return strings.Contains(output, "://")
+}
+
+type ExportArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	// RunName is the run to export from, the latest one if empty.
+	RunName    string
+	Format     string `validate:"required,oneof=onnx safetensors"`
+	Checkpoint string
+	// Output is a directory or an s3:// or gs:// url, a new directory under
+	// export in the run directory if empty.
+	Output        string
+	GPUs          []int `validate:"unique,dive,min=0"`
+	Image         string
+	DockerContext string
+	Timeout       time.Duration `validate:"required"`
+	Rest          []string
+}
+
+// Export converts a checkpoint of an experiment in the project image. The
+// conversion is recorded like a run and lands in the history with the
+// files it produced.
+func Export(args ExportArgs) {
+	validateArgs(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	runDir := ""
+	if args.RunName != "" {
+		_, runDir, err = defaultDirectories(args.ProjectName, args.ExperimentName, args.RunName)
+	} else {
+		runDir, err = latestRun(args.ProjectName, args.ExperimentName)
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	checkpoint := args.Checkpoint
+	switch {
+	case checkpoint == "":
+		checkpoint, err = latestCheckpoint(runDir)
+	case !filepath.IsAbs(checkpoint):
+		checkpoint = filepath.Join(runDir, checkpoint)
+	}
+	if err == nil {
+		_, err = os.Stat(checkpoint)
+	}
+	if err != nil {
+		errorf("invalid checkpoint: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	config, err := LoadProjectConfig(cwd)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	guestCheckpoint := exportIn + "/" + filepath.Base(checkpoint)
+	command, err := exportCommand(config.Export, args.Format, guestCheckpoint, args.Rest)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	stamp := clock.Now().UTC().Format("20060102_150405")
+	outDir := args.Output
+	if outDir == "" || isObjectStoreURL(outDir) {
+		outDir = filepath.Join(runDir, "export", args.Format+"_"+stamp)
+	}
+	if outDir, err = filepath.Abs(outDir); err == nil {
+		err = os.MkdirAll(outDir, 0o755)
+	}
+	if err != nil {
+		errorf("failed to create output directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	run := RunArgs{
+		ProjectName:    args.ProjectName,
+		Hosts:          []string{"localhost"},
+		NProcPerNode:   1,
+		ExperimentName: args.ExperimentName + "_export",
+		Port:           0,
+		RunName:        args.Format + "_" + stamp,
+		MaxRepeats:     -1,
+		GPUs:           args.GPUs,
+		CPUOnly:        len(args.GPUs) == 0,
+		Image:          args.Image,
+		ProjectPath:    cwd,
+		DockerContext:  args.DockerContext,
+		Namespace:      namespace,
+		Kind:           runKindExport,
+		Mounts:         []string{checkpoint + ":" + guestCheckpoint + ":ro", outDir + ":" + exportOut},
+	}
+
+	artifacts, err := runExport(context.Background(), run, command, args.Timeout, outDir, args.Output)
+	if err != nil {
+		errorf("export of %s failed: %v\n", checkpoint, err)
+		os.Exit(ExitInfra)
+	}
+
+	fmt.Printf("exported %s to %s:\n", checkpoint, args.Format)
+	for _, artifact := range artifacts {
+		fmt.Printf("  %s\n", artifact)
+	}
+}
+
+// runExport runs the conversion to completion, like the smoke test, and
+// retires it with the produced files.
+func runExport(ctx context.Context, run RunArgs, command []string, timeout time.Duration, outDir, output string) ([]string, error) {
+	containerName := nameFromRunArgs(run)
+	if err := launch(ctx, run, launchPlan{Master: "localhost", Entrypoint: command}); err != nil {
+		return nil, errors.WithMessage(err, "failed to launch export")
+	}
+
+	dr, err := NewDockerRun(ctx, run.DockerContext, run.ProjectName, run.ProjectPath, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open state")
+	}
+
+	exitCode, exportErr := dr.Wait(containerName, timeout)
+	if exportErr == nil && exitCode != 0 {
+		exportErr = errors.Errorf("export exited with code %d", exitCode)
+	}
+	if exportErr != nil {
+		if logs, err := dr.tailLogs(containerName, 50); err == nil {
+			fmt.Printf("last output of %s:\n%s\n", containerName, redactText(logs))
+		}
+	}
+
+	artifacts := make([]string, 0)
+	if exportErr == nil {
+		exportErr = filepath.WalkDir(outDir, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				artifacts = append(artifacts, path)
+			}
+			return err
+		})
+	}
+	if exportErr == nil && len(artifacts) == 0 {
+		exportErr = errors.Errorf("export wrote nothing to %s", outDir)
+	}
+	if exportErr == nil && isObjectStoreURL(output) {
+		if exportErr = uploadExport(outDir, output); exportErr == nil {
+			artifacts = append(artifacts, output)
+		}
+	}
+	sort.Strings(artifacts)
+
+	state, err := sm.Get(containerName)
+	if err != nil {
+		return nil, err
+	}
+	finishedAt := dr.finishedAt(containerName)
+
+	if err := dr.Kill(containerName); err != nil {
+		return nil, err
+	}
+
+	if state != nil {
+		state.Artifacts = artifacts
+		if exportErr != nil {
+			state.Outcome, state.OutcomeReason = outcomeFailed, exportErr.Error()
+		}
+		if err := sm.Retire(*state, finishedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	return artifacts, exportErr
+}
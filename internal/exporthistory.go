@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type ExportHistoryArgs struct {
+	Format string `validate:"required,oneof=csv parquet"`
+	// Output is the directory runs and metrics files are written to.
+	Output      string
+	Since       string
+	ProjectName string `validate:"omitempty,varname"`
+	// Tags only exports the runs that have every one of these key=value
+	// tags.
+	Tags []string
+}
+
+// historyTable is a table of the export, its columns all equally long.
+type historyTable []parquetColumn
+
+func (t historyTable) add(row ...any) {
+	for i := range t {
+		t[i].Values = append(t[i].Values, row[i])
+	}
+}
+
+func stringColumn(name string) parquetColumn {
+	return parquetColumn{Name: name, Type: parquetByteArray, Converted: parquetUTF8}
+}
+
+func timeColumn(name string, optional bool) parquetColumn {
+	return parquetColumn{Name: name, Type: parquetInt64, Converted: parquetTimestampMilli, Optional: optional}
+}
+
+func numberColumn(name string, kind parquetType, optional bool) parquetColumn {
+	return parquetColumn{Name: name, Type: kind, Converted: parquetNoConversion, Optional: optional}
+}
+
+func timeValue(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t.UnixMilli()
+}
+
+func floatValue(f *float64) any {
+	if f == nil {
+		return nil
+	}
+
+	return *f
+}
+
+// writeCSV writes the table with RFC 3339 timestamps and empty cells for
+// nulls.
+func (t historyTable) writeCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	row := make([]string, len(t))
+	for i, c := range t {
+		row[i] = c.Name
+	}
+	if err := w.Write(row); err != nil {
+		return nil, err
+	}
+
+	rows := 0
+	if len(t) > 0 {
+		rows = len(t[0].Values)
+	}
+	for r := 0; r < rows; r++ {
+		for i, c := range t {
+			switch v := c.Values[r].(type) {
+			case nil:
+				row[i] = ""
+			case int64:
+				if c.Converted == parquetTimestampMilli {
+					row[i] = time.UnixMilli(v).UTC().Format(time.RFC3339Nano)
+				} else {
+					row[i] = strconv.FormatInt(v, 10)
+				}
+			case float64:
+				row[i] = strconv.FormatFloat(v, 'g', -1, 64)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// ExportHistory writes the runs of this host, live and finished, with their
+// durations, restarts and final metrics to runs.csv or runs.parquet, and
+// every scraped metrics point to metrics.csv or metrics.parquet, for
+// analysis in notebooks.
+func ExportHistory(args ExportHistoryArgs) {
+	validateArgs(args)
+
+	since, err := parseSince(args.Since)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	tags, err := parseTags(args.Tags)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	output := args.Output
+	if output == "" {
+		output = "."
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	records, err := sm.History()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	config, err := LoadCostConfig()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	for _, s := range states {
+		records = append(records, recordFromState(s, config.HostClass, time.Time{}))
+	}
+
+	runs, metrics, err := historyTables(store, records, func(r RunRecord) bool {
+		return (args.ProjectName == "" || r.ProjectName == args.ProjectName) &&
+			(r.FinishedAt.IsZero() || !r.FinishedAt.Before(since)) && matchTags(r.Tags, tags)
+	})
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if err := files.MkdirAll(output, 0o755); err != nil {
+		errorf("failed to create %s: %v\n", output, err)
+		os.Exit(ExitInfra)
+	}
+	// the tables are written even when empty, so notebooks find the columns
+	for _, name := range []string{"runs", "metrics"} {
+		table := runs
+		if name == "metrics" {
+			table = metrics
+		}
+		var data []byte
+		if args.Format == "parquet" {
+			var buf bytes.Buffer
+			err = writeParquet(&buf, table)
+			data = buf.Bytes()
+		} else {
+			data, err = table.writeCSV()
+		}
+		file := filepath.Join(output, name+"."+args.Format)
+		if err == nil {
+			err = files.WriteFile(file, data, 0o644)
+		}
+		if err != nil {
+			errorf("failed to write %s: %v\n", file, err)
+			os.Exit(ExitInfra)
+		}
+		infof("wrote %d rows to %s\n", len(table[0].Values), file)
+	}
+}
+
+// historyTables are the runs of records that keep matches, newest first,
+// and their metrics. A point belongs to the last run of its container that
+// started before it, since the metrics of a container are kept across its
+// runs.
+func historyTables(store *MetricsStore, records []RunRecord, keep func(RunRecord) bool) (historyTable, historyTable, error) {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].StartedAt.After(records[j].StartedAt) })
+
+	runs := historyTable{
+		stringColumn("container_name"), stringColumn("project_name"), stringColumn("experiment_name"), stringColumn("run_name"),
+		stringColumn("team"), stringColumn("user"), stringColumn("host_class"), stringColumn("status"),
+		numberColumn("gpus", parquetInt64, false), timeColumn("started_at", false), timeColumn("finished_at", true),
+		numberColumn("duration_seconds", parquetDouble, false), numberColumn("restarts", parquetInt64, false),
+		numberColumn("failures", parquetInt64, false), numberColumn("final_step", parquetInt64, true),
+		numberColumn("final_loss", parquetDouble, true), numberColumn("best_loss", parquetDouble, true),
+		numberColumn("final_tokens_per_sec", parquetDouble, true), stringColumn("tags"), stringColumn("sweep"),
+	}
+	metrics := historyTable{
+		stringColumn("container_name"), stringColumn("project_name"), stringColumn("experiment_name"), stringColumn("run_name"),
+		timeColumn("time", false), numberColumn("step", parquetInt64, false),
+		numberColumn("loss", parquetDouble, true), numberColumn("tokens_per_sec", parquetDouble, true),
+	}
+
+	byContainer := make(map[string][]RunRecord)
+	for _, r := range records {
+		byContainer[r.ContainerName] = append(byContainer[r.ContainerName], r)
+	}
+	points := make(map[string][]MetricPoint, len(byContainer))
+	for _, containerName := range sortedKeys(byContainer) {
+		series, err := store.Series(containerName)
+		if err != nil {
+			return nil, nil, err
+		}
+		points[containerName] = series
+	}
+
+	now := clock.Now()
+	for _, r := range records {
+		if !keep(r) {
+			continue
+		}
+
+		// the container's runs are newest first, the points oldest first
+		var own []MetricPoint
+		var next time.Time
+		for _, other := range byContainer[r.ContainerName] {
+			if other.StartedAt.After(r.StartedAt) {
+				next = other.StartedAt
+			}
+		}
+		for _, p := range points[r.ContainerName] {
+			if !p.Time.Before(r.StartedAt) && (next.IsZero() || p.Time.Before(next)) {
+				own = append(own, p)
+			}
+		}
+
+		final := finalMetrics(own)
+		var finalStep, finalLoss, finalThroughput any
+		if final != nil {
+			finalStep = final.Step
+			if final.Loss != nil {
+				finalLoss = float64(*final.Loss)
+			}
+			if final.TokensPerSec != nil {
+				finalThroughput = float64(*final.TokensPerSec)
+			}
+		}
+		finishedAt := r.FinishedAt
+		if finishedAt.IsZero() {
+			finishedAt = now
+		}
+		status := runStatus(r)
+		if r.FinishedAt.IsZero() {
+			status = runStatusRunning
+		}
+		runs.add(r.ContainerName, r.ProjectName, r.ExperimentName, r.RunName, r.Team, r.User, r.HostClass, status,
+			int64(r.GPUs), timeValue(r.StartedAt), timeValue(r.FinishedAt), finishedAt.Sub(r.StartedAt).Seconds(),
+			int64(r.Attempts), int64(len(r.Failures)), finalStep, finalLoss, floatValue(r.BestLoss), finalThroughput, formatTags(r.Tags), r.Sweep)
+
+		for _, p := range own {
+			var loss, throughput any
+			if p.Loss != nil {
+				loss = float64(*p.Loss)
+			}
+			if p.TokensPerSec != nil {
+				throughput = float64(*p.TokensPerSec)
+			}
+			metrics.add(r.ContainerName, r.ProjectName, r.ExperimentName, r.RunName, p.Time.UnixMilli(), p.Step, loss, throughput)
+		}
+	}
+
+	return runs, metrics, nil
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// NodeFailure is how the container of a run ended on one node.
+type NodeFailure struct {
+	Host          string       `json:"host"`
+	Rank          int          `json:"rank"`
+	ContainerName string       `json:"container_name,omitempty"`
+	Status        string       `json:"status,omitempty"`
+	ExitCode      int          `json:"exit_code"`
+	Failure       FailureClass `json:"failure,omitempty"`
+	FinishedAt    time.Time    `json:"finished_at,omitempty"`
+	LastLines     []string     `json:"last_lines,omitempty"`
+	// Error is why the node couldn't report.
+	Error string `json:"error,omitempty"`
+}
+
+func (f NodeFailure) failed() bool {
+	return f.Error == "" && f.Status == "exited" && f.Failure != FailureNone
+}
+
+type FailureReportArgs struct {
+	ExperimentName string `validate:"required"`
+	ProjectName    string `validate:"omitempty,varname"`
+	// Hosts to ask, the recorded hosts of the run if empty.
+	Hosts []string
+	// Local only reports this host as json, it's how the other hosts are
+	// asked.
+	Local    bool
+	LogLines int `validate:"min=1"`
+	JSON     bool
+}
+
+// localNodeFailure reads how the container of the run ended on this host.
+func localNodeFailure(state *ExperimentState, args FailureReportArgs) NodeFailure {
+	node := NodeFailure{Rank: -1}
+	node.Host, _ = os.Hostname()
+
+	containerName := DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
+	if state != nil {
+		containerName = state.ContainerName
+		node.Rank = state.Rank
+		if state.Rank < len(state.RunArgs.Hosts) {
+			node.Host = state.RunArgs.Hosts[state.Rank]
+		}
+	}
+	node.ContainerName = containerName
+
+	dr, err := dockerRunOf(context.Background(), containerName)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	defer dr.client.Close()
+
+	ctx, cancel := dr.deadline(dockerOpInspect)
+	defer cancel()
+	inspect, err := dr.client.ContainerInspect(ctx, containerName)
+	if err != nil {
+		node.Error = dr.timedOut(ctx, dockerOpInspect, err).Error()
+		return node
+	}
+
+	node.Status = inspect.State.Status
+	node.ExitCode = inspect.State.ExitCode
+	node.FinishedAt, _ = time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+	if node.Status != "exited" {
+		return node
+	}
+
+	logs, err := dr.tailLogs(containerName, args.LogLines)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	node.Failure = classifyFailure(node.ExitCode, inspect.State.OOMKilled, logs)
+	if node.Failure != FailureNone {
+		node.LastLines = strings.Split(strings.TrimRight(redactText(logs), "\n"), "\n")
+	}
+
+	return node
+}
+
+// remoteNodeFailures asks the other hosts of the run over ssh, all at once.
+func remoteNodeFailures(hosts []string, self string, args FailureReportArgs) []NodeFailure {
+	remote := []string{"experiment", "failure-report", args.ExperimentName, "--project_name", args.ProjectName,
+		"--log_lines", fmt.Sprint(args.LogLines), "--local"}
+
+	nodes := make([]NodeFailure, len(hosts))
+	done := make(chan struct{})
+	for i, host := range hosts {
+		go func(i int, host string) {
+			defer func() { done <- struct{}{} }()
+			node := NodeFailure{Host: host, Rank: i}
+			if host == self || isLoopback(host) {
+				nodes[i] = NodeFailure{Rank: -1}
+				return
+			}
+
+			out, err := outputOnHost(context.Background(), host, remote...)
+			if err == nil {
+				err = json.Unmarshal([]byte(out), &node)
+			}
+			if err != nil {
+				node.Error = err.Error()
+			}
+			if node.Rank < 0 {
+				node.Rank = i
+			}
+			// the host names of the run, not the ones the nodes know
+			// themselves by
+			node.Host = host
+			nodes[i] = node
+		}(i, host)
+	}
+	for range hosts {
+		<-done
+	}
+
+	reported := make([]NodeFailure, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Host != "" {
+			reported = append(reported, n)
+		}
+	}
+
+	return reported
+}
+
+// FailureReport collects how the run ended on all of its nodes, and puts
+// the ones that failed first on top with their last lines of output.
+func FailureReport(args FailureReportArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	state, err := findLiveState(sm, args.ProjectName, args.ExperimentName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if state == nil && args.ProjectName == "" {
+		errorf("no recorded run of %s on this host, pass --project_name\n", args.ExperimentName)
+		os.Exit(ExitValidation)
+	}
+	if state != nil {
+		args.ProjectName = state.ProjectName
+	}
+
+	self := localNodeFailure(state, args)
+	if args.Local {
+		data, err := json.Marshal(self)
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 && state != nil {
+		hosts = state.RunArgs.Hosts
+	}
+	nodes := append([]NodeFailure{self}, remoteNodeFailures(hosts, self.Host, args)...)
+
+	// failed nodes first, in the order they failed, then the rest by rank
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.failed() != b.failed() {
+			return a.failed()
+		}
+		if a.failed() && !a.FinishedAt.Equal(b.FinishedAt) {
+			return a.FinishedAt.Before(b.FinishedAt)
+		}
+		return a.Rank < b.Rank
+	})
+
+	if args.JSON {
+		data, err := json.MarshalIndent(nodes, "", "  ")
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	printFailureReport(nodes)
+}
+
+func printFailureReport(nodes []NodeFailure) {
+	if len(nodes) == 0 || !nodes[0].failed() {
+		fmt.Println("no node of the run failed")
+	} else {
+		first := nodes[0]
+		fmt.Printf("rank %d on %s failed first at %s (%s, exit code %d)\n\n",
+			first.Rank, first.Host, first.FinishedAt.Local().Format("15:04:05.000"), first.Failure, first.ExitCode)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RANK\tHOST\tSTATUS\tEXIT\tFAILURE\tFINISHED")
+	for _, n := range nodes {
+		status, exit, finished := n.Status, fmt.Sprint(n.ExitCode), ""
+		if n.Error != "" {
+			status, exit = "unknown", "-"
+		}
+		if n.Status == "exited" {
+			finished = n.FinishedAt.Local().Format("15:04:05.000")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", n.Rank, n.Host, status, exit, n.Failure, finished)
+	}
+	w.Flush()
+
+	for _, n := range nodes {
+		switch {
+		case n.Error != "":
+			fmt.Printf("\n%s couldn't report: %s\n", n.Host, n.Error)
+		case n.failed():
+			fmt.Printf("\n--- rank %d on %s, last lines:\n%s\n", n.Rank, n.Host, strings.Join(n.LastLines, "\n"))
+		}
+	}
+}
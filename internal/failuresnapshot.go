@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FailureSnapshot points at what the host looked like right after a run
+// failed. The gpus, memory and disks are often fine again by the time
+// someone looks at the failure.
+type FailureSnapshot struct {
+	ExitCode   int       `json:"exit_code"`
+	FinishedAt time.Time `json:"finished_at"`
+	TakenAt    time.Time `json:"taken_at"`
+	// File holds the output of nvidia-smi, free and df.
+	File string `json:"file"`
+}
+
+// snapshotCommands are run on the host, their output goes into the
+// snapshot one after the other.
+var snapshotCommands = [][]string{
+	{"nvidia-smi"},
+	{"nvidia-smi", "--query-compute-apps=pid,process_name,used_memory", "--format=csv"},
+	{"free", "-m"},
+	{"df", "-h"},
+}
+
+func hostSnapshot() []byte {
+	var buf bytes.Buffer
+	for _, command := range snapshotCommands {
+		fmt.Fprintf(&buf, "$ %s\n", strings.Join(command, " "))
+		out, err := exec.Command(command[0], command[1:]...).CombinedOutput()
+		buf.Write(out)
+		if err != nil {
+			fmt.Fprintf(&buf, "error: %v\n", err)
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+func (m *InnerStateManager) failuresDir() string {
+	return filepath.Join(filepath.Dir(m.dir), "failures")
+}
+
+// recordFailure snapshots the host for the failed exit of the run and adds
+// the snapshot to its state, once per exit. It returns the updated state.
+func (m *InnerStateManager) recordFailure(d *DockerRun, state ExperimentState, exitCode int) (ExperimentState, error) {
+	finishedAt := d.finishedAt(state.ContainerName)
+	for _, f := range state.Failures {
+		if f.FinishedAt.Equal(finishedAt) {
+			return state, nil
+		}
+	}
+
+	// right away, before taking the lock
+	snapshot := hostSnapshot()
+	takenAt := clock.Now().UTC()
+
+	if err := files.MkdirAll(m.failuresDir(), 0o755); err != nil {
+		return state, errors.WithMessage(err, "failed to create failures directory")
+	}
+	file := filepath.Join(m.failuresDir(), fmt.Sprintf("%s-%s.txt", state.ContainerName, finishedAt.Format("20060102T150405")))
+	if err := files.WriteFile(file, snapshot, 0o644); err != nil {
+		return state, errors.WithMessagef(err, "failed to write failure snapshot of %s", state.ContainerName)
+	}
+
+	unlock, err := m.Lock()
+	if err != nil {
+		return state, err
+	}
+	defer unlock()
+
+	current, err := m.Get(state.ContainerName)
+	if err != nil {
+		return state, err
+	} else if current == nil {
+		return state, nil
+	}
+
+	current.Failures = append(current.Failures, FailureSnapshot{
+		ExitCode:   exitCode,
+		FinishedAt: finishedAt,
+		TakenAt:    takenAt,
+		File:       file,
+	})
+	if err := m.Put(*current); err != nil {
+		return state, err
+	}
+
+	fmt.Printf("saved the state of the host after %s failed to %s\n", state.ContainerName, file)
+	return *current, nil
+}
@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileSystem is how the state, the cache directories and env files are
+// read and written. Like the clock, it's a package variable, so tests can
+// replace it with a MemFileSystem and never touch the real home directory.
+// Unlike fs.FS it takes the absolute paths of the os package.
+type FileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	// AppendFile appends data to the file, creating it if it's missing.
+	AppendFile(name string, data []byte, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	// Chmod sets the mode of the file, sticky and setuid bits included,
+	// which unlike the perm of MkdirAll isn't masked by the umask.
+	Chmod(name string, mode fs.FileMode) error
+	// Lock takes an exclusive lock on the file, creating it, which other
+	// processes on the host respect too.
+	Lock(name string) (unlock func(), err error)
+	UserHomeDir() (string, error)
+}
+
+type osFileSystem struct{}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error)  { return os.ReadFile(name) }
+func (osFileSystem) Rename(oldpath, newpath string) error  { return os.Rename(oldpath, newpath) }
+func (osFileSystem) Remove(name string) error              { return os.Remove(name) }
+func (osFileSystem) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+func (osFileSystem) UserHomeDir() (string, error)          { return os.UserHomeDir() }
+
+func (osFileSystem) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (osFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFileSystem) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFileSystem) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+func (osFileSystem) AppendFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (osFileSystem) Lock(name string) (func(), error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+var files FileSystem = osFileSystem{}
+
+// SetFileSystem replaces the file system of the package until the
+// returned func restores the previous one.
+func SetFileSystem(f FileSystem) (restore func()) {
+	previous := files
+	files = f
+	return func() { files = previous }
+}
+
+// MemFileSystem keeps files in memory. Its locks only exclude the users
+// of the same MemFileSystem.
+type MemFileSystem struct {
+	mu    sync.Mutex
+	home  string
+	files map[string]*memFile
+	locks map[string]*sync.Mutex
+}
+
+type memFile struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// NewMemFileSystem is an empty file system whose user home directory is
+// home, which exists.
+func NewMemFileSystem(home string) *MemFileSystem {
+	m := &MemFileSystem{home: filepath.Clean(home), files: make(map[string]*memFile), locks: make(map[string]*sync.Mutex)}
+	m.mkdirAll(m.home, 0o755)
+	return m
+}
+
+func (m *MemFileSystem) UserHomeDir() (string, error) {
+	return m.home, nil
+}
+
+func memError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *MemFileSystem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, memError("open", name, fs.ErrNotExist)
+	} else if f.mode.IsDir() {
+		return nil, memError("read", name, syscall.EISDIR)
+	}
+
+	return bytes.Clone(f.data), nil
+}
+
+// parentExists fails like the os package does for a file whose directory
+// is missing.
+func (m *MemFileSystem) parentExists(op, name string) error {
+	dir, ok := m.files[filepath.Dir(name)]
+	if !ok {
+		return memError(op, name, fs.ErrNotExist)
+	} else if !dir.mode.IsDir() {
+		return memError(op, name, syscall.ENOTDIR)
+	}
+
+	return nil
+}
+
+func (m *MemFileSystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if err := m.parentExists("open", name); err != nil {
+		return err
+	}
+	if f, ok := m.files[name]; ok && f.mode.IsDir() {
+		return memError("open", name, syscall.EISDIR)
+	}
+
+	m.files[name] = &memFile{data: bytes.Clone(data), mode: perm, modTime: clock.Now()}
+	return nil
+}
+
+func (m *MemFileSystem) AppendFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok {
+		if err := m.parentExists("open", name); err != nil {
+			return err
+		}
+		f = &memFile{mode: perm}
+		m.files[name] = f
+	} else if f.mode.IsDir() {
+		return memError("open", name, syscall.EISDIR)
+	}
+
+	f.data = append(f.data, data...)
+	f.modTime = clock.Now()
+	return nil
+}
+
+// Rename moves a file, directories can't be renamed.
+func (m *MemFileSystem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	} else if f.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	if err := m.parentExists("rename", newpath); err != nil {
+		return err
+	}
+
+	m.files[newpath] = f
+	delete(m.files, oldpath)
+	return nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok {
+		return memError("remove", name, fs.ErrNotExist)
+	}
+	if f.mode.IsDir() && len(m.children(name)) > 0 {
+		return memError("remove", name, syscall.ENOTEMPTY)
+	}
+
+	delete(m.files, name)
+	return nil
+}
+
+// children are the names of the entries directly in the directory.
+func (m *MemFileSystem) children(dir string) []string {
+	names := make([]string, 0)
+	for name := range m.files {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok {
+		return nil, memError("open", name, fs.ErrNotExist)
+	} else if !f.mode.IsDir() {
+		return nil, memError("readdirent", name, syscall.ENOTDIR)
+	}
+
+	children := m.children(name)
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(m.info(filepath.Join(name, child))))
+	}
+
+	return entries, nil
+}
+
+func (m *MemFileSystem) info(name string) memFileInfo {
+	f := m.files[name]
+	return memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), mode: f.mode, modTime: f.modTime}
+}
+
+func (m *MemFileSystem) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return nil, memError("stat", name, fs.ErrNotExist)
+	}
+
+	return m.info(name), nil
+}
+
+func (m *MemFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mkdirAll(filepath.Clean(path), perm)
+}
+
+func (m *MemFileSystem) mkdirAll(name string, perm fs.FileMode) error {
+	if f, ok := m.files[name]; ok {
+		if !f.mode.IsDir() {
+			return memError("mkdir", name, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := m.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+
+	m.files[name] = &memFile{mode: fs.ModeDir | perm.Perm(), modTime: clock.Now()}
+	return nil
+}
+
+func (m *MemFileSystem) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok {
+		return memError("chmod", name, fs.ErrNotExist)
+	}
+	f.mode = f.mode.Type() | mode&(fs.ModePerm|fs.ModeSticky|fs.ModeSetuid|fs.ModeSetgid)
+
+	return nil
+}
+
+func (m *MemFileSystem) Lock(name string) (func(), error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	if err := m.parentExists("open", name); err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if _, ok := m.files[name]; !ok {
+		m.files[name] = &memFile{mode: 0o644, modTime: clock.Now()}
+	}
+	lock, ok := m.locks[name]
+	if !ok {
+		lock = new(sync.Mutex)
+		m.locks[name] = lock
+	}
+	m.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+// Paths lists every file and directory, for tests to check what was
+// written.
+func (m *MemFileSystem) Paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return sortedKeys(m.files)
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fatalXIDs are the Xid errors that point at the hardware rather than the
+// application, see the nvidia Xid catalog.
+var fatalXIDs = map[int]string{
+	48:  "double bit ecc error",
+	63:  "row remapping or page retirement event",
+	64:  "row remapping or page retirement failure",
+	74:  "nvlink error",
+	79:  "gpu has fallen off the bus",
+	92:  "high single bit ecc error rate",
+	94:  "contained ecc error",
+	95:  "uncontained ecc error",
+	119: "gsp rpc timeout",
+	120: "gsp error",
+}
+
+var xidRegex = regexp.MustCompile(`NVRM: Xid \(PCI:([0-9a-fA-F:.]+)\): (\d+)`)
+
+// GPUFault is a hardware problem seen on a gpu of this host.
+type GPUFault struct {
+	// GPU is the index of the gpu, -1 if it couldn't be told.
+	GPU    int       `json:"gpu"`
+	BusID  string    `json:"bus_id"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+	Time   time.Time `json:"time"`
+}
+
+// NodeHealth is what is known about the gpus of this host. Runs aren't
+// placed on or restarted onto gpus with faults until they're cleared.
+type NodeHealth struct {
+	Faults []GPUFault `json:"faults"`
+	// ClearedAt hides kernel messages from before the last clear, and
+	// ECCBaseline the ecc errors counted up to it, by bus id.
+	ClearedAt   time.Time      `json:"cleared_at"`
+	ECCBaseline map[string]int `json:"ecc_baseline"`
+}
+
+func (h *NodeHealth) add(fault GPUFault) bool {
+	for _, f := range h.Faults {
+		if f.BusID == fault.BusID && f.Kind == fault.Kind && f.Detail == fault.Detail {
+			return false
+		}
+	}
+
+	h.Faults = append(h.Faults, fault)
+	return true
+}
+
+// check fails if one of gpus has a fault. Faults of unknown gpus count
+// against every gpu.
+func (h NodeHealth) check(gpus []int) error {
+	for _, f := range h.Faults {
+		for _, gpu := range gpus {
+			if f.GPU == gpu || f.GPU < 0 {
+				return errors.Errorf("gpu %d of this host is unhealthy since %s: %s %s, run `invoker node clear` once it's fixed",
+					gpu, f.Time.Format(time.RFC3339), f.Kind, f.Detail)
+			}
+		}
+	}
+
+	return nil
+}
+
+// normalizeBusID reduces the bus ids of nvidia-smi and of kernel messages
+// to bus:device, which is what they have in common.
+func normalizeBusID(id string) string {
+	id, _, _ = strings.Cut(strings.ToLower(id), ".")
+	parts := strings.Split(id, ":")
+	if len(parts) < 2 {
+		return id
+	}
+
+	return strings.Join(parts[len(parts)-2:], ":")
+}
+
+type gpuStatus struct {
+	Index       int
+	BusID       string
+	ECCErrors   int
+	PagePending bool
+}
+
+// queryGPUs asks nvidia-smi for the ecc state of every gpu.
+func queryGPUs() ([]gpuStatus, error) {
+	records, err := nvidiaSMICSV("--query-gpu=index,pci.bus_id,ecc.errors.uncorrected.volatile.total,retired_pages.pending")
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := make([]gpuStatus, 0, len(records))
+	for _, r := range records {
+		if len(r) < 4 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(r[0]))
+		if err != nil {
+			continue
+		}
+
+		// counters read [N/A] on gpus without ecc
+		eccErrors, _ := strconv.Atoi(strings.TrimSpace(r[2]))
+		gpus = append(gpus, gpuStatus{
+			Index:       index,
+			BusID:       normalizeBusID(strings.TrimSpace(r[1])),
+			ECCErrors:   eccErrors,
+			PagePending: strings.EqualFold(strings.TrimSpace(r[3]), "yes"),
+		})
+	}
+
+	return gpus, nil
+}
+
+type xidEvent struct {
+	BusID string
+	XID   int
+	Time  time.Time
+}
+
+// fatalXIDEvents reads the hardware Xid errors from the kernel messages.
+func fatalXIDEvents(since time.Time) ([]xidEvent, error) {
+	out, err := gpuKernelMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]xidEvent, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		match := xidRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		xid, _ := strconv.Atoi(match[2])
+		if _, fatal := fatalXIDs[xid]; !fatal {
+			continue
+		}
+
+		stamp, _, _ := strings.Cut(line, " ")
+		at, err := time.Parse("2006-01-02T15:04:05,000000-07:00", stamp)
+		if err != nil || !at.After(since) {
+			continue
+		}
+
+		events = append(events, xidEvent{BusID: normalizeBusID(match[1]), XID: xid, Time: at})
+	}
+
+	return events, nil
+}
+
+func (m *InnerStateManager) healthFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "node_health.json")
+}
+
+func (m *InnerStateManager) NodeHealth() (NodeHealth, error) {
+	var health NodeHealth
+
+	data, err := files.ReadFile(m.healthFile())
+	if os.IsNotExist(err) {
+		return health, nil
+	} else if err != nil {
+		return health, errors.WithMessage(err, "failed to read node health")
+	}
+
+	if err := json.Unmarshal(data, &health); err != nil {
+		return health, errors.WithMessage(err, "failed to parse node health")
+	}
+
+	return health, nil
+}
+
+func (m *InnerStateManager) PutNodeHealth(health NodeHealth) error {
+	data, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode node health")
+	}
+
+	tmp := m.healthFile() + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write node health")
+	}
+
+	return errors.WithMessage(files.Rename(tmp, m.healthFile()), "failed to write node health")
+}
+
+// checkGPUHealth looks for new hardware faults of the gpus and records them.
+// Hosts without nvidia-smi have nothing to check.
+func checkGPUHealth(sm *InnerStateManager) (NodeHealth, error) {
+	unlock, err := sm.Lock()
+	if err != nil {
+		return NodeHealth{}, err
+	}
+	defer unlock()
+
+	health, err := sm.NodeHealth()
+	if err != nil {
+		return health, err
+	}
+
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return health, nil
+	}
+
+	gpus, err := queryGPUs()
+	if err != nil {
+		return health, err
+	}
+
+	indexOf := func(busID string) int {
+		for _, g := range gpus {
+			if g.BusID == busID {
+				return g.Index
+			}
+		}
+		return -1
+	}
+
+	now := clock.Now().UTC()
+	added := make([]GPUFault, 0)
+	for _, g := range gpus {
+		if errs := g.ECCErrors - health.ECCBaseline[g.BusID]; errs > 0 {
+			fault := GPUFault{GPU: g.Index, BusID: g.BusID, Kind: "ecc", Detail: fmt.Sprintf("%d uncorrected errors", errs), Time: now}
+			if health.add(fault) {
+				added = append(added, fault)
+			}
+		}
+		if g.PagePending {
+			fault := GPUFault{GPU: g.Index, BusID: g.BusID, Kind: "ecc", Detail: "page retirement pending", Time: now}
+			if health.add(fault) {
+				added = append(added, fault)
+			}
+		}
+	}
+
+	// without access to the kernel messages the ecc counters still count
+	events, err := fatalXIDEvents(health.ClearedAt)
+	if err != nil {
+		warnf("%v\n", err)
+	}
+	for _, e := range events {
+		fault := GPUFault{GPU: indexOf(e.BusID), BusID: e.BusID, Kind: "xid", Detail: fmt.Sprintf("%d %s", e.XID, fatalXIDs[e.XID]), Time: e.Time}
+		if health.add(fault) {
+			added = append(added, fault)
+		}
+	}
+
+	if len(added) == 0 {
+		return health, nil
+	}
+	for _, f := range added {
+		fmt.Printf("gpu %d (%s) is unhealthy: %s %s\n", f.GPU, f.BusID, f.Kind, f.Detail)
+	}
+
+	return health, sm.PutNodeHealth(health)
+}
+
+// NodeHealthShow checks the gpus of this host and prints their faults.
+func NodeHealthShow() {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	health, err := checkGPUHealth(sm)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if len(health.Faults) == 0 {
+		fmt.Println("no gpu faults")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GPU\tBUS\tKIND\tDETAIL\tSINCE")
+	for _, f := range health.Faults {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", f.GPU, f.BusID, f.Kind, f.Detail, f.Time.Format(time.RFC3339))
+	}
+	w.Flush()
+	os.Exit(ExitInfra)
+}
+
+// NodeClear forgets the faults of this host, once the hardware is fixed.
+// Kernel messages and ecc errors from before are not counted again.
+func NodeClear() {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	unlock, err := sm.Lock()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	defer unlock()
+
+	health := NodeHealth{ClearedAt: clock.Now().UTC(), ECCBaseline: map[string]int{}}
+	if _, err := exec.LookPath("nvidia-smi"); err == nil {
+		gpus, err := queryGPUs()
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		for _, g := range gpus {
+			health.ECCBaseline[g.BusID] = g.ECCErrors
+		}
+	}
+
+	if err := sm.PutNodeHealth(health); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	fmt.Println("cleared gpu faults of this host")
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	gpuPreflightAbort = "abort"
+	gpuPreflightWarn  = "warn"
+	gpuPreflightOff   = "off"
+
+	defaultGPUPreflightMaxUsed = "1g"
+)
+
+// GPUPreflightConfig checks the gpus of a run for memory taken by other
+// processes before it starts, which would make it fail with an out of
+// memory error once the model is loaded.
+type GPUPreflightConfig struct {
+	// MaxUsed is how much memory of a gpu may be in use already, 1g if
+	// empty. The driver and idle contexts take a few hundred megabytes.
+	MaxUsed string `yaml:"max_used"`
+	// Action is abort, warn or off, abort if empty.
+	Action string `yaml:"action"`
+}
+
+type gpuMemory struct {
+	Index       int    `json:"index"`
+	BusID       string `json:"bus_id"`
+	UsedMiB     int64  `json:"used_mib"`
+	TotalMiB    int64  `json:"total_mib"`
+	Utilization int    `json:"utilization"`
+}
+
+type gpuProcess struct {
+	BusID   string
+	PID     int
+	Name    string
+	UsedMiB int64
+}
+
+func nvidiaSMICSV(query string) ([][]string, error) {
+	out, err := exec.Command("nvidia-smi", query, "--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to query gpus")
+	}
+
+	records, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to parse nvidia-smi output")
+	}
+
+	return records, nil
+}
+
+// queryGPUMemory asks nvidia-smi for the memory use and utilization of
+// every gpu.
+func queryGPUMemory() ([]gpuMemory, error) {
+	records, err := nvidiaSMICSV("--query-gpu=index,pci.bus_id,memory.used,memory.total,utilization.gpu")
+	if err != nil {
+		return nil, err
+	}
+
+	gpus := make([]gpuMemory, 0, len(records))
+	for _, r := range records {
+		if len(r) < 5 {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(r[0]))
+		if err != nil {
+			continue
+		}
+		used, _ := strconv.ParseInt(strings.TrimSpace(r[2]), 10, 64)
+		total, _ := strconv.ParseInt(strings.TrimSpace(r[3]), 10, 64)
+		utilization, _ := strconv.Atoi(strings.TrimSpace(r[4]))
+		gpus = append(gpus, gpuMemory{
+			Index:       index,
+			BusID:       normalizeBusID(strings.TrimSpace(r[1])),
+			UsedMiB:     used,
+			TotalMiB:    total,
+			Utilization: utilization,
+		})
+	}
+
+	return gpus, nil
+}
+
+// queryGPUProcesses asks nvidia-smi which processes hold gpu memory.
+func queryGPUProcesses() ([]gpuProcess, error) {
+	records, err := nvidiaSMICSV("--query-compute-apps=gpu_bus_id,pid,process_name,used_memory")
+	if err != nil {
+		return nil, err
+	}
+
+	processes := make([]gpuProcess, 0, len(records))
+	for _, r := range records {
+		if len(r) < 4 {
+			continue
+		}
+		pid, _ := strconv.Atoi(strings.TrimSpace(r[1]))
+		used, _ := strconv.ParseInt(strings.TrimSpace(r[3]), 10, 64)
+		processes = append(processes, gpuProcess{BusID: normalizeBusID(strings.TrimSpace(r[0])), PID: pid, Name: strings.TrimSpace(r[2]), UsedMiB: used})
+	}
+
+	return processes, nil
+}
+
+// occupiedGPUs describes the gpus of indices with more than maxUsed bytes
+// of memory in use, with the processes holding it.
+func occupiedGPUs(gpus []gpuMemory, processes []gpuProcess, indices []int, maxUsed int64) []string {
+	wanted := make(map[int]bool, len(indices))
+	for _, i := range indices {
+		wanted[i] = true
+	}
+
+	occupied := make([]string, 0)
+	for _, g := range gpus {
+		if !wanted[g.Index] || g.UsedMiB*units.MiB <= maxUsed {
+			continue
+		}
+
+		holders := make([]string, 0)
+		for _, p := range processes {
+			if p.BusID == g.BusID {
+				holders = append(holders, fmt.Sprintf("%s (pid %d, %d MiB)", p.Name, p.PID, p.UsedMiB))
+			}
+		}
+		detail := fmt.Sprintf("gpu %d has %d of %d MiB in use", g.Index, g.UsedMiB, g.TotalMiB)
+		if len(holders) > 0 {
+			detail += " by " + strings.Join(holders, ", ")
+		}
+		occupied = append(occupied, detail)
+	}
+
+	return occupied
+}
+
+// checkGPUMemory runs the preflight on the gpus of a run. Hosts without
+// nvidia-smi have nothing to check.
+func checkGPUMemory(config GPUPreflightConfig, indices []int) error {
+	action := config.Action
+	if action == "" {
+		action = gpuPreflightAbort
+	}
+	switch action {
+	case gpuPreflightOff:
+		return nil
+	case gpuPreflightAbort, gpuPreflightWarn:
+	default:
+		return errors.Errorf("invalid gpu_preflight action %q in %s, expected abort, warn or off", action, projectConfigFile)
+	}
+
+	maxUsed := config.MaxUsed
+	if maxUsed == "" {
+		maxUsed = defaultGPUPreflightMaxUsed
+	}
+	maxUsedBytes, err := units.RAMInBytes(maxUsed)
+	if err != nil {
+		return errors.WithMessagef(err, "invalid gpu_preflight max_used %q in %s", maxUsed, projectConfigFile)
+	}
+
+	if len(indices) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		return nil
+	}
+
+	gpus, err := queryGPUMemory()
+	if err != nil {
+		return err
+	}
+	// only for telling who holds the memory
+	processes, _ := queryGPUProcesses()
+
+	occupied := occupiedGPUs(gpus, processes, indices, maxUsedBytes)
+	if len(occupied) == 0 {
+		return nil
+	}
+	if action == gpuPreflightWarn {
+		for _, o := range occupied {
+			warnf("%s\n", o)
+		}
+		return nil
+	}
+
+	return errors.Errorf("%s, the run would likely fail with an out of memory error (gpu_preflight in %s allows up to %s)",
+		strings.Join(occupied, "; "), projectConfigFile, maxUsed)
+}
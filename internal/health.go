@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	heartbeatFileName = "heartbeat"
+	heartbeatEnv      = "HIGGSFIELD_HEARTBEAT_FILE"
+
+	// the heartbeat file is optional, but once the training code starts
+	// touching it we expect it to be refreshed at least this often
+	heartbeatStaleAfter = 10 * time.Minute
+)
+
+// healthProbe succeeds while the launcher (torchrun, or python for runs
+// without it) for the given experiment and run is alive and, if the
+// heartbeat file exists, it was touched recently. The container shares the
+// host pid namespace, so we look for the exact experiment/run pair instead
+// of just any torchrun. "[t]orchrun" keeps the probe from matching its own
+// command line.
+const healthProbe = `found=
+for p in /proc/[0-9]*; do
+  if tr '\0' ' ' < "$p/cmdline" 2>/dev/null | grep -q -- "[%[5]s]%[6]s.*--experiment_name %[1]s --run_name %[2]s"; then
+    found=1
+    break
+  fi
+done
+[ -n "$found" ] || { echo "%[5]s%[6]s is not running"; exit 1; }
+if [ -f "%[3]s" ]; then
+  age=$(( $(date +%%s) - $(stat -c %%Y "%[3]s") ))
+  [ "$age" -lt %[4]d ] || { echo "heartbeat is ${age}s old"; exit 1; }
+fi
+exit 0`
+
+func healthConfig(launcher, experimentName, runName, heartbeatFile string) *container.HealthConfig {
+	return &container.HealthConfig{
+		Test: []string{
+			"CMD-SHELL",
+			fmt.Sprintf(healthProbe, experimentName, runName, heartbeatFile, int(heartbeatStaleAfter.Seconds()), launcher[:1], launcher[1:]),
+		},
+		Interval:    30 * time.Second,
+		Timeout:     10 * time.Second,
+		StartPeriod: 5 * time.Minute,
+		Retries:     3,
+	}
+}
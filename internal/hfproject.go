@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/namesgenerator"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	hfProjectYAML = "higgsfield.yaml"
+	defaultPort   = 1234
+)
+
+// hfConfigPaths are where a higgsfield project keeps its config.py, relative
+// to the project root.
+var hfConfigPaths = []string{"src/config.py", "config.py"}
+
+// HiggsfieldProject is what invoker knows about the higgsfield project it's
+// run from, read from higgsfield.yaml or config.py. Values left out are
+// zero.
+type HiggsfieldProject struct {
+	// File is where the config was read from.
+	File         string   `yaml:"-"`
+	Name         string   `yaml:"name"`
+	NProcPerNode int      `yaml:"nproc_per_node"`
+	Hosts        []string `yaml:"hosts"`
+	Port         int      `yaml:"port"`
+	// Experiments are the ones listed in the config and the ones declared
+	// with @experiment("name") in the project's python files.
+	Experiments []string `yaml:"experiments"`
+	// Params are the parameters by experiment, the declared ones are
+	// added to the ones listed in the config.
+	Params map[string][]ExperimentParam `yaml:"params"`
+	// Env are the names of host environment variables the experiments
+	// need, they are passed on to the container.
+	Env []string `yaml:"env"`
+}
+
+// LoadHiggsfieldProject reads the project config from higgsfield.yaml or,
+// without it, from config.py. It returns nil if the directory has neither.
+func LoadHiggsfieldProject(projectPath string) (*HiggsfieldProject, error) {
+	var project *HiggsfieldProject
+
+	path := filepath.Join(projectPath, hfProjectYAML)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		project = &HiggsfieldProject{File: path}
+		if err := yaml.Unmarshal(data, project); err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse %s", path)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	for _, rel := range hfConfigPaths {
+		if project != nil {
+			break
+		}
+		path = filepath.Join(projectPath, rel)
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read %s", path)
+		}
+		if project, err = parseConfigPy(data); err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse %s", path)
+		}
+		project.File = path
+	}
+	if project == nil {
+		return nil, nil
+	}
+
+	declared, err := discoverExperiments(projectPath)
+	if err != nil {
+		return nil, err
+	}
+	if project.Params == nil {
+		project.Params = make(map[string][]ExperimentParam)
+	}
+	for _, e := range declared {
+		project.Experiments = append(project.Experiments, e.Name)
+		project.Params[e.Name] = append(project.Params[e.Name], e.Params...)
+	}
+	project.Experiments = uniqueStrings(project.Experiments)
+
+	return project, nil
+}
+
+var pyAssignment = regexp.MustCompile(`^([A-Z][A-Z0-9_]*)\s*(?::\s*[\w\[\], ]+)?=\s*(.*)$`)
+
+// parseConfigPy reads the module level constants of a config.py without
+// running it. Only literals are understood, constants computed from
+// something else are skipped.
+func parseConfigPy(data []byte) (*HiggsfieldProject, error) {
+	project := &HiggsfieldProject{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		match := pyAssignment.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		name, value := match[1], stripPyComment(match[2])
+		// lists may span lines until their bracket closes
+		for strings.HasPrefix(value, "[") && strings.Count(value, "[") > strings.Count(value, "]") && scanner.Scan() {
+			value += " " + stripPyComment(scanner.Text())
+		}
+
+		var err error
+		switch name {
+		case "NAME", "PROJECT_NAME":
+			project.Name, err = pyString(value)
+		case "NPROC_PER_NODE", "NUM_PROCESSES", "NUM_PROCESSES_PER_NODE":
+			project.NProcPerNode, err = pyInt(value)
+		case "HOSTS":
+			project.Hosts, err = pyStrings(value)
+		case "PORT":
+			project.Port, err = pyInt(value)
+		case "EXPERIMENTS":
+			project.Experiments, err = pyStrings(value)
+		case "ENV", "REQUIRED_ENV":
+			project.Env, err = pyStrings(value)
+		default:
+			continue
+		}
+		if err != nil {
+			warnf("ignoring %s in config.py: %v\n", name, err)
+		}
+	}
+
+	return project, scanner.Err()
+}
+
+func stripPyComment(s string) string {
+	quote := rune(0)
+	for i, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return strings.TrimSpace(s[:i])
+		}
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func pyString(value string) (string, error) {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1], nil
+	}
+
+	return "", errors.Errorf("expected a string literal, got %s", value)
+}
+
+func pyInt(value string) (int, error) {
+	n, err := strconv.Atoi(strings.ReplaceAll(value, "_", ""))
+	if err != nil {
+		return 0, errors.Errorf("expected an integer literal, got %s", value)
+	}
+
+	return n, nil
+}
+
+func pyStrings(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") && !strings.HasPrefix(value, "(") {
+		return nil, errors.Errorf("expected a list of strings, got %s", value)
+	}
+
+	values := make([]string, 0)
+	for _, item := range strings.Split(strings.Trim(value, "[]() "), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s, err := pyString(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+
+	return values, nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+
+	return unique
+}
+
+func (p *HiggsfieldProject) experimentInfos() []ExperimentInfo {
+	infos := make([]ExperimentInfo, 0, len(p.Experiments))
+	for _, name := range p.Experiments {
+		params := p.Params[name]
+		if params == nil {
+			params = make([]ExperimentParam, 0)
+		}
+		infos = append(infos, ExperimentInfo{Name: name, Params: params})
+	}
+
+	return infos
+}
+
+func (p *HiggsfieldProject) hasExperiment(name string) bool {
+	for _, e := range p.Experiments {
+		if e == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// missingEnv are the required environment variables that aren't set.
+func (p *HiggsfieldProject) missingEnv() []string {
+	missing := make([]string, 0)
+	for _, name := range p.Env {
+		if _, ok := os.LookupEnv(name); !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// env passes the required environment variables on, as NAME=value.
+func (p *HiggsfieldProject) env() []string {
+	env := make([]string, 0, len(p.Env))
+	for _, name := range p.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+
+	return env
+}
+
+// applyHiggsfieldProject fills the run arguments left out from the project
+// config and checks the experiment exists and its environment is set, so a
+// run fails before the image is built. Without a config the arguments are
+// left as they are.
+func applyHiggsfieldProject(args *RunArgs) error {
+	projectPath := args.ProjectPath
+	if projectPath == "" {
+		var err error
+		if projectPath, err = os.Getwd(); err != nil {
+			return errors.WithMessage(err, "failed to get current working directory")
+		}
+	}
+
+	project, err := LoadHiggsfieldProject(projectPath)
+	if err != nil || project == nil {
+		return err
+	}
+
+	if args.ProjectName == "" {
+		args.ProjectName = project.Name
+	}
+	if len(args.Hosts) == 0 {
+		args.Hosts = project.Hosts
+		if len(args.Hosts) == 0 {
+			args.Hosts = []string{"localhost"}
+		}
+	}
+	if args.NProcPerNode == 0 {
+		args.NProcPerNode = project.NProcPerNode
+	}
+	if args.Port == 0 {
+		args.Port = project.Port
+	}
+
+	if args.ExperimentName == "" && len(project.Experiments) == 1 {
+		args.ExperimentName = project.Experiments[0]
+	} else if args.ExperimentName == "" {
+		picked, ok := pickExperiment(project.Experiments)
+		if !ok {
+			return errors.Errorf("no experiment given, %s has %s", project.File, experimentChoices(project.Experiments))
+		}
+		args.ExperimentName = picked
+	}
+	if len(project.Experiments) > 0 && !project.hasExperiment(args.ExperimentName) {
+		return errors.Errorf("there's no experiment %s in the project, it has %s", args.ExperimentName, experimentChoices(project.Experiments))
+	}
+	if err := checkExperimentArgs(project.Params[args.ExperimentName], args.Rest); err != nil {
+		return errors.WithMessagef(err, "invalid arguments for %s", args.ExperimentName)
+	}
+
+	if missing := project.missingEnv(); len(missing) > 0 {
+		return errors.Errorf("%s needs %s set in the environment", project.File, strings.Join(missing, ", "))
+	}
+
+	if args.RunName == "" {
+		args.RunName = namesgenerator.GetRandomName(0)
+		fmt.Printf("no run name given, running as %s\n", args.RunName)
+	}
+
+	return nil
+}
+
+func experimentChoices(experiments []string) string {
+	if len(experiments) == 0 {
+		return "no experiments"
+	}
+
+	return strings.Join(experiments, ", ")
+}
@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataTimeout is short, hosts outside a cloud don't answer on the
+	// link-local address at all.
+	metadataTimeout = time.Second
+	// cloudMetadataTTL is how long collected metadata is used before
+	// `experiment watch` collects it again.
+	cloudMetadataTTL = time.Hour
+)
+
+// CloudMetadata is what the metadata service of the cloud a host runs in
+// tells about it, and the gpus nvidia-smi finds.
+type CloudMetadata struct {
+	// Cloud is aws, gcp or azure, empty outside of them.
+	Cloud        string `json:"cloud,omitempty"`
+	InstanceType string `json:"instance_type,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	// Preemptible hosts are spot or preemptible instances the cloud may
+	// take back.
+	Preemptible bool      `json:"preemptible"`
+	GPUModel    string    `json:"gpu_model,omitempty"`
+	GPUCount    int       `json:"gpu_count"`
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+func metadataRequest(method, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	client := *httpClient
+	client.Timeout = metadataTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+
+	return strings.TrimSpace(string(data)), err
+}
+
+// awsMetadata asks the instance metadata service with an IMDSv2 token.
+func awsMetadata() (CloudMetadata, error) {
+	const base = "http://169.254.169.254/latest"
+	token, err := metadataRequest(http.MethodPut, base+"/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	get := func(key string) (string, error) {
+		return metadataRequest(http.MethodGet, base+"/meta-data/"+key, map[string]string{"X-aws-ec2-metadata-token": token})
+	}
+
+	metadata := CloudMetadata{Cloud: "aws"}
+	if metadata.InstanceType, err = get("instance-type"); err != nil {
+		return CloudMetadata{}, err
+	}
+	metadata.Zone, _ = get("placement/availability-zone")
+	lifecycle, _ := get("instance-life-cycle")
+	metadata.Preemptible = lifecycle == "spot"
+
+	return metadata, nil
+}
+
+func gcpMetadata() (CloudMetadata, error) {
+	get := func(key string) (string, error) {
+		return metadataRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/"+key, map[string]string{"Metadata-Flavor": "Google"})
+	}
+
+	machineType, err := get("machine-type")
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	// both are full resource names
+	metadata := CloudMetadata{Cloud: "gcp", InstanceType: path.Base(machineType)}
+	if zone, err := get("zone"); err == nil {
+		metadata.Zone = path.Base(zone)
+	}
+	preemptible, _ := get("scheduling/preemptible")
+	model, _ := get("scheduling/provisioning-model")
+	metadata.Preemptible = strings.EqualFold(preemptible, "true") || strings.EqualFold(model, "spot")
+
+	return metadata, nil
+}
+
+func azureMetadata() (CloudMetadata, error) {
+	data, err := metadataRequest(http.MethodGet, "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01", map[string]string{"Metadata": "true"})
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	var compute struct {
+		VMSize   string `json:"vmSize"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		Priority string `json:"priority"`
+	}
+	if err := json.Unmarshal([]byte(data), &compute); err != nil {
+		return CloudMetadata{}, errors.WithMessage(err, "failed to parse azure instance metadata")
+	}
+
+	metadata := CloudMetadata{Cloud: "azure", InstanceType: compute.VMSize, Zone: compute.Location}
+	if compute.Zone != "" {
+		metadata.Zone += "-" + compute.Zone
+	}
+	metadata.Preemptible = compute.Priority == "Spot" || compute.Priority == "Low"
+
+	return metadata, nil
+}
+
+// collectCloudMetadata asks the metadata services of every cloud at once,
+// the one the host runs in answers.
+func collectCloudMetadata() CloudMetadata {
+	services := []func() (CloudMetadata, error){awsMetadata, gcpMetadata, azureMetadata}
+	found := make([]*CloudMetadata, len(services))
+	var wg sync.WaitGroup
+	for i, service := range services {
+		wg.Add(1)
+		go func(i int, service func() (CloudMetadata, error)) {
+			defer wg.Done()
+			if metadata, err := service(); err == nil {
+				found[i] = &metadata
+			}
+		}(i, service)
+	}
+	wg.Wait()
+
+	var metadata CloudMetadata
+	for _, f := range found {
+		if f != nil {
+			metadata = *f
+			break
+		}
+	}
+	if names, err := hostGPUNames(); err == nil && len(names) > 0 {
+		metadata.GPUModel, metadata.GPUCount = names[0], len(names)
+	}
+	metadata.CollectedAt = clock.Now().UTC()
+
+	return metadata
+}
+
+func (m *InnerStateManager) cloudMetadataFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "cloud_metadata.json")
+}
+
+// CloudMetadata is the metadata collected last, nil if there is none.
+func (m *InnerStateManager) CloudMetadata() (*CloudMetadata, error) {
+	data, err := files.ReadFile(m.cloudMetadataFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to read cloud metadata")
+	}
+
+	var metadata CloudMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, errors.WithMessage(err, "failed to parse cloud metadata")
+	}
+
+	return &metadata, nil
+}
+
+func (m *InnerStateManager) PutCloudMetadata(metadata CloudMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode cloud metadata")
+	}
+
+	tmp := m.cloudMetadataFile() + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write cloud metadata")
+	}
+
+	return errors.WithMessage(files.Rename(tmp, m.cloudMetadataFile()), "failed to write cloud metadata")
+}
+
+// freshCloudMetadata is the collected metadata of this host, collected
+// again if it's older than maxAge.
+func (m *InnerStateManager) freshCloudMetadata(maxAge time.Duration) (CloudMetadata, error) {
+	cached, err := m.CloudMetadata()
+	if err != nil {
+		return CloudMetadata{}, err
+	}
+	if cached != nil && clock.Now().Sub(cached.CollectedAt) < maxAge {
+		return *cached, nil
+	}
+
+	metadata := collectCloudMetadata()
+	return metadata, m.PutCloudMetadata(metadata)
+}
+
+// hostInventory is the metadata of host.json, with what it leaves out
+// filled in from the cloud metadata.
+func hostInventory(maxAge time.Duration) (HostMetadata, error) {
+	metadata, err := LoadHostMetadata()
+	if err != nil {
+		return HostMetadata{}, err
+	}
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return metadata, errors.WithMessage(err, "failed to open state")
+	}
+	collected, err := sm.freshCloudMetadata(maxAge)
+	if err != nil {
+		return metadata, err
+	}
+
+	if metadata.Cloud == "" {
+		metadata.Cloud = collected.Cloud
+	}
+	if metadata.Zone == "" {
+		metadata.Zone = collected.Zone
+	}
+	if metadata.InstanceType == "" {
+		metadata.InstanceType = collected.InstanceType
+	}
+	if metadata.Preemptible == nil && collected.Cloud != "" {
+		metadata.Preemptible = &collected.Preemptible
+	}
+	metadata.GPUModel, metadata.GPUCount = collected.GPUModel, collected.GPUCount
+
+	return metadata, nil
+}
+
+// HostEntry is a host of `hosts list` and what it reported.
+type HostEntry struct {
+	Host     string       `json:"host"`
+	Metadata HostMetadata `json:"metadata"`
+	// Error is why the host couldn't report.
+	Error string `json:"error,omitempty"`
+}
+
+type HostsListArgs struct {
+	// Hosts are asked over ssh, only this host if empty.
+	Hosts []string
+	// Refresh collects the cloud metadata again instead of using the one
+	// collected within the last hour.
+	Refresh bool
+	// Local only reports this host as json, it's how the other hosts are
+	// asked.
+	Local bool
+	JSON  bool
+}
+
+// HostsList prints the inventory of the hosts: where they run, what they
+// are and their labels, what the constraints of runs are checked against.
+func HostsList(args HostsListArgs) {
+	maxAge := cloudMetadataTTL
+	if args.Refresh {
+		maxAge = 0
+	}
+
+	if args.Local {
+		metadata, err := hostInventory(maxAge)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	self, _ := os.Hostname()
+
+	entries := make([]HostEntry, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			entry := HostEntry{Host: host}
+			var err error
+			if host == self || isLoopback(host) {
+				entry.Metadata, err = hostInventory(maxAge)
+			} else {
+				list := []string{"hosts", "list", "--local"}
+				if args.Refresh {
+					list = append(list, "--refresh")
+				}
+				var out string
+				if out, err = outputOnHost(context.Background(), host, list...); err == nil {
+					err = json.Unmarshal([]byte(out), &entry.Metadata)
+				}
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			entries[i] = entry
+		}(i, host)
+	}
+	wg.Wait()
+
+	if args.JSON {
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCLOUD\tINSTANCE\tZONE\tPREEMPTIBLE\tGPUS\tLABELS")
+	for _, e := range entries {
+		if e.Error != "" {
+			failed = true
+			fmt.Fprintf(w, "%s\t?\t?\t?\t?\t?\t?\n", e.Host)
+			continue
+		}
+		m := e.Metadata
+		preemptible := "-"
+		if m.Preemptible != nil {
+			preemptible = fmt.Sprint(*m.Preemptible)
+		}
+		gpus := "-"
+		if m.GPUCount > 0 {
+			gpus = fmt.Sprintf("%dx %s", m.GPUCount, m.GPUModel)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Host, orDash(m.Cloud), orDash(m.InstanceType), orDash(m.Zone),
+			preemptible, gpus, orDash(strings.Join(m.Labels, ",")))
+	}
+	w.Flush()
+
+	for _, e := range entries {
+		if e.Error != "" {
+			warnf("%s couldn't report: %s\n", e.Host, e.Error)
+		}
+	}
+	if failed {
+		os.Exit(ExitInfra)
+	}
+}
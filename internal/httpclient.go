@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	httpAttempts = 3
+	httpBackoff  = 500 * time.Millisecond
+	// after breakerThreshold failed requests in a row an endpoint isn't
+	// asked again for breakerCooldown.
+	breakerThreshold = 3
+	breakerCooldown  = time.Minute
+)
+
+// httpClient is shared by everything invoker fetches over http. Unlike
+// http.DefaultClient it gives up on endpoints that don't connect or
+// answer, the whole request is bounded by the timeout passed to httpGet.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+// breakerAllows is false while the endpoint is cooling down after failing
+// repeatedly.
+func breakerAllows(host string) (bool, time.Time) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[host]
+	if !ok || clock.Now().After(b.openUntil) {
+		return true, time.Time{}
+	}
+
+	return false, b.openUntil
+}
+
+func breakerRecord(host string, failed bool) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[host]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers[host] = b
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = clock.Now().Add(breakerCooldown)
+	}
+}
+
+// httpGet fetches the url within timeout per attempt. Connection errors,
+// 429 and 5xx are retried with exponential backoff, other statuses fail
+// right away.
+func httpGet(rawURL string, timeout time.Duration) ([]byte, error) {
+	return httpGetWithHeader(rawURL, nil, timeout)
+}
+
+// httpGetWithHeader is httpGet sending header along, like a token.
+func httpGetWithHeader(rawURL string, header http.Header, timeout time.Duration) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid url %s", rawURL)
+	}
+
+	if ok, until := breakerAllows(u.Host); !ok {
+		return nil, errors.Errorf("%s failed %d times in a row, not asking again before %s", u.Host, breakerThreshold, until.Format(time.TimeOnly))
+	}
+
+	backoff := httpBackoff
+	for attempt := 1; ; attempt++ {
+		data, retry, err := httpGetOnce(rawURL, header, timeout)
+		if err == nil {
+			breakerRecord(u.Host, false)
+			return data, nil
+		}
+		if !retry {
+			return nil, err
+		}
+
+		breakerRecord(u.Host, true)
+		if ok, _ := breakerAllows(u.Host); !ok || attempt == httpAttempts {
+			return nil, errors.WithMessagef(err, "gave up after %d attempts", attempt)
+		}
+
+		clock.Sleep(backoff + time.Duration(random.Int63n(int64(backoff/2))))
+		backoff *= 2
+	}
+}
+
+func httpGetOnce(rawURL string, header http.Header, timeout time.Duration) ([]byte, bool, error) {
+	client := *httpClient
+	client.Timeout = timeout
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, errors.WithMessagef(err, "invalid url %s", rawURL)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, errors.WithMessagef(err, "failed to get %s", rawURL)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retry, errors.Errorf("failed to get %s: %s", rawURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, errors.WithMessagef(err, "failed to read %s", rawURL)
+	}
+
+	return data, false, nil
+}
+
+const (
+	publicIPURL = "https://api.ipify.org"
+	// publicIPTTL is how long a looked up public ip is used without asking
+	// again, so a burst of launches doesn't hit the endpoint for each one.
+	publicIPTTL = 10 * time.Minute
+)
+
+type cachedPublicIP struct {
+	IP        string    `json:"ip"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func publicIPFile() (string, error) {
+	return invokerCacheDir("public_ip.json")
+}
+
+func loadPublicIP() (cachedPublicIP, bool) {
+	var cached cachedPublicIP
+
+	file, err := publicIPFile()
+	if err != nil {
+		return cached, false
+	}
+	data, err := files.ReadFile(file)
+	if err != nil {
+		return cached, false
+	}
+	if err := json.Unmarshal(data, &cached); err != nil || net.ParseIP(cached.IP) == nil {
+		return cached, false
+	}
+
+	return cached, true
+}
+
+func storePublicIP(ip string) error {
+	file, err := publicIPFile()
+	if err != nil {
+		return err
+	}
+	if err := files.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return errors.WithMessage(err, "failed to create cache directory")
+	}
+
+	data, err := json.Marshal(cachedPublicIP{IP: ip, CheckedAt: clock.Now()})
+	if err != nil {
+		return err
+	}
+
+	return files.WriteFile(file, data, 0o644)
+}
+
+// myPublicIP asks ipify for the address of this host, at most every
+// publicIPTTL. When the lookup fails the last known address is used.
+func myPublicIP() (string, error) {
+	cached, ok := loadPublicIP()
+	if ok && clock.Now().Sub(cached.CheckedAt) < publicIPTTL {
+		return cached.IP, nil
+	}
+
+	body, err := httpGet(publicIPURL, 5*time.Second)
+	if err == nil {
+		ip := strings.TrimSpace(string(body))
+		if net.ParseIP(ip) == nil {
+			err = errors.Errorf("%s returned %q instead of an address", publicIPURL, truncate(ip, 64))
+		} else {
+			if err := storePublicIP(ip); err != nil {
+				warnf("failed to cache public ip: %v\n", err)
+			}
+			return ip, nil
+		}
+	}
+
+	if ok {
+		warnf("failed to get public ip, using %s from %s: %v\n", cached.IP, cached.CheckedAt.Format(time.DateTime), err)
+		return cached.IP, nil
+	}
+
+	return "", errors.WithMessage(err, "failed to get public IP")
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// HugePagesConfig hands huge pages of the host to the container, for
+// frameworks that pin large host buffers. It's configured under hugepages
+// in invoker.yaml.
+type HugePagesConfig struct {
+	// Pages is how many pages of Size the run needs free on the host.
+	Pages int `yaml:"pages"`
+	// Size of a page, 2M if empty. The host has to support it.
+	Size string `yaml:"size"`
+	// Allocate grows the host's pool if it has too few free pages, which
+	// needs root.
+	Allocate bool `yaml:"allocate"`
+	// Mount is where hugetlbfs appears in the container, /dev/hugepages if
+	// empty.
+	Mount string `yaml:"mount"`
+}
+
+func (c HugePagesConfig) enabled() bool {
+	return c.Pages > 0
+}
+
+func (c HugePagesConfig) pageBytes() (int64, error) {
+	size := c.Size
+	if size == "" {
+		size = "2M"
+	}
+
+	bytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "invalid huge page size %s", size)
+	}
+
+	return bytes, nil
+}
+
+func readSysInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// hugetlbfsMount is where a hugetlbfs with the page size is mounted on the
+// host, empty if there is none.
+func hugetlbfsMount(pageBytes int64) string {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] != "hugetlbfs" {
+			continue
+		}
+
+		// without a pagesize option the mount uses the default size, 2M on
+		// the machines we run on
+		pageSize := int64(2 << 20)
+		for _, option := range strings.Split(fields[3], ",") {
+			if value, ok := strings.CutPrefix(option, "pagesize="); ok {
+				pageSize, _ = units.RAMInBytes(value)
+			}
+		}
+		if pageSize == pageBytes {
+			return fields[1]
+		}
+	}
+
+	return ""
+}
+
+// prepareHugePages makes sure the host has the configured huge pages free,
+// allocating them if asked to, and returns the bind of its hugetlbfs.
+func prepareHugePages(config HugePagesConfig) ([]string, error) {
+	pageBytes, err := config.pageBytes()
+	if err != nil {
+		return nil, err
+	}
+	pageSize := units.BytesSize(float64(pageBytes))
+
+	dir := fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", pageBytes/1024)
+	total, err := readSysInt(filepath.Join(dir, "nr_hugepages"))
+	if err != nil {
+		return nil, errors.Errorf("this host doesn't support %s huge pages", pageSize)
+	}
+	free, err := readSysInt(filepath.Join(dir, "free_hugepages"))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read free %s huge pages", pageSize)
+	}
+
+	if free < config.Pages && config.Allocate {
+		want := total + config.Pages - free
+		fmt.Printf("allocating %d more %s huge pages\n", want-total, pageSize)
+		if err := os.WriteFile(filepath.Join(dir, "nr_hugepages"), []byte(strconv.Itoa(want)), 0o644); err != nil {
+			return nil, errors.WithMessagef(err, "failed to allocate %s huge pages, this needs root", pageSize)
+		}
+
+		// the kernel only allocates what it finds contiguous memory for
+		if free, err = readSysInt(filepath.Join(dir, "free_hugepages")); err != nil {
+			return nil, errors.WithMessagef(err, "failed to read free %s huge pages", pageSize)
+		}
+	}
+
+	if free < config.Pages {
+		return nil, errors.Errorf("this host has %d free %s huge pages but the run needs %d, raise vm.nr_hugepages or set hugepages.allocate",
+			free, pageSize, config.Pages)
+	}
+
+	mount := hugetlbfsMount(pageBytes)
+	if mount == "" {
+		return nil, errors.Errorf("no hugetlbfs with %s pages is mounted on this host", pageSize)
+	}
+
+	guestMount := config.Mount
+	if guestMount == "" {
+		guestMount = "/dev/hugepages"
+	}
+
+	fmt.Printf("%d of %d free %s huge pages available at %s\n", config.Pages, free, pageSize, guestMount)
+	return []string{mount + ":" + guestMount}, nil
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	autoKeyPrefix = "auto-"
+	// autoKeyWindow is how long a submission with a generated key counts
+	// as a retry of an earlier one. Submitting the same arguments later
+	// replaces the run, as it usually comes with changed code.
+	autoKeyWindow = 15 * time.Minute
+)
+
+// submissionKey hashes the arguments of a submission as they were given,
+// before any defaults or random names are filled in.
+func submissionKey(args RunArgs) (string, error) {
+	args.IdempotencyKey = ""
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to hash the submission")
+	}
+
+	sum := sha256.Sum256(data)
+	return autoKeyPrefix + hex.EncodeToString(sum[:8]), nil
+}
+
+// duplicateSubmission is a submission of a run that is already recorded
+// under the same idempotency key.
+type duplicateSubmission struct {
+	previous ExperimentState
+}
+
+func (e duplicateSubmission) Error() string {
+	return fmt.Sprintf("%s was already submitted with idempotency key %s at %s",
+		e.previous.ContainerName, e.previous.RunArgs.IdempotencyKey, e.previous.StartedAt.Local().Format(time.DateTime))
+}
+
+// checkSubmission fails with duplicateSubmission if previous is the same
+// submission as args. Given keys match for as long as the run is recorded.
+// Generated ones only match within autoKeyWindow and while the previous
+// run is still launching or has a live container among containers, so a
+// run that crashed can be submitted again right away, say with fixed code.
+func checkSubmission(previous *ExperimentState, args RunArgs, containers []ExperimentContainer) error {
+	key := args.IdempotencyKey
+	if previous == nil || key == "" || previous.RunArgs.IdempotencyKey != key {
+		return nil
+	}
+	if strings.HasPrefix(key, autoKeyPrefix) {
+		if clock.Now().Sub(previous.StartedAt) > autoKeyWindow {
+			return nil
+		}
+		if len(activeReservations([]ExperimentState{*previous}, containers, "")) == 0 {
+			return nil
+		}
+	}
+
+	return duplicateSubmission{previous: *previous}
+}
+
+// checkRecordedSubmission is checkSubmission against the run recorded on
+// this host, asking the daemon of the run about its container if the key
+// was generated.
+func checkRecordedSubmission(ctx context.Context, sm *InnerStateManager, args RunArgs) error {
+	previous, err := sm.Get(nameFromRunArgs(args))
+	if err != nil {
+		return err
+	}
+
+	var containers []ExperimentContainer
+	if previous != nil && strings.HasPrefix(args.IdempotencyKey, autoKeyPrefix) {
+		dr, err := dockerRunOf(ctx, previous.ContainerName)
+		if err != nil {
+			return err
+		}
+		if containers, err = dr.List(""); err != nil {
+			return err
+		}
+	}
+
+	return checkSubmission(previous, args, containers)
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSubmission(t *testing.T) {
+	running := []ExperimentContainer{{Name: "run", State: "running"}}
+	crashed := []ExperimentContainer{{Name: "run", State: "exited", ExitCode: 1}}
+
+	tests := []struct {
+		name string
+		key  string
+		// since is how long ago the previous submission started
+		since      time.Duration
+		containers []ExperimentContainer
+		submitted  string
+		duplicate  bool
+	}{
+		{"no key", "", time.Minute, running, "", false},
+		{"other key", "key-1", time.Minute, running, "key-2", false},
+		{"given key", "key-1", time.Minute, running, "key-1", true},
+		{"given key much later", "key-1", 24 * time.Hour, running, "key-1", true},
+		{"given key of a crashed run", "key-1", time.Minute, crashed, "key-1", true},
+		{"generated key", autoKeyPrefix + "1", time.Minute, running, autoKeyPrefix + "1", true},
+		{"generated key at the end of the window", autoKeyPrefix + "1", autoKeyWindow, running, autoKeyPrefix + "1", true},
+		{"generated key after the window", autoKeyPrefix + "1", autoKeyWindow + time.Second, running, autoKeyPrefix + "1", false},
+		{"generated key of a crashed run", autoKeyPrefix + "1", time.Minute, crashed, autoKeyPrefix + "1", false},
+		// no container and no launcher left
+		{"generated key of a failed launch", autoKeyPrefix + "1", time.Minute, nil, autoKeyPrefix + "1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer SetClock(c)()
+
+			previous := &ExperimentState{ContainerName: "run", StartedAt: c.Now(), RunArgs: RunArgs{IdempotencyKey: tt.key}}
+			c.Advance(tt.since)
+
+			err := checkSubmission(previous, RunArgs{IdempotencyKey: tt.submitted}, tt.containers)
+			if _, ok := err.(duplicateSubmission); ok != tt.duplicate || (err != nil && !ok) {
+				t.Errorf("checkSubmission = %v, want duplicate %v", err, tt.duplicate)
+			}
+		})
+	}
+
+	if err := checkSubmission(nil, RunArgs{IdempotencyKey: "key-1"}, nil); err != nil {
+		t.Errorf("checkSubmission without a previous run = %v", err)
+	}
+}
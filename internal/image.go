@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// ImagePolicy is checked against the image before a run starts, configured
+// under image_policy in invoker.yaml.
+type ImagePolicy struct {
+	// MaxSize is a size budget such as 25g, unlimited if empty.
+	MaxSize string `yaml:"max_size"`
+	// Scan runs trivy and fails on critical vulnerabilities.
+	Scan bool `yaml:"scan"`
+}
+
+func (p ImagePolicy) enabled() bool {
+	return p.MaxSize != "" || p.Scan
+}
+
+type imageLayer struct {
+	CreatedBy string
+	Size      int64
+}
+
+type ImageReport struct {
+	ID           string
+	Size         int64
+	Layers       []imageLayer
+	CUDAVersion  string
+	CuDNNVersion string
+	// Critical is the number of critical vulnerabilities, -1 if not scanned.
+	Critical int
+}
+
+// cuda and cudnn versions are exposed by the nvidia base images through
+// their environment and labels
+var (
+	cudaVersionKeys  = []string{"CUDA_VERSION", "com.nvidia.cuda.version"}
+	cudnnVersionKeys = []string{"NV_CUDNN_VERSION", "CUDNN_VERSION", "com.nvidia.cudnn.version"}
+)
+
+func lookupVersion(env []string, labels map[string]string, keys []string) string {
+	for _, key := range keys {
+		if v, ok := labels[key]; ok {
+			return v
+		}
+		for _, e := range env {
+			if v, ok := strings.CutPrefix(e, key+"="); ok {
+				return v
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+func (d *DockerRun) InspectImage(image string, scan bool) (ImageReport, error) {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return ImageReport{}, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to inspect image %s", image)
+	}
+
+	history, err := d.client.ImageHistory(ctx, inspect.ID)
+	if err != nil {
+		return ImageReport{}, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to get history of image %s", image)
+	}
+
+	report := ImageReport{ID: inspect.ID, Size: inspect.Size, Critical: -1}
+	if inspect.Config != nil {
+		report.CUDAVersion = lookupVersion(inspect.Config.Env, inspect.Config.Labels, cudaVersionKeys)
+		report.CuDNNVersion = lookupVersion(inspect.Config.Env, inspect.Config.Labels, cudnnVersionKeys)
+	}
+
+	for _, h := range history {
+		if h.Size == 0 {
+			continue
+		}
+		report.Layers = append(report.Layers, imageLayer{CreatedBy: h.CreatedBy, Size: h.Size})
+	}
+
+	if scan {
+		if report.Critical, err = trivyCritical(image); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// trivyCritical counts critical vulnerabilities of the image with trivy.
+func trivyCritical(image string) (int, error) {
+	if _, err := exec.LookPath("trivy"); err != nil {
+		return 0, errors.New("trivy is not installed, see https://trivy.dev")
+	}
+
+	out, err := exec.Command("trivy", "image", "--quiet", "--format", "json", "--severity", "CRITICAL", image).Output()
+	if err != nil {
+		return 0, errors.WithMessagef(err, "trivy failed to scan %s", image)
+	}
+
+	var result struct {
+		Results []struct {
+			Vulnerabilities []json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, errors.WithMessage(err, "failed to parse trivy output")
+	}
+
+	critical := 0
+	for _, r := range result.Results {
+		critical += len(r.Vulnerabilities)
+	}
+
+	return critical, nil
+}
+
+func (r ImageReport) check(policy ImagePolicy) error {
+	if policy.MaxSize != "" {
+		budget, err := units.RAMInBytes(policy.MaxSize)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid size budget %s", policy.MaxSize)
+		}
+		if r.Size > budget {
+			return errors.Errorf("image is %s, over the budget of %s", units.HumanSize(float64(r.Size)), policy.MaxSize)
+		}
+	}
+
+	if policy.Scan && r.Critical > 0 {
+		return errors.Errorf("image has %d critical vulnerabilities", r.Critical)
+	}
+
+	return nil
+}
+
+func (r ImageReport) print() {
+	fmt.Printf("image:  %s\n", r.ID)
+	fmt.Printf("size:   %s\n", units.HumanSize(float64(r.Size)))
+	fmt.Printf("cuda:   %s\n", r.CUDAVersion)
+	fmt.Printf("cudnn:  %s\n", r.CuDNNVersion)
+	if r.Critical >= 0 {
+		fmt.Printf("critical vulnerabilities: %d\n", r.Critical)
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tCREATED BY")
+	for _, l := range r.Layers {
+		fmt.Fprintf(w, "%s\t%s\n", units.HumanSize(float64(l.Size)), truncate(l.CreatedBy, 100))
+	}
+	w.Flush()
+}
+
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+
+	return s[:length] + "..."
+}
+
+// checkImage runs the image policy before a container is created from it.
+func (d *DockerRun) checkImage(image string, policy ImagePolicy) error {
+	fmt.Printf("checking image %s\n", image)
+	report, err := d.InspectImage(image, policy.Scan)
+	if err != nil {
+		return err
+	}
+
+	return errors.WithMessagef(report.check(policy), "image %s violates the image policy", image)
+}
+
+type ImageInspectArgs struct {
+	Image   string `validate:"required"`
+	MaxSize string
+	Scan    bool
+}
+
+func ImageInspect(args ImageInspectArgs) {
+	validateArgs(args)
+
+	dr, err := NewDockerRun(context.Background(), "", "", "", "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	report, err := dr.InspectImage(args.Image, args.Scan)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	report.print()
+
+	if err := report.check(ImagePolicy{MaxSize: args.MaxSize, Scan: args.Scan}); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
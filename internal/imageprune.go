@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const defaultKeepImages = 3
+
+// ImageRetention keeps the newest images built for each project, older
+// ones are removed after every build unless a container or the state of a
+// run still uses them, so restarts onto a recorded image keep working.
+type ImageRetention struct {
+	// Keep is how many images of a project are kept, 3 if 0.
+	Keep int `json:"keep"`
+	// AutoPrune removes the older images after every build, true if unset.
+	AutoPrune *bool `json:"auto_prune"`
+}
+
+func (r ImageRetention) keep() int {
+	if r.Keep <= 0 {
+		return defaultKeepImages
+	}
+
+	return r.Keep
+}
+
+// imageLabels mark the images invoker builds, see staleImages.
+func (d *DockerRun) imageLabels() map[string]string {
+	labels := map[string]string{labelProject: d.projectName}
+	if ns := strings.TrimSuffix(d.imageTag, "-"+imageTag); ns != d.imageTag {
+		labels[labelNamespace] = ns
+	}
+
+	return labels
+}
+
+// imagesInUse are the ids of the images of every container and of the
+// runs in the state of this host.
+func (d *DockerRun) imagesInUse() (map[string]bool, error) {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	containers, err := d.client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	err = d.timedOut(ctx, dockerOpInspect, err)
+	cancel()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list containers")
+	}
+
+	inUse := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		inUse[c.ImageID] = true
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open state")
+	}
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.ImageID != "" {
+			inUse[s.ImageID] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+// staleImages are the images invoker built in the namespace, of the
+// project or of every project if empty, beyond the newest keep of each
+// project that nothing uses anymore. Newest first.
+func (d *DockerRun) staleImages(namespace, projectName string, keep int) ([]types.ImageSummary, error) {
+	label := labelProject
+	if projectName != "" {
+		label += "=" + projectName
+	}
+
+	ctx, cancel := d.deadline(dockerOpInspect)
+	images, err := d.client.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("label", label))})
+	err = d.timedOut(ctx, dockerOpInspect, err)
+	cancel()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list images")
+	}
+
+	inUse, err := d.imagesInUse()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created > images[j].Created })
+
+	kept := make(map[string]int)
+	stale := make([]types.ImageSummary, 0)
+	for _, image := range images {
+		if image.Labels[labelNamespace] != namespace {
+			continue
+		}
+		project := image.Labels[labelProject]
+		if kept[project] < keep {
+			kept[project]++
+			continue
+		}
+		if !inUse[image.ID] {
+			stale = append(stale, image)
+		}
+	}
+
+	return stale, nil
+}
+
+// removeImages removes the images one by one, returning how much space
+// they took and the ones that failed. Layers shared with kept images
+// stay, so the space freed may be less.
+func (d *DockerRun) removeImages(images []types.ImageSummary) (int64, map[string]error) {
+	var size int64
+	failed := make(map[string]error)
+	for _, image := range images {
+		ctx, cancel := d.deadline(dockerOpRemove)
+		// without force, images tagged by someone else stay
+		_, err := d.client.ImageRemove(ctx, image.ID, types.ImageRemoveOptions{PruneChildren: true})
+		err = d.timedOut(ctx, dockerOpRemove, err)
+		cancel()
+		if err != nil {
+			failed[image.ID] = err
+			continue
+		}
+		size += image.Size
+	}
+
+	return size, failed
+}
+
+// pruneAfterBuild removes the stale images of the project just built,
+// failing only with a warning.
+func (d *DockerRun) pruneAfterBuild() {
+	if d.images.AutoPrune != nil && !*d.images.AutoPrune || d.projectName == "" {
+		return
+	}
+
+	stale, err := d.staleImages(d.imageLabels()[labelNamespace], d.projectName, d.images.keep())
+	if err != nil {
+		warnf("failed to prune old images of %s: %v\n", d.projectName, err)
+		return
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	size, failed := d.removeImages(stale)
+	for _, id := range sortedKeys(failed) {
+		warnf("failed to remove image %s: %v\n", truncate(id, 19), failed[id])
+	}
+	if removed := len(stale) - len(failed); removed > 0 {
+		infof("removed %d old images of %s, up to %s\n", removed, d.projectName, units.HumanSize(float64(size)))
+	}
+}
+
+type ImagePruneArgs struct {
+	ProjectName   string `validate:"omitempty,varname"`
+	Keep          int    `validate:"min=0"`
+	DockerContext string
+	DryRun        bool
+	Yes           bool
+}
+
+// ImagePrune removes the images invoker built on this host beyond the
+// newest of each project, keeping the ones containers or runs use.
+func ImagePrune(args ImagePruneArgs) {
+	validateArgs(args)
+
+	dr, err := NewDockerRun(context.Background(), args.DockerContext, args.ProjectName, "", "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	keep := args.Keep
+	if keep == 0 {
+		keep = dr.images.keep()
+	}
+	stale, err := dr.staleImages(namespace, args.ProjectName, keep)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if len(stale) == 0 {
+		fmt.Printf("no images beyond the newest %d of each project\n", keep)
+		return
+	}
+
+	var total int64
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tPROJECT\tCREATED\tSIZE")
+	for _, image := range stale {
+		total += image.Size
+		fmt.Fprintf(w, "%s\t%s\t%s ago\t%s\n", truncate(image.ID, 19), image.Labels[labelProject],
+			units.HumanDuration(clock.Now().Sub(time.Unix(image.Created, 0))), units.HumanSize(float64(image.Size)))
+	}
+	w.Flush()
+
+	// layers shared between the images are counted once for each
+	summary := fmt.Sprintf("%d images taking up to %s", len(stale), units.HumanSize(float64(total)))
+	if args.DryRun {
+		fmt.Printf("would remove %s\n", summary)
+		return
+	}
+	if !confirm("remove "+summary, args.Yes) {
+		os.Exit(ExitValidation)
+	}
+
+	size, failed := dr.removeImages(stale)
+	for _, id := range sortedKeys(failed) {
+		errorf("failed to remove image %s: %v\n", truncate(id, 19), failed[id])
+	}
+	successf("removed %d images, up to %s\n", len(stale)-len(failed), units.HumanSize(float64(size)))
+	if len(failed) > 0 {
+		os.Exit(ExitInfra)
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jobSlot is a run taking one of the job slots of the host, see
+// QuotaPolicy.MaxJobs. The slots of every user are kept in jobSlotsDir,
+// so a run of another user still building its image counts too, which its
+// state in the other home directory doesn't tell.
+type jobSlot struct {
+	ContainerName string    `json:"container_name"`
+	User          string    `json:"user"`
+	LauncherPID   int       `json:"launcher_pid"`
+	ClaimedAt     time.Time `json:"claimed_at"`
+}
+
+// jobSlotsDir is shared by the users of the host like /tmp, everyone
+// writes their own slots only. It's emptied by reboots, with the runs.
+func jobSlotsDir() string {
+	return filepath.Join(os.TempDir(), "invoker-jobs")
+}
+
+// launcherAlive is processAlive for the launchers of other users too,
+// which can't be signalled.
+func launcherAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func readJobSlots(dir string) ([]jobSlot, error) {
+	entries, err := files.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to list the job slots")
+	}
+
+	slots := make([]jobSlot, 0, len(entries))
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		// a slot being written or removed is someone else's business
+		data, err := files.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var slot jobSlot
+		if json.Unmarshal(data, &slot) == nil {
+			slots = append(slots, slot)
+		}
+	}
+
+	return slots, nil
+}
+
+// claimJobSlot takes a job slot of the host for the run, failing if the
+// host already runs limit jobs: the active runs of the state, the live
+// containers of invoker and the slots claimed before by runs still
+// launching. Runs launching at the same time both write their slot before
+// counting, so the later one backs off. The skipped runs are about to go
+// away.
+func claimJobSlot(state ExperimentState, limit int, active []ExperimentState, containers []ExperimentContainer, skip []string) error {
+	dir := jobSlotsDir()
+	if _, err := files.Stat(dir); os.IsNotExist(err) {
+		if err := files.MkdirAll(dir, 0o755); err != nil {
+			return errors.WithMessage(err, "failed to create the job slots directory")
+		}
+		if err := files.Chmod(dir, 0o777|fs.ModeSticky); err != nil {
+			return errors.WithMessage(err, "failed to share the job slots directory")
+		}
+	}
+
+	own := jobSlot{ContainerName: state.ContainerName, User: currentUser(), LauncherPID: os.Getpid(), ClaimedAt: clock.Now().UTC()}
+	data, err := json.Marshal(own)
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode the job slot")
+	}
+	file := filepath.Join(dir, state.ContainerName+".json")
+	tmp := file + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessage(err, "failed to claim a job slot")
+	}
+	if err := files.Rename(tmp, file); err != nil {
+		files.Remove(tmp)
+		return errors.WithMessage(err, "failed to claim a job slot")
+	}
+
+	jobs := make(map[string]bool)
+	for _, s := range active {
+		if s.Cloud == nil {
+			jobs[s.ContainerName] = true
+		}
+	}
+	live := make(map[string]bool)
+	for _, c := range containers {
+		switch c.State {
+		case "created", "running", "restarting", "paused":
+			jobs[c.Name], live[c.Name] = true, true
+		}
+	}
+
+	slots, err := readJobSlots(dir)
+	if err != nil {
+		files.Remove(file)
+		return err
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if !slots[i].ClaimedAt.Equal(slots[j].ClaimedAt) {
+			return slots[i].ClaimedAt.Before(slots[j].ClaimedAt)
+		}
+		return slots[i].ContainerName < slots[j].ContainerName
+	})
+	for _, slot := range slots {
+		if slot.ContainerName == own.ContainerName {
+			break
+		}
+		if launcherAlive(slot.LauncherPID) || live[slot.ContainerName] {
+			jobs[slot.ContainerName] = true
+		} else if slot.User == own.User {
+			files.Remove(filepath.Join(dir, slot.ContainerName+".json"))
+		}
+	}
+	for _, name := range append(skip, state.ContainerName) {
+		delete(jobs, name)
+	}
+
+	if len(jobs) >= limit {
+		files.Remove(file)
+		return errors.Errorf("the host already runs its limit of %d jobs: %s", limit, strings.Join(sortedKeys(jobs), ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClaimJobSlot(t *testing.T) {
+	// slots claimed a minute before or after the run, alive launchers are
+	// this test's own process
+	type slot struct {
+		name  string
+		user  string
+		alive bool
+		after bool
+	}
+
+	tests := []struct {
+		name    string
+		slots   []slot
+		limit   int
+		wantErr bool
+		// kept are the slots left, the run's own one included if it got
+		// one
+		kept []string
+	}{
+		{"free host", nil, 1, false, []string{"run"}},
+		{"earlier launch", []slot{{"other", "me", true, false}}, 1, true, []string{"other"}},
+		{"room for both", []slot{{"other", "me", true, false}}, 2, false, []string{"other", "run"}},
+		{"later launch backs off", []slot{{"other", "me", true, true}}, 1, false, []string{"other", "run"}},
+		{"own dead launcher", []slot{{"other", "me", false, false}}, 1, false, []string{"run"}},
+		{"dead launcher of another user", []slot{{"other", "them", false, false}}, 1, false, []string{"other", "run"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			defer SetClock(c)()
+			mem := NewMemFileSystem("/home/me")
+			defer SetFileSystem(mem)()
+
+			dir := jobSlotsDir()
+			if err := mem.MkdirAll(dir, 0o777); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.slots {
+				own := jobSlot{ContainerName: s.name, User: currentUser(), ClaimedAt: c.Now().Add(-time.Minute)}
+				if s.user != "me" {
+					own.User = "someone-" + own.User
+				}
+				if s.alive {
+					own.LauncherPID = os.Getpid()
+				}
+				if s.after {
+					own.ClaimedAt = c.Now().Add(time.Minute)
+				}
+				data, err := json.Marshal(own)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := mem.WriteFile(filepath.Join(dir, s.name+".json"), data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := claimJobSlot(ExperimentState{ContainerName: "run"}, tt.limit, nil, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("claimJobSlot = %v, want error %v", err, tt.wantErr)
+			}
+
+			slots, err := readJobSlots(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := make([]string, 0, len(slots))
+			for _, s := range slots {
+				kept = append(kept, s.ContainerName)
+			}
+			slices.Sort(kept)
+			if !slices.Equal(kept, tt.kept) {
+				t.Errorf("slots = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
@@ -10,6 +10,8 @@ type KillArgs struct {
 	Hosts          []string `validate:"required,min=1"`
 	ExperimentName string   `validate:"varname"`
 	ContainerName  *string
+	DockerContext  string
+	Yes            bool
 }
 
 func nameFromKillArgs(args KillArgs) string {
@@ -21,29 +23,73 @@ func nameFromKillArgs(args KillArgs) string {
 }
 
 func Kill(args KillArgs) {
-	if err := Validator().Struct(args); err != nil {
-		panic(err)
+	validateArgs(args)
+
+	hosts, err := orderHosts(args.Hosts, false)
+	if err == nil {
+		hosts, err = normalizeHosts(hosts)
+	}
+	if err != nil {
+		errorf("invalid hosts: %v\n", err)
+		os.Exit(ExitValidation)
 	}
+	args.Hosts = hosts
 
 	rankAndMasterElseExit(args.Hosts)
 
 	// get home directory
-	home, err := os.UserHomeDir()
+	cacheDir, err := cacheRoot()
 	if err != nil {
-		panic(err)
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
 	}
 
-	cachePath := home + "/.cache/" + args.ProjectName + "/" + "experiments/"
+	cachePath := cacheDir + "/" + args.ProjectName + "/" + "experiments/"
 
 	// get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
-		panic(err)
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), args.DockerContext, args.ProjectName, cwd, cachePath)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containerName := nameFromKillArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	state, err := sm.Get(containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if err := checkUnprotected(state); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
 	}
+	if !confirm("kill and remove "+containerName, args.Yes) {
+		os.Exit(ExitValidation)
+	}
+	finishedAt := dr.finishedAt(containerName)
 
-	dr := NewDockerRun(context.Background(), args.ProjectName, cwd, cachePath)
+	if err := dr.Kill(containerName); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
 
-	if err := dr.Kill(nameFromKillArgs(args)); err != nil {
-		panic(err)
+	if state != nil {
+		if err := sm.Retire(*state, finishedAt); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
 	}
 }
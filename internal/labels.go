@@ -0,0 +1,33 @@
+package internal
+
+const (
+	labelNamespace  = "higgsfield.namespace"
+	labelProject    = "higgsfield.project"
+	labelExperiment = "higgsfield.experiment"
+	labelRun        = "higgsfield.run"
+	labelUser       = "higgsfield.user"
+	labelIdentity   = "higgsfield.identity"
+)
+
+func experimentLabels(namespace, projectName, experimentName, runName, user, identity, sweep string, tags map[string]string) map[string]string {
+	labels := map[string]string{
+		labelProject:    projectName,
+		labelExperiment: experimentName,
+		labelRun:        runName,
+		labelUser:       user,
+	}
+	if namespace != "" {
+		labels[labelNamespace] = namespace
+	}
+	if identity != "" {
+		labels[labelIdentity] = identity
+	}
+	if sweep != "" {
+		labels[labelSweep] = sweep
+	}
+	for key, value := range tags {
+		labels[labelTagPrefix+key] = value
+	}
+
+	return labels
+}
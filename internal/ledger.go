@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reservation is what a single experiment claims on a host.
+type Reservation struct {
+	GPUs        []int `json:"gpus"`
+	Port        int   `json:"port"`
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+}
+
+const reservationRetryInterval = 30 * time.Second
+
+func hostMemoryBytes() (int64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, errors.WithMessage(err, "failed to open /proc/meminfo")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// MemTotal:       131900724 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, errors.WithMessage(err, "failed to parse MemTotal")
+			}
+			return kb * 1024, nil
+		}
+	}
+
+	return 0, errors.New("MemTotal not found in /proc/meminfo")
+}
+
+func processAlive(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// activeReservations filters out states whose containers are gone. A state
+// without a container still counts while the invoker that wrote it is
+// alive, since it may be building the image.
+func activeReservations(states []ExperimentState, containers []ExperimentContainer, except string) []ExperimentState {
+	alive := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		switch c.State {
+		case "created", "running", "restarting", "paused":
+			alive[c.Name] = true
+		default:
+			alive[c.Name] = false
+		}
+	}
+
+	active := make([]ExperimentState, 0, len(states))
+	for _, s := range states {
+		if s.ContainerName == except {
+			continue
+		}
+
+		isAlive, found := alive[s.ContainerName]
+		if isAlive || (!found && processAlive(s.LauncherPID)) {
+			active = append(active, s)
+		}
+	}
+
+	return active
+}
+
+func checkReservation(active []ExperimentState, r Reservation, hostGPUs []int, hostMemory int64) error {
+	for _, gpu := range r.GPUs {
+		if !slices.Contains(hostGPUs, gpu) {
+			return errors.Errorf("gpu %d does not exist on this host, available gpus: %v", gpu, hostGPUs)
+		}
+	}
+
+	var reservedMemory int64
+	for _, s := range active {
+		for _, gpu := range r.GPUs {
+			if slices.Contains(s.Reservation.GPUs, gpu) {
+				return errors.Errorf("gpu %d is already claimed by %s", gpu, s.ContainerName)
+			}
+		}
+
+		if r.Port != 0 && s.Reservation.Port == r.Port {
+			return errors.Errorf("port %d is already claimed by %s", r.Port, s.ContainerName)
+		}
+
+		reservedMemory += s.Reservation.MemoryBytes
+	}
+
+	if r.MemoryBytes > 0 && reservedMemory+r.MemoryBytes > hostMemory {
+		return errors.Errorf(
+			"not enough host memory: %d bytes requested, %d of %d bytes already claimed",
+			r.MemoryBytes, reservedMemory, hostMemory,
+		)
+	}
+
+	return nil
+}
+
+// Reserve records the state for a new experiment if its reservation fits
+// next to the ones already claimed on this host. With wait set it keeps
+// retrying until the resources free up instead of failing.
+func (d *DockerRun) Reserve(sm *InnerStateManager, state ExperimentState, wait bool) error {
+	// invoker in a memory limited cgroup only hands out its share
+	hostMemory, err := availableMemoryBytes()
+	if err != nil && state.Reservation.MemoryBytes > 0 {
+		return err
+	}
+
+	state.LauncherPID = os.Getpid()
+	defer sm.clearPending(state.ContainerName)
+
+	for {
+		var duplicate duplicateSubmission
+		err := d.tryReserve(sm, state, hostMemory)
+		if err == nil || !wait || errors.As(err, &duplicate) {
+			return err
+		}
+
+		fmt.Printf("waiting for resources: %v\n", err)
+		// the autoscaler may add nodes for runs that keep waiting
+		if err := sm.markPending(state, err.Error()); err != nil {
+			warnf("%v\n", err)
+		}
+		select {
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		case <-clock.After(reservationRetryInterval):
+		}
+	}
+}
+
+func (d *DockerRun) tryReserve(sm *InnerStateManager, state ExperimentState, hostMemory int64) error {
+	unlock, err := sm.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	states, err := sm.List()
+	if err != nil {
+		return err
+	}
+
+	containers, err := d.List("")
+	if err != nil {
+		return err
+	}
+
+	if state.Attempts == 0 {
+		previous, err := sm.Get(state.ContainerName)
+		if err != nil {
+			return err
+		}
+		if err := checkSubmission(previous, state.RunArgs, containers); err != nil {
+			return err
+		}
+	}
+
+	policy, err := LoadQuotaPolicy()
+	if err != nil {
+		return err
+	}
+
+	active := activeReservations(states, containers, state.ContainerName)
+	if err := policy.check(active, state); err != nil {
+		return err
+	}
+
+	health, err := sm.NodeHealth()
+	if err != nil {
+		return err
+	}
+	if err := health.check(state.Reservation.GPUs); err != nil {
+		return err
+	}
+
+	hostGPUs := nvidiaGPUIndices()
+	var victims []ExperimentState
+	if err := checkReservation(active, state.Reservation, hostGPUs, hostMemory); err != nil {
+		victims = policy.victims(active, state)
+		if len(victims) == 0 {
+			return err
+		}
+
+		// only preempt if that actually makes room for the new run
+		if err := checkReservation(withoutStates(active, victims), state.Reservation, hostGPUs, hostMemory); err != nil {
+			return err
+		}
+	}
+
+	if limit := policy.jobLimit(len(hostGPUs)); limit > 0 {
+		// the preempted runs free their job slots
+		skip := make([]string, 0, len(victims))
+		for _, v := range victims {
+			skip = append(skip, v.ContainerName)
+		}
+		if err := claimJobSlot(state, limit, active, containers, skip); err != nil {
+			return err
+		}
+	}
+
+	if len(victims) > 0 {
+		if err := d.preempt(sm, victims, state.ContainerName); err != nil {
+			return err
+		}
+	}
+
+	// the previous run under the same name is about to be replaced
+	previous, err := sm.Get(state.ContainerName)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		if err := sm.Retire(*previous, d.finishedAt(previous.ContainerName)); err != nil {
+			return err
+		}
+	}
+
+	return sm.Put(state)
+}
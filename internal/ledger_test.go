@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestActiveReservations(t *testing.T) {
+	launching := gpuRun("launching", "")
+	launching.LauncherPID = os.Getpid()
+	states := []ExperimentState{gpuRun("running", ""), gpuRun("exited", ""), gpuRun("gone", ""), launching, gpuRun("self", "")}
+	containers := []ExperimentContainer{{Name: "running", State: "running"}, {Name: "exited", State: "exited"}, {Name: "self", State: "running"}}
+
+	names := make([]string, 0)
+	for _, s := range activeReservations(states, containers, "self") {
+		names = append(names, s.ContainerName)
+	}
+	if want := []string{"running", "launching"}; !slices.Equal(names, want) {
+		t.Errorf("active = %v, want %v", names, want)
+	}
+}
+
+func TestCheckReservation(t *testing.T) {
+	active := []ExperimentState{
+		{ContainerName: "a", Reservation: Reservation{GPUs: []int{0, 1}, Port: 29500, MemoryBytes: 6 << 30}},
+	}
+	hostGPUs := []int{0, 1, 2, 3}
+
+	tests := []struct {
+		name    string
+		r       Reservation
+		wantErr bool
+	}{
+		{"free gpus", Reservation{GPUs: []int{2, 3}, Port: 29501}, false},
+		{"missing gpu", Reservation{GPUs: []int{4}}, true},
+		{"claimed gpu", Reservation{GPUs: []int{1, 2}}, true},
+		{"claimed port", Reservation{GPUs: []int{2}, Port: 29500}, true},
+		{"memory left", Reservation{GPUs: []int{2}, MemoryBytes: 2 << 30}, false},
+		{"memory exhausted", Reservation{GPUs: []int{2}, MemoryBytes: 3 << 30}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkReservation(active, tt.r, hostGPUs, 8<<30); (err != nil) != tt.wantErr {
+				t.Errorf("checkReservation = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
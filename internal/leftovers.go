@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// launchRollback collects how to undo the steps a launch has taken, so a
+// launch failing halfway leaves nothing behind that claims resources.
+type launchRollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	what string
+	undo func() error
+}
+
+func (r *launchRollback) add(what string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{what: what, undo: undo})
+}
+
+// run undoes the steps, the last one first.
+func (r *launchRollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		fmt.Printf("rolling back: %s\n", step.what)
+		if err := step.undo(); err != nil {
+			warnf("failed to roll back %s: %v\n", step.what, err)
+		}
+	}
+	r.steps = nil
+}
+
+// leftover is what a launch that crashed before it could roll back left on
+// this host.
+type leftover struct {
+	ContainerName string
+	Reason        string
+	// State is nil for containers without a state.
+	State *ExperimentState
+	// Container is set if a container was created but never started.
+	Container bool
+}
+
+// findLeftovers looks for states of launches whose invoker is gone before
+// their container started, and for invoker containers that were created but
+// never started. States of remote daemons are skipped, their containers
+// aren't in the list.
+func findLeftovers(states []ExperimentState, containers []ExperimentContainer) []leftover {
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	leftovers := make([]leftover, 0)
+	known := make(map[string]bool, len(states))
+	for i := range states {
+		s := &states[i]
+		known[s.ContainerName] = true
+		if s.RunArgs.DockerContext != "" || processAlive(s.LauncherPID) {
+			continue
+		}
+
+		c, found := byName[s.ContainerName]
+		switch {
+		case !found && s.ImageID == "":
+			leftovers = append(leftovers, leftover{ContainerName: s.ContainerName, Reason: "launch ended before the container was created", State: s})
+		case found && c.State == "created":
+			leftovers = append(leftovers, leftover{ContainerName: s.ContainerName, Reason: "container was created but never started", State: s, Container: true})
+		}
+	}
+
+	for _, c := range containers {
+		if !known[c.Name] && c.State == "created" {
+			leftovers = append(leftovers, leftover{ContainerName: c.Name, Reason: "container without state was created but never started", Container: true})
+		}
+	}
+
+	return leftovers
+}
+
+// warnLeftovers points at leftovers of crashed launches, without touching
+// them.
+func warnLeftovers(dr *DockerRun, sm *InnerStateManager) {
+	states, err := sm.List()
+	if err != nil {
+		return
+	}
+	containers, err := dr.List("")
+	if err != nil {
+		return
+	}
+
+	leftovers := findLeftovers(states, containers)
+	for _, l := range leftovers {
+		fmt.Printf("leftover of a crashed launch: %s, %s\n", l.ContainerName, l.Reason)
+	}
+	if len(leftovers) > 0 {
+		fmt.Printf("remove them with `invoker cleanup`\n")
+	}
+}
+
+func cleanLeftover(dr *DockerRun, sm *InnerStateManager, l leftover) error {
+	if l.Container {
+		if err := dr.Kill(l.ContainerName); err != nil {
+			return err
+		}
+	}
+	if l.State == nil {
+		return nil
+	}
+
+	if _, err := removeScratch(l.State.ScratchDir); err != nil {
+		return err
+	}
+
+	return sm.Delete(l.ContainerName)
+}
+
+type CleanupArgs struct {
+	DockerContext string
+	Yes           bool
+}
+
+// Cleanup removes what crashed launches left behind on this host: states
+// that still claim resources and containers that never started.
+func Cleanup(args CleanupArgs) {
+	validateArgs(args)
+
+	dr, err := NewDockerRun(context.Background(), args.DockerContext, "", "", "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	unlock, err := sm.Lock()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	defer unlock()
+
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	containers, err := dr.List("")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	leftovers := findLeftovers(states, containers)
+	if len(leftovers) == 0 {
+		fmt.Println("no leftovers of crashed launches")
+		return
+	}
+	for _, l := range leftovers {
+		fmt.Printf("%s: %s\n", l.ContainerName, l.Reason)
+	}
+	if !confirm(fmt.Sprintf("remove %d leftovers", len(leftovers)), args.Yes) {
+		os.Exit(ExitValidation)
+	}
+
+	failed := false
+	for _, l := range leftovers {
+		if err := cleanLeftover(dr, sm, l); err != nil {
+			warnf("failed to clean up %s: %v\n", l.ContainerName, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(ExitInfra)
+	}
+}
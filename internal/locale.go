@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const timezoneHost = "host"
+
+// hostTimezone returns the zone name of the host, e.g. Europe/Berlin, or
+// an empty string if it can't be figured out.
+func hostTimezone() string {
+	if tz := os.Getenv("TZ"); tz != "" {
+		return strings.TrimPrefix(tz, ":")
+	}
+
+	if data, err := os.ReadFile("/etc/timezone"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+
+	// /etc/localtime -> /usr/share/zoneinfo/Europe/Berlin
+	if target, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+		if _, zone, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return zone
+		}
+	}
+
+	return ""
+}
+
+// timeAndLocale makes the container's clock match the host, so timestamps
+// in the logs of all ranks line up with the host's logs. The locale is only
+// set when configured, the host's may not exist in the image.
+func timeAndLocale(timezone, locale string) (env []string, binds []string) {
+	if timezone == timezoneHost {
+		timezone = hostTimezone()
+		if _, err := os.Stat("/etc/localtime"); err == nil {
+			binds = append(binds, "/etc/localtime:/etc/localtime:ro")
+		}
+	}
+	if timezone != "" {
+		env = append(env, "TZ="+timezone)
+	}
+
+	if locale != "" {
+		env = append(env, "LANG="+locale, "LC_ALL="+locale)
+	}
+
+	return env, binds
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// logTimeFormat is how lines are stamped, in UTC so the nodes of a run line
+// up whatever their time zone.
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// logLine is a line of output of a node of a run.
+type logLine struct {
+	At time.Time
+	// Source is host/rank of the node.
+	Source string
+	Text   string
+	Stderr bool
+}
+
+// logPrinter prints the lines of one or more nodes, stamped and prefixed
+// with their node if asked. With a window, lines are held back that long
+// and printed ordered by time, so the output of several hosts interleaves
+// as it happened rather than as it arrived.
+type logPrinter struct {
+	Timestamps bool
+	Prefix     bool
+	Window     time.Duration
+
+	mu      sync.Mutex
+	pending []logLine
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (p *logPrinter) start() {
+	p.stop, p.done = make(chan struct{}), make(chan struct{})
+	if p.Window <= 0 {
+		close(p.done)
+		return
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(max(p.Window/4, 100*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				p.flush(time.Time{})
+				return
+			case <-ticker.C:
+				p.flush(clock.Now().Add(-p.Window))
+			}
+		}
+	}()
+}
+
+// close prints the lines still held back.
+func (p *logPrinter) close() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *logPrinter) add(l logLine) {
+	if p.Window <= 0 {
+		p.print(l)
+		return
+	}
+
+	p.mu.Lock()
+	p.pending = append(p.pending, l)
+	p.mu.Unlock()
+}
+
+// flush prints the pending lines up to before, all of them if it's zero.
+func (p *logPrinter) flush(before time.Time) {
+	p.mu.Lock()
+	sort.SliceStable(p.pending, func(i, j int) bool { return p.pending[i].At.Before(p.pending[j].At) })
+	n := len(p.pending)
+	if !before.IsZero() {
+		n = sort.Search(len(p.pending), func(i int) bool { return p.pending[i].At.After(before) })
+	}
+	ready := p.pending[:n:n]
+	p.pending = p.pending[n:]
+	p.mu.Unlock()
+
+	for _, l := range ready {
+		p.print(l)
+	}
+}
+
+func (p *logPrinter) print(l logLine) {
+	var b strings.Builder
+	if p.Timestamps {
+		b.WriteString(l.At.UTC().Format(logTimeFormat))
+		b.WriteByte(' ')
+	}
+	if p.Prefix && l.Source != "" {
+		b.WriteString("[" + l.Source + "] ")
+	}
+	b.WriteString(l.Text)
+	b.WriteByte('\n')
+
+	out := os.Stdout
+	if l.Stderr {
+		out = os.Stderr
+	}
+	outputMu.Lock()
+	out.WriteString(b.String())
+	outputMu.Unlock()
+}
+
+// streamLogs hands the lines of the container's output with their time to
+// emit, with secrets masked, until it exits or ctx ends.
+func (d *DockerRun) streamLogs(ctx context.Context, containerName, source string, emit func(logLine)) error {
+	logs, err := d.client.ContainerLogs(ctx, containerName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Tail:       "100",
+		Timestamps: true,
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read logs of %s", containerName)
+	}
+	defer logs.Close()
+
+	var wg sync.WaitGroup
+	scan := func(r io.Reader, stderr bool) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			// docker stamps every line as 2006-01-02T15:04:05.999999999Z
+			stamp, text, _ := strings.Cut(scanner.Text(), " ")
+			at, err := time.Parse(time.RFC3339Nano, stamp)
+			if err != nil {
+				at, text = clock.Now(), scanner.Text()
+			}
+			emit(logLine{At: at, Source: source, Text: redactText(text), Stderr: stderr})
+		}
+		// drain the rest of a line too long to scan
+		io.Copy(io.Discard, r)
+	}
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+	wg.Add(2)
+	go scan(stdoutR, false)
+	go scan(stderrR, true)
+
+	_, err = stdcopy.StdCopy(stdoutW, stderrW, logs)
+	stdoutW.Close()
+	stderrW.Close()
+	wg.Wait()
+
+	return err
+}
+
+// formatStreamLine is how `attach --stream` passes a line to the host
+// fanning in the output of the run: the time, 1 or 2 for stdout or stderr,
+// and the text, separated by tabs.
+func formatStreamLine(l logLine) string {
+	stream := "1"
+	if l.Stderr {
+		stream = "2"
+	}
+
+	return l.At.UTC().Format(time.RFC3339Nano) + "\t" + stream + "\t" + l.Text
+}
+
+func parseStreamLine(line, source string) logLine {
+	fields := strings.SplitN(line, "\t", 3)
+	if len(fields) == 3 {
+		if at, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+			return logLine{At: at, Source: source, Text: fields[2], Stderr: fields[1] == "2"}
+		}
+	}
+
+	// what invoker itself reports on the other host
+	return logLine{At: clock.Now(), Source: source, Text: line, Stderr: true}
+}
+
+// logSource is host/rank of a node of the run.
+func logSource(state *ExperimentState, rank int) string {
+	host := "localhost"
+	if state != nil && rank < len(state.RunArgs.Hosts) {
+		host = state.RunArgs.Hosts[rank]
+	} else if name, err := os.Hostname(); err == nil {
+		host = name
+	}
+
+	return host + "/" + strconv.Itoa(rank)
+}
+
+// fanInLogs streams the output of the run on the other hosts of the run
+// into the printer until their containers exit or ctx ends.
+func fanInLogs(ctx context.Context, state ExperimentState, p *logPrinter) map[string]error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make(map[string]error)
+
+	for rank, host := range state.RunArgs.Hosts {
+		if rank == state.Rank || isLoopback(host) {
+			continue
+		}
+		wg.Add(1)
+		go func(rank int, host string) {
+			defer wg.Done()
+			source := logSource(&state, rank)
+			r, w := io.Pipe()
+			go func() {
+				scanner := bufio.NewScanner(r)
+				scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+				for scanner.Scan() {
+					p.add(parseStreamLine(scanner.Text(), source))
+				}
+				io.Copy(io.Discard, r)
+			}()
+
+			attach := append([]string{"experiment", "attach", "--project_name", state.ProjectName, "--container_name", state.ContainerName, "--stream"}, namespaceFlags()...)
+			err := streamFromHost(ctx, host, w, attach...)
+			w.Close()
+			if err != nil && ctx.Err() == nil {
+				mu.Lock()
+				failed[fmt.Sprintf("%s (rank %d)", host, rank)] = err
+				mu.Unlock()
+			}
+		}(rank, host)
+	}
+	wg.Wait()
+
+	return failed
+}
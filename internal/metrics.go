@@ -0,0 +1,551 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+const (
+	metricsFormatRegex = "regex"
+	metricsFormatJSONL = "jsonl"
+)
+
+// MetricsConfig tells how training metrics are parsed from the container's
+// output. With the regex format every expression has to capture the value
+// in its first group, with jsonl the lines are json objects with the keys
+// step, loss and tokens_per_sec.
+type MetricsConfig struct {
+	Format     string `yaml:"format" json:"format"`
+	Step       string `yaml:"step" json:"step"`
+	Loss       string `yaml:"loss" json:"loss"`
+	Throughput string `yaml:"throughput" json:"throughput"`
+}
+
+func defaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Format:     metricsFormatRegex,
+		Step:       `(?i)\bstep\b\s*[:=]?\s*(\d+)`,
+		Loss:       `(?i)\bloss\b\s*[:=]?\s*([-+]?(?:nan|inf|[0-9]*\.?[0-9]+(?:e[-+]?[0-9]+)?))`,
+		Throughput: `(?i)\btokens?(?:/s|/sec|_per_sec|\s+per\s+sec)\b\s*[:=]?\s*([0-9]*\.?[0-9]+(?:e[-+]?[0-9]+)?)`,
+	}
+}
+
+// metricValue is a float that survives json, where NaN and Inf are spelled
+// as strings.
+type metricValue float64
+
+func (v metricValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+
+	return json.Marshal(f)
+}
+
+func (v *metricValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = metricValue(f)
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*v = metricValue(f)
+
+	return nil
+}
+
+// MetricPoint is one parsed line of output. Time is the docker log time of
+// the line.
+type MetricPoint struct {
+	Time         time.Time    `json:"time"`
+	Step         int64        `json:"step"`
+	Loss         *metricValue `json:"loss,omitempty"`
+	TokensPerSec *metricValue `json:"tokens_per_sec,omitempty"`
+}
+
+type metricsParser struct {
+	format     string
+	step       *regexp.Regexp
+	loss       *regexp.Regexp
+	throughput *regexp.Regexp
+}
+
+func newMetricsParser(config MetricsConfig) (*metricsParser, error) {
+	defaults := defaultMetricsConfig()
+	if config.Format == "" {
+		config.Format = defaults.Format
+	}
+	if config.Format != metricsFormatRegex && config.Format != metricsFormatJSONL {
+		return nil, errors.Errorf("unknown metrics format %s, expected regex or jsonl", config.Format)
+	}
+
+	p := &metricsParser{format: config.Format}
+	for _, e := range []struct {
+		expr, fallback string
+		re             **regexp.Regexp
+	}{
+		{config.Step, defaults.Step, &p.step},
+		{config.Loss, defaults.Loss, &p.loss},
+		{config.Throughput, defaults.Throughput, &p.throughput},
+	} {
+		if e.expr == "" {
+			e.expr = e.fallback
+		}
+
+		re, err := regexp.Compile(e.expr)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid metrics expression %s", e.expr)
+		}
+		*e.re = re
+	}
+
+	return p, nil
+}
+
+func matchFloat(re *regexp.Regexp, line string) *metricValue {
+	m := re.FindStringSubmatch(line)
+	if len(m) < 2 {
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return nil
+	}
+
+	return PtrTo(metricValue(f))
+}
+
+// parse returns false for lines without a loss or a throughput.
+func (p *metricsParser) parse(line string) (MetricPoint, bool) {
+	var point MetricPoint
+
+	if p.format == metricsFormatJSONL {
+		var entry struct {
+			Step         int64        `json:"step"`
+			Loss         *metricValue `json:"loss"`
+			TokensPerSec *metricValue `json:"tokens_per_sec"`
+		}
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &entry) != nil {
+			return point, false
+		}
+		point.Step, point.Loss, point.TokensPerSec = entry.Step, entry.Loss, entry.TokensPerSec
+	} else {
+		point.Loss = matchFloat(p.loss, line)
+		point.TokensPerSec = matchFloat(p.throughput, line)
+		if m := p.step.FindStringSubmatch(line); len(m) > 1 {
+			point.Step, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+	}
+
+	return point, point.Loss != nil || point.TokensPerSec != nil
+}
+
+// MetricsStore keeps the parsed time series of every run as json lines in
+// ~/.cache/higgsfield/metrics, next to a cursor of how far the container
+// output has been read.
+type MetricsStore struct {
+	dir string
+}
+
+func NewMetricsStore() (*MetricsStore, error) {
+	path, err := invokerCacheDir("metrics")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := Path{path: path}
+	if err := dir.mkdirIfNotExists(); err != nil {
+		return nil, errors.WithMessage(err, "failed to create metrics directory")
+	}
+
+	return &MetricsStore{dir: dir.path}, nil
+}
+
+func (s *MetricsStore) file(containerName string) string {
+	return filepath.Join(s.dir, containerName+".jsonl")
+}
+
+func (s *MetricsStore) cursorFile(containerName string) string {
+	return filepath.Join(s.dir, containerName+".cursor")
+}
+
+func (s *MetricsStore) cursor(containerName string) time.Time {
+	data, err := files.ReadFile(s.cursorFile(containerName))
+	if err != nil {
+		return time.Time{}
+	}
+
+	t, _ := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	return t
+}
+
+func (s *MetricsStore) append(containerName string, points []MetricPoint, cursor time.Time) error {
+	if len(points) > 0 {
+		var buf bytes.Buffer
+		for _, p := range points {
+			data, err := json.Marshal(p)
+			if err != nil {
+				return errors.WithMessagef(err, "failed to encode metrics of %s", containerName)
+			}
+			buf.Write(append(data, '\n'))
+		}
+		if err := files.AppendFile(s.file(containerName), buf.Bytes(), 0o644); err != nil {
+			return errors.WithMessagef(err, "failed to write metrics of %s", containerName)
+		}
+	}
+
+	if err := files.WriteFile(s.cursorFile(containerName), []byte(cursor.Format(time.RFC3339Nano)), 0o644); err != nil {
+		return errors.WithMessagef(err, "failed to write metrics cursor of %s", containerName)
+	}
+
+	return nil
+}
+
+// Reset forgets the series of a container name, so a new run under the
+// same name starts from scratch.
+func (s *MetricsStore) Reset(containerName string) error {
+	for _, f := range []string{s.file(containerName), s.cursorFile(containerName)} {
+		if err := files.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessagef(err, "failed to reset metrics of %s", containerName)
+		}
+	}
+
+	return nil
+}
+
+// Series returns every point recorded for the container, oldest first.
+func (s *MetricsStore) Series(containerName string) ([]MetricPoint, error) {
+	data, err := files.ReadFile(s.file(containerName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to open metrics of %s", containerName)
+	}
+
+	points := make([]MetricPoint, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var point MetricPoint
+		if err := decoder.Decode(&point); err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse metrics of %s", containerName)
+		}
+		points = append(points, point)
+	}
+
+	return points, nil
+}
+
+// ScrapeMetrics parses the container output written since the last scrape
+// and appends the points found to the store.
+func (d *DockerRun) ScrapeMetrics(store *MetricsStore, state ExperimentState) error {
+	parser, err := newMetricsParser(state.Metrics)
+	if err != nil {
+		return err
+	}
+
+	cursor := store.cursor(state.ContainerName)
+	options := types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: true}
+	if !cursor.IsZero() {
+		options.Since = strconv.FormatFloat(float64(cursor.UnixNano())/1e9, 'f', 9, 64)
+	}
+
+	logs, err := d.client.ContainerLogs(d.ctx, state.ContainerName, options)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read logs of %s", state.ContainerName)
+	}
+	defer logs.Close()
+
+	// the container runs without a tty, so stdout and stderr are multiplexed
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, logs); err != nil {
+		return errors.WithMessagef(err, "failed to read logs of %s", state.ContainerName)
+	}
+
+	points := make([]MetricPoint, 0)
+	scanner := bufio.NewScanner(&output)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		timestamp, line, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil || !t.After(cursor) {
+			continue
+		}
+		cursor = t
+
+		if point, ok := parser.parse(line); ok {
+			point.Time = t
+			points = append(points, point)
+		}
+	}
+
+	return store.append(state.ContainerName, points, cursor)
+}
+
+// scrapeLive scrapes every run of this host that still has a container,
+// reporting failures without stopping.
+func scrapeLive(ctx context.Context, store *MetricsStore, states []ExperimentState) {
+	clients := make(map[string]*DockerRun)
+	for _, state := range states {
+		if state.Cloud != nil {
+			continue
+		}
+		dockerContext := state.RunArgs.DockerContext
+		dr, ok := clients[dockerContext]
+		if !ok {
+			var err error
+			if dr, err = NewDockerRun(ctx, dockerContext, "", "", ""); err != nil {
+				warnf("failed to scrape metrics of %s: %v\n", state.ContainerName, err)
+				continue
+			}
+			clients[dockerContext] = dr
+		}
+
+		if err := dr.ScrapeMetrics(store, state); err != nil {
+			warnf("failed to scrape metrics of %s: %v\n", state.ContainerName, err)
+		}
+	}
+}
+
+func formatMetric(v *metricValue) string {
+	if v == nil {
+		return "-"
+	}
+
+	return strconv.FormatFloat(float64(*v), 'g', 6, 64)
+}
+
+type MetricsArgs struct {
+	ExperimentName string `validate:"required"`
+	ProjectName    string `validate:"omitempty,varname"`
+	Tail           int    `validate:"min=0"`
+}
+
+// Metrics scrapes the live runs of an experiment and prints the recorded
+// series of every run, live or finished.
+func Metrics(args MetricsArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	history, err := sm.History()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	matches := func(project, experiment, container string) bool {
+		if args.ProjectName != "" && project != args.ProjectName {
+			return false
+		}
+		return experiment == args.ExperimentName || container == args.ExperimentName
+	}
+
+	live := make([]ExperimentState, 0, 1)
+	containers := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, s := range states {
+		if matches(s.ProjectName, s.ExperimentName, s.ContainerName) {
+			live = append(live, s)
+			containers = append(containers, s.ContainerName)
+			seen[s.ContainerName] = true
+		}
+	}
+	for _, r := range history {
+		if matches(r.ProjectName, r.ExperimentName, r.ContainerName) && !seen[r.ContainerName] {
+			containers = append(containers, r.ContainerName)
+			seen[r.ContainerName] = true
+		}
+	}
+
+	if len(containers) == 0 {
+		errorf("no runs of %s on this host\n", args.ExperimentName)
+		os.Exit(ExitValidation)
+	}
+
+	scrapeLive(context.Background(), store, live)
+
+	for _, name := range containers {
+		points, err := store.Series(name)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		if args.Tail > 0 && len(points) > args.Tail {
+			points = points[len(points)-args.Tail:]
+		}
+
+		fmt.Printf("%s\n", name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tSTEP\tLOSS\tTOKENS/S")
+		for _, p := range points {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n",
+				p.Time.Local().Format(time.DateTime), p.Step, formatMetric(p.Loss), formatMetric(p.TokensPerSec))
+		}
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+type MetricsServeArgs struct {
+	Addr string `validate:"required,hostname_port"`
+}
+
+// MetricsServe exposes the latest metrics of every run of this host in the
+// prometheus text format on /metrics. Runs are scraped on every request.
+func MetricsServe(args MetricsServeArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		states, err := sm.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		scrapeLive(r.Context(), store, states)
+		stats := liveStats(r.Context(), states)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writePrometheusMetrics(w, store, states, stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	fmt.Printf("serving metrics on http://%s/metrics\n", args.Addr)
+	if err := http.ListenAndServe(args.Addr, nil); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
+
+func writePrometheusMetrics(w io.Writer, store *MetricsStore, states []ExperimentState, stats map[string]containerStats) error {
+	type sample struct {
+		labels string
+		value  float64
+	}
+	gauges := map[string][]sample{}
+
+	for _, s := range states {
+		points, err := store.Series(s.ContainerName)
+		if err != nil {
+			return err
+		}
+
+		labels := fmt.Sprintf(`project=%q,experiment=%q,run=%q,container=%q,sweep=%q`,
+			s.ProjectName, s.ExperimentName, s.RunName, s.ContainerName, s.Sweep)
+
+		var step int64
+		var loss, throughput *metricValue
+		for _, p := range points {
+			step = p.Step
+			if p.Loss != nil {
+				loss = p.Loss
+			}
+			if p.TokensPerSec != nil {
+				throughput = p.TokensPerSec
+			}
+		}
+
+		gauges["invoker_step"] = append(gauges["invoker_step"], sample{labels, float64(step)})
+		if loss != nil {
+			gauges["invoker_loss"] = append(gauges["invoker_loss"], sample{labels, float64(*loss)})
+		}
+		if throughput != nil {
+			gauges["invoker_tokens_per_second"] = append(gauges["invoker_tokens_per_second"], sample{labels, float64(*throughput)})
+		}
+
+		if usage, ok := stats[s.ContainerName]; ok {
+			gauges["invoker_container_cpu_percent"] = append(gauges["invoker_container_cpu_percent"], sample{labels, usage.CPUPercent})
+			gauges["invoker_container_memory_bytes"] = append(gauges["invoker_container_memory_bytes"], sample{labels, float64(usage.MemoryBytes)})
+			if usage.Network {
+				gauges["invoker_container_network_receive_bytes_total"] = append(gauges["invoker_container_network_receive_bytes_total"],
+					sample{labels, float64(usage.RxBytes)})
+				gauges["invoker_container_network_transmit_bytes_total"] = append(gauges["invoker_container_network_transmit_bytes_total"],
+					sample{labels, float64(usage.TxBytes)})
+			}
+		}
+	}
+
+	kinds := map[string]string{
+		"invoker_container_network_receive_bytes_total":  "counter",
+		"invoker_container_network_transmit_bytes_total": "counter",
+	}
+	for _, name := range []string{"invoker_step", "invoker_loss", "invoker_tokens_per_second", "invoker_container_cpu_percent",
+		"invoker_container_memory_bytes", "invoker_container_network_receive_bytes_total", "invoker_container_network_transmit_bytes_total"} {
+		if len(gauges[name]) == 0 {
+			continue
+		}
+
+		kind := "gauge"
+		if t, ok := kinds[name]; ok {
+			kind = t
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		for _, s := range gauges[name] {
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,10 +1,13 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
 	"net"
-	"net/http"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
 
 	"os"
 
@@ -15,25 +18,6 @@ import (
 	"path/filepath"
 )
 
-const url = "https://api.ipify.org"
-
-func myPublicIP() (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", errors.WithMessage(err, "failed to get public IP")
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-
-	if err != nil {
-		return "", errors.WithMessage(err, "failed to read response body")
-	}
-
-	return string(body), nil
-}
-
 func localIPs() ([]string, error) {
 	var ips []string
 	addresses, err := net.InterfaceAddrs()
@@ -52,20 +36,18 @@ func localIPs() ([]string, error) {
 }
 
 func rankAndMasterElseExit(hosts []string) (string, int) {
-	ip, err := myPublicIP()
+	plugins, err := LoadPluginConfig()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
 	}
-	ips := []string{ip}
 
-	localIPs, err := localIPs()
+	ips, err := hostIPs(plugins, hosts)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
 	}
-
-	ips = append(ips, localIPs...)
+	ip := ips[0]
 
 	master, rank := hosts[0], -1
 	for i, host := range hosts {
@@ -80,18 +62,45 @@ func rankAndMasterElseExit(hosts []string) (string, int) {
 	}
 
 	if rank == -1 {
-		fmt.Printf("%s not found in hosts list, omitting\n", ip)
-		os.Exit(0)
+		errorf("this host (%s) is not in the hosts list\n", ip)
+		os.Exit(ExitValidation)
 	}
 
 	return master, rank
 }
 
+// hostIPs are the addresses this host may be listed under, from the ip
+// resolver plugin if there is one.
+func hostIPs(plugins PluginConfig, hosts []string) ([]string, error) {
+	if plugins.IPResolver != "" {
+		ips, err := plugins.pluginIPs(hosts)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, errors.Errorf("ip resolver %s returned no addresses", plugins.IPResolver)
+		}
+		return ips, nil
+	}
+
+	ip, err := myPublicIP()
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := localIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{ip}, local...), nil
+}
+
 func portIsAvailable(port int) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		fmt.Printf("port %d is already in use\n", port)
-		os.Exit(1)
+		errorf("port %d is already in use\n", port)
+		os.Exit(ExitInfra)
 	}
 
 	defer listener.Close()
@@ -103,10 +112,10 @@ type Path struct {
 
 func (p *Path) mkdirIfNotExists() error {
 	// Check if the directory already exists
-	_, err := os.Stat(p.path)
+	_, err := files.Stat(p.path)
 	if os.IsNotExist(err) {
 		// Directory doesn't exist, so create it
-		err := os.MkdirAll(p.path, os.ModePerm)
+		err := files.MkdirAll(p.path, os.ModePerm)
 		if err != nil {
 			return errors.WithMessagef(err, "failed to create directory %s", p.path)
 		}
@@ -121,18 +130,35 @@ func (p *Path) Join(subpath string) *Path {
 	return &Path{path: filepath.Join(p.path, subpath)}
 }
 
+// defaultDirectories returns the cache and checkpoint directories of a run
+// without creating them.
+func defaultDirectories(projectName, experimentName, runName string) (string, string, error) {
+	cacheDir, err := cacheRoot()
+	if err != nil {
+		return "", "", err
+	}
+	root, err := checkpointRoot()
+	if err != nil {
+		return "", "", err
+	}
+
+	checkpointDir := filepath.Join(root, projectName, "experiments", experimentName, runName)
+
+	return cacheDir, checkpointDir, nil
+}
+
 func makeDefaultDirectories(projectName, experimentName, runName string) (string, string, error) {
-	home, err := os.UserHomeDir()
+	cachePath, checkpointPath, err := defaultDirectories(projectName, experimentName, runName)
 	if err != nil {
-		return "", "", errors.WithMessage(err, "failed to get user home directory")
+		return "", "", err
 	}
 
-	cacheDir := Path{path: filepath.Join(home, ".cache")}
+	cacheDir := Path{path: cachePath}
 	if err = cacheDir.mkdirIfNotExists(); err != nil {
 		return "", "", errors.WithMessage(err, "failed to create cache directory")
 	}
 
-	checkpointDir := cacheDir.Join("higgsfield").Join(projectName).Join("experiments").Join(experimentName).Join(runName)
+	checkpointDir := Path{path: checkpointPath}
 	if err = checkpointDir.mkdirIfNotExists(); err != nil {
 		return "", "", errors.WithMessagef(err, "failed to create checkpoint directory for experiment %s and run name %s", experimentName, runName)
 	}
@@ -140,18 +166,79 @@ func makeDefaultDirectories(projectName, experimentName, runName string) (string
 	return cacheDir.path, checkpointDir.path, nil
 }
 
+// loadConfigFile decodes ~/.config/higgsfield/<name> into v, leaving v
+// untouched if the file doesn't exist.
+func loadConfigFile(name string, v any) error {
+	dir, err := configRoot()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, "higgsfield", name)
+	data, err := files.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithMessagef(err, "failed to read %s", path)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.WithMessagef(err, "failed to parse %s", path)
+	}
+
+	return nil
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// parseSince parses durations like 30d, 2w or 12h into a point in the past.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	multiplier := time.Duration(0)
+	switch {
+	case strings.HasSuffix(since, "d"):
+		multiplier = 24 * time.Hour
+	case strings.HasSuffix(since, "w"):
+		multiplier = 7 * 24 * time.Hour
+	}
+
+	if multiplier == 0 {
+		d, err := time.ParseDuration(since)
+		if err != nil {
+			return time.Time{}, errors.WithMessagef(err, "invalid duration %s", since)
+		}
+		return clock.Now().Add(-d), nil
+	}
+
+	n, err := strconv.Atoi(since[:len(since)-1])
+	if err != nil {
+		return time.Time{}, errors.WithMessagef(err, "invalid duration %s", since)
+	}
+
+	return clock.Now().Add(-time.Duration(n) * multiplier), nil
+}
+
 type errStrategyFunc func(flag string, err error)
 
 func exitIfError(flag string, err error) {
 	if err != nil {
-		fmt.Printf("cannot parse %s: %v\n", flag, err)
-		os.Exit(1)
+		errorf("cannot parse %s: %v\n", flag, err)
+		os.Exit(ExitValidation)
 	}
 }
 
 func nothingIfError(flag string, err error) {}
 
-func ParseOrNil[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string) *T {
+func ParseOrNil[T ~string | ~int | ~bool | ~[]string | ~[]int | ~float64 | time.Duration](cmd *cobra.Command, flag string) *T {
   // TODO: buddy, need to fix this
   got, ok := parseOrExitInternal[T](cmd, flag, false)
 	if !ok {
@@ -160,12 +247,12 @@ func ParseOrNil[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string) *
 	return PtrTo(got.(T))
 }
 
-func ParseOrExit[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string) T {
+func ParseOrExit[T ~string | ~int | ~bool | ~[]string | ~[]int | ~float64 | time.Duration](cmd *cobra.Command, flag string) T {
 	got, _ := parseOrExitInternal[T](cmd, flag, true)
 	return got.(T)
 }
 
-func parseOrExitInternal[T ~string | ~int | ~[]string](cmd *cobra.Command, flag string, exit bool) (interface{}, bool) {
+func parseOrExitInternal[T ~string | ~int | ~bool | ~[]string | ~[]int | ~float64 | time.Duration](cmd *cobra.Command, flag string, exit bool) (interface{}, bool) {
 	errFunc := nothingIfError
 
 	if exit {
@@ -182,14 +269,40 @@ func parseOrExitInternal[T ~string | ~int | ~[]string](cmd *cobra.Command, flag
 		v, err := cmd.Flags().GetInt(flag)
 		errFunc(flag, err)
 		return v, err == nil
+	case bool:
+		v, err := cmd.Flags().GetBool(flag)
+		errFunc(flag, err)
+		return v, err == nil
+	case float64:
+		v, err := cmd.Flags().GetFloat64(flag)
+		errFunc(flag, err)
+		return v, err == nil
+	case time.Duration:
+		v, err := cmd.Flags().GetDuration(flag)
+		errFunc(flag, err)
+		return v, err == nil
 	case []string:
 		v, err := cmd.Flags().GetStringSlice(flag)
 		errFunc(flag, err)
 		return v, err == nil
+	case []int:
+		v, err := cmd.Flags().GetIntSlice(flag)
+		errFunc(flag, err)
+		return v, err == nil
 	default:
-		fmt.Printf("cannot parse %s: unknown type %T\n", flag, v)
-		os.Exit(1)
+		errorf("cannot parse %s: unknown type %T\n", flag, v)
+		os.Exit(ExitValidation)
 	}
 
 	return nil, false
 }
+
+// concat joins slices into a new one.
+func concat[T any](slices ...[]T) []T {
+	result := make([]T, 0)
+	for _, s := range slices {
+		result = append(result, s...)
+	}
+
+	return result
+}
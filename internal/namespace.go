@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// UserConfig holds settings of the user running invoker, read from
+// ~/.config/higgsfield/user.json.
+type UserConfig struct {
+	// Namespace is used when --namespace is not given.
+	Namespace string `json:"namespace"`
+	// Identity is who runs are attributed to next to the os user, like an
+	// email address, since os users are often shared on clusters.
+	Identity string `json:"identity"`
+}
+
+func LoadUserConfig() (UserConfig, error) {
+	var config UserConfig
+	if err := loadConfigFile("user.json", &config); err != nil {
+		return UserConfig{}, err
+	}
+
+	return config, nil
+}
+
+// userIdentity is the configured identity of the user, empty if there is
+// none.
+func userIdentity() string {
+	config, err := LoadUserConfig()
+	if err != nil {
+		warnf("%v\n", err)
+		return ""
+	}
+
+	return config.Identity
+}
+
+// namespaceRegex keeps namespaced names valid as container names and image
+// tags.
+var namespaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_]*$`)
+
+// namespace keeps the containers, images and state of users sharing a host
+// apart. It prefixes every name invoker derives, empty means no prefix.
+var namespace string
+
+// SetNamespace sets the namespace of this invocation, falling back to the
+// one of the user config if ns is empty.
+func SetNamespace(ns string) error {
+	if ns == "" {
+		config, err := LoadUserConfig()
+		if err != nil {
+			return err
+		}
+		ns = config.Namespace
+	}
+
+	if ns != "" && !namespaceRegex.MatchString(ns) {
+		return errors.Errorf("invalid namespace %q, use lowercase letters, digits and underscores", ns)
+	}
+
+	namespace = ns
+	return nil
+}
+
+// SetNamespaceOrExit is SetNamespace for the command line.
+func SetNamespaceOrExit(ns string) {
+	if err := SetNamespace(ns); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
+
+func namespacedName(ns, name string) string {
+	if ns == "" {
+		return name
+	}
+
+	return ns + "-" + name
+}
+
+// ImageTag is the tag images built from projects get in this namespace.
+func ImageTag() string {
+	return namespacedName(namespace, imageTag)
+}
+
+// namespaceFlags pass the namespace on to invoker on other hosts.
+func namespaceFlags() []string {
+	if namespace == "" {
+		return nil
+	}
+
+	return []string{"--namespace=" + namespace}
+}
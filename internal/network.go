@@ -2,8 +2,17 @@ package internal
 
 import (
 	"fmt"
-	"math/rand"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
 )
 
 func isPortAvailable(port int) bool {
@@ -17,10 +26,277 @@ func isPortAvailable(port int) bool {
 }
 
 func GeneratePort() int {
-	port := rand.Intn(65535-1024) + 1024
+	port := random.Intn(65535-1024) + 1024
 	for !isPortAvailable(port) {
-		port = rand.Intn(65535-1024) + 1024
+		port = random.Intn(65535-1024) + 1024
 	}
 
 	return port
 }
+
+// containerNetwork is the part of the container config that depends on the
+// network mode.
+type containerNetwork struct {
+	Mode         container.NetworkMode
+	ExposedPorts nat.PortSet
+	PortBindings nat.PortMap
+	Sysctls      map[string]string
+}
+
+func (d *DockerRun) setupNetwork(config NetworkConfig, masterPort int) (containerNetwork, error) {
+	switch config.Mode {
+	case "", networkModeHost:
+		return containerNetwork{Mode: container.NetworkMode("host")}, nil
+	case networkModeBridge, networkModeMacvlan, networkModeIpvlan:
+	default:
+		return containerNetwork{}, errors.Errorf("unknown network mode %s", config.Mode)
+	}
+
+	if err := d.ensureNetwork(config); err != nil {
+		return containerNetwork{}, err
+	}
+
+	network := containerNetwork{Mode: container.NetworkMode(config.Name)}
+	if config.Mode != networkModeBridge {
+		// macvlan and ipvlan containers get their own routable address
+		return network, nil
+	}
+
+	// jobs like exports don't listen on a port
+	ports := make([]string, 0, 2)
+	if masterPort != 0 {
+		ports = append(ports, fmt.Sprintf("%d:%d", masterPort, masterPort))
+	}
+	if config.NCCLPortRange != "" {
+		ports = append(ports, fmt.Sprintf("%s:%s", config.NCCLPortRange, config.NCCLPortRange))
+
+		// NCCL and gloo listen on ephemeral ports, so pin those to the
+		// published range
+		low, high, err := nat.ParsePortRangeToInt(config.NCCLPortRange)
+		if err != nil {
+			return containerNetwork{}, errors.WithMessagef(err, "invalid nccl port range %s", config.NCCLPortRange)
+		}
+		network.Sysctls = map[string]string{
+			"net.ipv4.ip_local_port_range": fmt.Sprintf("%d %d", low, high),
+		}
+	}
+
+	exposed, bindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return containerNetwork{}, errors.WithMessage(err, "failed to parse published ports")
+	}
+	network.ExposedPorts, network.PortBindings = exposed, bindings
+
+	return network, nil
+}
+
+// checkMultiNodeNetwork rejects bridge networking for runs of several
+// hosts. NCCL and torchrun advertise the container's bridge address, which
+// the other hosts can't reach, so the run would hang in the rendezvous or
+// the first collective.
+func checkMultiNodeNetwork(mode string, hosts int) error {
+	if mode == networkModeBridge && hosts > 1 {
+		return errors.Errorf("bridge networking only works for single-host runs, the other %d hosts can't reach the container's address; use host networking or a macvlan or ipvlan network", hosts-1)
+	}
+
+	return nil
+}
+
+// checkRunNetwork checks the network mode of a run before its hosts wait
+// for each other, from --network_mode or else invoker.yaml.
+func checkRunNetwork(args RunArgs) error {
+	mode := args.NetworkMode
+	if mode == "" {
+		path := args.ProjectPath
+		if path == "" {
+			var err error
+			if path, err = os.Getwd(); err != nil {
+				return errors.WithMessage(err, "failed to get the working directory")
+			}
+		}
+		config, err := LoadProjectConfig(path)
+		if err != nil {
+			return err
+		}
+		mode = config.Network.Mode
+	}
+
+	return checkMultiNodeNetwork(mode, len(args.Hosts))
+}
+
+// ensureNetwork creates the bridge network if it's missing. Macvlan and
+// ipvlan networks need the parent interface and subnet of the cluster, so
+// they are expected to exist already.
+func (d *DockerRun) ensureNetwork(config NetworkConfig) error {
+	ctx, cancel := d.deadline(dockerOpCreate)
+	defer cancel()
+
+	resource, err := d.client.NetworkInspect(ctx, config.Name, types.NetworkInspectOptions{})
+	if err == nil {
+		if resource.Driver != config.Mode {
+			return errors.Errorf("network %s uses driver %s, expected %s", config.Name, resource.Driver, config.Mode)
+		}
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to inspect network %s", config.Name)
+	}
+
+	if config.Mode != networkModeBridge {
+		return errors.Errorf(
+			"network %s does not exist, create it with `docker network create -d %s --subnet=<subnet> -o parent=<interface> %s`",
+			config.Name, config.Mode, config.Name,
+		)
+	}
+
+	fmt.Printf("creating network %s\n", config.Name)
+	if _, err := d.client.NetworkCreate(ctx, config.Name, types.NetworkCreate{Driver: networkModeBridge}); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			return nil
+		}
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to create network %s", config.Name)
+	}
+
+	return nil
+}
+
+// extraHosts pins the run's hosts to the addresses they resolve to right
+// now, so rendezvous inside the container doesn't depend on cluster DNS.
+// Explicit entries win over resolved ones.
+func extraHosts(hosts []string, explicit map[string]string) []string {
+	entries := make(map[string]string, len(hosts)+len(explicit))
+	for _, host := range hosts {
+		if host == "localhost" || net.ParseIP(host) != nil {
+			continue
+		}
+
+		addrs, err := net.LookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			warnf("failed to resolve %s, not adding it to /etc/hosts: %v\n", host, err)
+			continue
+		}
+		entries[host] = addrs[0]
+	}
+
+	for name, addr := range explicit {
+		entries[name] = addr
+	}
+
+	result := make([]string, 0, len(entries))
+	for name, addr := range entries {
+		result = append(result, name+":"+addr)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// normalizeHosts trims and lower-cases the hosts of a run and rejects lists
+// that would give two nodes the same rank: the same host twice, two names
+// resolving to the same address, or localhost next to other hosts.
+func normalizeHosts(hosts []string) ([]string, error) {
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return nil, errors.New("hosts contain an empty entry")
+		}
+		normalized = append(normalized, host)
+	}
+
+	if len(normalized) > 1 {
+		for _, host := range normalized {
+			if isLoopback(host) {
+				return nil, errors.Errorf("%s can't be mixed with other hosts, every node would take it for itself", host)
+			}
+		}
+	}
+
+	owners := make(map[string]string, len(normalized))
+	for _, host := range normalized {
+		addrs := []string{host}
+		if net.ParseIP(host) == nil {
+			resolved, err := net.LookupHost(host)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "failed to resolve host %s", host)
+			}
+			addrs = resolved
+		}
+
+		for _, addr := range addrs {
+			owner, ok := owners[addr]
+			if ok && owner == host {
+				return nil, errors.Errorf("host %s is listed twice", host)
+			} else if ok {
+				return nil, errors.Errorf("hosts %s and %s are the same machine, both resolve to %s", owner, host, addr)
+			}
+		}
+		for _, addr := range addrs {
+			owners[addr] = host
+		}
+	}
+
+	return normalized, nil
+}
+
+// orderHosts puts the hosts in the order that decides their ranks. Either
+// every host is annotated with its rank as host@rank, or the list is
+// sorted if sorted is set, or the given order is kept. The annotations are
+// removed.
+func orderHosts(hosts []string, sorted bool) ([]string, error) {
+	annotated := 0
+	for _, host := range hosts {
+		if strings.Contains(host, "@") {
+			annotated++
+		}
+	}
+
+	switch {
+	case annotated == 0 && sorted:
+		ordered := append([]string{}, hosts...)
+		sort.Strings(ordered)
+		return ordered, nil
+	case annotated == 0:
+		return hosts, nil
+	case annotated != len(hosts):
+		return nil, errors.New("either all hosts or none have to be annotated with their rank")
+	}
+
+	ordered := make([]string, len(hosts))
+	for _, entry := range hosts {
+		host, rankStr, _ := strings.Cut(entry, "@")
+		rank, err := strconv.Atoi(rankStr)
+		if err != nil || rank < 0 || rank >= len(hosts) {
+			return nil, errors.Errorf("invalid rank in %s, expected a number from 0 to %d", entry, len(hosts)-1)
+		}
+		if ordered[rank] != "" {
+			return nil, errors.Errorf("rank %d is given to both %s and %s", rank, ordered[rank], host)
+		}
+		ordered[rank] = host
+	}
+
+	return ordered, nil
+}
+
+// parseHostEntries parses name:ip pairs as given to --add_host.
+func parseHostEntries(entries []string) (map[string]string, error) {
+	result := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		name, addr, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || net.ParseIP(addr) == nil {
+			return nil, errors.Errorf("invalid host entry %s, expected name:ip", entry)
+		}
+		result[name] = addr
+	}
+
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	runKindNotebook    = "notebook"
+	notebookExperiment = "notebook"
+)
+
+// notebookCommand starts jupyter lab, installing it first if the image
+// doesn't have it.
+func notebookCommand(port int, token string) []string {
+	lab := fmt.Sprintf("exec jupyter lab --ip=0.0.0.0 --port=%d --no-browser --allow-root --ServerApp.token=%s", port, token)
+	return []string{"sh", "-c", "command -v jupyter >/dev/null 2>&1 || pip install -q jupyterlab; " + lab}
+}
+
+type NotebookArgs struct {
+	ProjectName string `validate:"required,varname"`
+	Port        int    `validate:"required,min=1"`
+	GPUs        []int  `validate:"unique,dive,min=0"`
+	Memory      string
+	// Image runs an existing image instead of building the project.
+	Image         string
+	ProjectPath   string
+	DockerContext string
+	// Host starts the notebook on another host over ssh and forwards its
+	// port to this one, this host if empty.
+	Host string
+}
+
+func (args NotebookArgs) remoteFlags() []string {
+	flags := []string{
+		"notebook",
+		"--project_name", args.ProjectName,
+		"--port", fmt.Sprint(args.Port),
+		"--project_path", args.ProjectPath,
+	}
+	if len(args.GPUs) > 0 {
+		gpus := make([]string, len(args.GPUs))
+		for i, gpu := range args.GPUs {
+			gpus[i] = fmt.Sprint(gpu)
+		}
+		flags = append(flags, "--gpus", strings.Join(gpus, ","))
+	}
+	if args.Memory != "" {
+		flags = append(flags, "--memory", args.Memory)
+	}
+	if args.Image != "" {
+		flags = append(flags, "--image", args.Image)
+	}
+
+	return append(flags, namespaceFlags()...)
+}
+
+// Notebook starts a jupyter lab container with the image, mounts and gpus
+// of the project's training runs, so exploring happens in the environment
+// training uses. It's recorded like a run, so ps, stop and the resource
+// ledger know about it.
+func Notebook(args NotebookArgs) {
+	validateArgs(args)
+
+	if args.ProjectPath == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			errorf("failed to get the working directory: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		args.ProjectPath = cwd
+	}
+
+	if args.Host != "" && !isLoopback(args.Host) {
+		if err := runOnHost(context.Background(), args.Host, args.remoteFlags()...); err != nil {
+			errorf("failed to start notebook on %s: %v\n", args.Host, err)
+			os.Exit(ExitInfra)
+		}
+
+		fmt.Printf("forwarding localhost:%d to %s, stop with ctrl-c\n", args.Port, args.Host)
+		forward := fmt.Sprintf("%d:localhost:%d", args.Port, args.Port)
+		cmd := exec.Command("ssh", "-N", "-o", "BatchMode=yes", "-L", forward, args.Host)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			errorf("port forwarding to %s ended: %v\n", args.Host, err)
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	if !isPortAvailable(args.Port) {
+		errorf("port %d is not available\n", args.Port)
+		os.Exit(ExitInfra)
+	}
+
+	token, err := notebookToken()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	run := RunArgs{
+		ProjectName:    args.ProjectName,
+		Hosts:          []string{"localhost"},
+		NProcPerNode:   1,
+		ExperimentName: notebookExperiment,
+		Port:           args.Port,
+		RunName:        currentUser(),
+		MaxRepeats:     -1,
+		GPUs:           args.GPUs,
+		Memory:         args.Memory,
+		Image:          args.Image,
+		ProjectPath:    args.ProjectPath,
+		DockerContext:  args.DockerContext,
+		Namespace:      namespace,
+		Kind:           runKindNotebook,
+	}
+
+	plan := launchPlan{Master: "localhost", Entrypoint: notebookCommand(args.Port, token)}
+	if err := launch(context.Background(), run, plan); err != nil {
+		errorf("failed to start notebook: %+v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	fmt.Printf("notebook %s is starting at http://localhost:%d/lab?token=%s\n", nameFromRunArgs(run), args.Port, token)
+	fmt.Printf("stop it with `invoker experiment stop --project_name=%s --experiment_name=%s`\n", args.ProjectName, notebookExperiment)
+}
+
+func notebookToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", errors.WithMessage(err, "failed to generate notebook token")
+	}
+
+	return hex.EncodeToString(token), nil
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moby/term"
+)
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiCyan   = "\x1b[36m"
+)
+
+// colorStdout and colorStderr are whether the streams get colors. Only
+// terminals get them, and neither with NO_COLOR set nor with TERM=dumb, so
+// piped output and logs stay plain text. Each stream is checked on its
+// own, warnings still show up colored when stdout is piped.
+var (
+	colorStdout = colorTerminal(os.Stdout)
+	colorStderr = colorTerminal(os.Stderr)
+)
+
+func colorTerminal(f *os.File) bool {
+	return term.IsTerminal(f.Fd()) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// DisableColor turns colors off for this invocation, for --no-color.
+func DisableColor() {
+	colorStdout, colorStderr = false, false
+}
+
+// paint colors text printed to stdout.
+func paint(color, s string) string {
+	return paintIf(colorStdout, color, s)
+}
+
+func paintIf(enabled bool, color, s string) string {
+	if !enabled || s == "" {
+		return s
+	}
+
+	// the reset goes before the newline, or the next line starts colored
+	// in terminals that clear lines with the current colors
+	text := strings.TrimRight(s, "\n")
+	return color + text + ansiReset + s[len(text):]
+}
+
+// infof prints progress. It's the same as fmt.Printf, for the other levels
+// to line up with.
+func infof(format string, args ...any) {
+	fmt.Printf(format, args...)
+}
+
+// successf prints that something the user waits for is done.
+func successf(format string, args ...any) {
+	fmt.Print(paint(ansiGreen, fmt.Sprintf(format, args...)))
+}
+
+// warnf prints something the user should look into to stderr, the command
+// goes on.
+func warnf(format string, args ...any) {
+	fmt.Fprint(os.Stderr, paintIf(colorStderr, ansiYellow, "warning: "+fmt.Sprintf(format, args...)))
+}
+
+// errorf prints why the command fails to stderr.
+func errorf(format string, args ...any) {
+	fmt.Fprint(os.Stderr, paintIf(colorStderr, ansiRed, "error: "+fmt.Sprintf(format, args...)))
+}
+
+// printFields prints a titled block of names and values, the names padded
+// to the longest one. Values are never cut, long ones just make the line
+// longer.
+func printFields(title string, fields [][2]string) {
+	width := 0
+	for _, f := range fields {
+		width = max(width, len(f[0]))
+	}
+
+	var b strings.Builder
+	b.WriteString("\n" + paint(ansiBold+ansiCyan, title) + "\n")
+	for _, f := range fields {
+		name := f[0] + strings.Repeat(" ", width-len(f[0]))
+		b.WriteString("  " + paint(ansiDim, name) + "  " + f[1] + "\n")
+	}
+	b.WriteString("\n")
+
+	fmt.Print(b.String())
+}
@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A minimal parquet writer for flat tables: one row group, a plain encoded
+// uncompressed data page per column, optional columns for nulls. That's
+// what pandas, polars and duckdb read without anything else installed on
+// this side.
+
+type parquetType int32
+
+const (
+	parquetInt32     parquetType = 1
+	parquetInt64     parquetType = 2
+	parquetDouble    parquetType = 5
+	parquetByteArray parquetType = 6
+)
+
+// converted types of the columns, parquetNoConversion for plain numbers
+const (
+	parquetNoConversion   = -1
+	parquetUTF8           = 0
+	parquetTimestampMilli = 9
+)
+
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// parquetColumn is a column of a table. Values are int32, int64, float64
+// or string by Type, nil for the nulls of optional columns. Timestamps are
+// int64 milliseconds.
+type parquetColumn struct {
+	Name      string
+	Type      parquetType
+	Converted int
+	Optional  bool
+	Values    []any
+}
+
+// thriftWriter writes the thrift compact protocol parquet's metadata is
+// encoded in.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// last are the ids of the last fields written, per nested struct
+	last []int16
+}
+
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := t.last[len(t.last)-1]
+	if delta := id - last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.uvarint(uint64((int64(id) << 1) ^ (int64(id) >> 63)))
+	}
+	t.last[len(t.last)-1] = id
+}
+
+func (t *thriftWriter) begin() { t.last = append(t.last, 0) }
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.uvarint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.uvarint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *thriftWriter) fieldStruct(id int16, fields func()) {
+	t.field(id, thriftStruct)
+	t.begin()
+	fields()
+	t.end()
+}
+
+// list writes the header of a list of n elements of kind, which the caller
+// writes next.
+func (t *thriftWriter) list(id int16, kind byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | kind)
+	} else {
+		t.buf.WriteByte(0xf0 | kind)
+		t.uvarint(uint64(n))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) { t.uvarint(uint64(uint32((v << 1) ^ (v >> 31)))) }
+
+func (t *thriftWriter) listBinary(v string) {
+	t.uvarint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+func (t *thriftWriter) listStruct(fields func()) {
+	t.begin()
+	fields()
+	t.end()
+}
+
+// plainValues encodes the non-null values of the column.
+func (c parquetColumn) plainValues() ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range c.Values {
+		if v == nil {
+			if !c.Optional {
+				return nil, errors.Errorf("null in required column %s", c.Name)
+			}
+			continue
+		}
+		var ok bool
+		switch c.Type {
+		case parquetInt32:
+			var i int32
+			if i, ok = v.(int32); ok {
+				binary.Write(&buf, binary.LittleEndian, i)
+			}
+		case parquetInt64:
+			var i int64
+			if i, ok = v.(int64); ok {
+				binary.Write(&buf, binary.LittleEndian, i)
+			}
+		case parquetDouble:
+			var f float64
+			if f, ok = v.(float64); ok {
+				binary.Write(&buf, binary.LittleEndian, math.Float64bits(f))
+			}
+		case parquetByteArray:
+			var s string
+			if s, ok = v.(string); ok {
+				binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+				buf.WriteString(s)
+			}
+		}
+		if !ok {
+			return nil, errors.Errorf("value %v of type %T doesn't fit column %s", v, v, c.Name)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// definitionLevels are 1 for values and 0 for nulls, RLE encoded in runs
+// and prefixed with their length.
+func (c parquetColumn) definitionLevels() []byte {
+	var runs bytes.Buffer
+	var b [binary.MaxVarintLen64]byte
+	for i := 0; i < len(c.Values); {
+		j := i
+		for j < len(c.Values) && (c.Values[j] == nil) == (c.Values[i] == nil) {
+			j++
+		}
+		runs.Write(b[:binary.PutUvarint(b[:], uint64(j-i)<<1)])
+		if c.Values[i] == nil {
+			runs.WriteByte(0)
+		} else {
+			runs.WriteByte(1)
+		}
+		i = j
+	}
+
+	levels := make([]byte, 4, 4+runs.Len())
+	binary.LittleEndian.PutUint32(levels, uint32(runs.Len()))
+
+	return append(levels, runs.Bytes()...)
+}
+
+// writeParquet writes the columns, which have to have the same length, as
+// a parquet file.
+func writeParquet(w io.Writer, columns []parquetColumn) error {
+	rows := 0
+	if len(columns) > 0 {
+		rows = len(columns[0].Values)
+	}
+
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(columns))
+	for i, c := range columns {
+		if len(c.Values) != rows {
+			return errors.Errorf("column %s has %d values instead of %d", c.Name, len(c.Values), rows)
+		}
+		values, err := c.plainValues()
+		if err != nil {
+			return err
+		}
+		var page []byte
+		if c.Optional {
+			page = c.definitionLevels()
+		}
+		page = append(page, values...)
+
+		header := &thriftWriter{}
+		header.begin()
+		header.i32(1, 0) // data page
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.fieldStruct(5, func() {
+			header.i32(1, int32(rows))
+			header.i32(2, parquetPlain)
+			header.i32(3, parquetRLE)
+			header.i32(4, parquetRLE)
+		})
+		header.end()
+
+		chunks[i] = chunk{offset: int64(file.Len()), size: int64(header.buf.Len() + len(page))}
+		file.Write(header.buf.Bytes())
+		file.Write(page)
+	}
+
+	var total int64
+	for _, ch := range chunks {
+		total += ch.size
+	}
+
+	meta := &thriftWriter{}
+	meta.begin()
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.listStruct(func() {
+		meta.binary(4, "schema")
+		meta.i32(5, int32(len(columns)))
+	})
+	for _, c := range columns {
+		meta.listStruct(func() {
+			meta.i32(1, int32(c.Type))
+			repetition := int32(parquetRequired)
+			if c.Optional {
+				repetition = parquetOptional
+			}
+			meta.i32(3, repetition)
+			meta.binary(4, c.Name)
+			if c.Converted != parquetNoConversion {
+				meta.i32(6, int32(c.Converted))
+			}
+		})
+	}
+	meta.i64(3, int64(rows))
+	meta.list(4, thriftStruct, 1)
+	meta.listStruct(func() {
+		meta.list(1, thriftStruct, len(columns))
+		for i, c := range columns {
+			meta.listStruct(func() {
+				meta.i64(2, chunks[i].offset)
+				meta.fieldStruct(3, func() {
+					meta.i32(1, int32(c.Type))
+					meta.list(2, thriftI32, 2)
+					meta.listI32(parquetPlain)
+					meta.listI32(parquetRLE)
+					meta.list(3, thriftBinary, 1)
+					meta.listBinary(c.Name)
+					meta.i32(4, 0) // uncompressed
+					meta.i64(5, int64(rows))
+					meta.i64(6, chunks[i].size)
+					meta.i64(7, chunks[i].size)
+					meta.i64(9, chunks[i].offset)
+				})
+			})
+		}
+		meta.i64(2, total)
+		meta.i64(3, int64(rows))
+	})
+	meta.binary(6, "invoker")
+	meta.end()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString("PAR1")
+
+	_, err := w.Write(file.Bytes())
+	return err
+}
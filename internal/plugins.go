@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Plugins are executables speaking a small json protocol: invoker writes a
+// pluginRequest to their stdin, reads the response from their stdout and
+// treats a non-zero exit as a failure. They are configured in
+// ~/.config/higgsfield/plugins.json. Custom launchers are plain executables
+// named invoker-<name> on the PATH, run as `invoker <name>`.
+type PluginConfig struct {
+	// IPResolver replaces the public ip lookup used to find this host in
+	// --hosts. It answers with {"ips": ["10.0.0.1"]}.
+	IPResolver string `json:"ip_resolver"`
+	// SecretProviders add environment variables to the container. They
+	// answer with {"env": {"NAME": "value"}}.
+	SecretProviders []string `json:"secret_providers"`
+	// Hooks run on the events pre_launch, post_launch, restart, retire and
+	// reboot. A failing pre_launch hook aborts the launch, the others are
+	// notifications.
+	Hooks map[string][]string `json:"hooks"`
+	// Webhooks get the events of the hooks posted as json, see
+	// WebhookConfig.
+	Webhooks []WebhookConfig `json:"webhooks"`
+}
+
+const (
+	hookPreLaunch  = "pre_launch"
+	hookPostLaunch = "post_launch"
+	hookRestart    = "restart"
+	hookRetire     = "retire"
+	// hookReboot runs for the runs a reboot took down that weren't
+	// restarted.
+	hookReboot = "reboot"
+
+	launcherPluginPrefix = "invoker-"
+)
+
+type pluginRequest struct {
+	Kind  string           `json:"kind"`
+	Event string           `json:"event,omitempty"`
+	State *ExperimentState `json:"state,omitempty"`
+	// Hosts is the --hosts list, for ip resolvers.
+	Hosts []string `json:"hosts,omitempty"`
+	// Restart is the failed run a restart policy decides on.
+	Restart *restartCandidate `json:"restart,omitempty"`
+	// Action, Pending, Count and Nodes are for provisioners, see
+	// AutoscaleConfig.
+	Action  string       `json:"action,omitempty"`
+	Pending []PendingRun `json:"pending,omitempty"`
+	Count   int          `json:"count,omitempty"`
+	Nodes   []string     `json:"nodes,omitempty"`
+}
+
+func LoadPluginConfig() (PluginConfig, error) {
+	var config PluginConfig
+	if err := loadConfigFile("plugins.json", &config); err != nil {
+		return PluginConfig{}, err
+	}
+
+	return config, nil
+}
+
+// callPlugin runs the plugin with the request on stdin and decodes its
+// stdout into response, if it's not nil. The plugin's stderr goes to ours.
+func callPlugin(plugin string, request pluginRequest, response any) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to encode request for plugin %s", plugin)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(plugin)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.WithMessagef(err, "plugin %s failed", plugin)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), response); err != nil {
+		return errors.WithMessagef(err, "failed to parse the answer of plugin %s", plugin)
+	}
+
+	return nil
+}
+
+// pluginIPs asks the ip resolver plugin for the addresses of this host.
+func (c PluginConfig) pluginIPs(hosts []string) ([]string, error) {
+	var response struct {
+		IPs []string `json:"ips"`
+	}
+	if err := callPlugin(c.IPResolver, pluginRequest{Kind: "ip_resolver", Hosts: hosts}, &response); err != nil {
+		return nil, err
+	}
+
+	return response.IPs, nil
+}
+
+// secretEnv collects the environment of all secret providers, as NAME=value
+// pairs.
+func (c PluginConfig) secretEnv(state ExperimentState) ([]string, error) {
+	env := make([]string, 0)
+	for _, plugin := range c.SecretProviders {
+		var response struct {
+			Env map[string]string `json:"env"`
+		}
+		if err := callPlugin(plugin, pluginRequest{Kind: "secret_provider", State: &state}, &response); err != nil {
+			return nil, err
+		}
+
+		for _, name := range sortedKeys(response.Env) {
+			env = append(env, name+"="+response.Env[name])
+		}
+	}
+
+	return env, nil
+}
+
+// runHooks runs the hooks of event in order, stopping at the first failure,
+// and then posts the event to the webhooks.
+func (c PluginConfig) runHooks(event string, state ExperimentState) error {
+	for _, plugin := range c.Hooks[event] {
+		if err := callPlugin(plugin, pluginRequest{Kind: "hook", Event: event, State: &state}, nil); err != nil {
+			return errors.WithMessagef(err, "%s hook failed", event)
+		}
+	}
+	c.sendWebhooks(event, state)
+
+	return nil
+}
+
+// notifyHooks runs the hooks of event, only reporting failures.
+func notifyHooks(event string, state ExperimentState) {
+	config, err := LoadPluginConfig()
+	if err == nil {
+		err = config.runHooks(event, state)
+	}
+	if err != nil {
+		warnf("%v\n", err)
+	}
+}
+
+// launcherPlugins are the invoker-<name> executables on the PATH, by name.
+func launcherPlugins() map[string]string {
+	plugins := make(map[string]string)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			name, ok := strings.CutPrefix(e.Name(), launcherPluginPrefix)
+			if !ok || name == "" || e.IsDir() {
+				continue
+			}
+			if _, seen := plugins[name]; seen {
+				continue
+			}
+
+			path := filepath.Join(dir, e.Name())
+			if info, err := os.Stat(path); err == nil && info.Mode()&0o111 != 0 {
+				plugins[name] = path
+			}
+		}
+	}
+
+	return plugins
+}
+
+// ExecLauncherPlugin replaces invoker with the invoker-<name> plugin if
+// there is one, passing it the remaining arguments. It returns only if there
+// is no such plugin.
+func ExecLauncherPlugin(name string, args []string) {
+	if strings.HasPrefix(name, "-") {
+		return
+	}
+
+	path, err := exec.LookPath(launcherPluginPrefix + name)
+	if err != nil {
+		return
+	}
+
+	argv := append([]string{path}, args...)
+	if err := syscall.Exec(path, argv, os.Environ()); err != nil {
+		errorf("failed to run plugin %s: %v\n", path, err)
+		os.Exit(ExitInfra)
+	}
+}
+
+// ListPlugins prints the launcher plugins found on the PATH and the
+// configured plugins.
+func ListPlugins() {
+	config, err := LoadPluginConfig()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	launchers := launcherPlugins()
+	names := make([]string, 0, len(launchers))
+	for name := range launchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("launchers:")
+	for _, name := range names {
+		fmt.Printf("  %s\t%s\n", name, launchers[name])
+	}
+
+	if config.IPResolver != "" {
+		fmt.Printf("ip resolver:\n  %s\n", config.IPResolver)
+	}
+
+	if len(config.SecretProviders) > 0 {
+		fmt.Println("secret providers:")
+		for _, p := range config.SecretProviders {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+
+	for _, event := range []string{hookPreLaunch, hookPostLaunch, hookRestart, hookRetire, hookReboot} {
+		if len(config.Hooks[event]) == 0 {
+			continue
+		}
+		fmt.Printf("%s hooks:\n", event)
+		for _, p := range config.Hooks[event] {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+
+	if len(config.Webhooks) > 0 {
+		fmt.Println("webhooks:")
+		for _, w := range config.Webhooks {
+			events := "every event but pre_launch"
+			if len(w.Events) > 0 {
+				events = strings.Join(w.Events, ", ")
+			}
+			signed := "unsigned"
+			if w.SecretEnv != "" || w.Secret != "" {
+				signed = "signed"
+			}
+			fmt.Printf("  %s\t%s, %s\n", w.URL, events, signed)
+		}
+	}
+}
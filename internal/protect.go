@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// confirm asks on the terminal before a destructive action, unless yes is
+// set. Without a terminal to ask on it refuses.
+func confirm(prompt string, yes bool) bool {
+	if yes {
+		return true
+	}
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		fmt.Printf("%s, pass --yes to confirm\n", prompt)
+		return false
+	}
+
+	fmt.Printf("%s? [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+// checkUnprotected refuses to touch a protected run, nil states are fine.
+func checkUnprotected(state *ExperimentState) error {
+	if state != nil && state.Protected {
+		return errors.Errorf("%s is protected, run `invoker experiment unprotect` on this host first", state.ContainerName)
+	}
+
+	return nil
+}
+
+type ProtectArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	Protected      bool
+}
+
+// Protect sets or clears the protection of an experiment on this host.
+// Protected experiments can't be killed, stopped, preempted or replaced by
+// a new run until they are unprotected.
+func Protect(args ProtectArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containerName := nameFromRestartArgs(RestartArgs{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		ContainerName:  args.ContainerName,
+	})
+
+	unlock, err := sm.Lock()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	defer unlock()
+
+	state, err := sm.Get(containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if state == nil {
+		errorf("no recorded run for %s on this host\n", containerName)
+		os.Exit(ExitValidation)
+	}
+
+	state.Protected = args.Protected
+	if err := sm.Put(*state); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.Protected {
+		fmt.Printf("%s is protected\n", containerName)
+	} else {
+		fmt.Printf("%s is not protected anymore\n", containerName)
+	}
+}
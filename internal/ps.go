@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+type PsArgs struct {
+	ProjectName string `validate:"omitempty,varname"`
+	// User only lists the runs launched by this os user or identity.
+	User string
+	// Stats adds the cpu, memory and network usage of running containers.
+	Stats bool
+	// Tags only lists the runs that have every one of these key=value tags.
+	Tags []string
+	// Sweep only lists the runs of this sweep.
+	Sweep string
+}
+
+func Ps(args PsArgs) {
+	validateArgs(args)
+
+	tags, err := parseTags(args.Tags)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), "", args.ProjectName, cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containers, err := dr.List(args.ProjectName)
+	if err != nil {
+		errorf("failed to list experiments: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	var stats map[string]containerStats
+	if args.Stats {
+		running := make([]string, 0, len(containers))
+		for _, c := range containers {
+			if c.State == "running" {
+				running = append(running, c.Name)
+			}
+		}
+		stats = dr.statsOf(running)
+	}
+	// usage columns, if asked for
+	usage := func(containerName string) string {
+		if !args.Stats {
+			return ""
+		}
+		s, ok := stats[containerName]
+		if !ok {
+			return "\t-\t-\t-"
+		}
+		cpu, memory, network := s.columns()
+		return fmt.Sprintf("\t%s\t%s\t%s", cpu, memory, network)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "CONTAINER\tPROJECT\tEXPERIMENT\tRUN\tUSER\tSTATE\tHEALTH\tRESTART"
+	if args.Stats {
+		header += "\tCPU\tMEM\tNET I/O"
+	}
+	fmt.Fprintln(w, header)
+	for _, c := range containers {
+		if namespace != "" && c.Namespace != namespace {
+			continue
+		}
+		if args.User != "" && c.User != args.User && c.Identity != args.User {
+			continue
+		}
+		if !matchTags(c.Tags, tags) || (args.Sweep != "" && c.Sweep != args.Sweep) {
+			continue
+		}
+
+		restart := "-"
+		if ok, reason := ShouldRestart(c); ok {
+			restart = reason
+		}
+
+		user := c.User
+		if c.Identity != "" {
+			user = c.Identity
+		}
+		if user == "" {
+			user = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s%s\n",
+			c.Name, c.ProjectName, c.ExperimentName, c.RunName, user, c.State, c.Health, restart, usage(c.Name))
+	}
+
+	// runs whose containers were removed behind invoker's back, and cloud
+	// runs as last checked
+	if sm, err := NewInnerStateManager(); err == nil {
+		states, _ := sm.List()
+		for _, s := range states {
+			if (s.VanishedAt.IsZero() && s.StrandedAt.IsZero() && s.Cloud == nil) || (args.ProjectName != "" && s.ProjectName != args.ProjectName) {
+				continue
+			}
+			if namespace != "" && s.RunArgs.Namespace != namespace {
+				continue
+			}
+			if args.User != "" && s.User != args.User && s.Identity != args.User {
+				continue
+			}
+			if !matchTags(s.Tags, tags) || (args.Sweep != "" && s.Sweep != args.Sweep) {
+				continue
+			}
+
+			state := "vanished"
+			if !s.StrandedAt.IsZero() {
+				state = "stranded"
+			}
+			if s.Cloud != nil {
+				state = fmt.Sprintf("%s %s", s.Cloud.Backend, strings.ToLower(s.Cloud.Status))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s%s\n",
+				s.ContainerName, s.ProjectName, s.ExperimentName, s.RunName, s.User, state, "-", "-", usage(s.ContainerName))
+		}
+	}
+	w.Flush()
+}
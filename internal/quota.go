@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// QuotaPolicy caps how many gpus of a host each team can claim. Teams
+// without a quota run best-effort: they can use whatever is idle, but with
+// Preempt set their runs are stopped when a team within its quota needs the
+// gpus back.
+type QuotaPolicy struct {
+	GPUQuotas map[string]int `json:"gpu_quotas"`
+	Preempt   bool           `json:"preempt"`
+	// MaxJobs caps the runs of the host at once, whoever launched them,
+	// MaxJobsPerGPU does so by the gpu count of the host. The lower one
+	// applies, none if both are 0.
+	MaxJobs       int `json:"max_jobs"`
+	MaxJobsPerGPU int `json:"max_jobs_per_gpu"`
+}
+
+// LoadQuotaPolicy reads ~/.config/higgsfield/quotas.json, a missing file
+// means no quotas at all.
+func LoadQuotaPolicy() (QuotaPolicy, error) {
+	var policy QuotaPolicy
+	if err := loadConfigFile("quotas.json", &policy); err != nil {
+		return QuotaPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+func (p QuotaPolicy) guaranteed(team string) bool {
+	_, ok := p.GPUQuotas[team]
+	return ok
+}
+
+func (p QuotaPolicy) usage(active []ExperimentState, team string) int {
+	used := 0
+	for _, s := range active {
+		if s.Team == team {
+			used += len(s.Reservation.GPUs)
+		}
+	}
+
+	return used
+}
+
+func (p QuotaPolicy) check(active []ExperimentState, state ExperimentState) error {
+	quota, ok := p.GPUQuotas[state.Team]
+	if !ok {
+		return nil
+	}
+
+	used := p.usage(active, state.Team)
+	if used+len(state.Reservation.GPUs) > quota {
+		return errors.Errorf(
+			"team %s would exceed its quota of %d gpus: %d in use, %d requested",
+			state.Team, quota, used, len(state.Reservation.GPUs),
+		)
+	}
+
+	return nil
+}
+
+// jobLimit is how many runs the host takes at once, 0 for no limit.
+func (p QuotaPolicy) jobLimit(hostGPUs int) int {
+	limit := p.MaxJobs
+	if perGPU := p.MaxJobsPerGPU * hostGPUs; perGPU > 0 && (limit == 0 || perGPU < limit) {
+		limit = perGPU
+	}
+
+	return limit
+}
+
+// victims returns best-effort runs holding any of the requested gpus,
+// newest first. Nothing is preemptible for best-effort requests.
+func (p QuotaPolicy) victims(active []ExperimentState, state ExperimentState) []ExperimentState {
+	if !p.Preempt || !p.guaranteed(state.Team) {
+		return nil
+	}
+
+	victims := make([]ExperimentState, 0)
+	for _, s := range active {
+		if p.guaranteed(s.Team) || s.Protected {
+			continue
+		}
+
+		for _, gpu := range state.Reservation.GPUs {
+			if slices.Contains(s.Reservation.GPUs, gpu) {
+				victims = append(victims, s)
+				break
+			}
+		}
+	}
+
+	sort.Slice(victims, func(i, j int) bool { return victims[i].StartedAt.After(victims[j].StartedAt) })
+
+	return victims
+}
+
+func withoutStates(states, remove []ExperimentState) []ExperimentState {
+	result := make([]ExperimentState, 0, len(states))
+	for _, s := range states {
+		if !slices.ContainsFunc(remove, func(r ExperimentState) bool { return r.ContainerName == s.ContainerName }) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+func (d *DockerRun) preempt(sm *InnerStateManager, victims []ExperimentState, by string) error {
+	for _, v := range victims {
+		fmt.Printf("preempting %s (team %s) in favour of %s\n", v.ContainerName, v.Team, by)
+		finishedAt := d.finishedAt(v.ContainerName)
+		// marked first, so attach sees why the container died
+		v.Outcome, v.OutcomeReason = outcomePreempted, "preempted by "+by
+		if err := sm.Put(v); err != nil {
+			return err
+		}
+		if err := d.Kill(v.ContainerName); err != nil {
+			return errors.WithMessagef(err, "failed to preempt %s", v.ContainerName)
+		}
+
+		if err := sm.Retire(v, finishedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
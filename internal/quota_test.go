@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func gpuRun(name, team string, gpus ...int) ExperimentState {
+	return ExperimentState{ContainerName: name, Team: team, Reservation: Reservation{GPUs: gpus}}
+}
+
+func TestQuotaPolicyCheck(t *testing.T) {
+	policy := QuotaPolicy{GPUQuotas: map[string]int{"research": 4}}
+	active := []ExperimentState{gpuRun("a", "research", 0, 1), gpuRun("b", "infra", 2, 3, 4)}
+
+	tests := []struct {
+		name    string
+		request ExperimentState
+		wantErr bool
+	}{
+		{"within quota", gpuRun("c", "research", 5, 6), false},
+		{"over quota", gpuRun("c", "research", 5, 6, 7), true},
+		{"best effort", gpuRun("c", "infra", 5, 6, 7), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := policy.check(active, tt.request); (err != nil) != tt.wantErr {
+				t.Errorf("check = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQuotaPolicyJobLimit(t *testing.T) {
+	tests := []struct {
+		maxJobs, perGPU, gpus, want int
+	}{
+		{0, 0, 8, 0},
+		{4, 0, 8, 4},
+		{0, 1, 8, 8},
+		{4, 1, 8, 4},
+		{16, 1, 8, 8},
+		// a host without gpus has no per gpu limit
+		{4, 1, 0, 4},
+	}
+	for _, tt := range tests {
+		policy := QuotaPolicy{MaxJobs: tt.maxJobs, MaxJobsPerGPU: tt.perGPU}
+		if got := policy.jobLimit(tt.gpus); got != tt.want {
+			t.Errorf("jobLimit of %+v on %d gpus = %d, want %d", policy, tt.gpus, got, tt.want)
+		}
+	}
+}
+
+func TestQuotaPolicyVictims(t *testing.T) {
+	c := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer SetClock(c)()
+
+	// runs started a minute apart, the way run stamps them
+	started := func(s ExperimentState) ExperimentState {
+		s.StartedAt = clock.Now().UTC()
+		c.Advance(time.Minute)
+		return s
+	}
+	protected := gpuRun("protected", "infra", 3)
+	protected.Protected = true
+	active := []ExperimentState{
+		started(gpuRun("old", "infra", 0)),
+		started(gpuRun("guaranteed", "research", 1)),
+		started(gpuRun("new", "infra", 2)),
+		started(protected),
+		started(gpuRun("elsewhere", "infra", 7)),
+	}
+	// every state write restamps UpdatedAt, the old run's came last, which
+	// doesn't make it any newer
+	for i := range active {
+		active[len(active)-1-i].UpdatedAt = clock.Now().UTC()
+		c.Advance(time.Minute)
+	}
+
+	tests := []struct {
+		name    string
+		policy  QuotaPolicy
+		request ExperimentState
+		want    []string
+	}{
+		{"newest first", QuotaPolicy{GPUQuotas: map[string]int{"research": 8}, Preempt: true}, gpuRun("r", "research", 0, 1, 2, 3), []string{"new", "old"}},
+		{"without preemption", QuotaPolicy{GPUQuotas: map[string]int{"research": 8}}, gpuRun("r", "research", 0, 1, 2, 3), nil},
+		{"best effort request", QuotaPolicy{GPUQuotas: map[string]int{"research": 8}, Preempt: true}, gpuRun("r", "infra", 0, 2), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			victims := tt.policy.victims(active, tt.request)
+			names := make([]string, 0, len(victims))
+			for _, v := range victims {
+				names = append(names, v.ContainerName)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("victims = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
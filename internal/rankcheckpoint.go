@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// rankCheckpointEnv is the directory the node writes its part of each
+	// checkpoint to, set for runs of several nodes on a shared run directory.
+	rankCheckpointEnv = "INVOKER_RANK_CHECKPOINT_DIR"
+	// checkpointCommitEnv is where node rank 0 commits checkpoints once
+	// every node wrote its part.
+	checkpointCommitEnv = "INVOKER_CHECKPOINT_COMMIT_DIR"
+	// nodeRankEnv and nodesEnv tell the node which part is its own and
+	// how many parts a checkpoint has.
+	nodeRankEnv = "INVOKER_NODE_RANK"
+	nodesEnv    = "INVOKER_NODES"
+
+	ranksDirName   = "ranks"
+	commitsDirName = "commits"
+	// writtenSuffix marks the part of a node as complete, next to it.
+	writtenSuffix = ".written"
+)
+
+// rankCheckpointDir is the directory of the node's parts in the run
+// directory.
+func rankCheckpointDir(runDir string, rank int) string {
+	return filepath.Join(runDir, ranksDirName, strconv.Itoa(rank))
+}
+
+// hasRankCheckpoints is whether the run wrote its checkpoints by rank.
+func hasRankCheckpoints(runDir string) bool {
+	_, err := files.Stat(filepath.Join(runDir, ranksDirName))
+	return err == nil
+}
+
+// prepareRankCheckpoints creates the directory of the node and the commit
+// directory, and gives the environment telling the node about them.
+//
+// Markers of parts that were never committed are removed, they are left
+// over from an attempt that failed while saving. Otherwise rank 0 could
+// take them for the parts of the next attempt and commit a checkpoint
+// before this node rewrote it. Each node only touches its own directory.
+func prepareRankCheckpoints(dr *DockerRun, runDir string, rank, nodes int) ([]string, error) {
+	rankDir := rankCheckpointDir(runDir, rank)
+	commitDir := filepath.Join(runDir, commitsDirName)
+	for _, dir := range []string{rankDir, commitDir} {
+		if err := files.MkdirAll(dir, 0o755); err != nil {
+			return nil, errors.WithMessagef(err, "failed to create %s", dir)
+		}
+	}
+
+	entries, err := files.ReadDir(rankDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to list %s", rankDir)
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), writtenSuffix)
+		if !ok {
+			continue
+		}
+		if _, err := files.Stat(filepath.Join(commitDir, name)); err == nil {
+			continue
+		}
+		if err := files.Remove(filepath.Join(rankDir, e.Name())); err != nil {
+			return nil, errors.WithMessagef(err, "failed to remove the stale marker of %s", name)
+		}
+		warnf("%s was never committed, its part of rank %d will be written again\n", name, rank)
+	}
+
+	guestRankDir, err := dr.guestPath(rankDir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to resolve rank checkpoint directory")
+	}
+	guestCommitDir, err := dr.guestPath(commitDir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to resolve checkpoint commit directory")
+	}
+
+	return []string{
+		rankCheckpointEnv + "=" + guestRankDir,
+		checkpointCommitEnv + "=" + guestCommitDir,
+		nodeRankEnv + "=" + strconv.Itoa(rank),
+		nodesEnv + "=" + strconv.Itoa(nodes),
+	}, nil
+}
+
+// committedCheckpoints are the checkpoints rank 0 committed whose parts
+// all nodes marked as written, newest first.
+func committedCheckpoints(runDir string, nodes int) ([]string, error) {
+	commitDir := filepath.Join(runDir, commitsDirName)
+	entries, err := files.ReadDir(commitDir)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to list %s", commitDir)
+	}
+
+	type commit struct {
+		name string
+		at   int64
+	}
+	commits := make([]commit, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if missing := missingParts(runDir, e.Name(), nodes); len(missing) > 0 {
+			warnf("%s was committed without the parts of ranks %v, skipping it\n", e.Name(), missing)
+			continue
+		}
+		commits = append(commits, commit{name: e.Name(), at: info.ModTime().UnixNano()})
+	}
+	sort.SliceStable(commits, func(i, j int) bool { return commits[i].at > commits[j].at })
+
+	names := make([]string, len(commits))
+	for i, c := range commits {
+		names[i] = c.name
+	}
+	return names, nil
+}
+
+// missingParts are the ranks that didn't mark their part of the checkpoint
+// as written.
+func missingParts(runDir, name string, nodes int) []int {
+	missing := make([]int, 0)
+	for rank := 0; rank < nodes; rank++ {
+		if _, err := files.Stat(filepath.Join(rankCheckpointDir(runDir, rank), name+writtenSuffix)); err != nil {
+			missing = append(missing, rank)
+		}
+	}
+
+	return missing
+}
+
+// latestCommittedCheckpoint is the node's part of the newest committed
+// checkpoint matching the pattern.
+func latestCommittedCheckpoint(runDir, pattern string, rank, nodes int) (string, error) {
+	names, err := committedCheckpoints(runDir, nodes)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if pattern != "" {
+			if ok, err := filepath.Match(pattern, name); err != nil {
+				return "", errors.WithMessagef(err, "invalid resume pattern %q", pattern)
+			} else if !ok {
+				continue
+			}
+		}
+		return filepath.Join(rankCheckpointDir(runDir, rank), name), nil
+	}
+
+	return "", errors.Errorf("no committed checkpoint in %s", filepath.Join(runDir, commitsDirName))
+}
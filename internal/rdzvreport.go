@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rendezvousTimeoutMarkers are what torch prints when nodes didn't join in
+// time, from the elastic agent and from the store based barrier.
+var rendezvousTimeoutMarkers = []string{
+	"RendezvousTimeoutError",
+	"RendezvousClosedError",
+	"Timed out initializing process group in store based barrier",
+	"DistStoreError",
+	"The client socket has timed out",
+}
+
+func rendezvousTimedOut(logs string) bool {
+	for _, marker := range rendezvousTimeoutMarkers {
+		if strings.Contains(logs, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerCheckTimeout bounds asking a peer over ssh whether it joined.
+const peerCheckTimeout = 15 * time.Second
+
+// missingPeersReport asks the other nodes of the run over ssh whether they
+// started their container, and lists the ones that didn't or couldn't be
+// asked.
+func missingPeersReport(ctx context.Context, state ExperimentState) string {
+	hosts := state.RunArgs.Hosts
+	if len(hosts) < 2 {
+		return ""
+	}
+
+	missing := make([]string, 0)
+	for rank, host := range hosts {
+		if rank == state.Rank {
+			continue
+		}
+		if reason := peerMissing(ctx, host, state.ContainerName); reason != "" {
+			missing = append(missing, fmt.Sprintf("  %s (rank %d): %s", host, rank, reason))
+		}
+	}
+
+	if len(missing) == 0 {
+		return "the rendezvous timed out, but every peer has started its container, check the network between the nodes and --rdzv_timeout"
+	}
+	return fmt.Sprintf("the rendezvous timed out waiting for %d of %d peers:\n%s", len(missing), len(hosts)-1, strings.Join(missing, "\n"))
+}
+
+// peerMissing tells why the node didn't show up, empty if it started its
+// container.
+func peerMissing(ctx context.Context, host, containerName string) string {
+	ctx, cancel := context.WithTimeout(ctx, peerCheckTimeout)
+	defer cancel()
+
+	out, err := outputOnHost(ctx, host, "state", "show", containerName)
+	if err != nil {
+		if strings.Contains(out, "no recorded state") {
+			return "no run was launched there"
+		}
+		return fmt.Sprintf("couldn't be asked: %v", err)
+	}
+
+	var states []ExperimentState
+	if err := json.Unmarshal([]byte(out), &states); err != nil || len(states) == 0 {
+		return "no run was launched there"
+	}
+	peer := states[0]
+	switch {
+	case !peer.VanishedAt.IsZero():
+		return "its container vanished"
+	case peer.ImageID == "":
+		return "its launch never created a container"
+	}
+
+	return ""
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+func (m *InnerStateManager) bootIDFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "boot_id")
+}
+
+// rebooted tells whether the host booted since the last call, recording
+// the boot it's in now. The first call on a host has nothing to compare
+// with, and hosts without a boot id never reboot as far as this goes.
+func (m *InnerStateManager) rebooted() (bool, error) {
+	data, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return false, nil
+	}
+	current := strings.TrimSpace(string(data))
+
+	previous, err := files.ReadFile(m.bootIDFile())
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.WithMessage(err, "failed to read the last boot id")
+	}
+	if strings.TrimSpace(string(previous)) == current {
+		return false, nil
+	}
+	if err := files.WriteFile(m.bootIDFile(), []byte(current+"\n"), 0o644); err != nil {
+		return false, errors.WithMessage(err, "failed to record the boot id")
+	}
+
+	return len(previous) > 0, nil
+}
+
+// resumeAfterReboot handles the runs a reboot of the host took down when
+// `experiment watch` starts: the ones their restart policy allows are
+// restarted, rejoining the other nodes of multi-node runs through the
+// restart barrier, the others are marked as stranded and the reboot hooks
+// tell whoever coordinates the hosts.
+func resumeAfterReboot(ctx context.Context, dr *DockerRun, sm *InnerStateManager, store *MetricsStore, args WatchArgs) error {
+	rebooted, err := sm.rebooted()
+	if err != nil || !rebooted {
+		return err
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		return err
+	}
+	containers, err := dr.List("")
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+	health, err := sm.NodeHealth()
+	if err != nil {
+		return err
+	}
+
+	infof("the host rebooted, resuming the runs it took down\n")
+	for _, state := range states {
+		// runs elsewhere didn't go down with this host
+		if state.Outcome != "" || state.Cloud != nil || state.RunArgs.DockerContext != "" {
+			continue
+		}
+		c, found := byName[state.ContainerName]
+		if found && c.State == "running" {
+			continue
+		}
+		if !found {
+			c = ExperimentContainer{Name: state.ContainerName, ProjectName: state.ProjectName, ExperimentName: state.ExperimentName, RunName: state.RunName, State: "missing"}
+		}
+
+		candidate := restartCandidate{Container: c, Reason: "the host rebooted", Failure: FailureKilled}
+		blocker, err := restartBlocker(dr, store, state, candidate, args.MaxRestarts, health)
+		if err != nil {
+			blocker = fmt.Sprintf("deciding on a restart failed: %v", err)
+		}
+		if blocker == "" {
+			fmt.Printf("restarting %s: the host rebooted\n", state.ContainerName)
+			notifyHooks(hookRestart, state)
+			// the container is gone with the boot or its image may be
+			err = restartFromState(ctx, state, "", args.Rebuild, args.Recreate || !found)
+			if err == nil {
+				continue
+			}
+			blocker = fmt.Sprintf("restarting it failed: %v", err)
+		}
+
+		warnf("%s was taken down by the reboot and stays down, %s\n", state.ContainerName, blocker)
+		current, err := sm.Get(state.ContainerName)
+		if err != nil {
+			return err
+		} else if current == nil {
+			continue
+		}
+		current.StrandedAt, current.StrandedReason = clock.Now().UTC(), blocker
+		if err := sm.Put(*current); err != nil {
+			return err
+		}
+		notifyHooks(hookReboot, *current)
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// reconcilePing is how long a command waits for the daemon before it skips
+// reconciling, docker not running shouldn't hold up commands that don't
+// need it.
+const reconcilePing = 2 * time.Second
+
+// localDocker connects to the daemon of this host without retrying, nil if
+// it isn't reachable or the environment points at a remote one.
+func localDocker(ctx context.Context) *DockerRun {
+	endpoint, err := resolveDockerEndpoint("")
+	if err != nil || endpoint.remote() {
+		return nil
+	}
+	opts, err := endpoint.clientOpts()
+	if err != nil {
+		return nil
+	}
+	config, err := LoadDockerConfig()
+	if err != nil {
+		return nil
+	}
+	timeouts, err := config.Timeouts.durations()
+	if err != nil {
+		return nil
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, reconcilePing)
+	defer cancel()
+	if _, err := cli.Ping(pingCtx); err != nil {
+		cli.Close()
+		return nil
+	}
+
+	return &DockerRun{client: cli, ctx: ctx, timeouts: timeouts}
+}
+
+// adoptedState rebuilds the state of a running invoker container from its
+// labels and configuration. The launch arguments are lost, so it's never
+// restarted.
+func (d *DockerRun) adoptedState(c ExperimentContainer) (ExperimentState, error) {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	inspect, err := d.client.ContainerInspect(ctx, c.Name)
+	if err != nil {
+		return ExperimentState{}, errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to inspect container %s", c.Name)
+	}
+
+	reservation := Reservation{}
+	if inspect.HostConfig != nil {
+		reservation.MemoryBytes = inspect.HostConfig.Memory
+		for _, request := range inspect.HostConfig.DeviceRequests {
+			for _, id := range request.DeviceIDs {
+				if gpu, err := strconv.Atoi(id); err == nil {
+					reservation.GPUs = append(reservation.GPUs, gpu)
+				}
+			}
+			if len(request.DeviceIDs) == 0 && request.Count == -1 {
+				reservation.GPUs = nvidiaGPUIndices()
+			}
+		}
+	}
+
+	var entrypoint []string
+	if inspect.Config != nil {
+		entrypoint = concat(inspect.Config.Entrypoint, inspect.Config.Cmd)
+		for port := range inspect.Config.ExposedPorts {
+			reservation.Port = port.Int()
+			break
+		}
+	}
+
+	return ExperimentState{
+		ContainerName:  c.Name,
+		ProjectName:    c.ProjectName,
+		ExperimentName: c.ExperimentName,
+		RunName:        c.RunName,
+		User:           c.User,
+		Identity:       c.Identity,
+		Reservation:    reservation,
+		RunArgs: RunArgs{
+			ProjectName:    c.ProjectName,
+			ExperimentName: c.ExperimentName,
+			RunName:        c.RunName,
+			Namespace:      c.Namespace,
+		},
+		Entrypoint: entrypoint,
+		ImageID:    inspect.Image,
+		Adopted:    true,
+		StartedAt:  c.StartedAt,
+		Tags:       c.Tags,
+		Sweep:      c.Sweep,
+	}, nil
+}
+
+// reconcile brings the state in line with the containers of this host: runs
+// whose containers vanished are marked, running invoker containers without
+// a state are adopted. States of launches in progress and of remote
+// daemons are left alone. It returns what it changed.
+func reconcile(dr *DockerRun, sm *InnerStateManager) ([]string, error) {
+	unlock, err := sm.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := dr.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	changes := make([]string, 0)
+	known := make(map[string]bool, len(states))
+	for _, s := range states {
+		known[s.ContainerName] = true
+		if _, found := byName[s.ContainerName]; found || !s.VanishedAt.IsZero() {
+			continue
+		}
+		// launches that haven't created their container yet are for
+		// cleanup to judge
+		if s.ImageID == "" || s.RunArgs.DockerContext != "" || s.Cloud != nil || processAlive(s.LauncherPID) {
+			continue
+		}
+
+		s.VanishedAt = clock.Now().UTC()
+		if err := sm.Put(s); err != nil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("container of %s vanished, marked its state", s.ContainerName))
+	}
+
+	for _, c := range containers {
+		if known[c.Name] || c.State != "running" {
+			continue
+		}
+
+		state, err := dr.adoptedState(c)
+		if err != nil {
+			return changes, err
+		}
+		if err := sm.Put(state); err != nil {
+			return changes, err
+		}
+		changes = append(changes, fmt.Sprintf("%s was running without a state, adopted it", c.Name))
+	}
+
+	return changes, nil
+}
+
+// ReconcileState runs before every command and reports what it changed on
+// stderr, so it doesn't end up in output that's piped on. It stays quiet
+// when docker isn't reachable, the commands that need it say so
+// themselves.
+func ReconcileState() {
+	ctx := context.Background()
+	dr := localDocker(ctx)
+	if dr == nil {
+		return
+	}
+	defer dr.client.Close()
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return
+	}
+
+	changes, err := reconcile(dr, sm)
+	for _, change := range changes {
+		fmt.Fprintf(os.Stderr, "reconciled state: %s\n", change)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reconcile state: %v\n", err)
+	}
+}
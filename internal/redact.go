@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "<redacted>"
+
+// secretName matches the names of variables and parameters whose values
+// are masked wherever invoker prints them.
+var secretName = regexp.MustCompile(`(?i)(TOKEN|SECRET|KEY|PASSWORD|PASSWD|CREDENTIAL|AUTH)`)
+
+// secretFlags and secretAssignments find --name value, --name=value and
+// NAME=value in free text.
+var (
+	secretFlags       = regexp.MustCompile(`(--[A-Za-z_][A-Za-z0-9_.-]*)(=|\s+)("[^"]*"|'[^']*'|\S+)`)
+	secretAssignments = regexp.MustCompile(`\b([A-Za-z_][A-Za-z0-9_]*)(=)("[^"]*"|'[^']*'|\S+)`)
+)
+
+// redactArgs masks the values of command line arguments with secret
+// names, given as --name value, --name=value or NAME=value.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, ok := strings.Cut(arg, "=")
+		switch {
+		case ok && secretName.MatchString(name):
+			arg = name + "=" + redactedValue
+		case !ok && strings.HasPrefix(arg, "--") && secretName.MatchString(arg) && i+1 < len(args) && !strings.HasPrefix(args[i+1], "--"):
+			redacted[i] = arg
+			i++
+			arg = redactedValue
+		}
+		redacted[i] = arg
+	}
+
+	return redacted
+}
+
+// redactText masks secret values in log output, where they show up as
+// NAME=value or as command line arguments.
+func redactText(text string) string {
+	for _, pattern := range []*regexp.Regexp{secretFlags, secretAssignments} {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			parts := pattern.FindStringSubmatch(match)
+			if !secretName.MatchString(parts[1]) {
+				return match
+			}
+			return parts[1] + parts[2] + redactedValue
+		})
+	}
+
+	return text
+}
+
+// redacted is the state as it's shown, with the secrets in its commands
+// masked.
+func (s ExperimentState) redacted() ExperimentState {
+	s.Entrypoint = redactArgs(s.Entrypoint)
+	s.RunArgs.Rest = redactArgs(s.RunArgs.Rest)
+	return s
+}
+
+func (r RunRecord) redacted() RunRecord {
+	r.Entrypoint = redactArgs(r.Entrypoint)
+	return r
+}
+
+// redactWriter masks secrets in output copied to w a line at a time. A
+// carriage return ends a line too, so progress bars keep moving.
+type redactWriter struct {
+	w       io.Writer
+	pending []byte
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	r.pending = append(r.pending, p...)
+	for {
+		end := bytes.IndexAny(r.pending, "\r\n")
+		if end < 0 {
+			return len(p), nil
+		}
+		if _, err := io.WriteString(r.w, redactText(string(r.pending[:end]))+string(r.pending[end])); err != nil {
+			return len(p), err
+		}
+		r.pending = r.pending[end+1:]
+	}
+}
+
+// Flush writes what's left of the last line.
+func (r *redactWriter) Flush() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, redactText(string(r.pending)))
+	r.pending = nil
+	return err
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rendezvousHello is what a worker tells the master before any container
+// starts, so that nodes disagreeing on the hosts or their ranks fail fast
+// instead of timing out inside torchrun. A master sends one to the master
+// address as well, with Claim set, to find out whether it's really the
+// node behind it.
+type rendezvousHello struct {
+	Digest string `json:"digest"`
+	Rank   int    `json:"rank"`
+	Claim  string `json:"claim,omitempty"`
+}
+
+type rendezvousReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// hostsDigest identifies the run and the ordered host list every node has
+// to agree on.
+func hostsDigest(hosts []string, experimentName, runName string) string {
+	sum := sha256.Sum256([]byte(experimentName + "/" + runName + "/" + strings.Join(hosts, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// rendezvousCheck makes sure every node computed the same host list and a
+// rank of its own. The master listens on the master port until all other
+// ranks checked in, the workers connect to it.
+func rendezvousCheck(hosts []string, rank, port int, digest string, timeout time.Duration) error {
+	masterAddr := net.JoinHostPort(hosts[0], fmt.Sprint(port))
+	if rank == 0 {
+		return rendezvousMaster(len(hosts), masterAddr, port, digest, timeout)
+	}
+
+	return rendezvousWorker(masterAddr, rank, digest, timeout)
+}
+
+// exchange sends hello over a fresh connection and waits for the reply.
+func exchange(addr string, hello rendezvousHello, deadline time.Time) (rendezvousReply, error) {
+	var reply rendezvousReply
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return reply, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(deadline)
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		return reply, errors.WithMessagef(err, "failed to check in with %s", addr)
+	}
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&reply); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return reply, errors.Errorf("%s did not confirm the rendezvous in time", addr)
+		}
+		return reply, errors.Errorf("%s did not answer the rendezvous check, another node may already run as rank 0", addr)
+	}
+
+	return reply, nil
+}
+
+// claimMaster connects to the master address until it reaches a listener.
+// It fails if the node behind the address is not this one, which means two
+// nodes both believe they are rank 0. It gives up silently when ctx ends,
+// some networks can't reach their own public address.
+func claimMaster(ctx context.Context, masterAddr, digest, nonce string, deadline time.Time) error {
+	for ctx.Err() == nil {
+		reply, err := exchange(masterAddr, rendezvousHello{Digest: digest, Claim: nonce}, deadline)
+		if _, ok := err.(net.Error); ok {
+			clock.Sleep(2 * time.Second)
+			continue
+		} else if err != nil {
+			return err
+		} else if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+func rendezvousMaster(nodes int, masterAddr string, port int, digest string, timeout time.Duration) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return errors.WithMessagef(err, "failed to listen on %d for the rendezvous check", port)
+	}
+	defer listener.Close()
+
+	deadline := clock.Now().Add(timeout)
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	claim := hex.EncodeToString(nonce)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	claimErr := make(chan error, 1)
+	go func() { claimErr <- claimMaster(ctx, masterAddr, digest, claim, deadline) }()
+
+	fmt.Printf("waiting for %d nodes to check in\n", nodes-1)
+	joined := make(map[int]net.Conn, nodes-1)
+	defer func() {
+		for _, conn := range joined {
+			conn.Close()
+		}
+	}()
+
+	fail := func(reason string) error {
+		// everyone who checked in fails with the same reason
+		for _, c := range joined {
+			json.NewEncoder(c).Encode(rendezvousReply{Error: reason})
+		}
+		return errors.New(reason)
+	}
+
+	for len(joined) < nodes-1 {
+		select {
+		case err := <-claimErr:
+			if err != nil {
+				return fail(fmt.Sprintf("this node and the one at %s both believe they are rank 0: %v", masterAddr, err))
+			}
+		default:
+		}
+
+		next := clock.Now().Add(time.Second)
+		if next.After(deadline) {
+			next = deadline
+		}
+		listener.(*net.TCPListener).SetDeadline(next)
+
+		conn, err := listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && clock.Now().Before(deadline) {
+			continue
+		} else if err != nil {
+			missing := make([]string, 0)
+			for r := 1; r < nodes; r++ {
+				if _, ok := joined[r]; !ok {
+					missing = append(missing, fmt.Sprint(r))
+				}
+			}
+			return fail(fmt.Sprintf("ranks %s did not check in within %s, if they checked in with another node it also believes it is rank 0",
+				strings.Join(missing, ", "), timeout))
+		}
+		conn.SetDeadline(clock.Now().Add(10 * time.Second))
+
+		var hello rendezvousHello
+		if err := json.NewDecoder(conn).Decode(&hello); err != nil {
+			conn.Close()
+			continue
+		}
+		conn.SetDeadline(deadline)
+
+		if hello.Claim == claim {
+			json.NewEncoder(conn).Encode(rendezvousReply{})
+			conn.Close()
+			continue
+		}
+
+		var reject string
+		switch {
+		case hello.Claim != "":
+			reject = fmt.Sprintf("%s and this node both believe they are rank 0", conn.RemoteAddr())
+		case hello.Digest != digest:
+			reject = fmt.Sprintf("%s has a different host list or run than the master", conn.RemoteAddr())
+		case hello.Rank <= 0 || hello.Rank >= nodes:
+			reject = fmt.Sprintf("%s computed rank %d, which is not a worker rank", conn.RemoteAddr(), hello.Rank)
+		case joined[hello.Rank] != nil:
+			reject = fmt.Sprintf("%s and %s both computed rank %d", joined[hello.Rank].RemoteAddr(), conn.RemoteAddr(), hello.Rank)
+		}
+		if reject != "" {
+			json.NewEncoder(conn).Encode(rendezvousReply{Error: reject})
+			conn.Close()
+			return fail(reject)
+		}
+
+		joined[hello.Rank] = conn
+	}
+
+	for _, conn := range joined {
+		json.NewEncoder(conn).Encode(rendezvousReply{})
+	}
+	fmt.Printf("all %d nodes checked in\n", nodes)
+
+	return nil
+}
+
+func rendezvousWorker(masterAddr string, rank int, digest string, timeout time.Duration) error {
+	deadline := clock.Now().Add(timeout)
+
+	fmt.Printf("checking in with the master at %s\n", masterAddr)
+	for {
+		reply, err := exchange(masterAddr, rendezvousHello{Digest: digest, Rank: rank}, deadline)
+		if _, ok := err.(net.Error); ok {
+			if clock.Now().After(deadline) {
+				return errors.Errorf("master %s did not answer within %s", masterAddr, timeout)
+			}
+			clock.Sleep(2 * time.Second)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+type RestartArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	Rebuild        bool
+	// Image moves the run onto another image instead of the recorded one.
+	Image string
+	// Recreate creates a new container even if the exited one could be
+	// started again.
+	Recreate bool
+}
+
+func nameFromRestartArgs(args RestartArgs) string {
+	if args.ContainerName != nil && *args.ContainerName != "" {
+		return *args.ContainerName
+	}
+
+	return DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
+}
+
+// launchDigest hashes what a container of the run is created from besides
+// the image: its arguments, invoker.yaml, the env file, the higgsfield
+// project and the plugins with their hooks.
+func launchDigest(args RunArgs) (string, error) {
+	config, err := LoadProjectConfig(args.ProjectPath)
+	if err != nil {
+		return "", err
+	}
+	var fileEnv []string
+	if args.EnvFile != "" {
+		if fileEnv, err = readEnvFile(args.EnvFile); err != nil {
+			return "", err
+		}
+	}
+	var projectEnv []string
+	if project, err := LoadHiggsfieldProject(args.ProjectPath); err != nil {
+		return "", err
+	} else if project != nil {
+		projectEnv = project.env()
+	}
+	plugins, err := LoadPluginConfig()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal([]any{args, config, fileEnv, projectEnv, plugins})
+	if err != nil {
+		return "", errors.WithMessage(err, "failed to hash the launch configuration")
+	}
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// startExisting starts the exited container of the run again as it is, if
+// it still runs the recorded image and nothing it was created from changed
+// since. That skips the build and the create and keeps whatever the run
+// left inside the container. It returns false if the container can't be
+// reused.
+func startExisting(ctx context.Context, state ExperimentState) (bool, error) {
+	if state.ImageID == "" || state.LaunchDigest == "" {
+		return false, nil
+	}
+	if digest, err := launchDigest(state.RunArgs); err != nil {
+		return false, err
+	} else if digest != state.LaunchDigest {
+		infof("the configuration of %s changed since its container was created, creating a new one\n", state.ContainerName)
+		return false, nil
+	}
+
+	dr, err := NewDockerRun(ctx, state.RunArgs.DockerContext, state.ProjectName, state.RunArgs.ProjectPath, "")
+	if err != nil {
+		return false, err
+	}
+
+	inspectCtx, cancel := dr.deadline(dockerOpInspect)
+	defer cancel()
+
+	inspect, err := dr.client.ContainerInspect(inspectCtx, state.ContainerName)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithMessagef(dr.timedOut(inspectCtx, dockerOpInspect, err), "failed to inspect container %s", state.ContainerName)
+	}
+	if inspect.State.Running || inspect.Image != state.ImageID {
+		return false, nil
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return false, errors.WithMessage(err, "failed to open state")
+	}
+
+	plugins, err := LoadPluginConfig()
+	if err != nil {
+		return false, err
+	}
+	if err := plugins.runHooks(hookPreLaunch, state); err != nil {
+		return false, err
+	}
+
+	state.Attempts++
+	state.StartedAt = clock.Now().UTC()
+	if err := sm.Put(state); err != nil {
+		return false, err
+	}
+
+	fmt.Printf("starting exited container %s again\n", state.ContainerName)
+	startCtx, cancel := dr.deadline(dockerOpCreate)
+	defer cancel()
+
+	if err := dr.client.ContainerStart(startCtx, inspect.ID, types.ContainerStartOptions{}); err != nil {
+		return false, errors.WithMessagef(dr.timedOut(startCtx, dockerOpCreate, err), "failed to start container %s", state.ContainerName)
+	}
+
+	if err := plugins.runHooks(hookPostLaunch, state); err != nil {
+		warnf("%v\n", err)
+	}
+
+	return true, nil
+}
+
+// restartFromState launches the recorded run again on this host with the
+// recorded entrypoint. Unless rebuild is set it reuses the image the run was
+// started from, so the restarted run executes the same code even if the
+// project or invoker itself changed since. A non-empty image replaces the
+// recorded one. When nothing is to change and recreate isn't set, the
+// exited container is started again instead of creating a new one.
+func restartFromState(ctx context.Context, state ExperimentState, image string, rebuild, recreate bool) error {
+	return relaunch(ctx, state, image, rebuild, recreate, nil)
+}
+
+// relaunch is restartFromState, resuming from a checkpoint if resume is
+// set, which always takes a new container.
+func relaunch(ctx context.Context, state ExperimentState, image string, rebuild, recreate bool, resume *resumePoint) error {
+	// the host may have changed since, like a swapped gpu
+	if endpoint, err := resolveDockerEndpoint(state.RunArgs.DockerContext); err == nil && !endpoint.remote() {
+		if err := checkConstraints(state.RunArgs.Constraints, state.Reservation.GPUs); err != nil {
+			return errors.WithMessage(err, "not restarting on this host")
+		}
+	}
+
+	if len(state.RunArgs.Hosts) > 1 {
+		if err := restartBarrier(ctx, state); err != nil {
+			return err
+		}
+	}
+
+	if image == "" && !rebuild && !recreate && resume == nil {
+		started, err := startExisting(ctx, state)
+		if err != nil {
+			return err
+		} else if started {
+			return nil
+		}
+	}
+
+	args := state.RunArgs
+	if image != "" {
+		args.Image = image
+	} else if rebuild {
+		args.Image = ""
+	} else if state.ImageID != "" {
+		args.Image = state.ImageID
+	}
+
+	plan := launchPlan{
+		Master:     state.Master,
+		Rank:       state.Rank,
+		Attempts:   state.Attempts + 1,
+		Entrypoint: state.Entrypoint,
+		Protected:  state.Protected,
+		Failures:   state.Failures,
+		Resume:     resume,
+	}
+
+	if err := launch(ctx, args, plan); err != nil {
+		if !rebuild && image == "" && args.Image != "" {
+			return errors.WithMessage(err, "failed to restart from the recorded image, use --rebuild to build a new one")
+		}
+		return err
+	}
+
+	return nil
+}
+
+func Restart(args RestartArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containerName := nameFromRestartArgs(args)
+	state, err := sm.Get(containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if state == nil {
+		errorf("no recorded run for %s on this host\n", containerName)
+		os.Exit(ExitValidation)
+	}
+
+	if err := restartFromState(context.Background(), *state, args.Image, args.Rebuild, args.Recreate); err != nil {
+		errorf("failed to restart %s: %+v\n", containerName, err)
+		os.Exit(ExitInfra)
+	}
+}
+
+type WatchArgs struct {
+	Interval    time.Duration `validate:"required"`
+	MaxRestarts int           `validate:"min=0"`
+	Rebuild     bool
+	Recreate    bool
+}
+
+// Watch restarts failed or unhealthy experiments of this host and enforces
+// their early stop and sweep policies until it's interrupted.
+func Watch(args WatchArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	ctx := context.Background()
+	dr, err := NewDockerRun(ctx, "", "", cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if err := resumeAfterReboot(ctx, dr, sm, store, args); err != nil {
+		warnf("failed to resume the runs after the reboot: %v\n", err)
+	}
+
+	for {
+		if err := sm.putWatchHeartbeat(args.Interval); err != nil {
+			warnf("watch: %v\n", err)
+		}
+		if err := watchOnce(ctx, dr, sm, store, args); err != nil {
+			warnf("watch: %v\n", err)
+		}
+		clock.Sleep(args.Interval)
+	}
+}
+
+func watchOnce(ctx context.Context, dr *DockerRun, sm *InnerStateManager, store *MetricsStore, args WatchArgs) error {
+	states, err := sm.List()
+	if err != nil {
+		return err
+	}
+
+	containers, err := dr.List("")
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	health, err := checkGPUHealth(sm)
+	if err != nil {
+		warnf("failed to check gpu health: %v\n", err)
+	}
+
+	refreshCloudRuns(sm, states)
+	if _, err := sm.freshCloudMetadata(cloudMetadataTTL); err != nil {
+		warnf("failed to collect cloud metadata: %v\n", err)
+	}
+	if err := autoscaleOnce(sm, states); err != nil {
+		warnf("autoscale: %v\n", err)
+	}
+	if err := retryWebhooks(); err != nil {
+		warnf("failed to retry webhooks: %v\n", err)
+	}
+
+	pruned := pruneSweeps(dr, sm, store, states, byName)
+
+	for _, state := range states {
+		c, ok := byName[state.ContainerName]
+		if !ok || pruned[state.ContainerName] {
+			continue
+		}
+
+		if c.State == "running" && state.EarlyStop.enabled() {
+			stopped, err := earlyStop(dr, sm, store, state)
+			if err != nil {
+				warnf("failed to check early stop of %s: %v\n", state.ContainerName, err)
+			}
+			if stopped {
+				continue
+			}
+		}
+
+		if c.State == "exited" {
+			if _, err := recordRunResult(dr, state); err != nil {
+				warnf("failed to record the result of %s: %v\n", state.ContainerName, err)
+			}
+		}
+
+		restart, reason := ShouldRestart(c)
+		if !restart {
+			continue
+		}
+
+		// a run being stopped is marked before its container stops, so
+		// looking again after seeing the container exit is enough
+		current, err := sm.Get(state.ContainerName)
+		if err != nil || current == nil || current.Outcome != "" {
+			continue
+		}
+		state = *current
+
+		if c.State == "exited" {
+			if state, err = sm.recordFailure(dr, state, c.ExitCode); err != nil {
+				warnf("failed to snapshot the host for %s: %v\n", state.ContainerName, err)
+			}
+		}
+
+		state = sm.refreshActions(state)
+		candidate, err := failedCandidate(dr, c, reason)
+		var blocker string
+		if err == nil {
+			blocker, err = restartBlocker(dr, store, state, candidate, args.MaxRestarts, health)
+		}
+		if err != nil {
+			warnf("%s %s, but deciding on a restart failed, asking again later: %v\n", state.ContainerName, reason, err)
+			continue
+		} else if blocker != "" {
+			fmt.Printf("%s %s, but %s\n", state.ContainerName, reason, blocker)
+			continue
+		}
+
+		fmt.Printf("restarting %s: %s\n", state.ContainerName, reason)
+		notifyHooks(hookRestart, state)
+		if err := restartFromState(ctx, state, "", args.Rebuild, args.Recreate); err != nil {
+			warnf("failed to restart %s: %+v\n", state.ContainerName, err)
+		}
+	}
+
+	return nil
+}
+
+// restartBlocker tells why the failed run is not restarted, empty if it is.
+// An error of its restart policy leaves it alone until the next check.
+func restartBlocker(dr *DockerRun, store *MetricsStore, state ExperimentState, candidate restartCandidate, maxRestarts int, health NodeHealth) (string, error) {
+	if state.Actions.Restartable != nil && !*state.Actions.Restartable {
+		return "it asked not to be restarted", nil
+	}
+
+	if state.Adopted {
+		return "it was adopted without its launch arguments", nil
+	}
+
+	ok, why, err := state.Restart.decide(dr, store, state, candidate)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "not restarting it as " + why, nil
+	}
+
+	if state.Actions.MaxRestarts != nil {
+		maxRestarts = *state.Actions.MaxRestarts
+	}
+	if state.Attempts >= maxRestarts {
+		return fmt.Sprintf("it was restarted %d times already", state.Attempts), nil
+	}
+
+	if err := health.check(state.Reservation.GPUs); err != nil {
+		return fmt.Sprintf("not restarting it: %v", err), nil
+	}
+
+	return "", nil
+}
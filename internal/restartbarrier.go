@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	restartBarrierDir = ".restart-barrier"
+	// restartBarrierTimeout is how long a restarting node waits for the
+	// other nodes of its run to stop, a hung node usually fails on its
+	// nccl timeout within it.
+	restartBarrierTimeout = 10 * time.Minute
+	// restartStopTimeout is the grace period of an old container that is
+	// still running, like an unhealthy one.
+	restartStopTimeout = 30 * time.Second
+)
+
+// restartBarrier returns once the old containers of the run are stopped
+// on every host, so no new node meets an old one in the rendezvous, which
+// an old master would answer. This node's container is stopped first.
+//
+// If the run directory is on a shared filesystem, every rank keeps a
+// marker there with the round it entered, and the round passes once every
+// marker reached it. A node that missed a round because it timed out
+// catches up on its next restart. Otherwise the nodes meet in the
+// rendezvous check on the master port, which the old master gave up when
+// it stopped.
+func restartBarrier(ctx context.Context, state ExperimentState) error {
+	dr, err := NewDockerRun(ctx, state.RunArgs.DockerContext, state.ProjectName, state.RunArgs.ProjectPath, "")
+	if err != nil {
+		return err
+	}
+	inspectCtx, cancel := dr.deadline(dockerOpInspect)
+	inspect, err := dr.client.ContainerInspect(inspectCtx, state.ContainerName)
+	err = dr.timedOut(inspectCtx, dockerOpInspect, err)
+	cancel()
+	if err != nil && !client.IsErrNotFound(err) {
+		return errors.WithMessagef(err, "failed to inspect container %s", state.ContainerName)
+	} else if err == nil && inspect.State.Running {
+		infof("stopping %s before waiting for the other nodes\n", state.ContainerName)
+		if err := dr.Stop(state.ContainerName, restartStopTimeout); err != nil {
+			return err
+		}
+	}
+
+	hosts := state.RunArgs.Hosts
+	_, runDir, err := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+	if err != nil {
+		return err
+	}
+	if sharedFilesystem(runDir) == "" {
+		// like in Run, ports of a remote daemon's host can't be used
+		if dr.remote {
+			warnf("can't wait for the other nodes of %s to stop, the run directory isn't shared and the daemon is remote\n", state.ContainerName)
+			return nil
+		}
+		infof("waiting for the other %d nodes to stop their old containers\n", len(hosts)-1)
+		digest := hostsDigest(hosts, state.ExperimentName, state.RunName)
+		return errors.WithMessage(rendezvousCheck(hosts, state.Rank, state.RunArgs.Port, digest, restartBarrierTimeout),
+			"not all nodes stopped their old containers")
+	}
+
+	dir := filepath.Join(runDir, restartBarrierDir)
+	if err := files.MkdirAll(dir, 0o755); err != nil {
+		return errors.WithMessagef(err, "failed to create %s", dir)
+	}
+
+	round, _ := barrierRound(dir, state.Rank)
+	round++
+	if err := writeBarrierRound(dir, state.Rank, round); err != nil {
+		return err
+	}
+
+	infof("waiting for the other %d nodes to stop their old containers\n", len(hosts)-1)
+	deadline := clock.Now().Add(restartBarrierTimeout)
+	for {
+		// a marker older than the timeout is from a node that entered long
+		// ago and gave up waiting, or one left behind on a copied run
+		// directory, so it doesn't tell that the node is restarting now
+		missing := make([]string, 0)
+		for rank := range hosts {
+			reached, at := barrierRound(dir, rank)
+			if reached < round {
+				missing = append(missing, fmt.Sprint(rank))
+			} else if rank != state.Rank && !at.IsZero() && clock.Now().Sub(at) > restartBarrierTimeout {
+				missing = append(missing, fmt.Sprintf("%d (stale since %s ago)", rank, units.HumanDuration(clock.Now().Sub(at))))
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if clock.Now().After(deadline) {
+			return errors.Errorf("ranks %s did not stop their old containers within %s", strings.Join(missing, ", "), restartBarrierTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+func barrierMarker(dir string, rank int) string {
+	return filepath.Join(dir, fmt.Sprintf("rank%d", rank))
+}
+
+// barrierRound is the last round the rank entered, 0 if none, and when by
+// the time of its marker.
+func barrierRound(dir string, rank int) (int, time.Time) {
+	file := barrierMarker(dir, rank)
+	data, err := files.ReadFile(file)
+	if err != nil {
+		return 0, time.Time{}
+	}
+
+	round, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	var at time.Time
+	if info, err := files.Stat(file); err == nil {
+		at = info.ModTime()
+	}
+	return round, at
+}
+
+func writeBarrierRound(dir string, rank, round int) error {
+	file := barrierMarker(dir, rank)
+	// other hosts never read half a marker
+	tmp := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+	if err := files.WriteFile(tmp, []byte(fmt.Sprintln(round)), 0o644); err != nil {
+		return errors.WithMessagef(err, "failed to write %s", file)
+	}
+	if err := files.Rename(tmp, file); err != nil {
+		files.Remove(tmp)
+		return errors.WithMessagef(err, "failed to write %s", file)
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	restartAlways         = "always"
+	restartNever          = "never"
+	restartOnInfraFailure = "on-infra-failure-only"
+	restartMetricAware    = "metric-aware"
+	restartExec           = "exec"
+	restartWebhook        = "webhook"
+
+	defaultRestartHookTimeout = 10 * time.Second
+)
+
+// RestartPolicy decides whether `invoker experiment watch` restarts a run
+// that ShouldRestart found failed, configured under restart in invoker.yaml
+// and overridden per run with --restart_policy.
+type RestartPolicy struct {
+	// Policy is one of
+	//   - always, the default, restarts every failure
+	//   - never leaves failed runs alone
+	//   - on-infra-failure-only restarts runs that failed on nccl, the
+	//     rendezvous, a signal, a dead container or the health probe, but
+	//     not on errors of the training code like an exception or cuda oom
+	//   - metric-aware restarts unless the loss went NaN or the run made no
+	//     progress since its previous failure
+	//   - exec asks the Exec plugin
+	//   - webhook asks the Webhook url
+	Policy string `yaml:"policy" json:"policy,omitempty"`
+	// Experiments picks the policy of single experiments, by name.
+	Experiments map[string]string `yaml:"experiments" json:"-"`
+	// Exec gets a restart_policy plugin request on stdin and answers with
+	// a restartVerdict, like {"restart": false, "reason": "..."}.
+	Exec string `yaml:"exec" json:"exec,omitempty"`
+	// Webhook gets the same request posted and answers the same way.
+	Webhook string `yaml:"webhook" json:"webhook,omitempty"`
+	// Timeout bounds a webhook call, 10s if 0.
+	Timeout time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+}
+
+// restartCandidate is a failed run a custom policy is asked about.
+type restartCandidate struct {
+	Container ExperimentContainer `json:"container"`
+	// Reason is why the run needs a restart, see ShouldRestart.
+	Reason string `json:"reason"`
+	// Failure is the class of the exit, empty for containers that didn't
+	// exit.
+	Failure FailureClass `json:"failure,omitempty"`
+	// Simulated candidates come from `invoker state simulate`, nothing
+	// happens to them whatever the answer.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+// failedCandidate describes the failed container c, classifying its exit.
+func failedCandidate(dr *DockerRun, c ExperimentContainer, reason string) (restartCandidate, error) {
+	candidate := restartCandidate{Container: c, Reason: reason}
+	if c.State == "exited" {
+		exit, err := dr.waitForExit(dr.ctx, c.Name)
+		if err != nil {
+			return candidate, err
+		}
+		candidate.Failure = exit.Failure
+	}
+
+	return candidate, nil
+}
+
+type restartVerdict struct {
+	Restart bool   `json:"restart"`
+	Reason  string `json:"reason"`
+}
+
+// ShouldRestart decides whether an experiment container has failed: it
+// either exited with a failure or it is still running but the health probe
+// considers it stuck. Whether it's restarted is up to its RestartPolicy.
+func ShouldRestart(c ExperimentContainer) (bool, string) {
+	switch {
+	case c.State == "exited" && c.ExitCode != 0:
+		return true, fmt.Sprintf("exited with code %d", c.ExitCode)
+	case c.State == "dead":
+		return true, "container is dead"
+	case c.State == "running" && c.Health == types.Unhealthy:
+		return true, "running but unhealthy"
+	}
+
+	return false, ""
+}
+
+// infra is true for failures of the hosts and the network rather than of
+// the training code, which a restart can get past.
+func (f FailureClass) infra() bool {
+	switch f {
+	case FailureNCCL, FailureRendezvous, FailureKilled:
+		return true
+	}
+
+	return false
+}
+
+// forRun is the policy of a run of the experiment, policy overriding the
+// configured one if it's not empty.
+func (p RestartPolicy) forRun(experimentName, policy string) RestartPolicy {
+	if named, ok := p.Experiments[experimentName]; ok {
+		p.Policy = named
+	}
+	if policy != "" {
+		p.Policy = policy
+	}
+	p.Experiments = nil
+
+	return p
+}
+
+func (p RestartPolicy) validate() error {
+	switch p.Policy {
+	case "", restartAlways, restartNever, restartOnInfraFailure, restartMetricAware:
+	case restartExec:
+		if p.Exec == "" {
+			return errors.New("the exec restart policy needs restart.exec in invoker.yaml")
+		}
+	case restartWebhook:
+		if p.Webhook == "" {
+			return errors.New("the webhook restart policy needs restart.webhook in invoker.yaml")
+		}
+	default:
+		return errors.Errorf("unknown restart policy %q, expected %s, %s, %s, %s, %s or %s",
+			p.Policy, restartAlways, restartNever, restartOnInfraFailure, restartMetricAware, restartExec, restartWebhook)
+	}
+
+	return nil
+}
+
+// decide tells whether the failed run is restarted and, if not, why. An
+// error leaves the run alone until the next check.
+func (p RestartPolicy) decide(dr *DockerRun, store *MetricsStore, state ExperimentState, candidate restartCandidate) (bool, string, error) {
+	switch p.Policy {
+	case "", restartAlways:
+		return true, "", nil
+	case restartNever:
+		return false, "its restart policy is never", nil
+	case restartOnInfraFailure:
+		if candidate.Failure != FailureNone && !candidate.Failure.infra() {
+			return false, fmt.Sprintf("it failed with %s, which is no infrastructure failure", candidate.Failure), nil
+		}
+		return true, "", nil
+	case restartMetricAware:
+		return metricAwareVerdict(dr, store, state, candidate.Container)
+	case restartExec:
+		var verdict restartVerdict
+		request := pluginRequest{Kind: "restart_policy", State: &state, Restart: &candidate}
+		if err := callPlugin(p.Exec, request, &verdict); err != nil {
+			return false, "", err
+		}
+		return customVerdict(verdict)
+	case restartWebhook:
+		redacted := state.redacted()
+		verdict, err := p.askWebhook(pluginRequest{Kind: "restart_policy", State: &redacted, Restart: &candidate})
+		if err != nil {
+			return false, "", err
+		}
+		return customVerdict(verdict)
+	}
+
+	return false, "", p.validate()
+}
+
+// customVerdict reads the answer of an exec or webhook policy.
+func customVerdict(verdict restartVerdict) (bool, string, error) {
+	if !verdict.Restart && verdict.Reason == "" {
+		verdict.Reason = "its restart policy said so"
+	}
+
+	return verdict.Restart, verdict.Reason, nil
+}
+
+// metricAwareVerdict keeps runs down that would fail the same way again:
+// ones whose loss diverged, and ones that didn't get past the step they
+// failed at before. Runs without metrics are restarted.
+func metricAwareVerdict(dr *DockerRun, store *MetricsStore, state ExperimentState, c ExperimentContainer) (bool, string, error) {
+	if store == nil {
+		return true, "", nil
+	}
+	if err := dr.ScrapeMetrics(store, state); err != nil {
+		return false, "", err
+	}
+	points, err := store.Series(state.ContainerName)
+	if err != nil {
+		return false, "", err
+	}
+
+	restart, reason := metricVerdict(points, state.Failures, c)
+	return restart, reason, nil
+}
+
+// metricVerdict is metricAwareVerdict on the scraped series of the run.
+func metricVerdict(points []MetricPoint, failures []FailureSnapshot, c ExperimentContainer) (bool, string) {
+	if len(points) == 0 {
+		return true, ""
+	}
+
+	last := points[len(points)-1]
+	if last.Loss != nil {
+		if loss := float64(*last.Loss); math.IsNaN(loss) || math.IsInf(loss, 0) {
+			return false, fmt.Sprintf("its loss is %v at step %d and would diverge again", loss, last.Step)
+		}
+	}
+
+	// the failure before the current one, which is recorded already if
+	// the container exited
+	current := c.FinishedAt
+	if c.State == "running" || current.IsZero() {
+		current = clock.Now().UTC()
+	}
+	var previous time.Time
+	for _, f := range failures {
+		if f.FinishedAt.Before(current) && f.FinishedAt.After(previous) {
+			previous = f.FinishedAt
+		}
+	}
+	if previous.IsZero() {
+		return true, ""
+	}
+
+	reached := int64(-1)
+	for _, point := range points {
+		if !point.Time.After(previous) {
+			reached = max(reached, point.Step)
+		}
+	}
+	if reached >= 0 && last.Step <= reached {
+		return false, fmt.Sprintf("it made no progress past step %d since its previous failure", reached)
+	}
+
+	return true, ""
+}
+
+func (p RestartPolicy) askWebhook(request pluginRequest) (restartVerdict, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return restartVerdict{}, err
+	}
+
+	client := *httpClient
+	client.Timeout = p.Timeout
+	if client.Timeout == 0 {
+		client.Timeout = defaultRestartHookTimeout
+	}
+	resp, err := client.Post(p.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return restartVerdict{}, errors.WithMessage(err, "failed to ask the restart webhook")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return restartVerdict{}, errors.WithMessage(err, "failed to read the answer of the restart webhook")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return restartVerdict{}, errors.Errorf("restart webhook answered %s: %s", resp.Status, truncate(string(body), 200))
+	}
+
+	var verdict restartVerdict
+	if err := json.Unmarshal(body, &verdict); err != nil {
+		return restartVerdict{}, errors.WithMessage(err, "failed to parse the answer of the restart webhook")
+	}
+
+	return verdict, nil
+}
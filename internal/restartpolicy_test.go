@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyDecide(t *testing.T) {
+	exited := ExperimentContainer{Name: "run", State: "exited", ExitCode: 1}
+
+	tests := []struct {
+		policy  string
+		failure FailureClass
+		restart bool
+	}{
+		{"", FailureError, true},
+		{restartAlways, FailureCUDAOOM, true},
+		{restartNever, FailureNCCL, false},
+		{restartOnInfraFailure, FailureNCCL, true},
+		{restartOnInfraFailure, FailureRendezvous, true},
+		{restartOnInfraFailure, FailureKilled, true},
+		{restartOnInfraFailure, FailureError, false},
+		{restartOnInfraFailure, FailureCUDAOOM, false},
+		// unhealthy containers that didn't exit have no class
+		{restartOnInfraFailure, FailureNone, true},
+		// without a metrics store there's nothing to go by
+		{restartMetricAware, FailureError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+string(tt.failure), func(t *testing.T) {
+			policy := RestartPolicy{Policy: tt.policy}
+			candidate := restartCandidate{Container: exited, Failure: tt.failure}
+			restart, reason, err := policy.decide(nil, nil, ExperimentState{ContainerName: "run"}, candidate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restart != tt.restart {
+				t.Errorf("restart = %v (%s), want %v", restart, reason, tt.restart)
+			}
+			if !restart && reason == "" {
+				t.Error("no reason for not restarting")
+			}
+		})
+	}
+}
+
+func TestRestartPolicyForRun(t *testing.T) {
+	policy := RestartPolicy{Policy: restartAlways, Experiments: map[string]string{"pretrain": restartNever}}
+
+	tests := []struct {
+		experiment, override, want string
+	}{
+		{"finetune", "", restartAlways},
+		{"pretrain", "", restartNever},
+		{"pretrain", restartMetricAware, restartMetricAware},
+	}
+	for _, tt := range tests {
+		if got := policy.forRun(tt.experiment, tt.override).Policy; got != tt.want {
+			t.Errorf("forRun(%q, %q) = %q, want %q", tt.experiment, tt.override, got, tt.want)
+		}
+	}
+}
+
+func TestMetricVerdict(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	point := func(minutes int, step int64, loss float64) MetricPoint {
+		return MetricPoint{Time: at(minutes), Step: step, Loss: metric(loss)}
+	}
+
+	// the first attempt got to step 200 and failed at minute 3, the
+	// second one resumed from step 100
+	first := []MetricPoint{point(0, 0, 4), point(1, 100, 3), point(2, 200, 2)}
+	failures := []FailureSnapshot{{ExitCode: 1, FinishedAt: at(3)}}
+
+	tests := []struct {
+		name      string
+		points    []MetricPoint
+		failures  []FailureSnapshot
+		container ExperimentContainer
+		restart   bool
+	}{
+		{"no metrics", nil, failures, ExperimentContainer{State: "exited", FinishedAt: at(3)}, true},
+		{"first failure", first, failures, ExperimentContainer{State: "exited", FinishedAt: at(3)}, true},
+		{"diverged", append(first[:2:2], point(2, 200, math.NaN())), nil, ExperimentContainer{State: "exited", FinishedAt: at(3)}, false},
+		{
+			"stuck at the previous failure",
+			append(first[:3:3], point(5, 100, 3), point(6, 200, 2)),
+			append(failures, FailureSnapshot{ExitCode: 1, FinishedAt: at(7)}),
+			ExperimentContainer{State: "exited", FinishedAt: at(7)},
+			false,
+		},
+		{
+			"past the previous failure",
+			append(first[:3:3], point(5, 100, 3), point(6, 200, 2), point(7, 300, 1.5)),
+			append(failures, FailureSnapshot{ExitCode: 1, FinishedAt: at(8)}),
+			ExperimentContainer{State: "exited", FinishedAt: at(8)},
+			true,
+		},
+		// unhealthy containers are still running, the clock tells when
+		// they failed
+		{
+			"stuck and unhealthy",
+			append(first[:3:3], point(5, 100, 3), point(6, 200, 2)),
+			failures,
+			ExperimentContainer{State: "running"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewManualClock(at(10))
+			defer SetClock(c)()
+
+			restart, reason := metricVerdict(tt.points, tt.failures, tt.container)
+			if restart != tt.restart {
+				t.Errorf("restart = %v (%s), want %v", restart, reason, tt.restart)
+			}
+		})
+	}
+}
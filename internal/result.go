@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RunResult is how a run ended, written as result.json into its run
+// directory for pipelines to gate on.
+type RunResult struct {
+	ContainerName   string       `json:"container_name"`
+	ProjectName     string       `json:"project_name"`
+	ExperimentName  string       `json:"experiment_name"`
+	RunName         string       `json:"run_name"`
+	Rank            int          `json:"rank"`
+	Succeeded       bool         `json:"succeeded"`
+	ExitCode        int          `json:"exit_code"`
+	Failure         FailureClass `json:"failure,omitempty"`
+	Outcome         string       `json:"outcome,omitempty"`
+	FinishedAt      time.Time    `json:"finished_at"`
+	DurationSeconds float64      `json:"duration_seconds"`
+	// Restarts is how often the run was started again after the first
+	// attempt.
+	Restarts int `json:"restarts"`
+	// RunDir holds the checkpoints, Artifacts are the files jobs like an
+	// export produced.
+	RunDir    string   `json:"run_dir"`
+	Artifacts []string `json:"artifacts,omitempty"`
+	// FinalMetrics are the last step, loss and throughput scraped from the
+	// output, if the run printed any.
+	FinalMetrics *MetricPoint `json:"final_metrics,omitempty"`
+}
+
+// runResultFile is result.json for rank 0. The other ranks get a file of
+// their own, since the run directory may be on a shared filesystem.
+func runResultFile(dir string, rank int) string {
+	if rank == 0 {
+		return filepath.Join(dir, "result.json")
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("result.rank%d.json", rank))
+}
+
+// finalMetrics folds the series into the last step and the last loss and
+// throughput, which may come from different lines.
+func finalMetrics(points []MetricPoint) *MetricPoint {
+	if len(points) == 0 {
+		return nil
+	}
+
+	final := MetricPoint{}
+	for _, p := range points {
+		final.Time, final.Step = p.Time, p.Step
+		if p.Loss != nil {
+			final.Loss = p.Loss
+		}
+		if p.TokensPerSec != nil {
+			final.TokensPerSec = p.TokensPerSec
+		}
+	}
+
+	return &final
+}
+
+func runResultOf(d *DockerRun, state ExperimentState, exit ExitResult) RunResult {
+	_, runDir, _ := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+
+	result := RunResult{
+		ContainerName:   state.ContainerName,
+		ProjectName:     state.ProjectName,
+		ExperimentName:  state.ExperimentName,
+		RunName:         state.RunName,
+		Rank:            state.Rank,
+		Succeeded:       exit.Succeeded(),
+		ExitCode:        exit.ExitCode,
+		Failure:         exit.Failure,
+		Outcome:         state.Outcome,
+		FinishedAt:      d.finishedAt(state.ContainerName),
+		DurationSeconds: exit.Duration.Seconds(),
+		Restarts:        state.Attempts,
+		RunDir:          runDir,
+		Artifacts:       state.Artifacts,
+	}
+
+	// the last lines may not have been scraped yet
+	if store, err := NewMetricsStore(); err == nil {
+		d.ScrapeMetrics(store, state)
+		if points, err := store.Series(state.ContainerName); err == nil {
+			result.FinalMetrics = finalMetrics(points)
+		}
+	}
+
+	return result
+}
+
+// recordRunResult writes the result of an exited run into its run
+// directory, unless it's there already for this exit.
+func recordRunResult(d *DockerRun, state ExperimentState) (RunResult, error) {
+	_, runDir, err := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+	if err != nil {
+		return RunResult{}, err
+	}
+	file := runResultFile(runDir, state.Rank)
+
+	var previous RunResult
+	if data, err := files.ReadFile(file); err == nil && json.Unmarshal(data, &previous) == nil &&
+		previous.ContainerName == state.ContainerName && previous.FinishedAt.Equal(d.finishedAt(state.ContainerName)) {
+		return previous, nil
+	}
+
+	exit, err := d.waitForExit(d.ctx, state.ContainerName)
+	if err != nil {
+		return RunResult{}, err
+	}
+
+	result := runResultOf(d, state, exit)
+	return result, writeRunResult(file, result)
+}
+
+func writeRunResult(file string, result RunResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := files.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return errors.WithMessagef(err, "failed to create %s", filepath.Dir(file))
+	}
+	// readers never see half a file
+	tmp := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+	if err := files.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return errors.WithMessagef(err, "failed to write %s", file)
+	}
+	if err := files.Rename(tmp, file); err != nil {
+		files.Remove(tmp)
+		return errors.WithMessagef(err, "failed to write %s", file)
+	}
+
+	return nil
+}
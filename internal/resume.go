@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// resumeEnv is 1 in runs launched by `experiment resume`.
+	resumeEnv = "INVOKER_RESUME"
+	// resumeFromEnv is the checkpoint to resume from, inside the
+	// container, empty if none was picked.
+	resumeFromEnv = "INVOKER_RESUME_FROM"
+	// attemptEnv counts the launches of the run, 0 for the first one.
+	attemptEnv = "INVOKER_ATTEMPT"
+
+	// resumeLatest picks the newest checkpoint of the run.
+	resumeLatest = "latest"
+)
+
+// ResumeConfig tells how `experiment resume` hands the checkpoint to the
+// training code, configured under resume in invoker.yaml.
+type ResumeConfig struct {
+	// Arg is the flag of the experiment taking the checkpoint, like
+	// --resume_from. The checkpoint is only passed in the environment if
+	// empty.
+	Arg string `yaml:"arg"`
+	// Pattern matches the checkpoints in the run directory that latest
+	// picks from, the checkpoint files export looks for if empty.
+	Pattern string `yaml:"pattern"`
+}
+
+// resumePoint is where a resumed run picks up, see relaunch.
+type resumePoint struct {
+	// Checkpoint is on this host, empty to leave it to the training code.
+	Checkpoint string
+}
+
+// invokerRunFiles are what invoker keeps in the run directory, which
+// are no checkpoints.
+var invokerRunFiles = []string{heartbeatFileName, actionsFileName, ncclDebugDirName, ranksDirName, commitsDirName}
+
+// findLatestCheckpoint is the newest entry of the run directory matching
+// the pattern, which may be a directory as sharded checkpoints are.
+func findLatestCheckpoint(runDir, pattern string) (string, error) {
+	if pattern == "" {
+		return latestCheckpoint(runDir)
+	}
+	entries, err := files.ReadDir(runDir)
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to list %s", runDir)
+	}
+
+	latest, latestInfo := "", os.FileInfo(nil)
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".tmp") || slices.Contains(invokerRunFiles, name) {
+			continue
+		}
+		if ok, err := filepath.Match(pattern, name); err != nil {
+			return "", errors.WithMessagef(err, "invalid resume pattern %q", pattern)
+		} else if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if latestInfo == nil || info.ModTime().After(latestInfo.ModTime()) {
+			latest, latestInfo = name, info
+		}
+	}
+	if latest == "" {
+		return "", errors.Errorf("no checkpoint matching %q in %s", pattern, runDir)
+	}
+
+	return filepath.Join(runDir, latest), nil
+}
+
+// resolveCheckpoint finds the checkpoint of --from_checkpoint on this
+// host: latest, or a path relative to the run directory or absolute. Runs
+// that write their checkpoints by rank resume from the node's part of the
+// newest committed one, and relative paths are looked up in the node's
+// directory first.
+func resolveCheckpoint(from, runDir, pattern string, rank, nodes int) (string, error) {
+	byRank := nodes > 1 && hasRankCheckpoints(runDir)
+	switch {
+	case from == "":
+		return "", nil
+	case from == resumeLatest && byRank:
+		return latestCommittedCheckpoint(runDir, pattern, rank, nodes)
+	case from == resumeLatest:
+		return findLatestCheckpoint(runDir, pattern)
+	case filepath.IsAbs(from):
+	case byRank:
+		part := filepath.Join(rankCheckpointDir(runDir, rank), from)
+		if _, err := files.Stat(part); err == nil {
+			return part, nil
+		}
+		from = filepath.Join(runDir, from)
+	default:
+		from = filepath.Join(runDir, from)
+	}
+	if _, err := files.Stat(from); err != nil {
+		return "", errors.WithMessage(err, "no such checkpoint")
+	}
+
+	return from, nil
+}
+
+// withResumeArg passes the checkpoint to the experiment, replacing the one
+// an earlier resume appended.
+func withResumeArg(cmdArgs []string, arg, checkpoint string) []string {
+	cmdArgs = append([]string(nil), cmdArgs...)
+	if n := len(cmdArgs); n >= 2 && cmdArgs[n-2] == arg {
+		cmdArgs = cmdArgs[:n-2]
+	} else if n >= 1 && strings.HasPrefix(cmdArgs[n-1], arg+"=") {
+		cmdArgs = cmdArgs[:n-1]
+	}
+
+	return append(cmdArgs, arg, checkpoint)
+}
+
+// apply gives the environment of the resumed run and its arguments with
+// the checkpoint, as the container sees it.
+func (r resumePoint) apply(dr *DockerRun, config ResumeConfig, cmdArgs []string, attempt int) ([]string, []string, error) {
+	guest := ""
+	if r.Checkpoint != "" {
+		var err error
+		if guest, err = dr.guestPath(r.Checkpoint); err != nil {
+			return nil, nil, errors.WithMessagef(err, "checkpoint %s isn't mounted into the container", r.Checkpoint)
+		}
+		infof("resuming from %s\n", r.Checkpoint)
+		if config.Arg != "" {
+			cmdArgs = withResumeArg(cmdArgs, config.Arg, guest)
+		}
+	}
+
+	env := []string{resumeEnv + "=1", resumeFromEnv + "=" + guest, attemptEnv + "=" + strconv.Itoa(attempt)}
+	return cmdArgs, env, nil
+}
+
+type ResumeArgs struct {
+	// ExperimentName is the experiment or container name of the run.
+	ExperimentName string `validate:"required"`
+	ProjectName    string `validate:"omitempty,varname"`
+	// FromCheckpoint is latest, a path in the run directory or an absolute
+	// one, left to the training code if empty.
+	FromCheckpoint string
+	Rebuild        bool
+	Image          string
+	// Local only resumes the run on this host, it's how the other hosts of
+	// the run are asked.
+	Local bool
+}
+
+// resumableState is the run as recorded on this host, in the state or
+// else in the history, with the number of its last attempt.
+func resumableState(sm *InnerStateManager, projectName, name string) (*ExperimentState, error) {
+	state, err := findLiveState(sm, projectName, name)
+	if err != nil || state != nil {
+		return state, err
+	}
+
+	history, err := sm.History()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		r := history[i]
+		if projectName != "" && r.ProjectName != projectName {
+			continue
+		}
+		if r.ExperimentName != name && r.ContainerName != name {
+			continue
+		}
+		if r.RunArgs == nil {
+			return nil, errors.Errorf("%s was recorded before runs could be resumed, start it again with experiment run", r.ContainerName)
+		}
+		if r.Cloud != nil {
+			return nil, errors.Errorf("%s ran on %s, resume it there", r.ContainerName, r.Cloud.Backend)
+		}
+		return &ExperimentState{
+			ContainerName:  r.ContainerName,
+			ProjectName:    r.ProjectName,
+			ExperimentName: r.ExperimentName,
+			RunName:        r.RunName,
+			Team:           r.Team,
+			RunArgs:        *r.RunArgs,
+			Master:         r.Master,
+			Rank:           r.Rank,
+			Entrypoint:     r.Entrypoint,
+			ImageID:        r.ImageID,
+			Attempts:       r.Attempts,
+			Failures:       r.Failures,
+			Tags:           r.Tags,
+			Sweep:          r.Sweep,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Resume launches a run that failed or was stopped again from the recorded
+// arguments and image, telling the training code to resume, as its next
+// attempt. A run of several hosts is resumed on all of them, from the
+// checkpoint picked on this host.
+func Resume(args ResumeArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	state, err := resumableState(sm, args.ProjectName, args.ExperimentName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if state == nil {
+		errorf("no recorded run of %s on this host\n", args.ExperimentName)
+		os.Exit(ExitValidation)
+	}
+	if state.Cloud != nil {
+		errorf("%s runs on %s, it can't be resumed here\n", state.ContainerName, state.Cloud.Backend)
+		os.Exit(ExitValidation)
+	}
+
+	ctx := context.Background()
+	dr, err := dockerRunOf(ctx, state.ContainerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	inspectCtx, cancel := dr.deadline(dockerOpInspect)
+	inspect, err := dr.client.ContainerInspect(inspectCtx, state.ContainerName)
+	err = dr.timedOut(inspectCtx, dockerOpInspect, err)
+	cancel()
+	if err != nil && !client.IsErrNotFound(err) {
+		errorf("failed to inspect container %s: %v\n", state.ContainerName, err)
+		os.Exit(ExitInfra)
+	} else if err == nil && inspect.State.Running {
+		errorf("%s is still running, stop it first\n", state.ContainerName)
+		os.Exit(ExitValidation)
+	}
+
+	_, runDir, err := defaultDirectories(state.ProjectName, state.ExperimentName, state.RunName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	config, err := LoadProjectConfig(state.RunArgs.ProjectPath)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	checkpoint, err := resolveCheckpoint(args.FromCheckpoint, runDir, config.Resume.Pattern, state.Rank, len(state.RunArgs.Hosts))
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	// the other hosts resume from the same checkpoint in their run
+	// directory, they wait for each other in the restart barrier
+	var others []string
+	if !args.Local {
+		for rank, host := range state.RunArgs.Hosts {
+			if rank != state.Rank && !isLoopback(host) {
+				others = append(others, host)
+			}
+		}
+	}
+	failed := make(chan map[string]error, 1)
+	if len(others) > 0 {
+		remote := []string{"experiment", "resume", state.ContainerName, "--project_name", state.ProjectName, "--local"}
+		if checkpoint != "" {
+			// the other nodes resume from their own part
+			rel, ok := relativeTo(rankCheckpointDir(runDir, state.Rank), checkpoint)
+			if !ok {
+				rel, ok = relativeTo(runDir, checkpoint)
+			}
+			if !ok {
+				errorf("%s is outside the run directory, the other hosts can't resume from it\n", checkpoint)
+				os.Exit(ExitValidation)
+			}
+			remote = append(remote, "--from_checkpoint", rel)
+		}
+		if args.Rebuild {
+			remote = append(remote, "--rebuild")
+		}
+		if args.Image != "" {
+			remote = append(remote, "--image", args.Image)
+		}
+		remote = append(remote, namespaceFlags()...)
+		go func() { failed <- runOnHosts(ctx, others, remote...) }()
+	} else {
+		failed <- nil
+	}
+
+	failures := make([]string, 0)
+	fmt.Printf("resuming %s as attempt %d\n", state.ContainerName, state.Attempts+1)
+	if err := relaunch(ctx, *state, args.Image, args.Rebuild, true, &resumePoint{Checkpoint: checkpoint}); err != nil {
+		failures = append(failures, fmt.Sprintf("failed to resume %s: %v", state.ContainerName, err))
+	}
+	remoteFailures := <-failed
+	for _, host := range sortedKeys(remoteFailures) {
+		failures = append(failures, fmt.Sprintf("%s: %v", host, remoteFailures[host]))
+	}
+
+	for _, f := range failures {
+		errorf("%s\n", f)
+	}
+	if len(failures) > 0 {
+		os.Exit(ExitInfra)
+	}
+	successf("resumed %s\n", state.ContainerName)
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy decides which run directories `invoker gc` deletes. A
+// run is deleted only if it is none of the KeepLast latest runs of its
+// experiment, none of the KeepBest runs with the lowest loss and, with
+// MaxAge set, older than that. Runs still in the state, live or protected,
+// are never deleted. It's configured under retention in invoker.yaml.
+type RetentionPolicy struct {
+	KeepLast int `yaml:"keep_last"`
+	KeepBest int `yaml:"keep_best"`
+	// MaxAge is like 90d, 2w or 12h.
+	MaxAge string `yaml:"max_age"`
+	// ObjectStore is an s3:// or gs:// url the run directories are mirrored
+	// to as <project>/<experiment>/<run>. Deleted runs are deleted there too.
+	ObjectStore string `yaml:"object_store"`
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.KeepLast > 0 || p.KeepBest > 0 || p.MaxAge != ""
+}
+
+// bestLoss is the lowest finite loss recorded for the container, nil if
+// there is none.
+func bestLoss(store *MetricsStore, containerName string) *float64 {
+	points, err := store.Series(containerName)
+	if err != nil {
+		return nil
+	}
+
+	var best *float64
+	for _, p := range points {
+		if p.Loss == nil {
+			continue
+		}
+		loss := float64(*p.Loss)
+		if math.IsNaN(loss) || math.IsInf(loss, 0) {
+			continue
+		}
+		if best == nil || loss < *best {
+			best = &loss
+		}
+	}
+
+	return best
+}
+
+type retainedRun struct {
+	Experiment string
+	Name       string
+	Dir        string
+	ModTime    time.Time
+	BestLoss   *float64
+	// Failures are the snapshot files of the run from the history.
+	Failures []string
+}
+
+// expiredRuns applies the policy to the runs of one experiment.
+func expiredRuns(policy RetentionPolicy, runs []retainedRun, cutoff time.Time) []retainedRun {
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ModTime.After(runs[j].ModTime) })
+
+	keep := make(map[string]bool)
+	for i := 0; i < policy.KeepLast && i < len(runs); i++ {
+		keep[runs[i].Name] = true
+	}
+
+	scored := make([]retainedRun, 0, len(runs))
+	for _, r := range runs {
+		if r.BestLoss != nil {
+			scored = append(scored, r)
+		}
+	}
+	sort.Slice(scored, func(i, j int) bool { return *scored[i].BestLoss < *scored[j].BestLoss })
+	for i := 0; i < policy.KeepBest && i < len(scored); i++ {
+		keep[scored[i].Name] = true
+	}
+
+	expired := make([]retainedRun, 0)
+	for _, r := range runs {
+		if keep[r.Name] || (!cutoff.IsZero() && r.ModTime.After(cutoff)) {
+			continue
+		}
+		expired = append(expired, r)
+	}
+
+	return expired
+}
+
+// projectRuns are the run directories of the project on this host by
+// experiment, without the runs in the state.
+func projectRuns(sm *InnerStateManager, projectName string) (map[string][]retainedRun, error) {
+	_, pattern, err := defaultDirectories(projectName, "*", "*")
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool, len(states))
+	for _, s := range states {
+		live[s.ExperimentName+"/"+s.RunName] = true
+	}
+
+	history, err := sm.History()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make(map[string][]retainedRun)
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		run := retainedRun{
+			Experiment: filepath.Base(filepath.Dir(dir)),
+			Name:       filepath.Base(dir),
+			Dir:        dir,
+			ModTime:    info.ModTime(),
+		}
+		if live[run.Experiment+"/"+run.Name] {
+			continue
+		}
+
+		for _, r := range history {
+			if r.ProjectName != projectName || r.ExperimentName != run.Experiment || r.RunName != run.Name {
+				continue
+			}
+			if r.BestLoss != nil && (run.BestLoss == nil || *r.BestLoss < *run.BestLoss) {
+				run.BestLoss = r.BestLoss
+			}
+			for _, f := range r.Failures {
+				run.Failures = append(run.Failures, f.File)
+			}
+		}
+
+		runs[run.Experiment] = append(runs[run.Experiment], run)
+	}
+
+	return runs, nil
+}
+
+// removeFromObjectStore deletes the mirror of a run with the cli of the
+// store.
+func removeFromObjectStore(store, projectName string, run retainedRun) error {
+	url := strings.TrimSuffix(store, "/") + "/" + projectName + "/" + run.Experiment + "/" + run.Name + "/"
+
+	var err error
+	switch {
+	case strings.HasPrefix(url, "s3://"):
+		_, err = runIn("", "aws", "s3", "rm", "--recursive", url)
+	case strings.HasPrefix(url, "gs://"):
+		_, err = runIn("", "gcloud", "storage", "rm", "--recursive", url)
+	default:
+		return errors.Errorf("unsupported object store %s, expected s3:// or gs://", store)
+	}
+
+	return errors.WithMessagef(err, "failed to delete %s", url)
+}
+
+type GCArgs struct {
+	ProjectName string `validate:"required,varname"`
+	DryRun      bool
+	Yes         bool
+}
+
+// GC deletes the run directories of the project that its retention policy
+// no longer keeps, on this host and in the object store.
+func GC(args GCArgs) {
+	validateArgs(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	config, err := LoadProjectConfig(cwd)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	policy := config.Retention
+	if !policy.enabled() {
+		fmt.Println("no retention policy in invoker.yaml, nothing to do")
+		return
+	}
+
+	cutoff, err := parseSince(policy.MaxAge)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	runs, err := projectRuns(sm, args.ProjectName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	expired := make([]retainedRun, 0)
+	var total int64
+	for _, experiment := range sortedKeys(runs) {
+		for _, r := range expiredRuns(policy, runs[experiment], cutoff) {
+			size := dirSize(r.Dir)
+			total += size
+			fmt.Printf("%s/%s, %s, last written %s\n", r.Experiment, r.Name, units.HumanSize(float64(size)), r.ModTime.Format(time.DateOnly))
+			expired = append(expired, r)
+		}
+	}
+
+	if len(expired) == 0 {
+		fmt.Println("no runs to delete")
+		return
+	}
+	if args.DryRun {
+		fmt.Printf("would delete %d runs holding %s\n", len(expired), units.HumanSize(float64(total)))
+		return
+	}
+	if !confirm(fmt.Sprintf("delete %d runs holding %s", len(expired), units.HumanSize(float64(total))), args.Yes) {
+		os.Exit(ExitValidation)
+	}
+
+	failed := false
+	for _, r := range expired {
+		if err := os.RemoveAll(r.Dir); err != nil {
+			warnf("failed to delete %s: %v\n", r.Dir, err)
+			failed = true
+			continue
+		}
+		for _, f := range r.Failures {
+			if err := files.Remove(f); err != nil && !os.IsNotExist(err) {
+				warnf("%v\n", err)
+			}
+		}
+		if policy.ObjectStore != "" {
+			if err := removeFromObjectStore(policy.ObjectStore, args.ProjectName, r); err != nil {
+				warnf("%v\n", err)
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(ExitInfra)
+	}
+	fmt.Printf("deleted %d runs holding %s\n", len(expired), units.HumanSize(float64(total)))
+}
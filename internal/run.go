@@ -4,19 +4,124 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
 )
 
 type RunArgs struct {
-	ProjectName    string   `validate:"required,varname"`
-	Hosts          []string `validate:"required"`
-	NProcPerNode   int      `validate:"required,min=1"`
-	ExperimentName string   `validate:"required,varname"`
-	Port           int      `validate:"required,min=1"`
-	RunName        string   `validate:"required,varname"`
-	MaxRepeats     int      `validate:"required,min=-1"`
-	Rest           []string
-  ContainerName  *string
+	ProjectName      string   `json:"project_name" validate:"required,varname"`
+	Hosts            []string `json:"hosts" validate:"required"`
+	NProcPerNode     int      `json:"nproc_per_node" validate:"required,min=1"`
+	ExperimentName   string   `json:"experiment_name" validate:"required,varname"`
+	Port             int      `json:"port" validate:"required,min=1"`
+	RunName          string   `json:"run_name" validate:"required,varname"`
+	MaxRepeats       int      `json:"max_repeats" validate:"required,min=-1"`
+	Rest             []string `json:"rest"`
+	ContainerName    *string  `json:"container_name"`
+	GPUs             []int    `json:"gpus" validate:"unique,dive,min=0"`
+	Memory           string   `json:"memory"`
+	WaitForResources bool     `json:"wait_for_resources"`
+	Team             string   `json:"team" validate:"omitempty,varname"`
+	// Image skips the build and runs an existing image id or tag instead.
+	Image string `json:"image"`
+	// ProjectPath is the directory the image is built from and mounted into
+	// the container, the working directory if empty.
+	ProjectPath string `json:"project_path"`
+	// GuestRootPath and GuestCachePath override the ones from invoker.yaml.
+	GuestRootPath  string `json:"guest_root_path" validate:"omitempty,startswith=/"`
+	GuestCachePath string `json:"guest_cache_path" validate:"omitempty,startswith=/"`
+	// Workdir, Entrypoint and User override the container defaults. The
+	// entrypoint gets the torchrun command as its arguments.
+	Workdir    string `json:"workdir" validate:"omitempty,startswith=/"`
+	Entrypoint string `json:"entrypoint"`
+	User       string `json:"user"`
+	// ReadOnlyRootfs and Scratch add to the ones from invoker.yaml.
+	ReadOnlyRootfs bool     `json:"read_only_rootfs"`
+	Scratch        []string `json:"scratch" validate:"dive,startswith=/"`
+	// NetworkMode overrides the network mode from invoker.yaml.
+	NetworkMode string `json:"network_mode" validate:"omitempty,oneof=host bridge macvlan ipvlan"`
+	// AddHosts are name:ip pairs added to the container's /etc/hosts.
+	AddHosts []string `json:"add_hosts"`
+	// DockerContext targets the daemon of a docker context instead of the
+	// one from the environment.
+	DockerContext string `json:"docker_context"`
+	// Smoke runs the experiment with a single process for SmokeSteps steps
+	// on this host first and only starts the real run if that succeeds.
+	Smoke        bool          `json:"smoke"`
+	SmokeSteps   int           `json:"smoke_steps" validate:"required_if=Smoke true,omitempty,min=1"`
+	SmokeTimeout time.Duration `json:"smoke_timeout" validate:"required_if=Smoke true"`
+	// SortHosts orders the hosts canonically instead of as given, unless
+	// they are annotated with their ranks as host@rank.
+	SortHosts bool `json:"sort_hosts"`
+	// RendezvousTimeout is how long the nodes wait for each other to cross
+	// check their ranks before anything starts, unchecked if 0.
+	RendezvousTimeout time.Duration `json:"rendezvous_timeout"`
+	// StartStagger spreads the start of the nodes other than the master
+	// over this window, after the rendezvous check.
+	StartStagger time.Duration `json:"start_stagger" validate:"min=0"`
+	// RdzvTimeout is how long torchrun waits for all nodes to join, its
+	// default if 0. MaxRestarts is how often torchrun restarts the
+	// workers of a node itself before the container fails.
+	RdzvTimeout time.Duration `json:"rdzv_timeout" validate:"min=0"`
+	MaxRestarts int           `json:"max_restarts" validate:"min=0"`
+	// Namespace prefixes the container name and image tag, it's the one of
+	// the invocation if empty.
+	Namespace string `json:"namespace"`
+	// NCCLDebug logs NCCL at INFO level into files in the run directory,
+	// which `invoker debug-bundle` collects.
+	NCCLDebug bool `json:"nccl_debug"`
+	// Warm runs on the image of the warm container of the project instead
+	// of building one, if there is a warm container.
+	Warm bool `json:"warm"`
+	// NoTorchrun runs the experiment as the only process without torchrun,
+	// for single process runs on this host that don't need a rendezvous.
+	NoTorchrun bool `json:"no_torchrun"`
+	// EnvFile is read on every launch and passed to the container.
+	EnvFile string `json:"env_file"`
+	// Kind is what the container runs, empty for training. Only training
+	// runs get the health probe, which looks for their launcher.
+	Kind string `json:"kind,omitempty"`
+	// Mounts are host:guest[:ro] binds the kind needs, like the checkpoint
+	// of a model server.
+	Mounts []string `json:"mounts,omitempty"`
+	// CPUOnly claims and hands no gpus to the container.
+	CPUOnly bool `json:"cpu_only,omitempty"`
+	// IdempotencyKey tells retries of a submission apart from new runs,
+	// see checkSubmission.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// RestartPolicy overrides the restart policy of invoker.yaml for this
+	// run, see RestartPolicy.
+	RestartPolicy string `json:"restart_policy,omitempty"`
+	// Constraints are key=value pairs every host of the run has to meet,
+	// on launch and on restarts, see checkConstraints.
+	Constraints []string `json:"constraints,omitempty"`
+	// Backend submits the run to a managed service instead of starting it
+	// on the hosts, which only give the number of nodes then, see
+	// submitCloud.
+	Backend string `json:"backend,omitempty" validate:"omitempty,oneof=aws-batch sagemaker vertex azureml"`
+	// Tags are key=value pairs to organize runs by, recorded in the state,
+	// the history and the container labels, see parseTags.
+	Tags []string `json:"tags,omitempty"`
+	// Sweep groups related runs, like the ones of a hyperparameter search,
+	// so they can be listed and stopped as one, see StopSweep.
+	Sweep string `json:"sweep,omitempty"`
+}
+
+// tmpfsMounts is /tmp for read-only containers plus the scratch directories.
+func tmpfsMounts(readOnly bool, scratch []string) map[string]string {
+	mounts := make(map[string]string, len(scratch)+1)
+	if readOnly {
+		mounts["/tmp"] = "rw,exec"
+	}
+	for _, dir := range scratch {
+		mounts[dir] = "rw,exec"
+	}
+
+	return mounts
 }
 
 const runScript = `#!/usr/bin/env python
@@ -28,81 +133,195 @@ func nameFromRunArgs(args RunArgs) string {
 		return *args.ContainerName
   }
 
-	return DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
-}
-
-func trimPathForLength(path string, length int) string {
-  // check if path is less than length
-  if len(path) < length {
-    return path
-  }
-
-  // get rid of home directory and replace is with ~
-  // e.g. /home/user/... -> ~/...
-  if path[0] == '/' {
-    path = path[1:]
-  }
-
-  branches := strings.Split(path, "/")
-  slashes := len(branches) - 1
-  if slashes == 0 {
-    return path[:length]
-  }
-
-  if branches[0] == "home" {
-    path = "~/" + strings.Join(branches[2:], "/")
-  }
-
-  if len(path) < length {
-    return path
-  }
-
-  return path[:length] + "..."
+	return namespacedName(args.Namespace, projExpName(args.ProjectName, args.ExperimentName))
 }
 
 func Run(args RunArgs) {
-	if err := Validator().Struct(args); err != nil {
-		panic(err)
+	switch args.IdempotencyKey {
+	case "":
+		key, err := submissionKey(args)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		args.IdempotencyKey = key
+	case "none":
+		args.IdempotencyKey = ""
+	}
+	if err := applyHiggsfieldProject(&args); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if args.Port == 0 {
+		args.Port = defaultPort
+	}
+	if args.NProcPerNode == 0 {
+		args.NProcPerNode = 1
+	}
+	validateArgs(args)
+
+	hosts, err := orderHosts(args.Hosts, args.SortHosts)
+	// the nodes of cloud runs are only counted
+	if err == nil && args.Backend == "" {
+		hosts, err = normalizeHosts(hosts)
+	}
+	if err != nil {
+		errorf("invalid hosts: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+	args.Hosts = hosts
+	if args.NoTorchrun && (args.NProcPerNode != 1 || len(args.Hosts) != 1 || !isLoopback(args.Hosts[0])) {
+		errorf("--no_torchrun needs --nproc_per_node=1 and --hosts=localhost\n")
+		os.Exit(ExitValidation)
+	}
+	if args.Namespace == "" {
+		args.Namespace = namespace
+	}
+	// retries are let go before they wait for peers or build anything,
+	// the check under the ledger lock catches the ones racing the first
+	if sm, err := NewInnerStateManager(); err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	} else if err := checkRecordedSubmission(context.Background(), sm, args); err != nil {
+		var duplicate duplicateSubmission
+		if !errors.As(err, &duplicate) {
+			errorf("failed to check for an earlier submission: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		infof("%v, not starting it again\n", err)
+		return
+	}
+	if _, err := parseConstraints(args.Constraints); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if _, err := parseTags(args.Tags); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if err := checkSweep(args.Sweep); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if args.EnvFile != "" {
+		// restarts may run from elsewhere
+		if args.EnvFile, err = filepath.Abs(args.EnvFile); err == nil {
+			_, err = readEnvFile(args.EnvFile)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitValidation)
+		}
+	}
+	if args.Backend != "" {
+		if err := submitCloud(context.Background(), args); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		return
 	}
 	
   master := args.Hosts[0]
 	rank := 0
 
 	if len(args.Hosts) > 1 {
+		if err := checkRunNetwork(args); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitValidation)
+		}
 		master, rank = rankAndMasterElseExit(args.Hosts)
 	} else {
 		master = "localhost"
 	}
 
-	portIsAvailable(args.Port)
-	nodeNum := len(args.Hosts)
+	endpoint, err := resolveDockerEndpoint(args.DockerContext)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	// ports and gpus of a remote daemon's host can't be checked from here
+	if !endpoint.remote() {
+		if err := checkConstraints(args.Constraints, args.GPUs); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitValidation)
+		}
+
+		portIsAvailable(args.Port)
+
+		if !isPortAvailable(args.Port) {
+			errorf("port %d is not available\n", args.Port)
+			os.Exit(ExitInfra)
+		}
+	}
+
+	if len(args.Hosts) > 1 && args.RendezvousTimeout > 0 && !endpoint.remote() {
+		digest := hostsDigest(args.Hosts, args.ExperimentName, args.RunName)
+		if err := rendezvousCheck(args.Hosts, rank, args.Port, digest, args.RendezvousTimeout); err != nil {
+			errorf("rendezvous check failed: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+	}
+
+	if delay := staggerDelay(rank, len(args.Hosts), args.StartStagger); delay > 0 {
+		infof("staggering the start of rank %d, waiting %s\n", rank, delay.Round(time.Second))
+		clock.Sleep(delay)
+	}
 
-	if !isPortAvailable(args.Port) {
-		fmt.Printf("port %d is not available\n", args.Port)
-		os.Exit(1)
+	if args.Smoke {
+		if _, err := smokeTest(context.Background(), args, args.SmokeSteps, args.SmokeTimeout); err != nil {
+			errorf("smoke test failed, not starting %s: %+v\n", args.ExperimentName, err)
+			os.Exit(ExitTraining)
+		}
 	}
 
-	hostCachePath, checkpointDir, err := makeDefaultDirectories(args.ProjectName, args.ExperimentName, args.RunName)
+	var duplicate duplicateSubmission
+	if err := launch(context.Background(), args, launchPlan{Master: master, Rank: rank}); errors.As(err, &duplicate) {
+		infof("%v, not starting it again\n", duplicate)
+	} else if err != nil {
+		errorf("failed to run experiment: %+v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
+
+// launchPlan is where a run sits in the cluster and, for restarts, how it
+// was launched before.
+type launchPlan struct {
+	Master   string
+	Rank     int
+	Attempts int
+	// Entrypoint replaces the torchrun command built from the args, so a
+	// restart runs exactly what the original run did.
+	Entrypoint []string
+	// Protected carries the protection of the run over to the restart.
+	Protected bool
+	// Failures carries the snapshots of earlier failed attempts over.
+	Failures []FailureSnapshot
+	// Resume tells the training code to pick up where the run left off,
+	// see resumePoint.
+	Resume *resumePoint
+}
+
+// launch reserves resources, builds the image unless args.Image is set and
+// starts the experiment container on this host.
+func launch(ctx context.Context, args RunArgs, plan launchPlan) (err error) {
+	nodeNum := len(args.Hosts)
+	master, rank := plan.Master, plan.Rank
+
+	hostCachePath, checkpointDir, err := prepareDirectories(args.ProjectName, args.ExperimentName, args.RunName, rank)
 	if err != nil {
-		fmt.Printf("failed to create directories: %v\n", err)
-		os.Exit(1)
-	}
-
-  containerName := nameFromRunArgs(args)
-
-	fmt.Printf(`
-╔══════════════════════════════════════════════════════════════════════════════════════════════════════
-║  
-║  > Training info:
-║  > 🛠🛠🛠
-║    
-║  > EXPERIMENT NAME  = %s 
-║  > RUN NAME         = %s
-║  > CONTAINER NAME   = %s
-║  > MODEL CHKPT PATH = %s
-║
-╚══════════════════════════════════════════════════════════════════════════════════════════════════════
-`, args.ExperimentName, args.RunName, containerName, trimPathForLength(checkpointDir, 70))
+		return errors.WithMessage(err, "failed to create directories")
+	}
+
+	containerName := nameFromRunArgs(args)
+
+	printFields("training info", [][2]string{
+		{"experiment name", args.ExperimentName},
+		{"run name", args.RunName},
+		{"container name", containerName},
+		{"rank", fmt.Sprintf("%d of %d", rank, nodeNum)},
+		{"checkpoint path", checkpointDir},
+	})
 
 	cmd, cmdArgs := buildArgs(
 		nodeNum,
@@ -115,28 +334,390 @@ func Run(args RunArgs) {
 		args.RunName,
 		args.MaxRepeats,
 		args.Rest,
+		torchrunOptions{MaxRestarts: args.MaxRestarts, RdzvTimeout: args.RdzvTimeout, StartStagger: args.StartStagger},
 	)
+	if args.NoTorchrun {
+		cmd, cmdArgs = directArgs([]string{"hf.py", "run"}, args.ExperimentName, args.RunName, args.MaxRepeats, args.Rest)
+	}
+	if len(plan.Entrypoint) > 0 {
+		cmd, cmdArgs = plan.Entrypoint[0], plan.Entrypoint[1:]
+	}
+	launcher := cmd
 
-	cwd, err := os.Getwd()
-	if err != nil {
-		fmt.Printf("failed to get current working directory: %v\n", err)
-		os.Exit(1)
+	cwd := args.ProjectPath
+	if cwd == "" {
+		if cwd, err = os.Getwd(); err != nil {
+			return errors.WithMessage(err, "failed to get current working directory")
+		}
+		args.ProjectPath = cwd
 	}
 
 	// create a "higgsfield" file in cwd
-	f, err := os.Create("hf.py")
+	if err := writeRunScript(cwd, rank); err != nil {
+		warnf("failed to create a file: %v\n", err)
+	}
+
+	var memoryBytes int64
+	if args.Memory != "" {
+		if memoryBytes, err = units.RAMInBytes(args.Memory); err != nil {
+			return errors.WithMessagef(err, "failed to parse memory %s", args.Memory)
+		}
+	}
+
+	config, err := LoadProjectConfig(cwd)
 	if err != nil {
-		fmt.Printf("failed to create a file: %v\n", err)
+		return err
+	}
+	restartPolicy := config.Restart.forRun(args.ExperimentName, args.RestartPolicy)
+	if err := restartPolicy.validate(); err != nil {
+		return err
+	}
+	var sweepPolicy SweepPolicy
+	if args.Sweep != "" {
+		if err := config.SweepPolicy.validate(); err != nil {
+			return err
+		}
+		sweepPolicy = config.SweepPolicy
+	}
+	if args.GuestRootPath != "" {
+		config.Guest.RootPath = args.GuestRootPath
+	}
+	if args.GuestCachePath != "" {
+		config.Guest.CachePath = args.GuestCachePath
 	}
-	defer f.Close()
 
-	f.Write([]byte(runScript))
+	if args.NetworkMode != "" {
+		config.Network.Mode = args.NetworkMode
+	}
+	// restarts may find invoker.yaml changed since
+	if err := checkMultiNodeNetwork(config.Network.Mode, len(args.Hosts)); err != nil {
+		return err
+	}
+
+	addHosts, err := parseHostEntries(args.AddHosts)
+	if err != nil {
+		return err
+	}
+	for name, addr := range config.ExtraHosts {
+		if _, ok := addHosts[name]; !ok {
+			addHosts[name] = addr
+		}
+	}
+
+	readOnly := config.ReadOnlyRootfs || args.ReadOnlyRootfs
+	scratch := append(config.Scratch, args.Scratch...)
+
+	dr, err := NewDockerRun(ctx, args.DockerContext, args.ProjectName, cwd, hostCachePath)
+	if err != nil {
+		return err
+	}
+	dr.SetGuestPaths(config.Guest)
+	dr.imageTag = namespacedName(args.Namespace, imageTag)
+
+	var resumeEnv []string
+	if plan.Resume != nil {
+		if cmdArgs, resumeEnv, err = plan.Resume.apply(dr, config.Resume, cmdArgs, plan.Attempts); err != nil {
+			return err
+		}
+	}
 
-	dr := NewDockerRun(context.Background(), args.ProjectName, cwd, hostCachePath)
-	if err := dr.Run(containerName, cmd, cmdArgs, args.Port); err != nil {
-		fmt.Printf("error occured while running experiment: %+v\n", err)
-		os.Exit(1)
+	// a full disk only shows as a corrupt checkpoint otherwise
+	if !dr.remote {
+		if err := checkDiskSpace(dr, config.DiskPreflight, hostCachePath, checkpointDir); err != nil {
+			return errors.WithMessage(err, "disk preflight failed")
+		}
+	}
+
+	if args.Warm && args.Image == "" {
+		if args.Image, err = dr.warmImage(args.ProjectName); err != nil {
+			return err
+		}
+		if args.Image == "" {
+			infof("no warm container for %s, building the image\n", args.ProjectName)
+		}
+	}
+
+	datasets, err := resolveDatasets(config.Datasets, cwd, hostCachePath)
+	if err != nil {
+		return err
+	}
+	if dr.remote && len(datasetBinds(datasets)) > 0 {
+		return errors.New("pinned datasets are downloaded to this host and can't be mounted into a remote container")
+	}
+
+	if dr.remote && len(config.Buckets) > 0 {
+		return errors.New("buckets are mounted on this host and can't be mounted into a remote container")
+	}
+	bucketBinds, err := mountBuckets(config.Buckets, hostCachePath)
+	if err != nil {
+		return err
 	}
+
+	var hugePageBinds []string
+	if config.HugePages.enabled() {
+		if dr.remote {
+			return errors.New("huge pages of this host can't be handed to a remote container")
+		}
+		if hugePageBinds, err = prepareHugePages(config.HugePages); err != nil {
+			return err
+		}
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return errors.WithMessage(err, "failed to open state")
+	}
+
+	if !dr.remote {
+		warnLeftovers(dr, sm)
+	}
+
+	if plan.Attempts == 0 {
+		previous, err := sm.Get(containerName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnprotected(previous); err != nil {
+			return errors.WithMessage(err, "refusing to replace it")
+		}
+		if config.EarlyStop.enabled() && !sm.watching() {
+			warnf("early_stop is only enforced by invoker experiment watch, which isn't running on this host\n")
+		}
+	}
+
+	if args.Team == "" {
+		args.Team = args.ProjectName
+	}
+
+	tags, err := parseTags(args.Tags)
+	if err != nil {
+		return err
+	}
+
+	reservation := Reservation{GPUs: args.GPUs, Port: args.Port, MemoryBytes: memoryBytes}
+	if len(reservation.GPUs) == 0 && !dr.remote && !args.CPUOnly {
+		reservation.GPUs = nvidiaGPUIndices()
+	}
+
+	state := ExperimentState{
+		ContainerName:  containerName,
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		RunName:        args.RunName,
+		Team:           args.Team,
+		Tags:           tags,
+		Sweep:          args.Sweep,
+		User:           currentUser(),
+		Identity:       userIdentity(),
+		Reservation:    reservation,
+		RunArgs:        args,
+		Master:         master,
+		Rank:           rank,
+		Entrypoint:     append([]string{cmd}, cmdArgs...),
+		Attempts:       plan.Attempts,
+		Protected:      plan.Protected,
+		Failures:       plan.Failures,
+		Metrics:        config.Metrics,
+		EarlyStop:      config.EarlyStop,
+		Restart:        restartPolicy,
+		SweepPolicy:    sweepPolicy,
+		Datasets:       datasetVersions(datasets),
+		LauncherPID:    os.Getpid(),
+		StartedAt:      clock.Now().UTC(),
+	}
+	plugins, err := LoadPluginConfig()
+	if err != nil {
+		return err
+	}
+	if err := plugins.runHooks(hookPreLaunch, state); err != nil {
+		return err
+	}
+	secretEnv, err := plugins.secretEnv(state)
+	if err != nil {
+		return err
+	}
+
+	if dr.remote {
+		// the ledger only knows about this host's gpus and containers
+		warnf("remote docker daemon, not reserving resources\n")
+		if err := sm.Put(state); err != nil {
+			return err
+		}
+	} else if err := dr.Reserve(sm, state, args.WaitForResources); err != nil {
+		return errors.WithMessagef(err, "cannot reserve resources for %s", containerName)
+	}
+
+	// from here on every step is undone if a later one fails
+	var rollback launchRollback
+	defer func() {
+		if err != nil {
+			rollback.run()
+		}
+	}()
+	rollback.add("release resources of "+containerName, func() error { return sm.Delete(containerName) })
+
+	// memory held by processes invoker doesn't know about only shows as an
+	// out of memory error minutes into the run otherwise
+	if !dr.remote {
+		if err = checkGPUMemory(config.GPUPreflight, reservation.GPUs); err != nil {
+			return errors.WithMessage(err, "gpu preflight failed")
+		}
+	}
+
+	// restarts keep appending to the series of the run
+	if plan.Attempts == 0 {
+		store, err := NewMetricsStore()
+		if err != nil {
+			return err
+		}
+		if err := store.Reset(containerName); err != nil {
+			return err
+		}
+	}
+
+	var scratchEnvs, scratchBinds []string
+	if config.NVMeScratch.Enabled {
+		if dr.remote {
+			return errors.New("nvme scratch directories can't be created for a remote container")
+		}
+		if state.ScratchDir, err = createScratch(config.NVMeScratch, containerName, state.StartedAt.Unix()); err != nil {
+			return err
+		}
+		scratchDir := state.ScratchDir
+		rollback.add("remove scratch directory "+scratchDir, func() error {
+			_, err := removeScratch(scratchDir)
+			return err
+		})
+		// recorded right away, so `invoker cleanup` finds it if we crash
+		if err := sm.Put(state); err != nil {
+			return err
+		}
+
+		mount := config.NVMeScratch.Mount
+		if mount == "" {
+			mount = "/scratch"
+		}
+		scratchEnvs = append(scratchEnvs, scratchEnv+"="+mount)
+		scratchBinds = append(scratchBinds, state.ScratchDir+":"+mount)
+	}
+
+	heartbeatFile, err := dr.guestPath(filepath.Join(checkpointDir, heartbeatFileName))
+	if err != nil {
+		return errors.WithMessage(err, "failed to resolve heartbeat file")
+	}
+
+	// restarts keep what the run asked for, a new run starts without
+	actionsPath := filepath.Join(checkpointDir, actionsFileName)
+	if plan.Attempts == 0 {
+		if err := os.Remove(actionsPath); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessage(err, "failed to remove actions of the previous run")
+		}
+	}
+	actionsFile, err := dr.guestPath(actionsPath)
+	if err != nil {
+		return errors.WithMessage(err, "failed to resolve actions file")
+	}
+
+	// the nodes of a run on a shared run directory would overwrite each
+	// other's checkpoints
+	var rankEnv []string
+	if len(args.Hosts) > 1 && !dr.remote && sharedFilesystem(checkpointDir) != "" {
+		if rankEnv, err = prepareRankCheckpoints(dr, checkpointDir, rank, len(args.Hosts)); err != nil {
+			return err
+		}
+	}
+
+	localeEnv, localeBinds := timeAndLocale(config.Timezone, config.Locale)
+
+	var fileEnv []string
+	if args.EnvFile != "" {
+		if fileEnv, err = readEnvFile(args.EnvFile); err != nil {
+			return err
+		}
+	}
+
+	var projectEnv []string
+	if project, err := LoadHiggsfieldProject(cwd); err != nil {
+		return err
+	} else if project != nil {
+		projectEnv = project.env()
+	}
+
+	var directEnv []string
+	if args.NoTorchrun {
+		directEnv = singleProcessEnv(args.Port)
+	}
+
+	var ncclEnv []string
+	if args.NCCLDebug {
+		dir := Path{path: filepath.Join(checkpointDir, ncclDebugDirName)}
+		if err := dir.mkdirIfNotExists(); err != nil {
+			return errors.WithMessage(err, "failed to create nccl debug directory")
+		}
+		guestDir, err := dr.guestPath(dir.path)
+		if err != nil {
+			return errors.WithMessage(err, "failed to resolve nccl debug directory")
+		}
+		ncclEnv = ncclDebugEnv(guestDir, rank)
+	}
+
+	spec := ContainerSpec{
+		Name:        containerName,
+		Image:       args.Image,
+		Command:     cmd,
+		Args:        cmdArgs,
+		ExposePort:  args.Port,
+		Env:         concat([]string{heartbeatEnv + "=" + heartbeatFile, actionsEnv + "=" + actionsFile}, sweepEnvs(args.Sweep), resumeEnv, rankEnv, localeEnv, fileEnv, projectEnv, scratchEnvs, directEnv, ncclEnv, secretEnv),
+		Labels:      experimentLabels(args.Namespace, args.ProjectName, args.ExperimentName, args.RunName, state.User, state.Identity, args.Sweep, tags),
+		GPUs:        args.GPUs,
+		MemoryBytes: memoryBytes,
+		Entrypoint:  strings.Fields(args.Entrypoint),
+		WorkingDir:  args.Workdir,
+		User:        args.User,
+
+		ReadOnlyRootfs: readOnly,
+		Tmpfs:          tmpfsMounts(readOnly, scratch),
+		Network:        config.Network,
+		ExtraHosts:     extraHosts(args.Hosts, addHosts),
+		DNS:            config.DNS,
+		Binds:          concat(localeBinds, datasetBinds(datasets), bucketBinds, scratchBinds, hugePageBinds, args.Mounts),
+		ImagePolicy:    config.ImagePolicy,
+		CPUOnly:        args.CPUOnly,
+		Init:           config.Init == nil || *config.Init,
+	}
+
+	if !dr.remote && (config.InheritLimits == nil || *config.InheritLimits) {
+		applySessionLimits(&spec)
+	}
+
+	if args.Kind == "" {
+		spec.Healthcheck = healthConfig(launcher, args.ExperimentName, args.RunName, heartbeatFile)
+	}
+
+	imageID, err := dr.Run(spec)
+	if err != nil {
+		return err
+	}
+	// the container runs, it owns the reservation now
+	rollback = launchRollback{}
+
+	// remember the exact image, so restarts don't pick up newer code
+	state.ImageID = imageID
+	if digest, err := launchDigest(state.RunArgs); err != nil {
+		warnf("%v, the container won't be started again as it is\n", err)
+	} else {
+		state.LaunchDigest = digest
+	}
+	if err := sm.Put(state); err != nil {
+		return errors.WithMessage(err, "failed to record image of the run")
+	}
+
+	if err := plugins.runHooks(hookPostLaunch, state); err != nil {
+		warnf("%v\n", err)
+	}
+
+	successf("started %s\n", containerName)
+	return nil
 }
 
 func buildArgs(
@@ -150,6 +731,7 @@ func buildArgs(
 	runName string,
 	maxRepeats int,
 	rest []string,
+	options torchrunOptions,
 ) (string, []string) {
 	args := []string{
 		"--nnodes",
@@ -168,16 +750,50 @@ func buildArgs(
 			fmt.Sprint(masterPort),
 		)
 	}
+	args = append(args, options.args(nodeNum)...)
 	args = append(args, experimentExecutable...)
-	args = append(args,
+	args = append(args, experimentArgs(experimentName, runName, maxRepeats, rest)...)
+
+	return "torchrun", args
+}
+
+func experimentArgs(experimentName string, runName string, maxRepeats int, rest []string) []string {
+	args := []string{
 		"--experiment_name",
 		experimentName,
 		"--run_name",
 		runName,
 		"--max_repeats",
-		fmt.Sprint(maxRepeats))
+		fmt.Sprint(maxRepeats),
+	}
 
-	args = append(args, rest...)
+	return append(args, rest...)
+}
 
-	return "torchrun", args
+// directArgs runs the experiment executable with python directly instead
+// of through torchrun, saving its startup and rendezvous.
+func directArgs(
+	experimentExecutable []string,
+	experimentName string,
+	runName string,
+	maxRepeats int,
+	rest []string,
+) (string, []string) {
+	args := append([]string{}, experimentExecutable...)
+	args = append(args, experimentArgs(experimentName, runName, maxRepeats, rest)...)
+
+	return "python", args
+}
+
+// singleProcessEnv is what torchrun would set for a single process, for
+// code that reads it to set up torch.distributed.
+func singleProcessEnv(port int) []string {
+	return []string{
+		"RANK=0",
+		"LOCAL_RANK=0",
+		"WORLD_SIZE=1",
+		"LOCAL_WORLD_SIZE=1",
+		"MASTER_ADDR=localhost",
+		fmt.Sprintf("MASTER_PORT=%d", port),
+	}
 }
@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	runStatusRunning  = "running"
+	runStatusFinished = "finished"
+)
+
+// runStatus is the outcome invoker gave the run, failed if its last
+// attempt failed and finished otherwise.
+func runStatus(r RunRecord) string {
+	if r.Outcome != "" {
+		return r.Outcome
+	}
+	if n := len(r.Failures); n > 0 && r.Failures[n-1].FinishedAt.Truncate(time.Second).Equal(r.FinishedAt.Truncate(time.Second)) {
+		return outcomeFailed
+	}
+
+	return runStatusFinished
+}
+
+// historyIndexEntry is what runs are searched by, with where the full
+// record is in the history.
+type historyIndexEntry struct {
+	Offset         int64             `json:"offset"`
+	Length         int               `json:"length"`
+	ContainerName  string            `json:"container_name"`
+	ProjectName    string            `json:"project_name"`
+	ExperimentName string            `json:"experiment_name"`
+	RunName        string            `json:"run_name"`
+	Status         string            `json:"status"`
+	StartedAt      time.Time         `json:"started_at"`
+	FinishedAt     time.Time         `json:"finished_at"`
+	Attempts       int               `json:"attempts"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Sweep          string            `json:"sweep,omitempty"`
+}
+
+// historyIndex indexes the history, which is only ever appended to, so it
+// is brought up to date by indexing what was appended after Size. Entries
+// are in the order of the history, ByExperiment and ByStatus hold their
+// positions.
+type historyIndex struct {
+	Size         int64               `json:"size"`
+	Entries      []historyIndexEntry `json:"entries"`
+	ByExperiment map[string][]int    `json:"by_experiment"`
+	ByStatus     map[string][]int    `json:"by_status"`
+}
+
+func (m *InnerStateManager) historyIndexFile() string {
+	return filepath.Join(filepath.Dir(m.dir), "history_index.json")
+}
+
+func (x *historyIndex) add(entry historyIndexEntry) {
+	i := len(x.Entries)
+	x.Entries = append(x.Entries, entry)
+	x.ByExperiment[entry.ExperimentName] = append(x.ByExperiment[entry.ExperimentName], i)
+	x.ByStatus[entry.Status] = append(x.ByStatus[entry.Status], i)
+}
+
+// historyIndex is the index of the history as it is now, updated on disk
+// if records were appended since it was last written. It is built again if
+// it doesn't match the history anymore, like after the history was edited
+// by hand.
+func (m *InnerStateManager) historyIndex(history []byte) (*historyIndex, error) {
+	unlock, err := m.Lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	index := &historyIndex{}
+	if data, err := files.ReadFile(m.historyIndexFile()); err == nil {
+		if err := json.Unmarshal(data, index); err != nil {
+			index = &historyIndex{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.WithMessage(err, "failed to read history index")
+	}
+	if !index.matches(history) {
+		index = &historyIndex{}
+	}
+	if index.ByExperiment == nil {
+		index.ByExperiment, index.ByStatus = make(map[string][]int), make(map[string][]int)
+	}
+	if index.Size == int64(len(history)) {
+		return index, nil
+	}
+
+	for index.Size < int64(len(history)) {
+		offset := index.Size
+		i := bytes.IndexByte(history[offset:], '\n')
+		if i < 0 {
+			// a record being appended right now, left for next time
+			break
+		}
+		end := offset + int64(i) + 1
+		var r RunRecord
+		if err := json.Unmarshal(history[offset:end], &r); err != nil {
+			return nil, errors.WithMessagef(err, "failed to parse history at byte %d", offset)
+		}
+		index.add(historyIndexEntry{
+			Offset:         offset,
+			Length:         int(end - offset),
+			ContainerName:  r.ContainerName,
+			ProjectName:    r.ProjectName,
+			ExperimentName: r.ExperimentName,
+			RunName:        r.RunName,
+			Status:         runStatus(r),
+			StartedAt:      r.StartedAt,
+			FinishedAt:     r.FinishedAt,
+			Attempts:       r.Attempts,
+			Tags:           r.Tags,
+			Sweep:          r.Sweep,
+		})
+		index.Size = end
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to encode history index")
+	}
+	tmp := m.historyIndexFile() + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return nil, errors.WithMessage(err, "failed to write history index")
+	}
+	if err := files.Rename(tmp, m.historyIndexFile()); err != nil {
+		return nil, errors.WithMessage(err, "failed to write history index")
+	}
+
+	return index, nil
+}
+
+// matches tells whether the index is of the start of history, checking
+// its last entry is still where it was.
+func (x *historyIndex) matches(history []byte) bool {
+	if x.Size > int64(len(history)) {
+		return false
+	}
+	if len(x.Entries) == 0 {
+		return x.Size == 0
+	}
+
+	last := x.Entries[len(x.Entries)-1]
+	if last.Offset+int64(last.Length) != x.Size {
+		return false
+	}
+	var r RunRecord
+	if err := json.Unmarshal(history[last.Offset:x.Size], &r); err != nil {
+		return false
+	}
+
+	return r.ContainerName == last.ContainerName && r.StartedAt.Equal(last.StartedAt)
+}
+
+type RunsListArgs struct {
+	// Since only lists runs that were still running this long ago, like 7d.
+	Since          string
+	Status         string `validate:"omitempty,oneof=running finished failed stopped converged preempted vanished stranded"`
+	ExperimentName string `validate:"omitempty,varname"`
+	ProjectName    string `validate:"omitempty,varname"`
+	// Tags only lists the runs that have every one of these key=value tags.
+	Tags  []string
+	Sweep string
+	Limit int `validate:"min=0"`
+	// JSON prints the full history records of the runs.
+	JSON bool
+}
+
+// runMatch is a run of `runs ls`, with the record of a live run or where
+// the one of a finished run is in the history.
+type runMatch struct {
+	historyIndexEntry
+	// Live is the record of a run that is still in the state.
+	Live *RunRecord
+}
+
+// RunsList searches the runs of this host, the live ones and the history,
+// newest first.
+func RunsList(args RunsListArgs) {
+	validateArgs(args)
+
+	since, err := parseSince(args.Since)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	tags, err := parseTags(args.Tags)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	history, err := files.ReadFile(sm.historyFile())
+	if err != nil && !os.IsNotExist(err) {
+		errorf("failed to read history: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	index, err := sm.historyIndex(history)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	matches := make([]runMatch, 0)
+	keep := func(e historyIndexEntry) bool {
+		return (args.ProjectName == "" || e.ProjectName == args.ProjectName) &&
+			(args.ExperimentName == "" || e.ExperimentName == args.ExperimentName) &&
+			(args.Status == "" || e.Status == args.Status) &&
+			(e.FinishedAt.IsZero() || !e.FinishedAt.Before(since)) &&
+			(args.Sweep == "" || e.Sweep == args.Sweep) &&
+			matchTags(e.Tags, tags)
+	}
+
+	// the narrowest posting list is enough to go through
+	var positions []int
+	switch {
+	case args.ExperimentName != "" && args.Status != "":
+		positions = index.ByExperiment[args.ExperimentName]
+		if byStatus := index.ByStatus[args.Status]; len(byStatus) < len(positions) {
+			positions = byStatus
+		}
+	case args.ExperimentName != "":
+		positions = index.ByExperiment[args.ExperimentName]
+	case args.Status != "":
+		positions = index.ByStatus[args.Status]
+	default:
+		positions = make([]int, len(index.Entries))
+		for i := range positions {
+			positions[i] = i
+		}
+	}
+	for _, i := range positions {
+		if e := index.Entries[i]; keep(e) {
+			matches = append(matches, runMatch{historyIndexEntry: e})
+		}
+	}
+
+	for _, s := range states {
+		record := recordFromState(s, "", time.Time{})
+		status := runStatusRunning
+		switch {
+		case !s.StrandedAt.IsZero():
+			status = "stranded"
+		case !s.VanishedAt.IsZero():
+			status = "vanished"
+		}
+		e := historyIndexEntry{ContainerName: s.ContainerName, ProjectName: s.ProjectName, ExperimentName: s.ExperimentName,
+			RunName: s.RunName, Status: status, StartedAt: s.StartedAt, Attempts: s.Attempts, Tags: s.Tags, Sweep: s.Sweep}
+		if keep(e) {
+			matches = append(matches, runMatch{historyIndexEntry: e, Live: &record})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].StartedAt.After(matches[j].StartedAt) })
+	if args.Limit > 0 && len(matches) > args.Limit {
+		matches = matches[:args.Limit]
+	}
+
+	if args.JSON {
+		records := make([]RunRecord, 0, len(matches))
+		for _, match := range matches {
+			if match.Live != nil {
+				records = append(records, *match.Live)
+				continue
+			}
+			var r RunRecord
+			if err := json.Unmarshal(history[match.Offset:match.Offset+int64(match.Length)], &r); err != nil {
+				errorf("failed to parse history: %v\n", err)
+				os.Exit(ExitInfra)
+			}
+			records = append(records, r)
+		}
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			errorf("failed to encode runs: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	now := clock.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tPROJECT\tEXPERIMENT\tRUN\tSTATUS\tSTARTED\tDURATION\tRESTARTS\tTAGS")
+	for _, m := range matches {
+		finishedAt := m.FinishedAt
+		if finishedAt.IsZero() {
+			finishedAt = now
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s ago\t%s\t%d\t%s\n", m.ContainerName, m.ProjectName, m.ExperimentName, m.RunName, m.Status,
+			units.HumanDuration(now.Sub(m.StartedAt)), units.HumanDuration(finishedAt.Sub(m.StartedAt)), m.Attempts, orDash(formatTags(m.Tags)))
+	}
+	w.Flush()
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+const (
+	scratchDirName = "higgsfield-scratch"
+	scratchEnv     = "HIGGSFIELD_SCRATCH"
+)
+
+// NVMeScratchConfig gives every run its own directory on a local NVMe disk,
+// configured under nvme_scratch in invoker.yaml. The directory is removed
+// once the run is retired.
+type NVMeScratchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Mount is where the directory appears in the container, /scratch if
+	// empty.
+	Mount string `yaml:"mount"`
+	// Path is the host directory to use instead of a detected NVMe disk.
+	Path string `yaml:"path"`
+}
+
+// nvmeMounts are the mount points of local NVMe filesystems, apart from the
+// root filesystem.
+func nvmeMounts() []string {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mounts := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		device, mount := fields[0], fields[1]
+		// md arrays are how instance nvme disks are usually striped together
+		if !strings.HasPrefix(device, "/dev/nvme") && !strings.HasPrefix(device, "/dev/md") {
+			continue
+		}
+		if mount == "/" || strings.HasPrefix(mount, "/boot") {
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+
+	return mounts
+}
+
+func freeBytes(dir string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0
+	}
+
+	return int64(stat.Bavail) * stat.Bsize
+}
+
+// scratchRoot is the configured path or the NVMe filesystem with the most
+// free space.
+func scratchRoot(config NVMeScratchConfig) (string, error) {
+	if config.Path != "" {
+		return config.Path, nil
+	}
+
+	best, bestFree := "", int64(0)
+	for _, mount := range nvmeMounts() {
+		if free := freeBytes(mount); free > bestFree {
+			best, bestFree = mount, free
+		}
+	}
+	if best == "" {
+		return "", errors.New("no local nvme disk found, set nvme_scratch.path")
+	}
+
+	return filepath.Join(best, scratchDirName), nil
+}
+
+// createScratch makes the scratch directory of a run.
+func createScratch(config NVMeScratchConfig, containerName string, startedAt int64) (string, error) {
+	root, err := scratchRoot(config)
+	if err != nil {
+		return "", err
+	}
+
+	dir := Path{path: filepath.Join(root, fmt.Sprintf("%s-%d", containerName, startedAt))}
+	if err := dir.mkdirIfNotExists(); err != nil {
+		return "", errors.WithMessage(err, "failed to create scratch directory")
+	}
+
+	// the container may run as another user
+	if err := os.Chmod(dir.path, 0o1777); err != nil {
+		return "", errors.WithMessage(err, "failed to open up scratch directory")
+	}
+
+	fmt.Printf("scratch directory %s with %s free\n", dir.path, units.HumanSize(float64(freeBytes(dir.path))))
+	return dir.path, nil
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// removeScratch deletes the scratch directory of a run, returning how much
+// it held.
+func removeScratch(dir string) (int64, error) {
+	if dir == "" {
+		return 0, nil
+	}
+
+	size := dirSize(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return size, errors.WithMessagef(err, "failed to remove scratch directory %s", dir)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version is set at release time through -ldflags.
+var Version = "dev"
+
+const releasesURL = "https://github.com/higgsfield-ai/invoker/releases/download"
+
+const (
+	updatePhaseStage    = "stage"
+	updatePhaseActivate = "activate"
+)
+
+func download(url string) ([]byte, error) {
+	data, err := httpGet(url, 5*time.Minute)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to download %s", url)
+	}
+
+	return data, nil
+}
+
+// releaseBinary downloads the release archive of version, checks it against
+// the published sha256 and returns the invoker binary in it.
+func releaseBinary(version string) ([]byte, error) {
+	archive := fmt.Sprintf("invoker-%s-%s-%s.tar.gz", version, runtime.GOOS, runtime.GOARCH)
+	url := fmt.Sprintf("%s/%s/%s", releasesURL, version, archive)
+
+	data, err := download(url)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum, err := download(url + ".sha256")
+	if err != nil {
+		return nil, err
+	}
+
+	want := strings.Fields(string(checksum))
+	sum := sha256.Sum256(data)
+	if len(want) == 0 || want[0] != hex.EncodeToString(sum[:]) {
+		return nil, errors.Errorf("checksum of %s does not match, refusing to install it", archive)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", archive)
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("%s does not contain the invoker binary", archive)
+		} else if err != nil {
+			return nil, errors.WithMessagef(err, "failed to read %s", archive)
+		}
+
+		if filepath.Base(header.Name) == "invoker" && header.Typeflag == tar.TypeReg {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+func stagedPath(executable, version string) string {
+	return executable + "." + version
+}
+
+// stageUpdate puts the verified binary next to the running one, ready to be
+// swapped in.
+func stageUpdate(executable, version string) error {
+	binary, err := releaseBinary(version)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(stagedPath(executable, version), binary, 0o755); err != nil {
+		return errors.WithMessage(err, "failed to stage the new binary")
+	}
+
+	return nil
+}
+
+// activateUpdate swaps the staged binary in with a rename, so the binary is
+// never half written.
+func activateUpdate(executable, version string) error {
+	if err := os.Rename(stagedPath(executable, version), executable); err != nil {
+		return errors.WithMessagef(err, "failed to activate %s, was it staged?", version)
+	}
+
+	return nil
+}
+
+type SelfUpdateArgs struct {
+	Version string `validate:"required,startswith=v"`
+	// Hosts are updated over ssh instead of this host.
+	Hosts []string
+	// Phase runs only the stage or activate step, for fleet updates.
+	Phase string `validate:"omitempty,oneof=stage activate"`
+}
+
+// SelfUpdate installs a release of invoker. With hosts every host stages the
+// release first and the binaries are only swapped once all of them have it,
+// so the fleet never ends up half updated because of a failed download.
+func SelfUpdate(args SelfUpdateArgs) {
+	validateArgs(args)
+
+	if len(args.Hosts) > 0 {
+		updateHosts(args)
+		return
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		errorf("failed to find the invoker binary: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.Phase != updatePhaseActivate {
+		fmt.Printf("downloading invoker %s\n", args.Version)
+		if err := stageUpdate(executable, args.Version); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+	}
+
+	if args.Phase != updatePhaseStage {
+		if err := activateUpdate(executable, args.Version); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Printf("updated %s from %s to %s\n", executable, Version, args.Version)
+	}
+}
+
+func updateHosts(args SelfUpdateArgs) {
+	ctx := context.Background()
+
+	for _, phase := range []string{updatePhaseStage, updatePhaseActivate} {
+		failed := runOnHosts(ctx, args.Hosts, "self-update", "--version", args.Version, "--phase", phase)
+		if len(failed) > 0 {
+			for _, host := range sortedKeys(failed) {
+				fmt.Printf("%s: %v\n", host, failed[host])
+			}
+			if phase == updatePhaseStage {
+				fmt.Printf("not all hosts could download %s, none were updated\n", args.Version)
+			}
+			os.Exit(ExitInfra)
+		}
+	}
+
+	fmt.Printf("updated %d hosts to %s\n", len(args.Hosts), args.Version)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+type VersionArgs struct {
+	Hosts []string
+}
+
+// PrintVersion prints the version of this invoker, or of every host with a
+// warning if they differ.
+func PrintVersion(args VersionArgs) {
+	if len(args.Hosts) == 0 {
+		fmt.Println(Version)
+		return
+	}
+
+	versions := hostVersions(context.Background(), args.Hosts)
+	distinct := make(map[string]bool)
+	for _, host := range args.Hosts {
+		fmt.Printf("%s\t%s\n", host, versions[host])
+		distinct[versions[host]] = true
+	}
+
+	if len(distinct) > 1 {
+		warnf("hosts run different invoker versions, update them with `invoker self-update --hosts`\n")
+		os.Exit(ExitInfra)
+	}
+}
+
+// hostVersions asks every host for its invoker version over ssh.
+func hostVersions(ctx context.Context, hosts []string) map[string]string {
+	versions := make(map[string]string, len(hosts))
+	for _, host := range hosts {
+		out, err := outputOnHost(ctx, host, "version")
+		if err != nil {
+			versions[host] = "unreachable"
+			continue
+		}
+		versions[host] = strings.TrimSpace(out)
+	}
+
+	return versions
+}
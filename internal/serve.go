@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/pkg/errors"
+)
+
+const (
+	runKindServe = "serve"
+	// modelMount is where the checkpoint appears in the server container.
+	modelMount = "/model"
+)
+
+// ServingConfig picks the inference server of serve-model. It's configured
+// under serving in invoker.yaml.
+type ServingConfig struct {
+	// Engine is vllm, tgi or torchserve, vllm if empty.
+	Engine string `yaml:"engine"`
+	// Image replaces the official image of the engine.
+	Image string `yaml:"image"`
+	// Args are passed on to the server.
+	Args []string `yaml:"args"`
+}
+
+var servingImages = map[string]string{
+	"vllm":       "vllm/vllm-openai:latest",
+	"tgi":        "ghcr.io/huggingface/text-generation-inference:latest",
+	"torchserve": "pytorch/torchserve:latest",
+}
+
+// servingCommand starts the engine on the checkpoint with its tensors split
+// over shards gpus.
+func servingCommand(engine, name string, port, shards int, extra []string) ([]string, error) {
+	switch engine {
+	case "vllm":
+		return append([]string{
+			"python3", "-m", "vllm.entrypoints.openai.api_server",
+			"--model", modelMount,
+			"--served-model-name", name,
+			"--host", "0.0.0.0",
+			"--port", fmt.Sprint(port),
+			"--tensor-parallel-size", fmt.Sprint(shards),
+		}, extra...), nil
+	case "tgi":
+		return append([]string{
+			"text-generation-launcher",
+			"--model-id", modelMount,
+			"--hostname", "0.0.0.0",
+			"--port", fmt.Sprint(port),
+			"--num-shard", fmt.Sprint(shards),
+		}, extra...), nil
+	case "torchserve":
+		// torchserve only takes its addresses from a config file
+		serve := fmt.Sprintf("printf 'inference_address=http://0.0.0.0:%d\\n' > /tmp/ts.properties && "+
+			"exec torchserve --start --foreground --ncs --model-store %s --models all --ts-config /tmp/ts.properties \"$@\"", port, modelMount)
+		return append([]string{"sh", "-c", serve, "torchserve"}, extra...), nil
+	}
+
+	return nil, errors.Errorf("unknown serving engine %s, use vllm, tgi or torchserve", engine)
+}
+
+// pullImage pulls the image unless the daemon already has it.
+func (d *DockerRun) pullImage(image string) error {
+	inspectCtx, cancel := d.deadline(dockerOpInspect)
+	_, _, err := d.client.ImageInspectWithRaw(inspectCtx, image)
+	cancel()
+	if err == nil {
+		return nil
+	} else if !client.IsErrNotFound(err) {
+		return errors.WithMessagef(d.timedOut(inspectCtx, dockerOpInspect, err), "failed to inspect image %s", image)
+	}
+
+	ctx, cancel := d.deadline(dockerOpPull)
+	defer cancel()
+
+	fmt.Printf("pulling image %s\n", image)
+	out, err := d.client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpPull, err), "failed to pull image %s", image)
+	}
+	defer out.Close()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(out, os.Stdout, os.Stdout.Fd(), false, nil); err != nil {
+		return errors.WithMessagef(d.timedOut(ctx, dockerOpPull, err), "failed to pull image %s", image)
+	}
+
+	return nil
+}
+
+type ServeModelArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"required,varname"`
+	Checkpoint     string `validate:"required"`
+	Port           int    `validate:"required,min=1"`
+	GPUs           []int  `validate:"unique,dive,min=0"`
+	Memory         string
+	// Engine and Image override the ones from invoker.yaml.
+	Engine        string `validate:"omitempty,oneof=vllm tgi torchserve"`
+	Image         string
+	DockerContext string
+	Rest          []string
+}
+
+// ServeModel starts an inference server on a checkpoint. The server is
+// recorded like a run, so it claims its gpus and port in the ledger, is
+// listed by ps, restarted by watch and ended by experiment stop.
+func ServeModel(args ServeModelArgs) {
+	validateArgs(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	checkpoint, err := filepath.Abs(args.Checkpoint)
+	if err == nil {
+		_, err = os.Stat(checkpoint)
+	}
+	if err != nil {
+		errorf("invalid checkpoint: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	config, err := LoadProjectConfig(cwd)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	engine := config.Serving.Engine
+	if args.Engine != "" {
+		engine = args.Engine
+	} else if engine == "" {
+		engine = "vllm"
+	}
+
+	image := args.Image
+	if image == "" {
+		image = config.Serving.Image
+	}
+	if image == "" {
+		image = servingImages[engine]
+	}
+
+	shards := len(args.GPUs)
+	if shards == 0 {
+		shards = max(len(nvidiaGPUIndices()), 1)
+	}
+
+	command, err := servingCommand(engine, args.ExperimentName, args.Port, shards, concat(config.Serving.Args, args.Rest))
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if !isPortAvailable(args.Port) {
+		errorf("port %d is not available\n", args.Port)
+		os.Exit(ExitInfra)
+	}
+
+	ctx := context.Background()
+	dr, err := NewDockerRun(ctx, args.DockerContext, args.ProjectName, cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if dr.remote {
+		errorf("the checkpoint is on this host and can't be mounted into a remote container\n")
+		os.Exit(ExitValidation)
+	}
+	if err := dr.pullImage(image); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	run := RunArgs{
+		ProjectName:    args.ProjectName,
+		Hosts:          []string{"localhost"},
+		NProcPerNode:   1,
+		ExperimentName: args.ExperimentName,
+		Port:           args.Port,
+		RunName:        engine,
+		MaxRepeats:     -1,
+		GPUs:           args.GPUs,
+		Memory:         args.Memory,
+		Image:          image,
+		ProjectPath:    cwd,
+		DockerContext:  args.DockerContext,
+		Namespace:      namespace,
+		Kind:           runKindServe,
+		Mounts:         []string{checkpoint + ":" + modelMount + ":ro"},
+	}
+
+	if err := launch(ctx, run, launchPlan{Master: "localhost", Entrypoint: command}); err != nil {
+		errorf("failed to start %s: %+v\n", engine, err)
+		os.Exit(ExitInfra)
+	}
+
+	fmt.Printf("%s is serving %s on port %d as %s\n", engine, checkpoint, args.Port, nameFromRunArgs(run))
+}
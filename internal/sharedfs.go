@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// filesystems that several hosts see at once, by statfs magic
+var sharedFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x0bd00bd0: "lustre",
+	0x47504653: "gpfs",
+	0x19830326: "beegfs",
+	0x00c36400: "cephfs",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+}
+
+// sharedFilesystem returns the name of the shared filesystem path is on,
+// empty for local ones. Missing paths are looked up through their parents.
+func sharedFilesystem(path string) string {
+	for {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err == nil {
+			return sharedFilesystems[int64(stat.Type)]
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return ""
+		}
+		path = parent
+	}
+}
+
+const sharedFSWaitTimeout = 5 * time.Minute
+
+// waitForPath waits for another host to create path on a shared filesystem.
+func waitForPath(path string, timeout time.Duration) error {
+	deadline := clock.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		if clock.Now().After(deadline) {
+			return errors.Errorf("%s did not appear within %s", path, timeout)
+		}
+		clock.Sleep(time.Second)
+	}
+}
+
+// prepareDirectories creates the cache and checkpoint directories of a run.
+// On a shared filesystem only rank 0 creates them and the other ranks wait
+// until they show up, instead of all hosts racing on the same paths.
+func prepareDirectories(projectName, experimentName, runName string, rank int) (string, string, error) {
+	cacheDir, checkpointDir, err := defaultDirectories(projectName, experimentName, runName)
+	if err != nil {
+		return "", "", err
+	}
+
+	fs := sharedFilesystem(checkpointDir)
+	if fs == "" || rank == 0 {
+		return makeDefaultDirectories(projectName, experimentName, runName)
+	}
+
+	fmt.Printf("%s is on %s, waiting for rank 0 to create it\n", checkpointDir, fs)
+	if err := waitForPath(checkpointDir, sharedFSWaitTimeout); err != nil {
+		return "", "", err
+	}
+
+	return cacheDir, checkpointDir, nil
+}
+
+// writeRunScript writes hf.py into the project. On a shared filesystem only
+// rank 0 writes it, so other ranks never see a half written file.
+func writeRunScript(projectPath string, rank int) error {
+	path := filepath.Join(projectPath, "hf.py")
+
+	if fs := sharedFilesystem(projectPath); fs != "" && rank != 0 {
+		return waitForPath(path, sharedFSWaitTimeout)
+	}
+
+	// write to a temporary file first, the project may be shared
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(runScript), 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write hf.py")
+	}
+
+	return errors.WithMessage(os.Rename(tmp, path), "failed to write hf.py")
+}
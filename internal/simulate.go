@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+type StateSimulateArgs struct {
+	// Inject are target=event pairs, see parseInjection.
+	Inject      []string
+	ProjectName string `validate:"omitempty,varname"`
+	MaxRestarts int    `validate:"min=0"`
+	// Hosts run the simulation over ssh, each on its own runs.
+	Hosts []string
+}
+
+// simulatedEvent is what an injection makes of a container.
+type simulatedEvent struct {
+	State    string
+	Health   string
+	ExitCode int
+	Failure  FailureClass
+}
+
+// parseInjection reads target=event, where the target is a container,
+// an experiment or a host of this host's runs, and the event one of
+// exit<code>, oom, cuda_oom, nccl, rendezvous, dead, unhealthy or running.
+func parseInjection(s string) (string, simulatedEvent, error) {
+	target, event, ok := strings.Cut(s, "=")
+	if !ok || target == "" {
+		return "", simulatedEvent{}, errors.Errorf("invalid injection %q, expected target=event", s)
+	}
+
+	switch event {
+	case "running":
+		return target, simulatedEvent{State: "running", Health: types.Healthy}, nil
+	case "unhealthy":
+		return target, simulatedEvent{State: "running", Health: types.Unhealthy}, nil
+	case "dead":
+		return target, simulatedEvent{State: "dead"}, nil
+	case string(FailureOOM):
+		return target, simulatedEvent{State: "exited", ExitCode: 137, Failure: FailureOOM}, nil
+	case string(FailureCUDAOOM), string(FailureNCCL), string(FailureRendezvous):
+		return target, simulatedEvent{State: "exited", ExitCode: 1, Failure: FailureClass(event)}, nil
+	}
+
+	if code, err := strconv.Atoi(strings.TrimPrefix(event, "exit")); err == nil && strings.HasPrefix(event, "exit") {
+		return target, simulatedEvent{State: "exited", ExitCode: code, Failure: classifyFailure(code, false, "")}, nil
+	}
+
+	return "", simulatedEvent{}, errors.Errorf("unknown event %q in %s, expected exit<code>, oom, cuda_oom, nccl, rendezvous, dead, unhealthy or running", event, s)
+}
+
+// runHost is the host of the run in its host list.
+func runHost(state ExperimentState) string {
+	if state.Rank < len(state.RunArgs.Hosts) {
+		return state.RunArgs.Hosts[state.Rank]
+	}
+
+	return ""
+}
+
+// StateSimulate shows what `invoker experiment watch` would decide for the
+// runs of this host if their containers were in the injected states,
+// without restarting or recording anything. Exec and webhook policies are
+// asked, with simulated set in the request.
+func StateSimulate(args StateSimulateArgs) {
+	validateArgs(args)
+
+	events := make(map[string]simulatedEvent, len(args.Inject))
+	for _, s := range args.Inject {
+		target, event, err := parseInjection(s)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitValidation)
+		}
+		events[target] = event
+	}
+
+	if len(args.Hosts) > 0 {
+		simulate := []string{"state", "simulate", "--max_restarts", fmt.Sprint(args.MaxRestarts)}
+		for _, s := range args.Inject {
+			simulate = append(simulate, "--inject", s)
+		}
+		if args.ProjectName != "" {
+			simulate = append(simulate, "--project_name", args.ProjectName)
+		}
+		failed := runOnHosts(context.Background(), args.Hosts, simulate...)
+		for _, host := range sortedKeys(failed) {
+			errorf("%s: %v\n", host, failed[host])
+		}
+		if len(failed) > 0 {
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	health, err := sm.NodeHealth()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), "", "", "", "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	containers, err := dr.List(args.ProjectName)
+	if err != nil {
+		errorf("failed to list experiments: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	byName := make(map[string]ExperimentContainer, len(containers))
+	for _, c := range containers {
+		byName[c.Name] = c
+	}
+
+	self, _ := os.Hostname()
+	matched := make(map[string]bool, len(events))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	// injected states are marked with *
+	fmt.Fprintln(w, "CONTAINER\tHOST\tRANK\tSTATE\tPOLICY\tDECISION")
+	for _, state := range states {
+		if args.ProjectName != "" && state.ProjectName != args.ProjectName {
+			continue
+		}
+
+		c, found := byName[state.ContainerName]
+		if !found {
+			c = ExperimentContainer{Name: state.ContainerName, State: "missing"}
+		}
+
+		var event *simulatedEvent
+		for _, target := range []string{state.ContainerName, state.ExperimentName, runHost(state), self} {
+			if e, ok := events[target]; ok && target != "" {
+				event, matched[target] = &e, true
+				break
+			}
+		}
+
+		shown := shownState(c)
+		if event != nil {
+			c.State, c.Health, c.ExitCode = event.State, event.Health, event.ExitCode
+			c.FinishedAt = clock.Now().UTC()
+			shown = shownState(c) + " *"
+			if event.Failure != FailureNone {
+				shown = fmt.Sprintf("%s (%s) *", shownState(c), event.Failure)
+			}
+		}
+
+		policy := state.Restart.Policy
+		if policy == "" {
+			policy = restartAlways
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", state.ContainerName, orNone(runHost(state)), state.Rank, shown, policy,
+			simulatedDecision(dr, store, state, c, event, args.MaxRestarts, health))
+	}
+	w.Flush()
+
+	for _, target := range sortedKeys(events) {
+		if !matched[target] {
+			warnf("%s matches no run of this host\n", target)
+		}
+	}
+}
+
+func shownState(c ExperimentContainer) string {
+	switch {
+	case c.State == "exited":
+		return fmt.Sprintf("exited %d", c.ExitCode)
+	case c.State == "running" && c.Health == types.Unhealthy:
+		return "running, unhealthy"
+	}
+
+	return c.State
+}
+
+// simulatedDecision is what the watcher would do about the run with its
+// container c, the same checks in the same order.
+func simulatedDecision(dr *DockerRun, store *MetricsStore, state ExperimentState, c ExperimentContainer, event *simulatedEvent,
+	maxRestarts int, health NodeHealth) string {
+	if c.State == "missing" {
+		return "none: the container is missing"
+	}
+
+	failed, reason := ShouldRestart(c)
+	if !failed {
+		return "none: it didn't fail"
+	}
+	if state.Outcome != "" {
+		return fmt.Sprintf("none: %s, but invoker ended it as %s", reason, state.Outcome)
+	}
+
+	var candidate restartCandidate
+	if event != nil {
+		candidate = restartCandidate{Container: c, Reason: reason, Failure: event.Failure}
+	} else {
+		var err error
+		if candidate, err = failedCandidate(dr, c, reason); err != nil {
+			return fmt.Sprintf("undecided: %v", err)
+		}
+	}
+	candidate.Simulated = true
+
+	blocker, err := restartBlocker(dr, store, state, candidate, maxRestarts, health)
+	if err != nil {
+		return fmt.Sprintf("undecided, asked again on the next pass: %v", err)
+	} else if blocker != "" {
+		return fmt.Sprintf("none: %s, but %s", reason, blocker)
+	}
+
+	decision := "restart: " + reason
+	if nodes := len(state.RunArgs.Hosts); nodes > 1 {
+		decision += fmt.Sprintf(", once the other %d hosts stopped theirs", nodes-1)
+	}
+	return decision
+}
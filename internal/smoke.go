@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// smokeArgs scales a run down to a single process on this host that only
+// runs a few steps, under its own run and container name.
+func smokeArgs(args RunArgs, steps int) RunArgs {
+	smoke := args
+	smoke.Hosts = []string{"localhost"}
+	smoke.NProcPerNode = 1
+	smoke.RunName = args.RunName + "_smoke"
+	smoke.ContainerName = PtrTo(nameFromRunArgs(args) + "-smoke")
+	smoke.Rest = append(append([]string{}, args.Rest...), "--max_steps", fmt.Sprint(steps))
+
+	gpus := args.GPUs
+	if len(gpus) == 0 {
+		gpus = nvidiaGPUIndices()
+	}
+	if len(gpus) > 0 {
+		smoke.GPUs = gpus[:1]
+	}
+
+	return smoke
+}
+
+// Wait blocks until the container exits and returns its exit code, or fails
+// once timeout has passed.
+func (d *DockerRun) Wait(containerName string, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+
+	statusCh, errCh := d.client.ContainerWait(ctx, containerName, container.WaitConditionNotRunning)
+	select {
+	case status := <-statusCh:
+		return status.StatusCode, nil
+	case err := <-errCh:
+		if ctx.Err() != nil {
+			return 0, errors.Errorf("%s did not finish within %s", containerName, timeout)
+		}
+		return 0, errors.WithMessagef(err, "failed to wait for %s", containerName)
+	}
+}
+
+// tailLogs returns the last lines of the container's output.
+func (d *DockerRun) tailLogs(containerName string, lines int) (string, error) {
+	logs, err := d.client.ContainerLogs(d.ctx, containerName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       fmt.Sprint(lines),
+	})
+	if err != nil {
+		return "", errors.WithMessagef(err, "failed to read logs of %s", containerName)
+	}
+	defer logs.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, logs); err != nil {
+		return "", errors.WithMessagef(err, "failed to read logs of %s", containerName)
+	}
+
+	return output.String(), nil
+}
+
+// smokeTest runs the scaled down experiment to completion before the real
+// run, so that broken code fails in minutes instead of after the whole
+// cluster spun up. It returns the metrics parsed from the smoke run.
+func smokeTest(ctx context.Context, args RunArgs, steps int, timeout time.Duration) ([]MetricPoint, error) {
+	smoke := smokeArgs(args, steps)
+	containerName := *smoke.ContainerName
+
+	fmt.Printf("smoke testing %s with %d steps\n", args.ExperimentName, steps)
+	if err := launch(ctx, smoke, launchPlan{Master: "localhost"}); err != nil {
+		return nil, errors.WithMessage(err, "failed to launch smoke test")
+	}
+
+	dr, err := NewDockerRun(ctx, smoke.DockerContext, smoke.ProjectName, smoke.ProjectPath, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open state")
+	}
+
+	store, err := NewMetricsStore()
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode, waitErr := dr.Wait(containerName, timeout)
+	if waitErr == nil && exitCode != 0 {
+		waitErr = errors.Errorf("smoke test exited with code %d", exitCode)
+	}
+
+	if waitErr != nil {
+		if logs, err := dr.tailLogs(containerName, 50); err == nil {
+			fmt.Printf("last output of %s:\n%s\n", containerName, redactText(logs))
+		}
+	}
+
+	state, err := sm.Get(containerName)
+	if err != nil {
+		return nil, err
+	}
+	finishedAt := dr.finishedAt(containerName)
+
+	var points []MetricPoint
+	if state != nil {
+		// the output is gone once the container is removed
+		if err := dr.ScrapeMetrics(store, *state); err != nil {
+			warnf("failed to scrape metrics of %s: %v\n", containerName, err)
+		}
+		if points, err = store.Series(containerName); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dr.Kill(containerName); err != nil {
+		return nil, err
+	}
+
+	if state != nil {
+		if waitErr != nil {
+			state.Outcome, state.OutcomeReason = outcomeFailed, waitErr.Error()
+		}
+		if err := sm.Retire(*state, finishedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	if waitErr != nil {
+		return nil, waitErr
+	}
+
+	fmt.Printf("smoke test of %s passed\n", args.ExperimentName)
+	return points, nil
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// remoteInvokerBinary is how invoker is called on the other hosts, which
+// have it installed the same way as this one.
+const remoteInvokerBinary = "invoker"
+
+// prefixWriter prefixes every line written to it, so the output of several
+// hosts stays readable when interleaved.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf.Write(b)
+	for {
+		line, err := p.buf.ReadBytes('\n')
+		if err != nil {
+			// keep the partial line for the next write
+			p.buf.Write(line)
+			return len(b), nil
+		}
+
+		p.mu.Lock()
+		fmt.Fprintf(p.w, "%s%s", p.prefix, line)
+		p.mu.Unlock()
+	}
+}
+
+var outputMu sync.Mutex
+
+// runOnHost runs invoker with args on host over ssh, streaming its output
+// prefixed with the host name.
+func runOnHost(ctx context.Context, host string, args ...string) error {
+	sshArgs := append([]string{"-o", "BatchMode=yes", host, remoteInvokerBinary}, args...)
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+
+	out := &prefixWriter{mu: &outputMu, w: os.Stdout, prefix: "[" + host + "] "}
+	cmd.Stdout, cmd.Stderr = out, out
+
+	if err := cmd.Run(); err != nil {
+		return errors.WithMessagef(err, "invoker failed on %s", host)
+	}
+
+	return nil
+}
+
+// outputOnHost runs invoker with args on host over ssh and returns what it
+// printed, also when it failed.
+func outputOnHost(ctx context.Context, host string, args ...string) (string, error) {
+	sshArgs := append([]string{"-o", "BatchMode=yes", host, remoteInvokerBinary}, args...)
+
+	out, err := exec.CommandContext(ctx, "ssh", sshArgs...).Output()
+	if err != nil {
+		return string(out), errors.WithMessagef(err, "invoker failed on %s", host)
+	}
+
+	return string(out), nil
+}
+
+// streamFromHost runs invoker with args on host over ssh, writing what it
+// prints to w as it comes. What it reports goes to stderr, prefixed with
+// the host name.
+func streamFromHost(ctx context.Context, host string, w io.Writer, args ...string) error {
+	sshArgs := append([]string{"-o", "BatchMode=yes", host, remoteInvokerBinary}, args...)
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	cmd.Stdout = w
+	cmd.Stderr = &prefixWriter{mu: &outputMu, w: os.Stderr, prefix: "[" + host + "] "}
+
+	if err := cmd.Run(); err != nil {
+		return errors.WithMessagef(err, "invoker failed on %s", host)
+	}
+
+	return nil
+}
+
+// pipeToHost runs invoker with args on host over ssh with stdin as its
+// input and returns what it printed. What it reports goes to stderr,
+// prefixed with the host name.
+func pipeToHost(ctx context.Context, host string, stdin io.Reader, args ...string) (string, error) {
+	sshArgs := append([]string{"-o", "BatchMode=yes", host, remoteInvokerBinary}, args...)
+	cmd := exec.CommandContext(ctx, "ssh", sshArgs...)
+	cmd.Stdin = stdin
+	cmd.Stderr = &prefixWriter{mu: &outputMu, w: os.Stderr, prefix: "[" + host + "] "}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), errors.WithMessagef(err, "invoker failed on %s", host)
+	}
+
+	return string(out), nil
+}
+
+// runOnHosts runs invoker with args on every host at once and returns the
+// errors by host.
+func runOnHosts(ctx context.Context, hosts []string, args ...string) map[string]error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make(map[string]error)
+
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := runOnHost(ctx, host, args...); err != nil {
+				mu.Lock()
+				failed[host] = err
+				mu.Unlock()
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	return failed
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+)
+
+// torchrunJoinTimeout is how long torchrun waits for all nodes to join
+// when the start is staggered without --rdzv_timeout, before the stagger is
+// added.
+const torchrunJoinTimeout = 15 * time.Minute
+
+// staggerDelay is how long the node of rank waits before it starts, so the
+// nodes of a large run don't all pull images and datasets at once. The
+// master starts right away, the other nodes get a slot each within window
+// and a random point in it.
+func staggerDelay(rank, nodes int, window time.Duration) time.Duration {
+	if rank == 0 || nodes < 2 || window <= 0 {
+		return 0
+	}
+
+	slot := window / time.Duration(nodes-1)
+	delay := slot * time.Duration(rank-1)
+	if slot > 0 {
+		delay += time.Duration(random.Int63n(int64(slot)))
+	}
+
+	return delay
+}
+
+// torchrunOptions are the torchrun settings invoker passes through.
+type torchrunOptions struct {
+	MaxRestarts  int
+	RdzvTimeout  time.Duration
+	StartStagger time.Duration
+}
+
+// args of torchrun for a run of nodes. The join timeout is extended by the
+// start stagger, so the last staggered node still makes it in time.
+func (o torchrunOptions) args(nodes int) []string {
+	args := make([]string, 0)
+	if o.MaxRestarts > 0 {
+		args = append(args, "--max_restarts", fmt.Sprint(o.MaxRestarts))
+	}
+	if nodes < 2 || (o.RdzvTimeout <= 0 && o.StartStagger <= 0) {
+		return args
+	}
+
+	timeout := o.RdzvTimeout
+	if timeout <= 0 {
+		timeout = torchrunJoinTimeout
+	}
+	if o.StartStagger > 0 {
+		timeout += o.StartStagger
+	}
+	seconds := int(timeout.Seconds())
+
+	return append(args, "--rdzv_conf", fmt.Sprintf("timeout=%d,join_timeout=%d", seconds, seconds))
+}
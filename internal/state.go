@@ -0,0 +1,367 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// ExperimentState is what invoker remembers about a container it launched
+// on this host. It's keyed by container name.
+type ExperimentState struct {
+	ContainerName  string           `json:"container_name"`
+	ProjectName    string           `json:"project_name"`
+	ExperimentName string           `json:"experiment_name"`
+	RunName        string           `json:"run_name"`
+	Team           string           `json:"team"`
+	User           string           `json:"user"`
+	Identity       string           `json:"identity,omitempty"`
+	Reservation    Reservation      `json:"reservation"`
+	RunArgs        RunArgs          `json:"run_args"`
+	Master         string           `json:"master"`
+	Rank           int              `json:"rank"`
+	Entrypoint     []string         `json:"entrypoint"`
+	ImageID        string           `json:"image_id"`
+	Attempts       int              `json:"attempts"`
+	Metrics        MetricsConfig    `json:"metrics"`
+	EarlyStop      EarlyStopPolicy  `json:"early_stop"`
+	Restart        RestartPolicy    `json:"restart"`
+	Datasets       []DatasetVersion `json:"datasets"`
+	ScratchDir     string           `json:"scratch_dir,omitempty"`
+	Protected      bool             `json:"protected,omitempty"`
+	// LaunchDigest is the hash of what the container was created from
+	// besides the image, see launchDigest.
+	LaunchDigest string `json:"launch_digest,omitempty"`
+	// Failures are snapshots of the host taken when attempts of the run
+	// failed.
+	Failures []FailureSnapshot `json:"failures,omitempty"`
+	// Artifacts are the files a job like an export produced.
+	Artifacts []string `json:"artifacts,omitempty"`
+	// Actions are the last directives read from the training code.
+	Actions     RunActions `json:"actions"`
+	LauncherPID int        `json:"launcher_pid"`
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	// Outcome is set when invoker ended the run itself, see EarlyStopPolicy.
+	Outcome       string `json:"outcome,omitempty"`
+	OutcomeReason string `json:"outcome_reason,omitempty"`
+	// VanishedAt is when the container was found missing, see reconcile.
+	VanishedAt time.Time `json:"vanished_at,omitempty"`
+	// Adopted states were rebuilt from a container that had none.
+	Adopted bool `json:"adopted,omitempty"`
+	// StrandedAt is when a reboot of the host took the run down and it
+	// wasn't restarted, see resumeAfterReboot.
+	StrandedAt     time.Time `json:"stranded_at,omitempty"`
+	StrandedReason string    `json:"stranded_reason,omitempty"`
+	// Cloud is the job of a run submitted to a managed backend, which has
+	// no container on this host.
+	Cloud *CloudJob `json:"cloud,omitempty"`
+	// Tags are the parsed --tag pairs of the run.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Sweep is the one of the run, see RunArgs.Sweep.
+	Sweep string `json:"sweep,omitempty"`
+	// SweepPolicy is the one of the sweep, unset for runs of none.
+	SweepPolicy SweepPolicy `json:"sweep_policy"`
+}
+
+// RunRecord is appended to the history once a run is gone from the state.
+type RunRecord struct {
+	ContainerName  string    `json:"container_name"`
+	ProjectName    string    `json:"project_name"`
+	ExperimentName string    `json:"experiment_name"`
+	RunName        string    `json:"run_name"`
+	Team           string    `json:"team"`
+	User           string    `json:"user"`
+	Identity       string    `json:"identity,omitempty"`
+	HostClass      string    `json:"host_class"`
+	GPUs           int       `json:"gpus"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	Outcome        string    `json:"outcome,omitempty"`
+	OutcomeReason  string    `json:"outcome_reason,omitempty"`
+	// ImageID, Entrypoint and Datasets tell what exactly the run executed,
+	// for comparing runs.
+	ImageID    string           `json:"image_id,omitempty"`
+	Entrypoint []string         `json:"entrypoint,omitempty"`
+	Datasets   []DatasetVersion `json:"datasets,omitempty"`
+	// ScratchBytes is what the run left in its nvme scratch directory.
+	ScratchBytes int64             `json:"scratch_bytes,omitempty"`
+	Failures     []FailureSnapshot `json:"failures,omitempty"`
+	// Kind is empty for training, see RunArgs.Kind.
+	Kind      string   `json:"kind,omitempty"`
+	Artifacts []string `json:"artifacts,omitempty"`
+	// BestLoss is the lowest loss parsed from the output, for retention.
+	BestLoss *float64  `json:"best_loss,omitempty"`
+	Cloud    *CloudJob `json:"cloud,omitempty"`
+	// Tags are the ones of the run, see RunArgs.Tags.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Attempts is how often the run was restarted.
+	Attempts int    `json:"attempts,omitempty"`
+	Sweep    string `json:"sweep,omitempty"`
+	// RunArgs, Master and Rank let `experiment resume` launch the run
+	// again once it's gone from the state.
+	RunArgs *RunArgs `json:"run_args,omitempty"`
+	Master  string   `json:"master,omitempty"`
+	Rank    int      `json:"rank,omitempty"`
+}
+
+func recordFromState(state ExperimentState, hostClass string, finishedAt time.Time) RunRecord {
+	return RunRecord{
+		ContainerName:  state.ContainerName,
+		ProjectName:    state.ProjectName,
+		ExperimentName: state.ExperimentName,
+		RunName:        state.RunName,
+		Team:           state.Team,
+		User:           state.User,
+		Identity:       state.Identity,
+		HostClass:      hostClass,
+		GPUs:           len(state.Reservation.GPUs),
+		StartedAt:      state.StartedAt,
+		FinishedAt:     finishedAt,
+		Outcome:        state.Outcome,
+		OutcomeReason:  state.OutcomeReason,
+		ImageID:        state.ImageID,
+		Entrypoint:     state.Entrypoint,
+		Datasets:       state.Datasets,
+		Failures:       state.Failures,
+		Kind:           state.RunArgs.Kind,
+		Artifacts:      state.Artifacts,
+		Cloud:          state.Cloud,
+		Tags:           state.Tags,
+		Attempts:       state.Attempts,
+		Sweep:          state.Sweep,
+		RunArgs:        &state.RunArgs,
+		Master:         state.Master,
+		Rank:           state.Rank,
+	}
+}
+
+// InnerStateManager keeps the per-host state: one json file per container
+// in ~/.cache/higgsfield/state, or under the cache directory of cacheRoot,
+// accessed through files.
+type InnerStateManager struct {
+	dir string
+}
+
+func NewInnerStateManager() (*InnerStateManager, error) {
+	path, err := invokerCacheDir("state")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := Path{path: path}
+	if err := dir.mkdirIfNotExists(); err != nil {
+		return nil, errors.WithMessage(err, "failed to create state directory")
+	}
+
+	return &InnerStateManager{dir: dir.path}, nil
+}
+
+// Lock takes an exclusive lock over the whole state directory, so that
+// concurrent invocations on the same host can do read-modify-write safely.
+func (m *InnerStateManager) Lock() (func(), error) {
+	unlock, err := files.Lock(filepath.Join(m.dir, ".lock"))
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to lock state")
+	}
+
+	return unlock, nil
+}
+
+func (m *InnerStateManager) file(containerName string) string {
+	return filepath.Join(m.dir, containerName+".json")
+}
+
+// Get returns nil if there is no state for the container.
+func (m *InnerStateManager) Get(containerName string) (*ExperimentState, error) {
+	data, err := files.ReadFile(m.file(containerName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read state of %s", containerName)
+	}
+
+	var state ExperimentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.WithMessagef(err, "failed to parse state of %s", containerName)
+	}
+
+	return &state, nil
+}
+
+func (m *InnerStateManager) Put(state ExperimentState) error {
+	state.UpdatedAt = clock.Now().UTC()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.WithMessagef(err, "failed to encode state of %s", state.ContainerName)
+	}
+
+	// write to a temporary file first so readers never see a partial state
+	tmp := m.file(state.ContainerName) + ".tmp"
+	if err := files.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.WithMessagef(err, "failed to write state of %s", state.ContainerName)
+	}
+
+	if err := files.Rename(tmp, m.file(state.ContainerName)); err != nil {
+		return errors.WithMessagef(err, "failed to write state of %s", state.ContainerName)
+	}
+
+	return nil
+}
+
+func (m *InnerStateManager) Delete(containerName string) error {
+	if err := files.Remove(m.file(containerName)); err != nil && !os.IsNotExist(err) {
+		return errors.WithMessagef(err, "failed to delete state of %s", containerName)
+	}
+
+	return nil
+}
+
+func (m *InnerStateManager) List() ([]ExperimentState, error) {
+	entries, err := files.ReadDir(m.dir)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read state directory")
+	}
+
+	states := make([]ExperimentState, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		state, err := m.Get(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if state != nil {
+			states = append(states, *state)
+		}
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].ContainerName < states[j].ContainerName })
+
+	return states, nil
+}
+
+func (m *InnerStateManager) historyFile() string {
+	return filepath.Join(m.dir, "history.jsonl")
+}
+
+func (m *InnerStateManager) AppendHistory(record RunRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to encode history of %s", record.ContainerName)
+	}
+
+	if err := files.AppendFile(m.historyFile(), append(data, '\n'), 0o644); err != nil {
+		return errors.WithMessage(err, "failed to write history")
+	}
+
+	return nil
+}
+
+func (m *InnerStateManager) History() ([]RunRecord, error) {
+	data, err := files.ReadFile(m.historyFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "failed to read history")
+	}
+
+	records := make([]RunRecord, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var record RunRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, errors.WithMessage(err, "failed to parse history")
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Retire moves a run from the state to the history and removes its scratch
+// directory.
+func (m *InnerStateManager) Retire(state ExperimentState, finishedAt time.Time) error {
+	config, err := LoadCostConfig()
+	if err != nil {
+		return err
+	}
+
+	record := recordFromState(state, config.HostClass, finishedAt)
+	record.ScratchBytes, err = removeScratch(state.ScratchDir)
+	if err != nil {
+		warnf("%v\n", err)
+	} else if state.ScratchDir != "" {
+		fmt.Printf("removed scratch directory %s holding %s\n", state.ScratchDir, units.HumanSize(float64(record.ScratchBytes)))
+	}
+	if store, err := NewMetricsStore(); err == nil {
+		record.BestLoss = bestLoss(store, state.ContainerName)
+	}
+
+	if err := m.AppendHistory(record); err != nil {
+		return err
+	}
+
+	if err := m.Delete(state.ContainerName); err != nil {
+		return err
+	}
+
+	notifyHooks(hookRetire, state)
+	return nil
+}
+
+type StateShowArgs struct {
+	ExperimentName string `validate:"required"`
+	ProjectName    string `validate:"omitempty,varname"`
+}
+
+// StateShow prints the recorded state of an experiment, matched either by
+// experiment or by container name.
+func StateShow(args StateShowArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	matches := make([]ExperimentState, 0, 1)
+	for _, s := range states {
+		if args.ProjectName != "" && s.ProjectName != args.ProjectName {
+			continue
+		}
+		if s.ExperimentName == args.ExperimentName || s.ContainerName == args.ExperimentName {
+			matches = append(matches, s.redacted())
+		}
+	}
+
+	if len(matches) == 0 {
+		errorf("no recorded state for %s on this host\n", args.ExperimentName)
+		os.Exit(ExitValidation)
+	}
+
+	data, err := json.MarshalIndent(matches, "", "  ")
+	if err != nil {
+		errorf("failed to encode the output: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	fmt.Println(string(data))
+}
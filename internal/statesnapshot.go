@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	units "github.com/docker/go-units"
+)
+
+const (
+	snapshotVersion = 1
+	// staleSnapshotAge is when a snapshot is old enough that its runs
+	// likely restarted or ended on the old host since.
+	staleSnapshotAge = time.Hour
+)
+
+// StateSnapshot is everything invoker knows on a host, for moving it to
+// another one.
+type StateSnapshot struct {
+	Version    int               `json:"version"`
+	Host       string            `json:"host"`
+	ExportedAt time.Time         `json:"exported_at"`
+	States     []ExperimentState `json:"states"`
+	History    []RunRecord       `json:"history"`
+	NodeHealth NodeHealth        `json:"node_health"`
+}
+
+// StateExport writes the snapshot of this host to stdout.
+func StateExport() {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	snapshot, err := sm.snapshot()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitInfra)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		errorf("failed to encode the output: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	fmt.Println(string(data))
+}
+
+func (m *InnerStateManager) snapshot() (StateSnapshot, error) {
+	unlock, err := m.Lock()
+	if err != nil {
+		return StateSnapshot{}, err
+	}
+	defer unlock()
+
+	host, _ := os.Hostname()
+	snapshot := StateSnapshot{Version: snapshotVersion, Host: host, ExportedAt: clock.Now().UTC()}
+
+	if snapshot.States, err = m.List(); err != nil {
+		return StateSnapshot{}, err
+	}
+	if snapshot.History, err = m.History(); err != nil {
+		return StateSnapshot{}, err
+	}
+	if snapshot.NodeHealth, err = m.NodeHealth(); err != nil {
+		return StateSnapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+type StateImportArgs struct {
+	// File is the snapshot to import, - for stdin.
+	File string `validate:"required"`
+	// Overwrite replaces the states this host already has for a container.
+	Overwrite bool
+}
+
+// StateImport merges a snapshot into the state of this host. History
+// records already present are skipped, gpu faults are added to the ones
+// of this host.
+func StateImport(args StateImportArgs) {
+	validateArgs(args)
+
+	var data []byte
+	var err error
+	if args.File == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args.File)
+	}
+	if err != nil {
+		errorf("failed to read snapshot: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	var snapshot StateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		errorf("failed to parse snapshot: %v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if snapshot.Version != snapshotVersion {
+		errorf("snapshot has version %d, this invoker reads version %d\n", snapshot.Version, snapshotVersion)
+		os.Exit(ExitValidation)
+	}
+
+	if age := clock.Now().Sub(snapshot.ExportedAt); !snapshot.ExportedAt.IsZero() && age > staleSnapshotAge {
+		warnf("the snapshot of %s is %s old, its runs may have restarted or ended since\n", snapshot.Host, units.HumanDuration(age))
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if err := sm.importSnapshot(snapshot, args.Overwrite); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
+
+func (m *InnerStateManager) importSnapshot(snapshot StateSnapshot, overwrite bool) error {
+	unlock, err := m.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	imported, skipped := 0, 0
+	for _, state := range snapshot.States {
+		existing, err := m.Get(state.ContainerName)
+		if err != nil {
+			return err
+		}
+		if existing != nil && !overwrite {
+			fmt.Printf("%s already has a state here, skipping it\n", state.ContainerName)
+			skipped++
+			continue
+		}
+
+		// the invoker that launched it ran on the other host
+		state.LauncherPID = 0
+		if err := m.Put(state); err != nil {
+			return err
+		}
+		imported++
+	}
+
+	history, err := m.History()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(history))
+	for _, r := range history {
+		seen[fmt.Sprint(r.ContainerName, r.StartedAt.UnixNano())] = true
+	}
+	records := 0
+	for _, r := range snapshot.History {
+		if seen[fmt.Sprint(r.ContainerName, r.StartedAt.UnixNano())] {
+			continue
+		}
+		if err := m.AppendHistory(r); err != nil {
+			return err
+		}
+		records++
+	}
+
+	health, err := m.NodeHealth()
+	if err != nil {
+		return err
+	}
+	faults := 0
+	for _, f := range snapshot.NodeHealth.Faults {
+		if health.add(f) {
+			faults++
+		}
+	}
+	if faults > 0 {
+		if err := m.PutNodeHealth(health); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("imported %d states, %d history records and %d gpu faults from %s as of %s, skipped %d states\n",
+		imported, records, faults, snapshot.Host, snapshot.ExportedAt.Local().Format(time.DateTime), skipped)
+	return nil
+}
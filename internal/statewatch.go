@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types of the state watch stream, named like kubernetes watch events.
+const (
+	stateAdded    = "ADDED"
+	stateModified = "MODIFIED"
+	stateDeleted  = "DELETED"
+)
+
+const (
+	stateWatchInterval  = time.Second
+	stateWatchKeepalive = 30 * time.Second
+	// stateWatchBuffer is how many events a watcher may fall behind before
+	// it's disconnected and has to watch again.
+	stateWatchBuffer = 256
+
+	defaultStateServePort = 9465
+	// maxServedLogLines bounds the log tails served on /logs.
+	maxServedLogLines = 1000
+)
+
+type StateEvent struct {
+	Type  string          `json:"type"`
+	State ExperimentState `json:"state"`
+}
+
+// diffStates returns the events that turn before into after, by container
+// name.
+func diffStates(before, after map[string]ExperimentState) []StateEvent {
+	events := make([]StateEvent, 0)
+	for _, name := range sortedKeys(after) {
+		previous, ok := before[name]
+		if !ok {
+			events = append(events, StateEvent{Type: stateAdded, State: after[name]})
+		} else if !previous.UpdatedAt.Equal(after[name].UpdatedAt) {
+			events = append(events, StateEvent{Type: stateModified, State: after[name]})
+		}
+	}
+	for _, name := range sortedKeys(before) {
+		if _, ok := after[name]; !ok {
+			events = append(events, StateEvent{Type: stateDeleted, State: before[name]})
+		}
+	}
+
+	return events
+}
+
+// stateBroadcaster polls the state directory once for all watchers and
+// pushes the changes to each of them.
+type stateBroadcaster struct {
+	mu          sync.Mutex
+	current     map[string]ExperimentState
+	subscribers map[chan StateEvent]struct{}
+}
+
+func newStateBroadcaster() *stateBroadcaster {
+	return &stateBroadcaster{
+		current:     make(map[string]ExperimentState),
+		subscribers: make(map[chan StateEvent]struct{}),
+	}
+}
+
+// subscribe returns the channel of future events along with the states at
+// this point, so a watcher misses nothing in between.
+func (b *stateBroadcaster) subscribe() (chan StateEvent, []ExperimentState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan StateEvent, stateWatchBuffer)
+	b.subscribers[ch] = struct{}{}
+
+	snapshot := make([]ExperimentState, 0, len(b.current))
+	for _, name := range sortedKeys(b.current) {
+		snapshot = append(snapshot, b.current[name])
+	}
+
+	return ch, snapshot
+}
+
+func (b *stateBroadcaster) unsubscribe(ch chan StateEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (b *stateBroadcaster) update(states []ExperimentState) {
+	next := make(map[string]ExperimentState, len(states))
+	for _, s := range states {
+		next[s.ContainerName] = s
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range diffStates(b.current, next) {
+		for ch := range b.subscribers {
+			select {
+			case ch <- event:
+			default:
+				// too slow, it gets a fresh snapshot when it watches again
+				delete(b.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+	b.current = next
+}
+
+func (b *stateBroadcaster) run(sm *InnerStateManager) {
+	for {
+		states, err := sm.List()
+		if err != nil {
+			warnf("failed to read state: %v\n", err)
+		} else {
+			b.update(states)
+		}
+		clock.Sleep(stateWatchInterval)
+	}
+}
+
+func writeStateEvent(w http.ResponseWriter, event StateEvent) error {
+	event.State = event.State.redacted()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// watchState streams the states of this host as server-sent events: an
+// ADDED event for every current state, then every change as it happens.
+func (b *stateBroadcaster) watchState(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, snapshot := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, s := range snapshot {
+		if err := writeStateEvent(w, StateEvent{Type: stateAdded, State: s}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(stateWatchKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeStateEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// HostStatus is what runs on a host right now, served on /host.
+type HostStatus struct {
+	Containers []ExperimentContainer `json:"containers"`
+	GPUs       []gpuMemory           `json:"gpus"`
+	// At is when the host gathered the status, by its clock.
+	At time.Time `json:"at"`
+}
+
+func serveHostStatus(dr *DockerRun) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		containers, err := dr.List("")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := HostStatus{Containers: make([]ExperimentContainer, 0, len(containers)), At: clock.Now().UTC()}
+		for _, c := range containers {
+			if namespace == "" || c.Namespace == namespace {
+				status.Containers = append(status.Containers, c)
+			}
+		}
+		// hosts without nvidia-smi have no gpus to show
+		status.GPUs, _ = queryGPUMemory()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// serveLogs serves the last lines of an invoker container, with secrets
+// masked. Other containers of the host aren't served.
+func serveLogs(dr *DockerRun) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("container")
+		lines, err := strconv.Atoi(r.URL.Query().Get("lines"))
+		if err != nil || lines < 1 || lines > maxServedLogLines {
+			http.Error(w, fmt.Sprintf("lines must be between 1 and %d", maxServedLogLines), http.StatusBadRequest)
+			return
+		}
+
+		containers, err := dr.List("")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !slices.ContainsFunc(containers, func(c ExperimentContainer) bool { return c.Name == name }) {
+			http.Error(w, "no invoker container "+name, http.StatusNotFound)
+			return
+		}
+
+		logs, err := dr.tailLogs(name, lines)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, redactText(logs))
+	}
+}
+
+// stateTokenEnv is the default variable holding the token of state serve,
+// top sends it too.
+const stateTokenEnv = "INVOKER_STATE_TOKEN"
+
+type StateServeArgs struct {
+	Addr string `validate:"required,hostname_port"`
+	// TokenEnv names the environment variable holding the token clients
+	// send as a bearer token. Without one anyone who reaches the address
+	// gets the state, and the logs only on a loopback address.
+	TokenEnv string `validate:"required"`
+}
+
+// stateAuthorization is the header top sends to state serve, none without
+// a token.
+func stateAuthorization() http.Header {
+	token := os.Getenv(stateTokenEnv)
+	if token == "" {
+		return nil
+	}
+
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+// requireToken answers 401 to requests without the bearer token, if
+// there is one.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// StateServe exposes the state of this host over http: a snapshot on
+// /state, a stream of changes on /state/watch, the containers and gpus on
+// /host and the logs of a container on /logs.
+func StateServe(args StateServeArgs) {
+	validateArgs(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), "", "", cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	token := os.Getenv(args.TokenEnv)
+	host, _, _ := net.SplitHostPort(args.Addr)
+	logs := serveLogs(dr)
+	if token == "" && !isLoopback(host) {
+		warnf("%s is empty, anyone who reaches %s gets the state of this host, its logs aren't served\n", args.TokenEnv, args.Addr)
+		logs = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, fmt.Sprintf("logs are only served with a token, set %s on the host", args.TokenEnv), http.StatusForbidden)
+		}
+	}
+
+	broadcaster := newStateBroadcaster()
+	broadcaster.update(states)
+	go broadcaster.run(sm)
+
+	http.HandleFunc("/state", requireToken(token, func(w http.ResponseWriter, r *http.Request) {
+		states, err := sm.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for i := range states {
+			states[i] = states[i].redacted()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+	}))
+	http.HandleFunc("/state/watch", requireToken(token, broadcaster.watchState))
+	http.HandleFunc("/host", requireToken(token, serveHostStatus(dr)))
+	http.HandleFunc("/logs", requireToken(token, logs))
+
+	fmt.Printf("serving state on http://%s/state and http://%s/state/watch\n", args.Addr, args.Addr)
+	if err := http.ListenAndServe(args.Addr, nil); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
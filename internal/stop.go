@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+type StopArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	Timeout        time.Duration `validate:"required"`
+	Yes            bool
+}
+
+func (args StopArgs) experimentFlags() []string {
+	flags := []string{"--project_name", args.ProjectName, "--experiment_name", args.ExperimentName, "--timeout", args.Timeout.String()}
+	if args.ContainerName != nil && *args.ContainerName != "" {
+		flags = append(flags, "--container_name", *args.ContainerName)
+	}
+	// ssh gives the remote side no terminal to ask on
+	if args.Yes {
+		flags = append(flags, "--yes")
+	}
+
+	return append(flags, namespaceFlags()...)
+}
+
+// stopRun marks the run as stopped before stopping its container, so a
+// watcher that sees the container exit also sees that it must not restart
+// it, and then retires the run.
+func stopRun(dr *DockerRun, sm *InnerStateManager, containerName string, timeout time.Duration) error {
+	unlock, err := sm.Lock()
+	if err != nil {
+		return err
+	}
+	state, err := sm.Get(containerName)
+	if err == nil {
+		err = checkUnprotected(state)
+	}
+	if err == nil && state != nil {
+		state.Outcome, state.OutcomeReason = outcomeStopped, "stopped by "+currentUser()
+		err = sm.Put(*state)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("stopping container %s\n", containerName)
+	if err := dr.Stop(containerName, timeout); err != nil && !client.IsErrNotFound(errors.Cause(err)) {
+		return err
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	return sm.Retire(*state, dr.finishedAt(containerName))
+}
+
+// Stop stops an experiment on this host for good, the watcher won't
+// restart it.
+func Stop(args StopArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	containerName := nameFromRestartArgs(RestartArgs{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		ContainerName:  args.ContainerName,
+	})
+
+	dr, err := dockerRunOf(context.Background(), containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	// stopRun checks again under the lock, this is only to not ask in vain
+	state, err := sm.Get(containerName)
+	if err == nil {
+		if err := checkUnprotected(state); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+	}
+	if !confirm("stop "+containerName, args.Yes) {
+		os.Exit(ExitValidation)
+	}
+
+	if state != nil && state.Cloud != nil {
+		if err := cancelCloudRun(sm, *state); err != nil {
+			errorf("failed to stop %s: %v\n", containerName, err)
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	if err := stopRun(dr, sm, containerName, args.Timeout); err != nil {
+		errorf("failed to stop %s: %v\n", containerName, err)
+		os.Exit(ExitInfra)
+	}
+}
+
+type StopAllArgs struct {
+	StopArgs
+	// Hosts are the hosts to stop the experiment on, the ones it was started
+	// on as recorded on this host if empty.
+	Hosts []string
+}
+
+// StopAll stops an experiment on every host it runs on, over ssh.
+func StopAll(args StopAllArgs) {
+	validateArgs(args)
+
+	hosts := args.Hosts
+	if len(hosts) == 0 {
+		recorded, err := recordedHosts(args.StopArgs)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		hosts = recorded
+	}
+
+	if !confirm(fmt.Sprintf("stop %s on %s", args.ExperimentName, strings.Join(hosts, ", ")), args.Yes) {
+		os.Exit(ExitValidation)
+	}
+	args.Yes = true
+
+	fmt.Printf("stopping %s on %d hosts\n", args.ExperimentName, len(hosts))
+	stop := append([]string{"experiment", "stop"}, args.experimentFlags()...)
+	failed := runOnHosts(context.Background(), hosts, stop...)
+	if len(failed) == 0 {
+		fmt.Printf("stopped %s on %d hosts\n", args.ExperimentName, len(hosts))
+		return
+	}
+
+	for _, host := range sortedKeys(failed) {
+		fmt.Printf("%s: %v\n", host, failed[host])
+	}
+	os.Exit(ExitInfra)
+}
+
+// recordedHosts are the hosts the experiment was started on, from the
+// state of this host.
+func recordedHosts(args StopArgs) ([]string, error) {
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to open state")
+	}
+
+	containerName := nameFromRestartArgs(RestartArgs{
+		ProjectName:    args.ProjectName,
+		ExperimentName: args.ExperimentName,
+		ContainerName:  args.ContainerName,
+	})
+	state, err := sm.Get(containerName)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.Errorf("no recorded run for %s on this host, pass --hosts", containerName)
+	}
+
+	return state.RunArgs.Hosts, nil
+}
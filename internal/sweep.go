@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	labelSweep = "higgsfield.sweep"
+	// sweepEnv tells the training code which sweep it's part of.
+	sweepEnv = "INVOKER_SWEEP_ID"
+)
+
+var sweepPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func checkSweep(sweep string) error {
+	if sweep != "" && !sweepPattern.MatchString(sweep) {
+		return errors.Errorf("invalid sweep %q, use letters, digits, '_', '.' and '-'", sweep)
+	}
+
+	return nil
+}
+
+// sweepEnvs pass the sweep to the container, also as the group trackers
+// put runs in. They come first, so env files and the project can override
+// them.
+func sweepEnvs(sweep string) []string {
+	if sweep == "" {
+		return nil
+	}
+
+	return []string{sweepEnv + "=" + sweep, "WANDB_RUN_GROUP=" + sweep}
+}
+
+type StopSweepArgs struct {
+	Sweep   string        `validate:"required"`
+	Timeout time.Duration `validate:"required"`
+	// Hosts are the other hosts to stop the sweep on, the ones its runs on
+	// this host were started with if empty.
+	Hosts []string
+	Yes   bool
+	// Local only stops the runs of this host, it's how the other hosts
+	// are asked.
+	Local bool
+}
+
+// StopSweep stops every run of a sweep for good, on this host and on the
+// other hosts of its runs over ssh.
+func StopSweep(args StopSweepArgs) {
+	validateArgs(args)
+	if err := checkSweep(args.Sweep); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	runs := make([]ExperimentState, 0)
+	others := make(map[string]bool)
+	for _, s := range states {
+		if s.Sweep != args.Sweep || (namespace != "" && s.RunArgs.Namespace != namespace) {
+			continue
+		}
+		runs = append(runs, s)
+		for rank, host := range s.RunArgs.Hosts {
+			if rank != s.Rank && !isLoopback(host) {
+				others[host] = true
+			}
+		}
+	}
+	hosts := args.Hosts
+	if len(hosts) == 0 && !args.Local {
+		hosts = sortedKeys(others)
+	}
+	if args.Local {
+		hosts = nil
+	}
+	if len(runs) == 0 && len(hosts) == 0 {
+		if args.Local {
+			return
+		}
+		errorf("no runs of sweep %s on this host, pass --hosts\n", args.Sweep)
+		os.Exit(ExitValidation)
+	}
+
+	prompt := fmt.Sprintf("stop the %d runs of sweep %s on this host", len(runs), args.Sweep)
+	if len(hosts) > 0 {
+		prompt += fmt.Sprintf(" and its runs on %d other hosts", len(hosts))
+	}
+	if !confirm(prompt, args.Yes) {
+		os.Exit(ExitValidation)
+	}
+
+	failures := make([]string, 0)
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ContainerName < runs[j].ContainerName })
+	for _, s := range runs {
+		if s.Cloud != nil {
+			err = cancelCloudRun(sm, s)
+		} else {
+			var dr *DockerRun
+			if dr, err = dockerRunOf(context.Background(), s.ContainerName); err == nil {
+				err = stopRun(dr, sm, s.ContainerName, args.Timeout)
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", s.ContainerName, err))
+		}
+	}
+
+	if len(hosts) > 0 {
+		stop := append([]string{"experiment", "stop-sweep", args.Sweep, "--local", "--yes", "--timeout", args.Timeout.String()}, namespaceFlags()...)
+		failed := runOnHosts(context.Background(), hosts, stop...)
+		for _, host := range sortedKeys(failed) {
+			failures = append(failures, fmt.Sprintf("%s: %v", host, failed[host]))
+		}
+	}
+
+	for _, f := range failures {
+		errorf("%s\n", f)
+	}
+	if len(failures) > 0 {
+		os.Exit(ExitInfra)
+	}
+	successf("stopped sweep %s\n", args.Sweep)
+}
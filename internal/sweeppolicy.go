@@ -0,0 +1,485 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sweepMetricLoss       = "loss"
+	sweepMetricThroughput = "tokens_per_sec"
+)
+
+// SweepPolicy stops the runs of a sweep that fall behind the others, by
+// successive halving, configured under sweep_policy in invoker.yaml. The
+// runs are compared at rungs, step counts, and the ones ranking below the
+// Keep fraction of the runs that got to a rung are stopped, freeing their
+// gpus for the others. `invoker experiment watch` enforces it, pooling the
+// metrics it scrapes with the ones of the other hosts of the sweep.
+type SweepPolicy struct {
+	// Metric is loss, lower is better, the default, or tokens_per_sec.
+	Metric string `yaml:"metric" json:"metric,omitempty"`
+	// Rungs are the steps the runs are compared at, the policy is off
+	// without them.
+	Rungs []int64 `yaml:"rungs" json:"rungs,omitempty"`
+	// Keep is the fraction of the runs kept at a rung, 0.5 if 0.
+	Keep float64 `yaml:"keep" json:"keep,omitempty"`
+	// MinRuns have to get to a rung before it's decided, 2 if 0.
+	MinRuns int `yaml:"min_runs" json:"min_runs,omitempty"`
+	// Hosts are the other hosts of the sweep, asked for their runs on top
+	// of the hosts of the runs of this host.
+	Hosts []string `yaml:"hosts" json:"hosts,omitempty"`
+	// StopTimeout is how long a pruned run gets to exit after SIGTERM.
+	StopTimeout time.Duration `yaml:"stop_timeout" json:"stop_timeout,omitempty"`
+}
+
+func (p SweepPolicy) enabled() bool {
+	return len(p.Rungs) > 0
+}
+
+func (p SweepPolicy) validate() error {
+	switch p.Metric {
+	case "", sweepMetricLoss, sweepMetricThroughput:
+	default:
+		return errors.Errorf("unknown sweep_policy metric %q, expected %s or %s", p.Metric, sweepMetricLoss, sweepMetricThroughput)
+	}
+	if p.Keep < 0 || p.Keep >= 1 {
+		return errors.Errorf("sweep_policy keep is %g, it has to be between 0 and 1", p.Keep)
+	}
+	if p.MinRuns < 0 {
+		return errors.Errorf("sweep_policy min_runs is %d, it can't be negative", p.MinRuns)
+	}
+	for i, rung := range p.Rungs {
+		if rung <= 0 || (i > 0 && rung <= p.Rungs[i-1]) {
+			return errors.Errorf("sweep_policy rungs %v have to be positive and increasing", p.Rungs)
+		}
+	}
+
+	return nil
+}
+
+func (p SweepPolicy) withDefaults() SweepPolicy {
+	if p.Metric == "" {
+		p.Metric = sweepMetricLoss
+	}
+	if p.Keep == 0 {
+		p.Keep = 0.5
+	}
+	if p.MinRuns == 0 {
+		p.MinRuns = 2
+	}
+
+	return p
+}
+
+// better tells whether the value a ranks above b, NaN ranking last.
+func (p SweepPolicy) better(a, b float64) bool {
+	switch {
+	case math.IsNaN(a):
+		return false
+	case math.IsNaN(b):
+		return true
+	case p.Metric == sweepMetricThroughput:
+		return a > b
+	default:
+		return a < b
+	}
+}
+
+// sweepStanding is how far a run of a sweep got, with its metric at every
+// rung it reached.
+type sweepStanding struct {
+	ContainerName string `json:"container_name"`
+	Host          string `json:"host"`
+	Step          int64  `json:"step"`
+	// Values are by rung, the last one reported up to the rung.
+	Values  map[int64]metricValue `json:"values"`
+	Live    bool                  `json:"live"`
+	Outcome string                `json:"outcome,omitempty"`
+}
+
+// standing reduces the series of a run to its values at the rungs.
+func (p SweepPolicy) standing(containerName string, points []MetricPoint) sweepStanding {
+	standing := sweepStanding{ContainerName: containerName, Values: make(map[int64]metricValue)}
+	for _, point := range points {
+		standing.Step = max(standing.Step, point.Step)
+	}
+
+	for _, rung := range p.Rungs {
+		if standing.Step < rung {
+			break
+		}
+		for _, point := range points {
+			value := point.Loss
+			if p.Metric == sweepMetricThroughput {
+				value = point.TokensPerSec
+			}
+			if value != nil && point.Step <= rung {
+				standing.Values[rung] = *value
+			}
+		}
+	}
+
+	return standing
+}
+
+// prune tells why the run falls behind at a rung it reached, empty if it's
+// kept. At every rung it's compared with each run that got there, running
+// or not, once MinRuns of them did.
+func (p SweepPolicy) prune(standings []sweepStanding, containerName string) string {
+	p = p.withDefaults()
+	i := slices.IndexFunc(standings, func(s sweepStanding) bool { return s.ContainerName == containerName })
+	if i < 0 {
+		return ""
+	}
+
+	for _, rung := range p.Rungs {
+		value, ok := standings[i].Values[rung]
+		if !ok {
+			return ""
+		}
+
+		reached := make([]sweepStanding, 0, len(standings))
+		for _, s := range standings {
+			if _, ok := s.Values[rung]; ok {
+				reached = append(reached, s)
+			}
+		}
+		if len(reached) < p.MinRuns {
+			return ""
+		}
+		sort.Slice(reached, func(a, b int) bool {
+			va, vb := float64(reached[a].Values[rung]), float64(reached[b].Values[rung])
+			if p.better(va, vb) || p.better(vb, va) {
+				return p.better(va, vb)
+			}
+			return reached[a].ContainerName < reached[b].ContainerName
+		})
+
+		keep := int(math.Ceil(float64(len(reached)) * p.Keep))
+		place := slices.IndexFunc(reached, func(s sweepStanding) bool { return s.ContainerName == containerName })
+		if place < keep {
+			continue
+		}
+		return fmt.Sprintf("%s %s at step %d ranks %d of %d, the best %d are kept",
+			p.Metric, formatMetric(&value), rung, place+1, len(reached), keep)
+	}
+
+	return ""
+}
+
+// localStandings are the ones of the runs of the sweep on this host, live
+// and in the history. The metrics of the live runs are scraped beforehand.
+func localStandings(sm *InnerStateManager, store *MetricsStore, sweep string, policy SweepPolicy) ([]sweepStanding, error) {
+	states, err := sm.List()
+	if err != nil {
+		return nil, err
+	}
+	history, err := sm.History()
+	if err != nil {
+		return nil, err
+	}
+
+	self, _ := os.Hostname()
+	standings := make([]sweepStanding, 0)
+	add := func(containerName string, live bool, outcome string) error {
+		points, err := store.Series(containerName)
+		if err != nil {
+			return err
+		}
+		standing := policy.standing(containerName, points)
+		standing.Host, standing.Live, standing.Outcome = self, live, outcome
+		standings = append(standings, standing)
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range states {
+		if s.Sweep == sweep && s.Cloud == nil && !seen[s.ContainerName] {
+			seen[s.ContainerName] = true
+			if err := add(s.ContainerName, true, s.Outcome); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// the history is oldest first, a reused name is ranked by its last run
+	for i := len(history) - 1; i >= 0; i-- {
+		r := history[i]
+		if r.Sweep == sweep && r.Cloud == nil && !seen[r.ContainerName] {
+			seen[r.ContainerName] = true
+			outcome := r.Outcome
+			if outcome == "" {
+				outcome = "finished"
+			}
+			if err := add(r.ContainerName, false, outcome); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return standings, nil
+}
+
+// gatherStandings adds the standings of the other hosts of the sweep to the
+// local ones. A run of several hosts counts once, with the host that got
+// furthest. The hosts that failed to answer are returned with their error.
+func gatherStandings(local []sweepStanding, sweep string, policy SweepPolicy, hosts []string) ([]sweepStanding, map[string]error) {
+	rungs := make([]string, 0, len(policy.Rungs))
+	for _, rung := range policy.Rungs {
+		rungs = append(rungs, strconv.FormatInt(rung, 10))
+	}
+	remote := []string{"experiment", "sweep-standings", sweep, "--local", "--rungs", strings.Join(rungs, ",")}
+	if policy.Metric != "" {
+		remote = append(remote, "--metric", policy.Metric)
+	}
+	remote = append(remote, namespaceFlags()...)
+
+	answers := make(map[string][]sweepStanding)
+	var mu sync.Mutex
+	failed := syncHosts(hosts, func(host string) error {
+		out, err := outputOnHost(context.Background(), host, remote...)
+		if err != nil {
+			return err
+		}
+		var standings []sweepStanding
+		if err := json.Unmarshal([]byte(lastLine(out)), &standings); err != nil {
+			return errors.WithMessage(err, "failed to parse the standings")
+		}
+		mu.Lock()
+		answers[host] = standings
+		mu.Unlock()
+		return nil
+	})
+
+	byName := make(map[string]sweepStanding)
+	merge := func(s sweepStanding) {
+		if current, ok := byName[s.ContainerName]; !ok || s.Step > current.Step {
+			byName[s.ContainerName] = s
+		}
+	}
+	for _, s := range local {
+		merge(s)
+	}
+	for _, host := range sortedKeys(answers) {
+		for _, s := range answers[host] {
+			s.Host = host
+			merge(s)
+		}
+	}
+
+	standings := make([]sweepStanding, 0, len(byName))
+	for _, name := range sortedKeys(byName) {
+		standings = append(standings, byName[name])
+	}
+
+	return standings, failed
+}
+
+// sweepHosts are the other hosts to ask about the sweep: the ones of the
+// policy and of the runs of this host.
+func sweepHosts(states []ExperimentState, policy SweepPolicy) []string {
+	self, _ := os.Hostname()
+	hosts := make(map[string]bool)
+	for _, host := range policy.Hosts {
+		hosts[host] = true
+	}
+	for _, s := range states {
+		for rank, host := range s.RunArgs.Hosts {
+			if rank != s.Rank {
+				hosts[host] = true
+			}
+		}
+	}
+	for host := range hosts {
+		if host == self || isLoopback(host) {
+			delete(hosts, host)
+		}
+	}
+
+	return sortedKeys(hosts)
+}
+
+// pruneSweeps enforces the sweep policies of the running runs of this host,
+// returning the ones it stopped. A sweep is left alone while a host of it
+// doesn't answer, as ranking without its runs could stop the wrong ones.
+func pruneSweeps(dr *DockerRun, sm *InnerStateManager, store *MetricsStore, states []ExperimentState, byName map[string]ExperimentContainer) map[string]bool {
+	sweeps := make(map[string][]ExperimentState)
+	for _, s := range states {
+		if c, ok := byName[s.ContainerName]; ok && c.State == "running" && s.Sweep != "" && s.SweepPolicy.enabled() {
+			sweeps[s.Sweep] = append(sweeps[s.Sweep], s)
+		}
+	}
+
+	stopped := make(map[string]bool)
+	for _, sweep := range sortedKeys(sweeps) {
+		runs := sweeps[sweep]
+		policy := runs[0].SweepPolicy
+		for _, s := range runs {
+			if err := dr.ScrapeMetrics(store, s); err != nil {
+				warnf("failed to scrape metrics of %s: %v\n", s.ContainerName, err)
+			}
+		}
+
+		local, err := localStandings(sm, store, sweep, policy)
+		if err != nil {
+			warnf("failed to rank sweep %s: %v\n", sweep, err)
+			continue
+		}
+		standings, failed := gatherStandings(local, sweep, policy, sweepHosts(runs, policy))
+		if len(failed) > 0 {
+			for _, host := range sortedKeys(failed) {
+				fmt.Printf("not ranking sweep %s, %s didn't answer: %v\n", sweep, host, failed[host])
+			}
+			continue
+		}
+
+		for _, s := range runs {
+			reason := policy.prune(standings, s.ContainerName)
+			if reason == "" {
+				continue
+			}
+			ok, err := stopWithOutcome(dr, sm, s, outcomePruned, fmt.Sprintf("%s in sweep %s", reason, sweep), policy.StopTimeout)
+			if err != nil {
+				warnf("failed to prune %s: %v\n", s.ContainerName, err)
+			}
+			if ok {
+				stopped[s.ContainerName] = true
+			}
+		}
+	}
+
+	return stopped
+}
+
+type SweepStandingsArgs struct {
+	Sweep string `validate:"required"`
+	// Metric and Rungs are the ones of the policy of the sweep's runs on
+	// this host if empty.
+	Metric string `validate:"omitempty,oneof=loss tokens_per_sec"`
+	Rungs  []int
+	Hosts  []string
+	// Local prints the standings of this host as json, it's how the other
+	// hosts are asked.
+	Local bool
+}
+
+// SweepStandings prints the runs of a sweep with their metric at every
+// rung, the way `experiment watch` ranks them.
+func SweepStandings(args SweepStandingsArgs) {
+	validateArgs(args)
+	if err := checkSweep(args.Sweep); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	store, err := NewMetricsStore()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	states, err := sm.List()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	runs := make([]ExperimentState, 0)
+	var policy SweepPolicy
+	for _, s := range states {
+		if s.Sweep == args.Sweep && s.Cloud == nil {
+			runs = append(runs, s)
+			if !policy.enabled() {
+				policy = s.SweepPolicy
+			}
+		}
+	}
+	if len(args.Rungs) > 0 {
+		policy.Rungs = make([]int64, 0, len(args.Rungs))
+		for _, rung := range args.Rungs {
+			policy.Rungs = append(policy.Rungs, int64(rung))
+		}
+	}
+	if args.Metric != "" {
+		policy.Metric = args.Metric
+	}
+	if err := policy.validate(); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if !policy.enabled() {
+		errorf("no sweep policy recorded for sweep %s on this host, pass --rungs\n", args.Sweep)
+		os.Exit(ExitValidation)
+	}
+	policy = policy.withDefaults()
+
+	scrapeLive(context.Background(), store, runs)
+	local, err := localStandings(sm, store, args.Sweep, policy)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.Local {
+		data, err := json.Marshal(local)
+		if err != nil {
+			errorf("failed to encode the standings: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 {
+		hosts = sweepHosts(runs, policy)
+	}
+	standings, failed := gatherStandings(local, args.Sweep, policy, hosts)
+	for _, host := range sortedKeys(failed) {
+		warnf("%s: %v\n", host, failed[host])
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "RUN\tHOST\tSTEP")
+	for _, rung := range policy.Rungs {
+		fmt.Fprintf(w, "\t%s@%d", strings.ToUpper(policy.Metric), rung)
+	}
+	fmt.Fprintln(w, "\tSTATUS")
+	for _, s := range standings {
+		fmt.Fprintf(w, "%s\t%s\t%d", s.ContainerName, s.Host, s.Step)
+		for _, rung := range policy.Rungs {
+			value, ok := s.Values[rung]
+			if !ok {
+				fmt.Fprint(w, "\t-")
+				continue
+			}
+			fmt.Fprintf(w, "\t%s", formatMetric(&value))
+		}
+		status := s.Outcome
+		if s.Live && status == "" {
+			status = "running"
+		}
+		fmt.Fprintf(w, "\t%s\n", status)
+	}
+	w.Flush()
+
+	if len(failed) > 0 {
+		os.Exit(ExitInfra)
+	}
+}
@@ -0,0 +1,524 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const invokerIgnoreFile = ".invokerignore"
+
+// ignoreRule is a line of .invokerignore, which has the syntax of
+// .gitignore.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// ignoreRules are the rules of a project's .invokerignore, the last rule
+// matching a path decides, like in git.
+type ignoreRules []ignoreRule
+
+// globRegexp translates a gitignore glob to a regexp on slash separated
+// paths relative to the project root.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("unclosed [ in %s", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// a matched directory takes everything in it along
+	re.WriteString("(/.*)?$")
+
+	return regexp.Compile(re.String())
+}
+
+// loadIgnoreRules reads .invokerignore from the project root, no rules if
+// there is none.
+func loadIgnoreRules(root string) (ignoreRules, error) {
+	data, err := files.ReadFile(filepath.Join(root, invokerIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read %s", invokerIgnoreFile)
+	}
+
+	var rules ignoreRules
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if rule.negate = strings.HasPrefix(line, "!"); rule.negate {
+			line = line[1:]
+		}
+		if rule.dirOnly = strings.HasSuffix(line, "/"); rule.dirOnly {
+			line = strings.TrimSuffix(line, "/")
+		}
+		rule.pattern = line
+		if rule.re, err = globRegexp(line); err != nil {
+			return nil, errors.WithMessagef(err, "invalid pattern on line %d of %s", n, invokerIgnoreFile)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ignored tells whether the path, relative to the project root and slash
+// separated, is left out.
+func (r ignoreRules) ignored(rel string, dir bool) bool {
+	ignored := false
+	for _, rule := range r {
+		m := rule.re.FindStringSubmatch(rel)
+		if m == nil {
+			continue
+		}
+		// a dir-only rule matches what's below the directory, not a file
+		// of that name
+		if rule.dirOnly && !dir && m[len(m)-1] == "" {
+			continue
+		}
+		ignored = !rule.negate
+	}
+
+	return ignored
+}
+
+// rsyncFilters are the rules as rsync filter rules. Rsync goes by the
+// first rule that matches, so they are in reverse.
+func (r ignoreRules) rsyncFilters() []string {
+	filters := []string{"- /" + invokerIgnoreFile}
+	for i := len(r) - 1; i >= 0; i-- {
+		rule := r[i]
+		// rsync matches patterns with inner slashes at any depth, git only
+		// from the root
+		pattern := rule.pattern
+		if rest, ok := strings.CutPrefix(pattern, "**/"); ok && !strings.Contains(rest, "/") {
+			pattern = rest
+		} else if strings.Contains(pattern, "/") && !strings.HasPrefix(pattern, "/") && !strings.HasPrefix(pattern, "**") {
+			pattern = "/" + pattern
+		}
+		if rule.dirOnly {
+			pattern += "/"
+		}
+		if rule.negate {
+			filters = append(filters, "+ "+pattern)
+		} else {
+			filters = append(filters, "- "+pattern)
+		}
+	}
+
+	return filters
+}
+
+// rsync copies from to to, either of them may be host:path, and returns
+// what it printed.
+func rsync(ctx context.Context, from, to string, filters []string, extra ...string) (string, error) {
+	args := []string{"-az", "-e", "ssh -o BatchMode=yes"}
+	for _, f := range filters {
+		args = append(args, "--filter="+f)
+	}
+	args = append(append(args, extra...), from, to)
+
+	out, err := exec.CommandContext(ctx, "rsync", args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("rsync failed: %v %s", err, lastLine(string(out)))
+	}
+
+	return string(out), nil
+}
+
+// syncHosts runs do for every host at once and returns the errors by
+// host.
+func syncHosts(hosts []string, do func(host string) error) map[string]error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := make(map[string]error)
+
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := do(host); err != nil {
+				mu.Lock()
+				failed[host] = err
+				mu.Unlock()
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// projectHosts are the hosts given or else the ones of the project config,
+// without their rank annotations.
+func projectHosts(root string, hosts []string) ([]string, error) {
+	if len(hosts) == 0 {
+		project, err := LoadHiggsfieldProject(root)
+		if err != nil {
+			return nil, err
+		} else if project != nil {
+			hosts = project.Hosts
+		}
+	}
+
+	stripped := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		host, _, _ = strings.Cut(host, "@")
+		if !isLoopback(host) {
+			stripped = append(stripped, host)
+		}
+	}
+
+	return stripped, nil
+}
+
+type PushArgs struct {
+	// Hosts to push to, the ones of the project config if empty.
+	Hosts []string
+	// Dest is where the project goes on the hosts, the same path as here
+	// if empty.
+	Dest string `validate:"omitempty,startswith=/"`
+	// Delete removes files from the hosts that are gone here, except for
+	// ignored ones.
+	Delete bool
+	DryRun bool
+	// Chunks sends the files as content addressed chunks instead of with
+	// rsync, only the chunks a host doesn't have yet. Peers has the hosts
+	// pass them on to each other, it implies Chunks.
+	Chunks bool
+	Peers  bool
+	// Receive and Relay are how hosts are asked to take a push and to
+	// pass it on.
+	Receive string `validate:"omitempty,oneof=missing apply"`
+	Relay   bool
+}
+
+// Push uploads the project in the working directory to every host, leaving
+// out what .invokerignore lists. Only changed files are transferred.
+func Push(args PushArgs) {
+	validateArgs(args)
+
+	if args.Receive != "" || args.Relay {
+		pushFromHost(args)
+		return
+	}
+
+	root, err := os.Getwd()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	rules, err := loadIgnoreRules(root)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	hosts, err := projectHosts(root, args.Hosts)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	if len(hosts) == 0 {
+		errorf("no remote hosts to push to, pass --hosts\n")
+		os.Exit(ExitValidation)
+	}
+	dest := args.Dest
+	if dest == "" {
+		dest = root
+	}
+
+	if args.Chunks || args.Peers {
+		if args.DryRun {
+			errorf("--dry_run only works with rsync\n")
+			os.Exit(ExitValidation)
+		}
+		manifest, locations, err := buildManifest(root, rules)
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		source := func(hash string) ([]byte, error) { return locations[hash].read() }
+		failed := pushChunks(hosts, dest, manifest, source, args)
+		for _, host := range sortedKeys(failed) {
+			errorf("%s: %v\n", host, failed[host])
+		}
+		if len(failed) > 0 {
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	extra := []string{"--rsync-path", "mkdir -p " + shellQuote(dest) + " && rsync"}
+	if args.Delete {
+		extra = append(extra, "--delete")
+	}
+	if args.DryRun {
+		extra = append(extra, "--dry-run", "--itemize-changes")
+	}
+
+	failed := syncHosts(hosts, func(host string) error {
+		out, err := rsync(context.Background(), root+"/", host+":"+dest+"/", rules.rsyncFilters(), extra...)
+		if err == nil && args.DryRun {
+			w := &prefixWriter{mu: &outputMu, w: os.Stdout, prefix: "[" + host + "] "}
+			w.Write([]byte(out))
+		}
+		return err
+	})
+	for _, host := range hosts {
+		if err, ok := failed[host]; ok {
+			errorf("%s: %v\n", host, err)
+		} else if !args.DryRun {
+			successf("pushed %s to %s:%s\n", root, host, dest)
+		}
+	}
+	if len(failed) > 0 {
+		os.Exit(ExitInfra)
+	}
+}
+
+// pushFromHost is the part of a push that runs on the hosts: taking the
+// chunks and tree and passing them on to other hosts.
+func pushFromHost(args PushArgs) {
+	if args.Dest == "" {
+		errorf("--dest is required\n")
+		os.Exit(ExitValidation)
+	}
+
+	var err error
+	switch {
+	case args.Receive == "missing":
+		err = receiveMissing()
+	case args.Receive == "apply":
+		err = receiveApply(args.Dest, args.Delete)
+	default:
+		var manifest syncManifest
+		var source func(string) ([]byte, error)
+		if manifest, source, err = relayManifest(args.Dest); err != nil {
+			break
+		}
+		args.Peers = false
+		failed := pushChunks(args.Hosts, args.Dest, manifest, source, args)
+		for _, host := range sortedKeys(failed) {
+			err = errors.WithMessage(failed[host], host)
+		}
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
+
+type PullResultsArgs struct {
+	ExperimentName string `validate:"required,varname"`
+	ProjectName    string `validate:"omitempty,varname"`
+	// RunName pulls a single run, the recorded run on each host or else
+	// every run of the experiment if empty.
+	RunName string `validate:"omitempty,varname"`
+	// Hosts to pull from, the recorded hosts of the run or those of the
+	// project config if empty.
+	Hosts []string
+	// Output gets a directory per host with the run directories in it.
+	Output string
+	// Exclude are rsync patterns left on the hosts, like *.pt.
+	Exclude []string
+	// Local prints the run directories of this host, it's how the other
+	// hosts are asked.
+	Local bool
+}
+
+// localRunDirs are the existing run directories of the experiment on this
+// host.
+func localRunDirs(sm *InnerStateManager, args PullResultsArgs) ([]string, *ExperimentState, error) {
+	state, err := findLiveState(sm, args.ProjectName, args.ExperimentName)
+	if err != nil {
+		return nil, nil, err
+	}
+	projectName := args.ProjectName
+	if projectName == "" && state != nil {
+		projectName = state.ProjectName
+	}
+	if projectName == "" {
+		return nil, nil, errors.Errorf("no recorded run of %s on this host, pass --project_name", args.ExperimentName)
+	}
+
+	var dirs []string
+	if args.RunName != "" {
+		_, dir, err := defaultDirectories(projectName, args.ExperimentName, args.RunName)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirs = []string{dir}
+	} else if dirs, err = runDirs(state, projectName, args.ExperimentName); err != nil {
+		return nil, nil, err
+	}
+
+	existing := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			existing = append(existing, dir)
+		}
+	}
+
+	return existing, state, nil
+}
+
+// PullResults fetches the run directories of an experiment, with their
+// checkpoints, logs and manifests, from every host of the run to
+// <output>/<host>/<run>.
+func PullResults(args PullResultsArgs) {
+	validateArgs(args)
+
+	sm, err := NewInnerStateManager()
+	if err != nil {
+		errorf("failed to open state: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	dirs, state, err := localRunDirs(sm, args)
+	if args.Local {
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitValidation)
+		}
+		data, err := json.Marshal(dirs)
+		if err != nil {
+			errorf("failed to encode run directories: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if err != nil && args.ProjectName == "" {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+
+	hosts := args.Hosts
+	if len(hosts) == 0 && state != nil {
+		hosts = state.RunArgs.Hosts
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+	if hosts, err = projectHosts(cwd, hosts); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitValidation)
+	}
+	output := args.Output
+	if output == "" {
+		output = "results"
+	}
+	filters := make([]string, 0, len(args.Exclude))
+	for _, pattern := range args.Exclude {
+		filters = append(filters, "- "+pattern)
+	}
+
+	pull := func(host string, dirs []string, remote bool) error {
+		target := filepath.Join(output, host)
+		if err := files.MkdirAll(target, 0o755); err != nil {
+			return errors.WithMessagef(err, "failed to create %s", target)
+		}
+		for _, dir := range dirs {
+			from := dir
+			if remote {
+				from = host + ":" + dir
+			}
+			if _, err := rsync(context.Background(), from, target+"/", filters); err != nil {
+				return err
+			}
+		}
+		infof("pulled %d runs from %s to %s\n", len(dirs), host, target)
+		return nil
+	}
+
+	var failures []string
+	if len(dirs) > 0 {
+		self, _ := os.Hostname()
+		if err := pull(self, dirs, false); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", self, err))
+		}
+	}
+	projectName := args.ProjectName
+	if projectName == "" {
+		projectName = state.ProjectName
+	}
+	// empty arguments would get lost on the way through ssh
+	remote := []string{"pull-results", args.ExperimentName, "--project_name", projectName, "--local"}
+	if args.RunName != "" {
+		remote = append(remote, "--run_name", args.RunName)
+	}
+	remote = append(remote, namespaceFlags()...)
+	failed := syncHosts(hosts, func(host string) error {
+		out, err := outputOnHost(context.Background(), host, remote...)
+		if err != nil {
+			return err
+		}
+		var dirs []string
+		if err := json.Unmarshal([]byte(lastLine(out)), &dirs); err != nil {
+			return errors.WithMessage(err, "failed to parse the run directories")
+		}
+		return pull(host, dirs, true)
+	})
+	for _, host := range sortedKeys(failed) {
+		failures = append(failures, fmt.Sprintf("%s: %v", host, failed[host]))
+	}
+
+	for _, f := range failures {
+		errorf("%s\n", f)
+	}
+	if len(failures) > 0 {
+		os.Exit(ExitInfra)
+	}
+}
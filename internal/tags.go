@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// labelTagPrefix prefixes the container labels of the tags of a run, the
+// key follows it.
+const labelTagPrefix = "higgsfield.tag."
+
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// parseTags parses key=value tags, the last value of a key given twice
+// wins.
+func parseTags(tags []string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string]string, len(tags))
+	for _, t := range tags {
+		key, value, ok := strings.Cut(t, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !tagKeyPattern.MatchString(key) {
+			return nil, errors.Errorf("invalid tag %q, expected key=value with a key of letters, digits, '_', '.' and '-'", t)
+		}
+		parsed[key] = value
+	}
+
+	return parsed, nil
+}
+
+func tagsFromLabels(labels map[string]string) map[string]string {
+	var tags map[string]string
+	for label, value := range labels {
+		if key, ok := strings.CutPrefix(label, labelTagPrefix); ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = value
+		}
+	}
+
+	return tags
+}
+
+// matchTags tells whether tags has every key=value of filter.
+func matchTags(tags, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := tags[key]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatTags is key=value,... sorted by key.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for _, key := range sortedKeys(tags) {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,622 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/docker/go-units"
+	"github.com/moby/term"
+	"github.com/pkg/errors"
+)
+
+const (
+	topReconnect   = 2 * time.Second
+	topHTTPTimeout = 5 * time.Second
+	topActionLimit = 5 * time.Minute
+)
+
+type TopArgs struct {
+	// Hosts run state serve, on port 9465 unless given as host:port.
+	Hosts    []string      `validate:"required,min=1,dive,required"`
+	Interval time.Duration `validate:"required"`
+	LogLines int           `validate:"min=1"`
+}
+
+// topHost is what top knows about one host: the states from its watch
+// stream and the containers and gpus it polls.
+type topHost struct {
+	name      string
+	addr      string
+	states    map[string]ExperimentState
+	status    HostStatus
+	streamErr error
+	statusErr error
+	// statusAt is when the shown status was received, and statesAt when
+	// the shown states were last known to be current, both by our clock. They are shown
+	// once the host stops answering.
+	statusAt  time.Time
+	statesAt  time.Time
+	streaming bool
+}
+
+// topRow is a run on a host, from its container, its state or both.
+type topRow struct {
+	host      *topHost
+	container string
+	project   string
+	exp       string
+	run       string
+	rank      string
+	state     string
+	health    string
+	attempts  string
+	sweep     string
+}
+
+type topModel struct {
+	mu       sync.Mutex
+	hosts    []*topHost
+	selected string
+	tail     bool
+	logs     string
+	message  string
+	// pending is the action waiting for y, stop or restart.
+	pending string
+	redraw  chan struct{}
+}
+
+func (m *topModel) changed() {
+	select {
+	case m.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// rows lists the runs of all hosts by host, experiment and container.
+// Must be called with mu held.
+func (m *topModel) rows() []topRow {
+	rows := make([]topRow, 0)
+	for _, h := range m.hosts {
+		hostRows := make([]topRow, 0)
+		seen := make(map[string]bool)
+		for _, c := range h.status.Containers {
+			seen[c.Name] = true
+			row := topRow{host: h, container: c.Name, project: c.ProjectName, exp: c.ExperimentName, run: c.RunName,
+				rank: "-", state: c.State, health: c.Health, attempts: "-", sweep: c.Sweep}
+			if s, ok := h.states[c.Name]; ok {
+				row.rank, row.attempts = fmt.Sprint(s.Rank), fmt.Sprint(s.Attempts)
+			}
+			hostRows = append(hostRows, row)
+		}
+		// runs whose containers are gone
+		for _, name := range sortedKeys(h.states) {
+			if seen[name] {
+				continue
+			}
+			s := h.states[name]
+			state := "no container"
+			if !s.VanishedAt.IsZero() {
+				state = "vanished"
+			}
+			hostRows = append(hostRows, topRow{host: h, container: name, project: s.ProjectName, exp: s.ExperimentName, run: s.RunName,
+				rank: fmt.Sprint(s.Rank), state: state, health: "-", attempts: fmt.Sprint(s.Attempts), sweep: s.Sweep})
+		}
+
+		sort.Slice(hostRows, func(i, j int) bool {
+			a, b := hostRows[i], hostRows[j]
+			// the runs of a sweep stay together
+			if a.sweep != b.sweep {
+				return a.sweep < b.sweep
+			}
+			if a.exp != b.exp {
+				return a.exp < b.exp
+			}
+			return a.container < b.container
+		})
+		rows = append(rows, hostRows...)
+	}
+
+	return rows
+}
+
+// selectedRow is the row under the cursor, the first one if the selected
+// run went away. Must be called with mu held.
+func (m *topModel) selectedRow(rows []topRow) (topRow, int, bool) {
+	for i, r := range rows {
+		if r.host.name+"/"+r.container == m.selected {
+			return r, i, true
+		}
+	}
+	if len(rows) == 0 {
+		return topRow{}, -1, false
+	}
+
+	m.selected = rows[0].host.name + "/" + rows[0].container
+	return rows[0], 0, true
+}
+
+func (m *topModel) move(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rows := m.rows()
+	_, i, ok := m.selectedRow(rows)
+	if !ok {
+		return
+	}
+	i = min(max(i+delta, 0), len(rows)-1)
+	m.selected = rows[i].host.name + "/" + rows[i].container
+	m.logs = ""
+}
+
+// watch follows the state stream of the host, connecting again when it
+// breaks.
+func (m *topModel) watch(ctx context.Context, h *topHost) {
+	for ctx.Err() == nil {
+		err := m.stream(ctx, h)
+		m.mu.Lock()
+		if h.streaming {
+			h.statesAt, h.streaming = clock.Now(), false
+		}
+		h.streamErr = err
+		m.mu.Unlock()
+		m.changed()
+
+		select {
+		case <-ctx.Done():
+		case <-clock.After(topReconnect):
+		}
+	}
+}
+
+func (m *topModel) stream(ctx context.Context, h *topHost) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+h.addr+"/state/watch", nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range stateAuthorization() {
+		req.Header[name] = values
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to watch %s", h.addr)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to watch %s: %s", h.addr, resp.Status)
+	}
+
+	// the stream starts over with the current states
+	m.mu.Lock()
+	h.states = make(map[string]ExperimentState)
+	h.streamErr, h.streaming = nil, true
+	m.mu.Unlock()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event StateEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return errors.WithMessagef(err, "invalid event from %s", h.addr)
+		}
+
+		m.mu.Lock()
+		if event.Type == stateDeleted {
+			delete(h.states, event.State.ContainerName)
+		} else {
+			h.states[event.State.ContainerName] = event.State
+		}
+		m.mu.Unlock()
+		m.changed()
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.WithMessagef(err, "lost the stream of %s", h.addr)
+	}
+
+	return errors.Errorf("%s closed the stream", h.addr)
+}
+
+// poll fetches the containers and gpus of every host and the logs of the
+// selected run.
+func (m *topModel) poll(args TopArgs) {
+	var wg sync.WaitGroup
+	for _, h := range m.hosts {
+		wg.Add(1)
+		go func(h *topHost) {
+			defer wg.Done()
+			var status HostStatus
+			data, err := httpGetWithHeader("http://"+h.addr+"/host", stateAuthorization(), topHTTPTimeout)
+			if err == nil {
+				err = json.Unmarshal(data, &status)
+			}
+
+			m.mu.Lock()
+			h.statusErr = err
+			if err == nil {
+				// the host's own stamp is by its clock, which may be off
+				h.status, h.statusAt = status, clock.Now()
+			}
+			m.mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	row, _, ok := m.selectedRow(m.rows())
+	lines := args.LogLines
+	if m.tail {
+		lines = maxServedLogLines
+	}
+	m.mu.Unlock()
+	if !ok {
+		m.changed()
+		return
+	}
+
+	query := url.Values{"container": {row.container}, "lines": {fmt.Sprint(lines)}}
+	data, err := httpGetWithHeader("http://"+row.host.addr+"/logs?"+query.Encode(), stateAuthorization(), topHTTPTimeout)
+	logs := string(data)
+	if err != nil {
+		logs = err.Error()
+	}
+
+	m.mu.Lock()
+	if m.selected == row.host.name+"/"+row.container {
+		m.logs = logs
+	}
+	m.mu.Unlock()
+	m.changed()
+}
+
+// act runs invoker on the host of the selected run, over ssh unless it's
+// this host. stop-sweep goes on from there to the other hosts of the
+// sweep.
+func (m *topModel) act(action string) {
+	m.mu.Lock()
+	row, _, ok := m.selectedRow(m.rows())
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	args := []string{"experiment", action, "--project_name", row.project, "--experiment_name", row.exp, "--container_name", row.container}
+	target := row.container
+	switch action {
+	case "stop":
+		args = append(args, "--yes")
+	case "stop-sweep":
+		args, target = []string{"experiment", action, row.sweep, "--yes"}, "sweep "+row.sweep
+	}
+	args = append(args, namespaceFlags()...)
+
+	m.setMessage(fmt.Sprintf("%s %s on %s...", action, target, row.host.name))
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), topActionLimit)
+		defer cancel()
+
+		var out []byte
+		var err error
+		if isLoopback(row.host.name) {
+			var executable string
+			if executable, err = os.Executable(); err == nil {
+				out, err = exec.CommandContext(ctx, executable, args...).CombinedOutput()
+			}
+		} else {
+			var output string
+			output, err = outputOnHost(ctx, row.host.name, args...)
+			out = []byte(output)
+		}
+
+		if err != nil {
+			last := strings.TrimSpace(string(out))
+			if i := strings.LastIndex(last, "\n"); i >= 0 {
+				last = last[i+1:]
+			}
+			m.setMessage(fmt.Sprintf("%s %s on %s failed: %v %s", action, target, row.host.name, err, last))
+			return
+		}
+		m.setMessage(fmt.Sprintf("%s %s on %s done", action, target, row.host.name))
+	}()
+}
+
+// staleSince tells how old what's shown of a host is once it stopped
+// answering, nothing if it never answered.
+func staleSince(what string, at time.Time) string {
+	if at.IsZero() {
+		return ""
+	}
+
+	return fmt.Sprintf(", %s as of %s ago", what, units.HumanDuration(clock.Now().Sub(at)))
+}
+
+func (m *topModel) setMessage(message string) {
+	m.mu.Lock()
+	m.message = message
+	m.mu.Unlock()
+	m.changed()
+}
+
+// key handles a key press and returns false on quit.
+func (m *topModel) key(key string) bool {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = ""
+	m.mu.Unlock()
+
+	if pending != "" {
+		if key == "y" || key == "Y" {
+			m.act(pending)
+		} else {
+			m.setMessage("")
+		}
+		return true
+	}
+
+	switch key {
+	case "q", "\x03":
+		return false
+	case "j", "\x1b[B":
+		m.move(1)
+	case "k", "\x1b[A":
+		m.move(-1)
+	case "t", "\r":
+		m.mu.Lock()
+		m.tail = !m.tail
+		m.mu.Unlock()
+	case "\x1b":
+		m.mu.Lock()
+		m.tail = false
+		m.mu.Unlock()
+	case "s", "r":
+		action := map[string]string{"s": "stop", "r": "restart"}[key]
+		m.mu.Lock()
+		row, _, ok := m.selectedRow(m.rows())
+		if ok {
+			m.pending = action
+			m.message = fmt.Sprintf("%s %s on %s? (y/n)", action, row.container, row.host.name)
+		}
+		m.mu.Unlock()
+	case "S":
+		m.mu.Lock()
+		row, _, ok := m.selectedRow(m.rows())
+		if ok && row.sweep != "" {
+			m.pending = "stop-sweep"
+			m.message = fmt.Sprintf("stop every run of sweep %s? (y/n)", row.sweep)
+		}
+		m.mu.Unlock()
+	}
+	m.changed()
+
+	return true
+}
+
+// render draws the whole screen, the gpus of each host, the runs and the
+// last lines of the selected run, or only its lines when tailing.
+func (m *topModel) render(width, height int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lines := []string{fmt.Sprintf("invoker top  %d hosts  %s    q quit  j/k select  t tail  s stop  r restart  S stop sweep",
+		len(m.hosts), clock.Now().Format(time.TimeOnly)), ""}
+
+	rows := m.rows()
+	row, selected, ok := m.selectedRow(rows)
+
+	if !m.tail {
+		for _, h := range m.hosts {
+			line := h.name
+			switch {
+			case h.streamErr != nil:
+				line += "  " + h.streamErr.Error() + staleSince("runs", h.statesAt)
+			case h.statusErr != nil:
+				line += "  " + h.statusErr.Error() + staleSince("containers and gpus", h.statusAt)
+			case len(h.status.GPUs) == 0:
+				line += "  no gpus"
+			}
+			for _, g := range h.status.GPUs {
+				line += fmt.Sprintf("  gpu%d %3d%% %s/%s", g.Index, g.Utilization,
+					units.BytesSize(float64(g.UsedMiB*units.MiB)), units.BytesSize(float64(g.TotalMiB*units.MiB)))
+			}
+			lines = append(lines, line)
+		}
+		lines = append(lines, "")
+
+		table := [][]string{{"HOST", "RANK", "SWEEP", "EXPERIMENT", "RUN", "CONTAINER", "STATE", "HEALTH", "ATTEMPTS"}}
+		for _, r := range rows {
+			table = append(table, []string{r.host.name, r.rank, orDash(r.sweep), r.exp, r.run, r.container, r.state, r.health, r.attempts})
+		}
+		for i, line := range alignColumns(table) {
+			line = " " + line
+			if i == selected+1 {
+				line = "\x1b[7m" + padRight(line, width) + "\x1b[0m"
+			}
+			lines = append(lines, line)
+		}
+		if len(rows) == 0 {
+			lines = append(lines, " no runs")
+		}
+		lines = append(lines, "")
+	}
+
+	if ok {
+		lines = append(lines, fmt.Sprintf("--- %s on %s", row.container, row.host.name))
+		logs := strings.Split(strings.TrimRight(m.logs, "\n"), "\n")
+		// leave room for the message
+		room := max(height-len(lines)-1, 0)
+		if len(logs) > room {
+			logs = logs[len(logs)-room:]
+		}
+		lines = append(lines, logs...)
+	}
+
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines[:min(len(lines), height-1)], m.message)
+
+	var screen strings.Builder
+	screen.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			screen.WriteString("\r\n")
+		}
+		screen.WriteString(fitWidth(line, width))
+		screen.WriteString("\x1b[K")
+	}
+
+	return screen.String()
+}
+
+// alignColumns pads the cells of each column to the widest one.
+func alignColumns(table [][]string) []string {
+	widths := make([]int, 0)
+	for _, row := range table {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], len([]rune(cell)))
+		}
+	}
+
+	lines := make([]string, len(table))
+	for i, row := range table {
+		cells := make([]string, len(row))
+		for j, cell := range row {
+			cells[j] = padRight(cell, widths[j])
+		}
+		lines[i] = strings.TrimRight(strings.Join(cells, "  "), " ")
+	}
+
+	return lines
+}
+
+func padRight(s string, width int) string {
+	if n := len([]rune(s)); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// fitWidth cuts lines that would wrap, leaving escape sequences alone.
+func fitWidth(line string, width int) string {
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			end := strings.IndexByte(line[i:], 'm')
+			if end < 0 {
+				break
+			}
+			i += end + 1
+			continue
+		}
+		if visible == width {
+			return line[:i] + "\x1b[0m"
+		}
+		_, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+		visible++
+	}
+
+	return line
+}
+
+func stateServeAddr(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, fmt.Sprint(defaultStateServePort))
+}
+
+// Top is a live view of the runs on the hosts, fed by their state serve
+// endpoints. Stop and restart run invoker on the host of the run.
+func Top(args TopArgs) {
+	validateArgs(args)
+
+	if !term.IsTerminal(os.Stdin.Fd()) || !term.IsTerminal(os.Stdout.Fd()) {
+		errorf("top needs a terminal, use state serve or experiment ps otherwise\n")
+		os.Exit(ExitValidation)
+	}
+
+	m := &topModel{redraw: make(chan struct{}, 1)}
+	for _, host := range args.Hosts {
+		addr := stateServeAddr(host)
+		name, _, _ := net.SplitHostPort(addr)
+		m.hosts = append(m.hosts, &topHost{name: name, addr: addr, states: make(map[string]ExperimentState)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, h := range m.hosts {
+		go m.watch(ctx, h)
+	}
+	go func() {
+		for ctx.Err() == nil {
+			m.poll(args)
+			select {
+			case <-ctx.Done():
+			case <-clock.After(args.Interval):
+			}
+		}
+	}()
+
+	saved, err := term.MakeRaw(os.Stdin.Fd())
+	if err != nil {
+		errorf("failed to set up the terminal: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+	// alternate screen without a cursor, restored on the way out
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.RestoreTerminal(os.Stdin.Fd(), saved)
+	}()
+
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		width, height := 80, 24
+		if size, err := term.GetWinsize(os.Stdout.Fd()); err == nil && size.Width > 0 && size.Height > 0 {
+			width, height = int(size.Width), int(size.Height)
+		}
+		fmt.Print(m.render(width, height))
+
+		select {
+		case key, ok := <-keys:
+			if !ok || !m.key(key) {
+				return
+			}
+		case <-m.redraw:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// triggerSkew is how far the timestamp of a trigger may be off, older
+	// requests are taken for replays.
+	triggerSkew = 5 * time.Minute
+	// triggerLimit bounds the checkout, build and start of a triggered run.
+	triggerLimit   = time.Hour
+	triggerMaxBody = 1 << 20
+)
+
+// triggerRefPattern keeps refs from being taken for git options.
+var triggerRefPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]*$`)
+
+// triggerRequest is the body of a trigger, like one posted by a GitHub
+// Actions job on merge.
+type triggerRequest struct {
+	// ID makes retries of a trigger start the run once, the hash of the
+	// body if empty.
+	ID         string            `json:"id"`
+	Repo       string            `json:"repo" validate:"required"`
+	Ref        string            `json:"ref" validate:"required"`
+	Experiment string            `json:"experiment" validate:"required,varname"`
+	RunName    string            `json:"run_name" validate:"omitempty,varname"`
+	Params     []string          `json:"params"`
+	Tags       map[string]string `json:"tags"`
+}
+
+type TriggerServeArgs struct {
+	Addr string `validate:"required"`
+	// SecretEnv names the environment variable holding the secret triggers
+	// are signed with.
+	SecretEnv string `validate:"required"`
+	// Repos are the repositories triggers may run, as they are cloned.
+	Repos []string `validate:"required,min=1"`
+	// Workspace is where the repositories are checked out.
+	Workspace string
+}
+
+// verifyTrigger checks the signature of a trigger, made like the ones of
+// outgoing webhooks, and that it's recent.
+func verifyTrigger(r *http.Request, secret string, body []byte) error {
+	timestamp := r.Header.Get(webhookTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Errorf("missing or invalid %s", webhookTimestampHeader)
+	}
+	if skew := clock.Now().Sub(time.Unix(seconds, 0)); skew > triggerSkew || skew < -triggerSkew {
+		return errors.Errorf("timestamp is %s off", skew.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(signWebhook(secret, timestamp, body))) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// checkoutDir is the directory of the repository in the workspace.
+func checkoutDir(workspace, repo string) string {
+	name := strings.TrimSuffix(filepath.Base(strings.TrimRight(repo, "/")), ".git")
+	sum := sha256.Sum256([]byte(repo))
+
+	return filepath.Join(workspace, fmt.Sprintf("%s-%s", name, hex.EncodeToString(sum[:4])))
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("git %s failed: %v %s", args[0], err, lastLine(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func lastLine(out string) string {
+	out = strings.TrimSpace(out)
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		return out[i+1:]
+	}
+
+	return out
+}
+
+// checkout clones the repository or updates its checkout to the ref,
+// giving the commit it's at.
+func checkout(ctx context.Context, dir, repo, ref string) (string, error) {
+	if _, err := files.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := files.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return "", errors.WithMessage(err, "failed to create the workspace")
+		}
+		if _, err := git(ctx, filepath.Dir(dir), "clone", "--no-checkout", "--", repo, dir); err != nil {
+			return "", err
+		}
+	}
+	if _, err := git(ctx, dir, "fetch", "--force", "origin", ref); err != nil {
+		return "", err
+	}
+	if _, err := git(ctx, dir, "checkout", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	// ignored files like datasets and caches are kept between runs
+	if _, err := git(ctx, dir, "clean", "-ffd"); err != nil {
+		return "", err
+	}
+
+	return git(ctx, dir, "rev-parse", "HEAD")
+}
+
+// launchTrigger checks out the ref of the trigger and runs its experiment
+// from there, through `experiment run` so it's built, placed and recorded
+// like any other run.
+func launchTrigger(workspace string, req triggerRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), triggerLimit)
+	defer cancel()
+
+	dir := checkoutDir(workspace, req.Repo)
+	commit, err := checkout(ctx, dir, req.Repo, req.Ref)
+	if err != nil {
+		return err
+	}
+	infof("trigger %s: %s is at %s, running %s\n", req.ID, req.Ref, commit, req.Experiment)
+
+	args := []string{"experiment", "run", req.Experiment, "--idempotency_key", "trigger-" + req.ID,
+		"--tag", "commit=" + commit, "--tag", "ref=" + req.Ref}
+	for _, key := range sortedKeys(req.Tags) {
+		args = append(args, "--tag", key+"="+req.Tags[key])
+	}
+	if req.RunName != "" {
+		args = append(args, "--run_name", req.RunName)
+	}
+	args = append(args, namespaceFlags()...)
+	args = append(append(args, "--"), req.Params...)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	os.Stdout.Write(out)
+	if err != nil {
+		return errors.Errorf("experiment run failed: %v %s", err, lastLine(string(out)))
+	}
+
+	return nil
+}
+
+// TriggerServe accepts signed triggers on /trigger and runs them one at a
+// time, for "train on merge" workflows. A trigger is answered once it's
+// verified, the run is started in the background.
+func TriggerServe(args TriggerServeArgs) {
+	validateArgs(args)
+
+	secret := os.Getenv(args.SecretEnv)
+	if secret == "" {
+		errorf("%s is empty, set it to the secret triggers are signed with\n", args.SecretEnv)
+		os.Exit(ExitValidation)
+	}
+	workspace := args.Workspace
+	if workspace == "" {
+		dir, err := invokerCacheDir("triggers")
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		workspace = dir
+	}
+
+	// checkouts are shared between triggers of a repository
+	var launching sync.Mutex
+	http.HandleFunc("/trigger", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "triggers are posted", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, triggerMaxBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := verifyTrigger(r, secret, body); err != nil {
+			warnf("rejected trigger from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req triggerRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid trigger: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := Validator().Struct(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid trigger: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(args.Repos, req.Repo) {
+			http.Error(w, fmt.Sprintf("repository %s isn't allowed", req.Repo), http.StatusForbidden)
+			return
+		}
+		if !triggerRefPattern.MatchString(req.Ref) {
+			http.Error(w, fmt.Sprintf("invalid ref %q", req.Ref), http.StatusBadRequest)
+			return
+		}
+		for key := range req.Tags {
+			if !tagKeyPattern.MatchString(key) {
+				http.Error(w, fmt.Sprintf("invalid tag key %q", key), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.ID == "" {
+			sum := sha256.Sum256(body)
+			req.ID = hex.EncodeToString(sum[:8])
+		}
+
+		infof("trigger %s: %s %s from %s\n", req.ID, req.Repo, req.Ref, r.RemoteAddr)
+		go func() {
+			launching.Lock()
+			defer launching.Unlock()
+			if err := launchTrigger(workspace, req); err != nil {
+				errorf("trigger %s: %v\n", req.ID, err)
+				return
+			}
+			successf("trigger %s: started %s\n", req.ID, req.Experiment)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"id": req.ID})
+	})
+
+	fmt.Printf("accepting triggers on http://%s/trigger\n", args.Addr)
+	if err := http.ListenAndServe(args.Addr, nil); err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"os"
 	"reflect"
 	"regexp"
 
@@ -24,7 +25,8 @@ var _validator = validator.New()
 
 func init() {
 	if err := _validator.RegisterValidation("varname", VarName); err != nil {
-		panic(err)
+		errorf("failed to register the varname validation: %v\n", err)
+		os.Exit(ExitInfra)
 	}
 }
 
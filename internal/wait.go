@@ -0,0 +1,355 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/pkg/errors"
+)
+
+// FailureClass tells why an experiment container exited, empty if it
+// succeeded.
+type FailureClass string
+
+const (
+	FailureNone FailureClass = ""
+	// FailureOOM is the kernel killing the container for its memory limit.
+	FailureOOM FailureClass = "oom"
+	// FailureCUDAOOM is the training running out of gpu memory.
+	FailureCUDAOOM FailureClass = "cuda_oom"
+	// FailureNCCL is a collective failing or timing out, usually another
+	// node dying or the network.
+	FailureNCCL FailureClass = "nccl"
+	// FailureRendezvous is torchrun giving up on nodes that never joined.
+	FailureRendezvous FailureClass = "rendezvous"
+	// FailureKilled is the container being stopped by a signal from outside.
+	FailureKilled FailureClass = "killed"
+	// FailureError is any other non-zero exit.
+	FailureError FailureClass = "error"
+)
+
+// failureLogLines is how much of the output is searched for known errors.
+const failureLogLines = 200
+
+// ExitResult is how an experiment container ended.
+type ExitResult struct {
+	ContainerName string        `json:"container_name"`
+	ExitCode      int           `json:"exit_code"`
+	OOMKilled     bool          `json:"oom_killed"`
+	Duration      time.Duration `json:"duration"`
+	Failure       FailureClass  `json:"failure,omitempty"`
+	// Error is what docker reports when the container couldn't run at all.
+	Error string `json:"error,omitempty"`
+	// Detail explains the failure further, e.g. the nodes a rendezvous
+	// waited for in vain.
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r ExitResult) Succeeded() bool {
+	return r.Failure == FailureNone
+}
+
+func (r ExitResult) String() string {
+	if r.Succeeded() {
+		return fmt.Sprintf("%s finished after %s", r.ContainerName, r.Duration.Round(time.Second))
+	}
+
+	s := fmt.Sprintf("%s failed after %s with code %d (%s)", r.ContainerName, r.Duration.Round(time.Second), r.ExitCode, r.Failure)
+	if r.Error != "" {
+		s += ": " + r.Error
+	}
+	if r.Detail != "" {
+		s += "\n" + r.Detail
+	}
+	return s
+}
+
+// classifyFailure looks at the exit and the tail of the output to tell
+// failures apart that need different reactions.
+func classifyFailure(exitCode int, oomKilled bool, logs string) FailureClass {
+	switch {
+	case exitCode == 0 && !oomKilled:
+		return FailureNone
+	case oomKilled:
+		return FailureOOM
+	case strings.Contains(logs, "CUDA out of memory") || strings.Contains(logs, "OutOfMemoryError"):
+		return FailureCUDAOOM
+	case rendezvousTimedOut(logs):
+		return FailureRendezvous
+	case strings.Contains(logs, "NCCL error") || strings.Contains(logs, "ProcessGroupNCCL"):
+		return FailureNCCL
+	// 143 and 137 are SIGTERM and SIGKILL
+	case exitCode == 143 || exitCode == 137:
+		return FailureKilled
+	default:
+		return FailureError
+	}
+}
+
+// waitForExit blocks until the container is not running anymore, right
+// away if it already exited, and reports how it ended.
+func (d *DockerRun) waitForExit(ctx context.Context, containerName string) (ExitResult, error) {
+	statusCh, errCh := d.client.ContainerWait(ctx, containerName, container.WaitConditionNotRunning)
+	select {
+	case <-statusCh:
+	case err := <-errCh:
+		return ExitResult{}, errors.WithMessagef(err, "failed to wait for %s", containerName)
+	}
+
+	inspect, err := d.client.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return ExitResult{}, errors.WithMessagef(err, "failed to inspect container %s", containerName)
+	}
+
+	startedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	finishedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt)
+
+	result := ExitResult{
+		ContainerName: containerName,
+		ExitCode:      inspect.State.ExitCode,
+		OOMKilled:     inspect.State.OOMKilled,
+		Error:         inspect.State.Error,
+	}
+	if !startedAt.IsZero() && finishedAt.After(startedAt) {
+		result.Duration = finishedAt.Sub(startedAt)
+	}
+
+	var logs string
+	if result.ExitCode != 0 {
+		// the class is still useful without the logs
+		logs, _ = d.tailLogs(containerName, failureLogLines)
+	}
+	result.Failure = classifyFailure(result.ExitCode, result.OOMKilled, logs)
+
+	return result, nil
+}
+
+// dockerRunOf connects to the docker daemon the run was started on, as
+// recorded in the state of this host.
+func dockerRunOf(ctx context.Context, containerName string) (*DockerRun, error) {
+	dockerContext := ""
+	if sm, err := NewInnerStateManager(); err == nil {
+		if state, err := sm.Get(containerName); err == nil && state != nil {
+			dockerContext = state.RunArgs.DockerContext
+		}
+	}
+
+	return NewDockerRun(ctx, dockerContext, "", "", "")
+}
+
+// WaitForExperiment blocks until the experiment container exits and
+// reports how it ended. A container that already exited is reported right
+// away.
+func WaitForExperiment(ctx context.Context, containerName string) (ExitResult, error) {
+	dr, err := dockerRunOf(ctx, containerName)
+	if err != nil {
+		return ExitResult{}, err
+	}
+
+	return dr.waitForExit(ctx, containerName)
+}
+
+// followLogs copies the output of the container to ours, with secrets
+// masked, until it exits or ctx ends.
+func (d *DockerRun) followLogs(ctx context.Context, containerName string) error {
+	logs, err := d.client.ContainerLogs(ctx, containerName, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Tail:       "100",
+	})
+	if err != nil {
+		return errors.WithMessagef(err, "failed to read logs of %s", containerName)
+	}
+	defer logs.Close()
+
+	stdout, stderr := &redactWriter{w: os.Stdout}, &redactWriter{w: os.Stderr}
+	_, err = stdcopy.StdCopy(stdout, stderr, logs)
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+type AttachArgs struct {
+	ProjectName    string `validate:"required,varname"`
+	ExperimentName string `validate:"varname"`
+	ContainerName  *string
+	// JSON prints the result as json, for orchestrators driving invoker.
+	JSON bool
+	// Output json prints the run result that's also written to
+	// result.json, for pipelines gating on the outcome.
+	Output string `validate:"omitempty,oneof=text json"`
+	// Timestamps and Prefix start every line with its time and the
+	// host/rank of the node.
+	Timestamps bool
+	Prefix     bool
+	// AllHosts fans in the output of the run on its other hosts over ssh,
+	// prefixed with their node.
+	AllHosts bool
+	// Interleave holds lines back that long to print them ordered by time,
+	// not at all if zero.
+	Interleave time.Duration `validate:"gte=0"`
+	// Stream only prints the output as timestamped lines, it's how the
+	// host fanning in the output asks the others.
+	Stream bool
+}
+
+func nameFromAttachArgs(args AttachArgs) string {
+	if args.ContainerName != nil && *args.ContainerName != "" {
+		return *args.ContainerName
+	}
+
+	return DefaultProjExpContainerName(args.ProjectName, args.ExperimentName)
+}
+
+// Attach follows the output of an experiment on this host until it exits,
+// then exits with ExitTraining if it failed or ExitPreempted if it was
+// preempted.
+func Attach(args AttachArgs) {
+	validateArgs(args)
+
+	containerName := nameFromAttachArgs(args)
+	ctx := context.Background()
+
+	dr, err := dockerRunOf(ctx, containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.Stream {
+		err := dr.streamLogs(ctx, containerName, "", func(l logLine) {
+			outputMu.Lock()
+			fmt.Println(formatStreamLine(l))
+			outputMu.Unlock()
+		})
+		if err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	// a preempted run is retired right away, its outcome is then only
+	// found in the history by when it started
+	var startedAt time.Time
+	var attached *ExperimentState
+	if sm, err := NewInnerStateManager(); err == nil {
+		if state, err := sm.Get(containerName); err == nil && state != nil {
+			startedAt, attached = state.StartedAt, state
+		}
+	}
+	if args.AllHosts && attached == nil {
+		errorf("%s isn't recorded on this host, its other hosts are unknown\n", containerName)
+		os.Exit(ExitValidation)
+	}
+
+	printer := &logPrinter{Timestamps: args.Timestamps, Prefix: args.Prefix || args.AllHosts, Window: args.Interleave}
+	plain := !printer.Timestamps && !printer.Prefix && printer.Window == 0
+	followCtx, stopFollowing := context.WithCancel(ctx)
+	defer stopFollowing()
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		if plain {
+			if err := dr.followLogs(followCtx, containerName); err != nil && followCtx.Err() == nil {
+				warnf("%v\n", err)
+			}
+			return
+		}
+
+		printer.start()
+		defer printer.close()
+		var wg sync.WaitGroup
+		if args.AllHosts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				failed := fanInLogs(followCtx, *attached, printer)
+				for _, node := range sortedKeys(failed) {
+					warnf("no more output of %s: %v\n", node, failed[node])
+				}
+			}()
+		}
+		rank := 0
+		if attached != nil {
+			rank = attached.Rank
+		}
+		if err := dr.streamLogs(followCtx, containerName, logSource(attached, rank), printer.add); err != nil && followCtx.Err() == nil {
+			warnf("%v\n", err)
+		}
+		wg.Wait()
+	}()
+
+	result, err := dr.waitForExit(ctx, containerName)
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	// let the last lines of output through before the result, also of
+	// the other hosts, whose containers usually exit right after
+	select {
+	case <-followed:
+	case <-clock.After(5 * time.Second):
+	}
+	stopFollowing()
+	<-followed
+
+	if result.ExitCode != 0 {
+		if sm, err := NewInnerStateManager(); err == nil {
+			if state, err := sm.Get(containerName); err == nil && state != nil && state.Outcome == "" {
+				if _, err := sm.recordFailure(dr, *state, result.ExitCode); err != nil {
+					warnf("%v\n", err)
+				}
+			}
+			if state, err := sm.Get(containerName); err == nil && state != nil && result.Failure == FailureRendezvous {
+				result.Detail = missingPeersReport(ctx, *state)
+			}
+		}
+	}
+
+	runResult := RunResult{ContainerName: containerName, Succeeded: result.Succeeded(), ExitCode: result.ExitCode,
+		Failure: result.Failure, DurationSeconds: result.Duration.Seconds()}
+	if sm, err := NewInnerStateManager(); err == nil {
+		if state, err := sm.Get(containerName); err == nil && state != nil {
+			runResult = runResultOf(dr, *state, result)
+			if err := writeRunResult(runResultFile(runResult.RunDir, state.Rank), runResult); err != nil {
+				warnf("%v\n", err)
+			}
+		}
+	}
+
+	outcome := runResult.Outcome
+	if sm, err := NewInnerStateManager(); err == nil && outcome == "" {
+		outcome = sm.outcomeOf(containerName, startedAt)
+		runResult.Outcome = outcome
+	}
+
+	if args.Output == "json" {
+		data, err := json.MarshalIndent(runResult, "", "  ")
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+	} else if args.JSON {
+		data, err := json.Marshal(result)
+		if err != nil {
+			errorf("failed to encode the output: %v\n", err)
+			os.Exit(ExitInfra)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Println(result)
+	}
+	os.Exit(runExitCode(result, outcome))
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+const labelWarm = "higgsfield.warm"
+
+// warmCommand loads the heavy imports once, so their files sit in the page
+// cache, and then idles.
+var warmCommand = []string{"sh", "-c", "python -c 'import torch' >/dev/null 2>&1; exec sleep infinity"}
+
+func warmContainerName(projectName string) string {
+	return namespacedName(namespace, projectName+"-warm")
+}
+
+// warmImage is the image of the warm container of the project, empty if
+// there is none.
+func (d *DockerRun) warmImage(projectName string) (string, error) {
+	ctx, cancel := d.deadline(dockerOpInspect)
+	defer cancel()
+
+	inspect, err := d.client.ContainerInspect(ctx, warmContainerName(projectName))
+	if client.IsErrNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.WithMessagef(d.timedOut(ctx, dockerOpInspect, err), "failed to inspect warm container of %s", projectName)
+	}
+	if !inspect.State.Running {
+		return "", nil
+	}
+
+	return inspect.Image, nil
+}
+
+// startWarm builds the project image and starts an idle container from it
+// that keeps it from being pruned.
+func (d *DockerRun) startWarm(projectName string) (string, error) {
+	containerName := warmContainerName(projectName)
+	if err := d.Kill(containerName); err != nil {
+		return "", err
+	}
+
+	if err := d.Build(); err != nil {
+		return "", err
+	}
+
+	hostConfig := &container.HostConfig{RestartPolicy: container.RestartPolicy{Name: "unless-stopped"}}
+	if _, err := os.Stat("/dev/nvidia0"); err == nil || d.remote {
+		hostConfig.Resources.DeviceRequests = []container.DeviceRequest{gpuDeviceRequest(nil)}
+	}
+
+	ctx, cancel := d.deadline(dockerOpCreate)
+	defer cancel()
+
+	resp, err := d.client.ContainerCreate(ctx, &container.Config{
+		Image:      d.imageTag,
+		Entrypoint: warmCommand,
+		Labels:     map[string]string{labelWarm: projectName},
+	}, hostConfig, nil, nil, containerName)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			d.removeLeftover(containerName)
+		}
+		return "", errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to create container %s", containerName)
+	}
+
+	if err := d.client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		d.removeLeftover(containerName)
+		return "", errors.WithMessagef(d.timedOut(ctx, dockerOpCreate, err), "failed to start container %s", containerName)
+	}
+
+	return d.warmImage(projectName)
+}
+
+type WarmArgs struct {
+	ProjectName   string `validate:"required,varname"`
+	DockerContext string
+	// Stop removes the warm container instead.
+	Stop bool
+}
+
+// Warm keeps a built image and an idle container from it on this host, so
+// that runs started with --warm skip the build.
+func Warm(args WarmArgs) {
+	validateArgs(args)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		errorf("failed to get the working directory: %v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	dr, err := NewDockerRun(context.Background(), args.DockerContext, args.ProjectName, cwd, "")
+	if err != nil {
+		errorf("%v\n", err)
+		os.Exit(ExitInfra)
+	}
+
+	if args.Stop {
+		if err := dr.Kill(warmContainerName(args.ProjectName)); err != nil {
+			errorf("%v\n", err)
+			os.Exit(ExitInfra)
+		}
+		return
+	}
+
+	image, err := dr.startWarm(args.ProjectName)
+	if err != nil {
+		errorf("failed to warm up %s: %v\n", args.ProjectName, err)
+		os.Exit(ExitInfra)
+	}
+
+	fmt.Printf("%s is warm on image %s\n", warmContainerName(args.ProjectName), truncate(image, 19))
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// webhookAttempts are made right away, with httpBackoff between them,
+	// before the delivery is left to `experiment watch`.
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+	// webhookRetryBackoff doubles with every retry by `experiment watch` up
+	// to webhookRetryMax, deliveries older than webhookExpiry are dropped.
+	webhookRetryBackoff = time.Minute
+	webhookRetryMax     = time.Hour
+	webhookExpiry       = 24 * time.Hour
+
+	webhookSignatureHeader = "X-Invoker-Signature-256"
+	webhookTimestampHeader = "X-Invoker-Timestamp"
+)
+
+// WebhookConfig posts lifecycle events to an url, for systems like Airflow
+// or internal portals to react to. It's configured under webhooks in
+// plugins.json.
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// SecretEnv names the environment variable holding the secret the
+	// events are signed with, Secret is the secret itself. Unsigned if
+	// neither is set.
+	SecretEnv string `json:"secret_env"`
+	Secret    string `json:"secret"`
+	// Events are the hook events posted, every one but pre_launch if
+	// empty.
+	Events []string `json:"events"`
+}
+
+func (w WebhookConfig) secret() string {
+	if w.SecretEnv != "" {
+		return os.Getenv(w.SecretEnv)
+	}
+
+	return w.Secret
+}
+
+func (w WebhookConfig) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return event != hookPreLaunch
+	}
+
+	return slices.Contains(w.Events, event)
+}
+
+// webhookEvent is the body of a webhook request. The state is the full
+// manifest of the run: its arguments, image, entrypoint, datasets and
+// tags.
+type webhookEvent struct {
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	Time  time.Time       `json:"time"`
+	Host  string          `json:"host"`
+	State ExperimentState `json:"state"`
+}
+
+// webhookDelivery is an event that couldn't be posted yet, kept in
+// ~/.cache/higgsfield/webhooks until `experiment watch` gets it through.
+// The secret isn't kept, it's looked up by url when retrying.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+}
+
+// signWebhook is the hex HMAC-SHA256 of the timestamp, a dot and the body,
+// so a captured request can't be replayed with another timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook makes one attempt, telling whether a failure is worth
+// retrying.
+func postWebhook(url, secret, id, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.WithMessagef(err, "invalid webhook url %s", url)
+	}
+	timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Invoker-Event", event)
+	req.Header.Set("X-Invoker-Delivery", id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(secret, timestamp, body))
+	}
+
+	client := *httpClient
+	client.Timeout = webhookTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, errors.WithMessagef(err, "failed to post to %s", url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if answer = bytes.TrimSpace(answer); len(answer) > 0 {
+			return retry, errors.Errorf("%s answered %s: %s", url, resp.Status, truncate(string(answer), 200))
+		}
+		return retry, errors.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	return false, nil
+}
+
+func webhookOutbox() (string, error) {
+	return invokerCacheDir("webhooks")
+}
+
+// sendWebhooks posts the event to every webhook that wants it. Deliveries
+// that keep failing are left for `experiment watch` to retry.
+func (c PluginConfig) sendWebhooks(event string, state ExperimentState) {
+	host, _ := os.Hostname()
+	for _, w := range c.Webhooks {
+		if !w.wants(event) {
+			continue
+		}
+
+		id := fmt.Sprintf("%x%x", clock.Now().UnixNano(), random.Int63n(1<<62))
+		// the url is outside, the arguments of the run may carry secrets
+		body, err := json.Marshal(webhookEvent{ID: id, Event: event, Time: clock.Now().UTC(), Host: host, State: state.redacted()})
+		if err != nil {
+			warnf("failed to encode %s event for %s: %v\n", event, w.URL, err)
+			continue
+		}
+
+		backoff := httpBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := postWebhook(w.URL, w.secret(), id, event, body)
+			if err == nil {
+				break
+			}
+			if !retry {
+				warnf("dropping %s event for %s: %v\n", event, w.URL, err)
+				break
+			}
+			if attempt == webhookAttempts {
+				delivery := webhookDelivery{ID: id, URL: w.URL, Body: body, CreatedAt: clock.Now().UTC(), Attempts: attempt,
+					NextAttempt: clock.Now().UTC().Add(webhookRetryBackoff), LastError: err.Error()}
+				if putErr := putWebhookDelivery(delivery); putErr != nil {
+					warnf("dropping %s event for %s: %v\n", event, w.URL, putErr)
+				} else {
+					warnf("%v, experiment watch retries the %s event\n", err, event)
+				}
+				break
+			}
+			clock.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func putWebhookDelivery(delivery webhookDelivery) error {
+	dir, err := webhookOutbox()
+	if err != nil {
+		return err
+	}
+	if err := files.MkdirAll(dir, 0o755); err != nil {
+		return errors.WithMessage(err, "failed to create webhook outbox")
+	}
+	data, err := json.MarshalIndent(delivery, "", "  ")
+	if err != nil {
+		return errors.WithMessage(err, "failed to encode webhook delivery")
+	}
+
+	tmp := filepath.Join(dir, delivery.ID+".json.tmp")
+	if err := files.WriteFile(tmp, data, 0o600); err != nil {
+		return errors.WithMessage(err, "failed to write webhook delivery")
+	}
+
+	return errors.WithMessage(files.Rename(tmp, filepath.Join(dir, delivery.ID+".json")), "failed to write webhook delivery")
+}
+
+// retryWebhooks posts the deliveries that are due again, with backoff
+// doubling per attempt, run by `experiment watch`.
+func retryWebhooks() error {
+	dir, err := webhookOutbox()
+	if err != nil {
+		return err
+	}
+	entries, err := files.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithMessage(err, "failed to list webhook outbox")
+	}
+	config, err := LoadPluginConfig()
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now()
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		file := filepath.Join(dir, e.Name())
+		data, err := files.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var delivery webhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			warnf("dropping unreadable webhook delivery %s: %v\n", e.Name(), err)
+			files.Remove(file)
+			continue
+		}
+		if now.Before(delivery.NextAttempt) {
+			continue
+		}
+
+		// the secret may have been rotated since
+		i := slices.IndexFunc(config.Webhooks, func(w WebhookConfig) bool { return w.URL == delivery.URL })
+		if i < 0 {
+			warnf("dropping event %s for %s, the webhook is gone from plugins.json\n", delivery.ID, delivery.URL)
+			files.Remove(file)
+			continue
+		}
+		var event webhookEvent
+		json.Unmarshal(delivery.Body, &event)
+
+		retry, err := postWebhook(delivery.URL, config.Webhooks[i].secret(), delivery.ID, event.Event, delivery.Body)
+		switch {
+		case err == nil:
+			files.Remove(file)
+			continue
+		case !retry || now.Sub(delivery.CreatedAt) > webhookExpiry:
+			warnf("dropping %s event %s for %s after %d attempts: %v\n", event.Event, delivery.ID, delivery.URL, delivery.Attempts+1, err)
+			files.Remove(file)
+			continue
+		}
+
+		// the first retry by watch waited webhookRetryBackoff
+		retries := max(delivery.Attempts-webhookAttempts+1, 0)
+		backoff := webhookRetryBackoff << min(retries, 10)
+		delivery.Attempts++
+		delivery.NextAttempt = now.UTC().Add(min(backoff, webhookRetryMax))
+		delivery.LastError = err.Error()
+		if err := putWebhookDelivery(delivery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
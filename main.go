@@ -3,64 +3,1322 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/docker/docker/pkg/namesgenerator"
 	"github.com/ml-doom/invoker/internal"
 	"github.com/spf13/cobra"
 )
 
-var rootCmd = &cobra.Command{Use: "higgsfield"}
+var rootCmd = &cobra.Command{
+	Use: "higgsfield",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if internal.ParseOrExit[bool](cmd, "no-color") {
+			internal.DisableColor()
+		}
+		internal.SetNamespaceOrExit(internal.ParseOrExit[string](cmd, "namespace"))
+		internal.SetCacheDirsOrExit(internal.ParseOrExit[string](cmd, "cache-dir"), internal.ParseOrExit[string](cmd, "checkpoint-dir"))
+		if !skipReconcile[cmd.Name()] {
+			internal.ReconcileState()
+		}
+	},
+}
+
+// skipReconcile are the commands that neither read nor change the state.
+var skipReconcile = map[string]bool{
+	"completion":     true,
+	"__complete":     true,
+	"help":           true,
+	"version":        true,
+	"self-update":    true,
+	"decode-secrets": true,
+	"random-name":    true,
+	"random-port":    true,
+}
+
+var experimentCmd = &cobra.Command{Use: "experiment", Aliases: []string{"experiments"}, Short: "Experiment commands"}
+
+func runCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run [experiment] [-- experiment args]",
+		Short: "Run an experiment",
+		Run: func(cmd *cobra.Command, args []string) {
+			experimentName := internal.ParseOrExit[string](cmd, "experiment_name")
+			if experimentName == "" && len(args) > 0 && cmd.ArgsLenAtDash() != 0 {
+				experimentName, args = args[0], args[1:]
+			}
+			internal.Run(internal.RunArgs{
+				ExperimentName:    experimentName,
+				ProjectName:       internal.ParseOrExit[string](cmd, "project_name"),
+				Port:              internal.ParseOrExit[int](cmd, "port"),
+				RunName:           internal.ParseOrExit[string](cmd, "run_name"),
+				NProcPerNode:      internal.ParseOrExit[int](cmd, "nproc_per_node"),
+				Hosts:             internal.ParseOrExit[[]string](cmd, "hosts"),
+				MaxRepeats:        -1,
+				ContainerName:     internal.ParseOrNil[string](cmd, "container_name"),
+				Rest:              args,
+				GPUs:              internal.ParseOrExit[[]int](cmd, "gpus"),
+				Memory:            internal.ParseOrExit[string](cmd, "memory"),
+				WaitForResources:  internal.ParseOrExit[bool](cmd, "wait_for_resources"),
+				Team:              internal.ParseOrExit[string](cmd, "team"),
+				GuestRootPath:     internal.ParseOrExit[string](cmd, "guest_root_path"),
+				GuestCachePath:    internal.ParseOrExit[string](cmd, "guest_cache_path"),
+				Workdir:           internal.ParseOrExit[string](cmd, "workdir"),
+				Entrypoint:        internal.ParseOrExit[string](cmd, "entrypoint"),
+				User:              internal.ParseOrExit[string](cmd, "user"),
+				ReadOnlyRootfs:    internal.ParseOrExit[bool](cmd, "read_only_rootfs"),
+				Scratch:           internal.ParseOrExit[[]string](cmd, "scratch"),
+				NetworkMode:       internal.ParseOrExit[string](cmd, "network_mode"),
+				AddHosts:          internal.ParseOrExit[[]string](cmd, "add_host"),
+				DockerContext:     internal.ParseOrExit[string](cmd, "docker_context"),
+				Smoke:             internal.ParseOrExit[bool](cmd, "smoke"),
+				SmokeSteps:        internal.ParseOrExit[int](cmd, "smoke_steps"),
+				SmokeTimeout:      internal.ParseOrExit[time.Duration](cmd, "smoke_timeout"),
+				SortHosts:         internal.ParseOrExit[bool](cmd, "sort_hosts"),
+				RendezvousTimeout: internal.ParseOrExit[time.Duration](cmd, "rendezvous_timeout"),
+				Warm:              internal.ParseOrExit[bool](cmd, "warm"),
+				NCCLDebug:         internal.ParseOrExit[bool](cmd, "nccl_debug"),
+				NoTorchrun:        internal.ParseOrExit[bool](cmd, "no_torchrun"),
+				EnvFile:           internal.ParseOrExit[string](cmd, "env_file"),
+				StartStagger:      internal.ParseOrExit[time.Duration](cmd, "start_stagger"),
+				RdzvTimeout:       internal.ParseOrExit[time.Duration](cmd, "rdzv_timeout"),
+				MaxRestarts:       internal.ParseOrExit[int](cmd, "max_restarts"),
+				IdempotencyKey:    internal.ParseOrExit[string](cmd, "idempotency_key"),
+				RestartPolicy:     internal.ParseOrExit[string](cmd, "restart_policy"),
+				Constraints:       internal.ParseOrExit[[]string](cmd, "constraints"),
+				Backend:           internal.ParseOrExit[string](cmd, "backend"),
+				Tags:              internal.ParseOrExit[[]string](cmd, "tag"),
+				Sweep:             internal.ParseOrExit[string](cmd, "sweep"),
+			})
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 || cmd.Flags().Changed("experiment_name") {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return internal.ExperimentNames(), cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment, can be given as the first argument instead")
+	cmd.PersistentFlags().String("project_name", "", "name of the project, from the project config if empty")
+	cmd.PersistentFlags().Int("port", 0, "port to run the experiment on, from the project config or 1234 if 0")
+	cmd.PersistentFlags().String("run_name", "", "name of the run, a random one if empty and the project has a config")
+	cmd.PersistentFlags().Int("nproc_per_node", 0, "number of processes per node, from the project config or 1 if 0")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on, from the project config or localhost if empty")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().IntSlice("gpus", []int{}, "indices of the gpus to claim, all gpus of the host if empty")
+	cmd.PersistentFlags().String("memory", "", "host memory to claim and limit the container to, e.g. 64g, optional")
+	cmd.PersistentFlags().Bool("wait_for_resources", false, "wait until the claimed gpus, port and memory are free instead of failing")
+	cmd.PersistentFlags().String("team", "", "team the gpus are accounted to, defaults to the project name")
+	cmd.PersistentFlags().String("guest_root_path", "", "where the project is mounted and run from inside the container, overrides invoker.yaml")
+	cmd.PersistentFlags().String("guest_cache_path", "", "where the cache is mounted inside the container, overrides invoker.yaml")
+	cmd.PersistentFlags().String("workdir", "", "working directory inside the container, the guest root path by default")
+	cmd.PersistentFlags().String("entrypoint", "", "launch wrapper, e.g. \"bash scripts/launch.sh\", it gets the torchrun command as arguments")
+	cmd.PersistentFlags().String("user", "", "user[:group] to run the container as")
+	cmd.PersistentFlags().Bool("read_only_rootfs", false, "make the container filesystem read-only, except for mounts, /tmp and scratch directories")
+	cmd.PersistentFlags().StringSlice("scratch", []string{}, "directories inside the container to mount as tmpfs")
+	cmd.PersistentFlags().String("network_mode", "", "host, bridge, macvlan or ipvlan, overrides invoker.yaml")
+	cmd.PersistentFlags().StringSlice("add_host", []string{}, "name:ip pairs to add to the container's /etc/hosts")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("smoke", false, "run a single process for a few steps on this host first, and only start the run if it succeeds")
+	cmd.PersistentFlags().Int("smoke_steps", 10, "steps of the smoke test, passed to the experiment as --max_steps")
+	cmd.PersistentFlags().Duration("smoke_timeout", 10*time.Minute, "time the smoke test may take")
+	cmd.PersistentFlags().Bool("sort_hosts", false, "rank the hosts in sorted order instead of as given, unless they are annotated as host@rank")
+	cmd.PersistentFlags().Duration("rendezvous_timeout", 10*time.Minute, "how long the nodes wait for each other to cross check their ranks, 0 to skip the check")
+	cmd.PersistentFlags().Bool("nccl_debug", false, "log nccl at INFO level into files in the run directory, collected by debug-bundle")
+	cmd.PersistentFlags().Bool("warm", false, "run on the image of the project's warm container instead of building one")
+	cmd.PersistentFlags().Bool("no_torchrun", false, "run the experiment as a single process without torchrun, needs --nproc_per_node=1 and --hosts=localhost")
+	cmd.PersistentFlags().String("env_file", "", "file of KEY=value lines to set in the container")
+	cmd.PersistentFlags().Duration("rdzv_timeout", 0, "how long torchrun waits for all nodes to join, torchrun's default if 0")
+	cmd.PersistentFlags().Int("max_restarts", 0, "how often torchrun restarts the workers of a node before the container fails")
+	cmd.PersistentFlags().String("idempotency_key", "", "key of this submission, retries with the same key don't start the run again, generated from the arguments if empty, none to always start")
+	cmd.PersistentFlags().StringSlice("constraints", []string{}, "gpu=<model>, zone=<zone> or label=<label> pairs every host has to meet, e.g. gpu=H100,label=ib")
+	cmd.PersistentFlags().String("restart_policy", "", "always, never, on-infra-failure-only, metric-aware, exec or webhook, when experiment watch restarts the failed run, overrides invoker.yaml")
+	cmd.PersistentFlags().String("backend", "", "aws-batch, sagemaker, vertex or azureml to submit the run there instead of starting it on the hosts, which only give the number of nodes, see cloud.json")
+	cmd.PersistentFlags().StringSlice("tag", []string{}, "key=value tag to organize runs by, recorded with the run and filterable in ps and cost, can be repeated")
+	cmd.PersistentFlags().String("sweep", "", "id grouping related runs like the ones of a hyperparameter search, to list and stop them as one")
+	cmd.PersistentFlags().Duration("start_stagger", 0, "spread the start of the non-master nodes over this window, e.g. 2m, so they don't all pull at once")
+
+	cmd.RegisterFlagCompletionFunc("experiment_name", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return internal.ExperimentNames(), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	return cmd
+}
+
+func experimentsListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the experiments of the project in the working directory and their parameters",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ExperimentsList(internal.ExperimentsListArgs{
+				JSON: internal.ParseOrExit[bool](cmd, "json"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Bool("json", false, "print the experiments as json")
+
+	return cmd
+}
+
+func killCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kill",
+		Short: "Kill an experiment",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Kill(internal.KillArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				DockerContext:  internal.ParseOrExit[string](cmd, "docker_context"),
+				Yes:            internal.ParseOrExit[bool](cmd, "yes"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to kill on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+
+	return cmd
+}
+
+func restartCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restart",
+		Short: "Restart an experiment on this host from its recorded image",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Restart(internal.RestartArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				Rebuild:        internal.ParseOrExit[bool](cmd, "rebuild"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				Recreate:       internal.ParseOrExit[bool](cmd, "recreate"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().Bool("rebuild", false, "rebuild the image from the current project instead of reusing the recorded one")
+	cmd.PersistentFlags().String("image", "", "restart onto this image id or tag instead of the recorded one")
+	cmd.PersistentFlags().Bool("recreate", false, "create a new container instead of starting the exited one again")
+
+	return cmd
+}
+
+func resumeCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resume <experiment>",
+		Short: "Launch a failed or stopped run again from a checkpoint as its next attempt",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Resume(internal.ResumeArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				FromCheckpoint: internal.ParseOrExit[string](cmd, "from_checkpoint"),
+				Rebuild:        internal.ParseOrExit[bool](cmd, "rebuild"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				Local:          internal.ParseOrExit[bool](cmd, "local"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("from_checkpoint", "", "latest, or a checkpoint in the run directory or an absolute path, left to the training code if empty")
+	cmd.PersistentFlags().Bool("rebuild", false, "rebuild the image from the current project instead of reusing the recorded one")
+	cmd.PersistentFlags().String("image", "", "resume onto this image id or tag instead of the recorded one")
+	cmd.PersistentFlags().Bool("local", false, "only resume the run on this host")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+func attachCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "attach",
+		Short: "Follow the output of an experiment on this host until it exits",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Attach(internal.AttachArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				JSON:           internal.ParseOrExit[bool](cmd, "json"),
+				Output:         internal.ParseOrExit[string](cmd, "output"),
+				Timestamps:     internal.ParseOrExit[bool](cmd, "timestamps"),
+				Prefix:         internal.ParseOrExit[bool](cmd, "prefix"),
+				AllHosts:       internal.ParseOrExit[bool](cmd, "all_hosts"),
+				Interleave:     internal.ParseOrExit[time.Duration](cmd, "interleave"),
+				Stream:         internal.ParseOrExit[bool](cmd, "stream"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().Bool("json", false, "print the result as json")
+	cmd.PersistentFlags().String("output", "text", "text or json, json prints the run result also written to result.json")
+	cmd.PersistentFlags().Bool("timestamps", false, "start every line with its time in UTC")
+	cmd.PersistentFlags().Bool("prefix", false, "start every line with the [host/rank] of the node")
+	cmd.PersistentFlags().Bool("all_hosts", false, "also follow the output of the run on its other hosts over ssh, prefixed with their node")
+	cmd.PersistentFlags().Duration("interleave", 0, "hold lines back this long to print the output of all nodes ordered by time, e.g. 2s")
+	cmd.PersistentFlags().Bool("stream", false, "only print the output as timestamped lines")
+	cmd.PersistentFlags().MarkHidden("stream")
+
+	return cmd
+}
+
+func stopCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop",
+		Short: "Stop an experiment on this host without the watcher restarting it",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Stop(stopArgs(cmd))
+		},
+	}
+
+	addStopFlags(cmd)
+
+	return cmd
+}
+
+func stopSweepCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop-sweep <sweep>",
+		Short: "Stop every run of a sweep on this host and the other hosts of its runs",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StopSweep(internal.StopSweepArgs{
+				Sweep:   args[0],
+				Timeout: internal.ParseOrExit[time.Duration](cmd, "timeout"),
+				Hosts:   internal.ParseOrExit[[]string](cmd, "hosts"),
+				Yes:     internal.ParseOrExit[bool](cmd, "yes"),
+				Local:   internal.ParseOrExit[bool](cmd, "local"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Duration("timeout", 30*time.Second, "how long the runs get to exit before they are killed")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "other hosts to stop the sweep on, the recorded ones of this host if empty")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+	cmd.PersistentFlags().Bool("local", false, "only stop the runs of this host")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+func sweepStandingsCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sweep-standings <sweep>",
+		Short: "Rank the runs of a sweep at the rungs of its sweep policy",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.SweepStandings(internal.SweepStandingsArgs{
+				Sweep:  args[0],
+				Metric: internal.ParseOrExit[string](cmd, "metric"),
+				Rungs:  internal.ParseOrExit[[]int](cmd, "rungs"),
+				Hosts:  internal.ParseOrExit[[]string](cmd, "hosts"),
+				Local:  internal.ParseOrExit[bool](cmd, "local"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("metric", "", "loss or tokens_per_sec, the one of the recorded sweep policy if empty")
+	cmd.PersistentFlags().IntSlice("rungs", []int{}, "steps to compare the runs at, the ones of the recorded sweep policy if empty")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "other hosts of the sweep, the ones of the policy and of the runs of this host if empty")
+	cmd.PersistentFlags().Bool("local", false, "print the standings of this host as json")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+func stopAllCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stop-all",
+		Short: "Stop an experiment on all of its hosts over ssh",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StopAll(internal.StopAllArgs{
+				StopArgs: stopArgs(cmd),
+				Hosts:    internal.ParseOrExit[[]string](cmd, "hosts"),
+			})
+		},
+	}
+
+	addStopFlags(cmd)
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to stop the experiment on, the recorded ones of this host if empty")
+
+	return cmd
+}
+
+func stopArgs(cmd *cobra.Command) internal.StopArgs {
+	return internal.StopArgs{
+		ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+		ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+		ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+		Timeout:        internal.ParseOrExit[time.Duration](cmd, "timeout"),
+		Yes:            internal.ParseOrExit[bool](cmd, "yes"),
+	}
+}
+
+func addStopFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().Duration("timeout", 30*time.Second, "time the experiment gets to shut down before it's killed")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+}
+
+func protectCmdFunc(protected bool) *cobra.Command {
+	use, short := "protect", "Protect an experiment on this host from being stopped, killed or preempted"
+	if !protected {
+		use, short = "unprotect", "Allow a protected experiment on this host to be stopped again"
+	}
+
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Protect(internal.ProtectArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				Protected:      protected,
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+
+	return cmd
+}
+
+func warmCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "warm",
+		Short: "Keep a built image and an idle container of the project on this host for fast starts",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Warm(internal.WarmArgs{
+				ProjectName:   internal.ParseOrExit[string](cmd, "project_name"),
+				DockerContext: internal.ParseOrExit[string](cmd, "docker_context"),
+				Stop:          internal.ParseOrExit[bool](cmd, "stop"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to warm up, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("stop", false, "remove the warm container")
+
+	return cmd
+}
+
+func canaryCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "canary",
+		Short: "Smoke test the experiment of this host on a new image",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Canary(internal.CanaryArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				Rebuild:        internal.ParseOrExit[bool](cmd, "rebuild"),
+				Steps:          internal.ParseOrExit[int](cmd, "steps"),
+				Timeout:        internal.ParseOrExit[time.Duration](cmd, "timeout"),
+				MaxLoss:        internal.ParseOrExit[float64](cmd, "max_loss"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("image", "", "image id or tag to test")
+	cmd.PersistentFlags().Bool("rebuild", false, "test an image built from the current project")
+	cmd.PersistentFlags().Int("steps", 10, "steps to run, passed to the experiment as --max_steps")
+	cmd.PersistentFlags().Duration("timeout", 10*time.Minute, "time the canary may take")
+	cmd.PersistentFlags().Float64("max_loss", 0, "fail if the last loss is above this, unchecked if 0")
+
+	return cmd
+}
+
+func rolloutCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollout",
+		Short: "Move an experiment onto a new image on all hosts once a canary passes",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Rollout(internal.RolloutArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				Rebuild:        internal.ParseOrExit[bool](cmd, "rebuild"),
+				CanaryHost:     internal.ParseOrExit[string](cmd, "canary_host"),
+				CanarySteps:    internal.ParseOrExit[int](cmd, "canary_steps"),
+				CanaryTimeout:  internal.ParseOrExit[time.Duration](cmd, "canary_timeout"),
+				CanaryMaxLoss:  internal.ParseOrExit[float64](cmd, "canary_max_loss"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts the experiment runs on")
+	cmd.PersistentFlags().String("image", "", "image id or tag to move to, it has to exist on every host")
+	cmd.PersistentFlags().Bool("rebuild", false, "rebuild the image from the project on every host instead")
+	cmd.PersistentFlags().String("canary_host", "", "host to run the canary on, the first host if empty")
+	cmd.PersistentFlags().Int("canary_steps", 10, "steps the canary runs")
+	cmd.PersistentFlags().Duration("canary_timeout", 10*time.Minute, "time the canary may take")
+	cmd.PersistentFlags().Float64("canary_max_loss", 0, "fail the canary if its last loss is above this, unchecked if 0")
+
+	return cmd
+}
+
+func diffCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <run> <run>",
+		Short: "Compare the image, command and dataset versions of two runs",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Diff(internal.DiffArgs{RunA: args[0], RunB: args[1]})
+		},
+	}
+
+	return cmd
+}
+
+func watchCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Restart failed or unhealthy experiments on this host and enforce their early_stop and sweep_policy",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Watch(internal.WatchArgs{
+				Interval:    internal.ParseOrExit[time.Duration](cmd, "interval"),
+				MaxRestarts: internal.ParseOrExit[int](cmd, "max_restarts"),
+				Rebuild:     internal.ParseOrExit[bool](cmd, "rebuild"),
+				Recreate:    internal.ParseOrExit[bool](cmd, "recreate"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Duration("interval", time.Minute, "how often to check the experiments")
+	cmd.PersistentFlags().Int("max_restarts", 3, "give up on an experiment after this many restarts")
+	cmd.PersistentFlags().Bool("rebuild", false, "rebuild the image on restart instead of reusing the recorded one")
+	cmd.PersistentFlags().Bool("recreate", false, "create new containers instead of starting exited ones again")
+
+	return cmd
+}
+
+func psCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ps",
+		Short: "List experiment containers on this host",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Ps(internal.PsArgs{
+				ProjectName: internal.ParseOrExit[string](cmd, "project_name"),
+				User:        internal.ParseOrExit[string](cmd, "user"),
+				Stats:       internal.ParseOrExit[bool](cmd, "stats"),
+				Tags:        internal.ParseOrExit[[]string](cmd, "tag"),
+				Sweep:       internal.ParseOrExit[string](cmd, "sweep"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project, optional")
+	cmd.PersistentFlags().String("user", "", "only list runs launched by this os user or identity")
+	cmd.PersistentFlags().Bool("stats", false, "add the cpu, memory and network usage of running containers")
+	cmd.PersistentFlags().StringSlice("tag", []string{}, "only list runs with this key=value tag, can be repeated")
+	cmd.PersistentFlags().String("sweep", "", "only list runs of this sweep")
+
+	return cmd
+}
+
+func topCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "top",
+		Short: "Live view of the experiments, containers and gpus of hosts running state serve",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Top(internal.TopArgs{
+				Hosts:    internal.ParseOrExit[[]string](cmd, "hosts"),
+				Interval: internal.ParseOrExit[time.Duration](cmd, "interval"),
+				LogLines: internal.ParseOrExit[int](cmd, "log_lines"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("hosts", []string{"localhost"}, "hosts running state serve, as host or host:port")
+	cmd.PersistentFlags().Duration("interval", 2*time.Second, "how often containers, gpus and logs are fetched")
+	cmd.PersistentFlags().Int("log_lines", 10, "log lines of the selected run to show")
+
+	return cmd
+}
+
+func envReportCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env-report",
+		Short: "Compare driver, cuda, docker, kernel and sysctl versions across hosts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.EnvReport(internal.EnvReportArgs{
+				Hosts: internal.ParseOrExit[[]string](cmd, "hosts"),
+				Local: internal.ParseOrExit[bool](cmd, "local"),
+				JSON:  internal.ParseOrExit[bool](cmd, "json"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("hosts", nil, "hosts to compare over ssh, this host if empty")
+	cmd.PersistentFlags().Bool("local", false, "print the facts of this host as json")
+	cmd.PersistentFlags().Bool("json", false, "print the facts of every host as json instead of a matrix")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+var hostsCmd = &cobra.Command{Use: "hosts", Short: "Host inventory commands"}
+
+func hostsListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the cloud, instance type, zone, preemptibility, gpus and labels of hosts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.HostsList(internal.HostsListArgs{
+				Hosts:   internal.ParseOrExit[[]string](cmd, "hosts"),
+				Refresh: internal.ParseOrExit[bool](cmd, "refresh"),
+				Local:   internal.ParseOrExit[bool](cmd, "local"),
+				JSON:    internal.ParseOrExit[bool](cmd, "json"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("hosts", nil, "hosts to list over ssh, this host if empty")
+	cmd.PersistentFlags().Bool("refresh", false, "ask the cloud metadata services again instead of using what was collected within the last hour")
+	cmd.PersistentFlags().Bool("local", false, "print the inventory of this host as json")
+	cmd.PersistentFlags().Bool("json", false, "print the inventory of every host as json instead of a table")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+func costCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cost",
+		Short: "Report gpu hours and cost of experiments on this host",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Cost(internal.CostArgs{
+				By:     internal.ParseOrExit[string](cmd, "by"),
+				Since:  internal.ParseOrExit[string](cmd, "since"),
+				Format: internal.ParseOrExit[string](cmd, "format"),
+				Tags:   internal.ParseOrExit[[]string](cmd, "tag"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("by", "project", "group by project, experiment, user or team")
+	cmd.PersistentFlags().String("since", "", "only account usage after this long ago, e.g. 30d, 2w or 12h")
+	cmd.PersistentFlags().String("format", "table", "output format, table or csv")
+	cmd.PersistentFlags().StringSlice("tag", []string{}, "only account runs with this key=value tag, can be repeated")
+
+	return cmd
+}
+
+func exportHistoryCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export-history",
+		Short: "Write the runs of this host and their scraped metrics to csv or parquet files",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ExportHistory(internal.ExportHistoryArgs{
+				Format:      internal.ParseOrExit[string](cmd, "format"),
+				Output:      internal.ParseOrExit[string](cmd, "output"),
+				Since:       internal.ParseOrExit[string](cmd, "since"),
+				ProjectName: internal.ParseOrExit[string](cmd, "project_name"),
+				Tags:        internal.ParseOrExit[[]string](cmd, "tag"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("format", "csv", "csv or parquet")
+	cmd.PersistentFlags().String("output", ".", "directory to write runs and metrics files to")
+	cmd.PersistentFlags().String("since", "", "only export runs that were running within this long, e.g. 30d")
+	cmd.PersistentFlags().String("project_name", "", "name of the project, optional")
+	cmd.PersistentFlags().StringSlice("tag", []string{}, "only export runs with this key=value tag, can be repeated")
+
+	return cmd
+}
+
+var imageCmd = &cobra.Command{Use: "image", Short: "Image commands"}
+
+func imageInspectCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect [image]",
+		Short: "Report size, layers, cuda versions and vulnerabilities of an image",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			image := internal.ImageTag()
+			if len(args) == 1 {
+				image = args[0]
+			}
+
+			internal.ImageInspect(internal.ImageInspectArgs{
+				Image:   image,
+				MaxSize: internal.ParseOrExit[string](cmd, "max_size"),
+				Scan:    internal.ParseOrExit[bool](cmd, "scan"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("max_size", "", "fail if the image is larger, e.g. 25g")
+	cmd.PersistentFlags().Bool("scan", false, "scan with trivy and fail on critical vulnerabilities")
+
+	return cmd
+}
+
+func imagePruneCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the older images built for projects on this host, keeping the ones runs use",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ImagePrune(internal.ImagePruneArgs{
+				ProjectName:   internal.ParseOrExit[string](cmd, "project_name"),
+				Keep:          internal.ParseOrExit[int](cmd, "keep"),
+				DockerContext: internal.ParseOrExit[string](cmd, "docker_context"),
+				DryRun:        internal.ParseOrExit[bool](cmd, "dry_run"),
+				Yes:           internal.ParseOrExit[bool](cmd, "yes"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "only prune the images of this project")
+	cmd.PersistentFlags().Int("keep", 0, "newest images of each project to keep, from ~/.config/higgsfield/docker.json or 3 if 0")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("dry_run", false, "only list the images that would be removed")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+
+	return cmd
+}
+
+var cloudCmd = &cobra.Command{Use: "cloud", Short: "Commands for runs submitted with --backend"}
+
+func cloudStatusCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Check the jobs of the cloud runs of this host, retiring the finished ones",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.CloudStatus(internal.CloudStatusArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "only check the runs of this project")
+	cmd.PersistentFlags().String("experiment_name", "", "only check the runs of this experiment")
+
+	return cmd
+}
+
+func cloudLogsCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Stream the output of the job of a cloud run and save it in the cache directory",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.CloudLogs(internal.CloudLogsArgs{
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+
+	return cmd
+}
+
+var runsCmd = &cobra.Command{Use: "runs", Short: "Search the runs of this host"}
+
+func runsListCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the live and finished runs of this host, newest first",
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.RunsList(internal.RunsListArgs{
+				Since:          internal.ParseOrExit[string](cmd, "since"),
+				Status:         internal.ParseOrExit[string](cmd, "status"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment"),
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				Tags:           internal.ParseOrExit[[]string](cmd, "tag"),
+				Sweep:          internal.ParseOrExit[string](cmd, "sweep"),
+				Limit:          internal.ParseOrExit[int](cmd, "limit"),
+				JSON:           internal.ParseOrExit[bool](cmd, "json"),
+			})
+		},
+	}
 
-var experimentCmd = &cobra.Command{Use: "experiment", Short: "Experiment commands"}
+	cmd.PersistentFlags().String("since", "", "only list runs that were running within this long, e.g. 7d, 2w or 12h")
+	cmd.PersistentFlags().String("status", "", "running, finished, failed, stopped, converged, preempted, vanished or stranded")
+	cmd.PersistentFlags().String("experiment", "", "name of the experiment, optional")
+	cmd.PersistentFlags().String("project_name", "", "name of the project, optional")
+	cmd.PersistentFlags().StringSlice("tag", []string{}, "only list runs with this key=value tag, can be repeated")
+	cmd.PersistentFlags().String("sweep", "", "only list runs of this sweep")
+	cmd.PersistentFlags().Int("limit", 50, "list at most this many runs, all if 0")
+	cmd.PersistentFlags().Bool("json", false, "print the full records of the runs as json")
 
-func runCmdFunc() *cobra.Command {
+	return cmd
+}
+
+var autoscaleCmd = &cobra.Command{Use: "autoscale", Short: "Commands for the nodes experiment watch requests from a provisioner"}
+
+func autoscaleStatusCmdFunc() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "run",
-		Short: "Run an experiment",
+		Use:   "status",
+		Short: "List the runs waiting for resources on this host and the nodes requested for them",
 		Run: func(cmd *cobra.Command, args []string) {
-			internal.Run(internal.RunArgs{
-				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+			internal.AutoscaleStatus()
+		},
+	}
+
+	return cmd
+}
+
+func metricsCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "metrics <experiment>",
+		Short: "Show the training metrics parsed from the output of an experiment",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Metrics(internal.MetricsArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				Tail:           internal.ParseOrExit[int](cmd, "tail"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project, optional")
+	cmd.PersistentFlags().Int("tail", 20, "number of points to show per run, 0 for all")
+
+	return cmd
+}
+
+func metricsServeCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the metrics of the experiments of this host to prometheus",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.MetricsServe(internal.MetricsServeArgs{
+				Addr: internal.ParseOrExit[string](cmd, "addr"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("addr", "0.0.0.0:9464", "address to listen on")
+
+	return cmd
+}
+
+var triggerCmd = &cobra.Command{Use: "trigger", Short: "Start runs from signed requests, like CI jobs on merge"}
+
+func triggerServeCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Accept signed triggers and check out, build and run the experiments they name",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.TriggerServe(internal.TriggerServeArgs{
+				Addr:      internal.ParseOrExit[string](cmd, "addr"),
+				SecretEnv: internal.ParseOrExit[string](cmd, "secret_env"),
+				Repos:     internal.ParseOrExit[[]string](cmd, "repo"),
+				Workspace: internal.ParseOrExit[string](cmd, "workspace"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("addr", "0.0.0.0:9466", "address to listen on")
+	cmd.PersistentFlags().String("secret_env", "INVOKER_TRIGGER_SECRET", "environment variable holding the secret triggers are signed with")
+	cmd.PersistentFlags().StringSlice("repo", []string{}, "repository triggers may run, as it's cloned, can be given multiple times")
+	cmd.PersistentFlags().String("workspace", "", "where repositories are checked out, ~/.cache/higgsfield/triggers if empty")
+
+	return cmd
+}
+
+var stateCmd = &cobra.Command{Use: "state", Short: "Inspect the experiment state of this host"}
+
+func stateShowCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "show <experiment>",
+		Short: "Show the recorded state of an experiment",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StateShow(internal.StateShowArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project, optional")
+
+	return cmd
+}
+
+func stateServeCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the state of this host and stream its changes",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StateServe(internal.StateServeArgs{
+				Addr:     internal.ParseOrExit[string](cmd, "addr"),
+				TokenEnv: internal.ParseOrExit[string](cmd, "token_env"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("addr", "127.0.0.1:9465", "address to listen on, 0.0.0.0:9465 for top on other hosts")
+	cmd.PersistentFlags().String("token_env", "INVOKER_STATE_TOKEN", "environment variable with the token clients have to send, required to serve logs beyond this host")
+
+	return cmd
+}
+
+func stateSimulateCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Show what experiment watch would decide for the runs of this host with injected failures, without acting",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StateSimulate(internal.StateSimulateArgs{
+				Inject:      internal.ParseOrExit[[]string](cmd, "inject"),
+				ProjectName: internal.ParseOrExit[string](cmd, "project_name"),
+				MaxRestarts: internal.ParseOrExit[int](cmd, "max_restarts"),
+				Hosts:       internal.ParseOrExit[[]string](cmd, "hosts"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("inject", []string{}, "target=event pairs, the target a container, experiment or host, the event exit<code>, oom, cuda_oom, nccl, rendezvous, dead, unhealthy or running")
+	cmd.PersistentFlags().String("project_name", "", "only simulate the runs of this project")
+	cmd.PersistentFlags().Int("max_restarts", 3, "max restarts of the watch to simulate")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "simulate on these hosts over ssh instead of this one")
+
+	return cmd
+}
+
+func stateExportCmdFunc() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export",
+		Short: "Write the state, history and gpu health of this host to stdout",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StateExport()
+		},
+	}
+}
+
+func stateImportCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Merge a snapshot from state export into the state of this host, - reads stdin",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.StateImport(internal.StateImportArgs{
+				File:      args[0],
+				Overwrite: internal.ParseOrExit[bool](cmd, "overwrite"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().Bool("overwrite", false, "replace the states this host already has for the same containers")
+
+	return cmd
+}
+
+func notebookCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "notebook",
+		Short: "Start jupyter lab in the training environment of a project",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Notebook(internal.NotebookArgs{
+				ProjectName:   internal.ParseOrExit[string](cmd, "project_name"),
+				Port:          internal.ParseOrExit[int](cmd, "port"),
+				GPUs:          internal.ParseOrExit[[]int](cmd, "gpus"),
+				Memory:        internal.ParseOrExit[string](cmd, "memory"),
+				Image:         internal.ParseOrExit[string](cmd, "image"),
+				ProjectPath:   internal.ParseOrExit[string](cmd, "project_path"),
+				DockerContext: internal.ParseOrExit[string](cmd, "docker_context"),
+				Host:          internal.ParseOrExit[string](cmd, "host"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().Int("port", 8888, "port of jupyter lab")
+	cmd.PersistentFlags().IntSlice("gpus", []int{}, "indices of the gpus to claim, all gpus of the host if empty")
+	cmd.PersistentFlags().String("memory", "", "host memory to claim and limit the container to, e.g. 64g, optional")
+	cmd.PersistentFlags().String("image", "", "existing image to run instead of building the project")
+	cmd.PersistentFlags().String("project_path", "", "directory of the project, the working directory if empty")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().String("host", "", "host to start the notebook on over ssh, its port is forwarded to this one")
+
+	return cmd
+}
+
+func serveModelCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve-model [-- server args]",
+		Short: "Start an inference server on a checkpoint",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ServeModel(internal.ServeModelArgs{
 				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
+				Checkpoint:     internal.ParseOrExit[string](cmd, "checkpoint"),
 				Port:           internal.ParseOrExit[int](cmd, "port"),
-				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
-				NProcPerNode:   internal.ParseOrExit[int](cmd, "nproc_per_node"),
-				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
-				MaxRepeats:     -1,
-				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				GPUs:           internal.ParseOrExit[[]int](cmd, "gpus"),
+				Memory:         internal.ParseOrExit[string](cmd, "memory"),
+				Engine:         internal.ParseOrExit[string](cmd, "engine"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				DockerContext:  internal.ParseOrExit[string](cmd, "docker_context"),
 				Rest:           args,
 			})
 		},
 	}
 
-	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
 	cmd.PersistentFlags().String("project_name", "", "name of the project")
-	cmd.PersistentFlags().Int("port", 1234, "port to run the experiment on")
-	cmd.PersistentFlags().String("run_name", "", "name of the run")
+	cmd.PersistentFlags().String("experiment_name", "serve", "name the server is recorded and stopped under, and the served model name")
+	cmd.PersistentFlags().String("checkpoint", "", "path of the checkpoint to serve")
+	cmd.PersistentFlags().Int("port", 8000, "port of the server")
+	cmd.PersistentFlags().IntSlice("gpus", []int{}, "indices of the gpus to serve on, all gpus of the host if empty")
+	cmd.PersistentFlags().String("memory", "", "host memory to claim and limit the container to, e.g. 64g, optional")
+	cmd.PersistentFlags().String("engine", "", "vllm, tgi or torchserve, overrides invoker.yaml")
+	cmd.PersistentFlags().String("image", "", "image of the server, overrides invoker.yaml and the engine's official image")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+
+	return cmd
+}
+
+func exportCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export <experiment> [-- converter args]",
+		Short: "Convert a checkpoint of an experiment to onnx or safetensors",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Export(internal.ExportArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
+				Format:         internal.ParseOrExit[string](cmd, "format"),
+				Checkpoint:     internal.ParseOrExit[string](cmd, "checkpoint"),
+				Output:         internal.ParseOrExit[string](cmd, "output"),
+				GPUs:           internal.ParseOrExit[[]int](cmd, "gpus"),
+				Image:          internal.ParseOrExit[string](cmd, "image"),
+				DockerContext:  internal.ParseOrExit[string](cmd, "docker_context"),
+				Timeout:        internal.ParseOrExit[time.Duration](cmd, "timeout"),
+				Rest:           args[1:],
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().String("run_name", "", "run to export from, the latest one if empty")
+	cmd.PersistentFlags().String("format", "safetensors", "onnx or safetensors")
+	cmd.PersistentFlags().String("checkpoint", "", "checkpoint to export, relative to the run directory, the latest one if empty")
+	cmd.PersistentFlags().String("output", "", "directory or s3:// or gs:// url to write to, a directory under export in the run directory if empty")
+	cmd.PersistentFlags().IntSlice("gpus", []int{}, "indices of the gpus to convert on, none if empty")
+	cmd.PersistentFlags().String("image", "", "existing image to run instead of building the project")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Duration("timeout", time.Hour, "time the conversion may take")
+
+	return cmd
+}
+
+func gcCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Delete the runs the retention policy of the project no longer keeps",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.GC(internal.GCArgs{
+				ProjectName: internal.ParseOrExit[string](cmd, "project_name"),
+				DryRun:      internal.ParseOrExit[bool](cmd, "dry_run"),
+				Yes:         internal.ParseOrExit[bool](cmd, "yes"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project")
+	cmd.PersistentFlags().Bool("dry_run", false, "only list the runs that would be deleted")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+
+	return cmd
+}
+
+func cleanupCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove what crashed launches left behind on this host",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.Cleanup(internal.CleanupArgs{
+				DockerContext: internal.ParseOrExit[string](cmd, "docker_context"),
+				Yes:           internal.ParseOrExit[bool](cmd, "yes"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("yes", false, "don't ask for confirmation")
+
+	return cmd
+}
+
+var benchCmd = &cobra.Command{Use: "bench", Short: "Benchmark the cluster"}
+
+func benchNCCLCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "nccl",
+		Short: "Measure the all_reduce bus bandwidth between the hosts",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.BenchNCCL(internal.BenchNCCLArgs{
+				ProjectName:   internal.ParseOrExit[string](cmd, "project_name"),
+				Hosts:         internal.ParseOrExit[[]string](cmd, "hosts"),
+				NProcPerNode:  internal.ParseOrExit[int](cmd, "nproc_per_node"),
+				Port:          internal.ParseOrExit[int](cmd, "port"),
+				GPUs:          internal.ParseOrExit[[]int](cmd, "gpus"),
+				MinBytes:      internal.ParseOrExit[string](cmd, "min_bytes"),
+				MaxBytes:      internal.ParseOrExit[string](cmd, "max_bytes"),
+				Iters:         internal.ParseOrExit[int](cmd, "iters"),
+				Timeout:       internal.ParseOrExit[time.Duration](cmd, "timeout"),
+				Image:         internal.ParseOrExit[string](cmd, "image"),
+				ProjectPath:   internal.ParseOrExit[string](cmd, "project_path"),
+				DockerContext: internal.ParseOrExit[string](cmd, "docker_context"),
+				Local:         internal.ParseOrExit[bool](cmd, "local"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project whose container setup is used")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to benchmark")
 	cmd.PersistentFlags().Int("nproc_per_node", 1, "number of processes per node")
-	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
-  cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().Int("port", 1234, "port of the rendezvous")
+	cmd.PersistentFlags().IntSlice("gpus", []int{}, "indices of the gpus to claim, all gpus of the host if empty")
+	cmd.PersistentFlags().String("min_bytes", "8", "smallest message size")
+	cmd.PersistentFlags().String("max_bytes", "1g", "largest message size, sizes double from min_bytes")
+	cmd.PersistentFlags().Int("iters", 20, "timed iterations per message size")
+	cmd.PersistentFlags().Duration("timeout", 10*time.Minute, "time the benchmark may take")
+	cmd.PersistentFlags().String("image", "", "existing image to run instead of building the project")
+	cmd.PersistentFlags().String("project_path", "", "directory of the project on the hosts, the working directory if empty")
+	cmd.PersistentFlags().String("docker_context", "", "docker context of the daemon to run on, DOCKER_HOST or the current context if empty")
+	cmd.PersistentFlags().Bool("local", false, "only run the node of this host, instead of starting every host over ssh")
 
 	return cmd
 }
 
-func killCmdFunc() *cobra.Command {
+var nodeCmd = &cobra.Command{Use: "node", Short: "Check the hardware health of this host"}
+
+func nodeHealthCmdFunc() *cobra.Command {
+	return &cobra.Command{
+		Use:   "health",
+		Short: "Check the gpus for Xid and ecc errors and print their faults",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.NodeHealthShow()
+		},
+	}
+}
+
+func nodeClearCmdFunc() *cobra.Command {
+	return &cobra.Command{
+		Use:   "clear",
+		Short: "Mark the gpus of this host healthy again",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.NodeClear()
+		},
+	}
+}
+
+func pushCmdFunc() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "kill",
-		Short: "Kill an experiment",
+		Use:   "push",
+		Short: "Upload the project in the working directory to its hosts, leaving out what .invokerignore lists",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
-			internal.Kill(internal.KillArgs{
+			internal.Push(internal.PushArgs{
+				Hosts:  internal.ParseOrExit[[]string](cmd, "hosts"),
+				Dest:   internal.ParseOrExit[string](cmd, "dest"),
+				Delete: internal.ParseOrExit[bool](cmd, "delete"),
+				DryRun: internal.ParseOrExit[bool](cmd, "dry_run"),
+				Chunks: internal.ParseOrExit[bool](cmd, "chunks"),
+				Peers:  internal.ParseOrExit[bool](cmd, "peers"),
+				// how the hosts are asked to take a push and pass it on
+				Receive: internal.ParseOrExit[string](cmd, "receive"),
+				Relay:   internal.ParseOrExit[bool](cmd, "relay"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to push to, from the project config if empty")
+	cmd.PersistentFlags().String("dest", "", "where the project goes on the hosts, the same path as here if empty")
+	cmd.PersistentFlags().Bool("delete", false, "remove files from the hosts that are gone here, ignored ones are kept")
+	cmd.PersistentFlags().Bool("dry_run", false, "only list what would be transferred")
+	cmd.PersistentFlags().Bool("chunks", false, "send content addressed chunks the hosts don't have yet instead of using rsync")
+	cmd.PersistentFlags().Bool("peers", false, "have the hosts pass the chunks on to each other, implies --chunks")
+	cmd.PersistentFlags().String("receive", "", "take a push on this host")
+	cmd.PersistentFlags().Bool("relay", false, "pass the last push to --dest on to the hosts")
+	cmd.PersistentFlags().MarkHidden("receive")
+	cmd.PersistentFlags().MarkHidden("relay")
+
+	return cmd
+}
+
+func pullResultsCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pull-results <experiment>",
+		Short: "Fetch the run directories of an experiment from its hosts",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.PullResults(internal.PullResultsArgs{
+				ExperimentName: args[0],
 				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				RunName:        internal.ParseOrExit[string](cmd, "run_name"),
 				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
-				ExperimentName: internal.ParseOrExit[string](cmd, "experiment_name"),
-				ContainerName:  internal.ParseOrNil[string](cmd, "container_name"),
+				Output:         internal.ParseOrExit[string](cmd, "output"),
+				Exclude:        internal.ParseOrExit[[]string](cmd, "exclude"),
+				Local:          internal.ParseOrExit[bool](cmd, "local"),
 			})
 		},
 	}
 
-	cmd.PersistentFlags().String("experiment_name", "", "name of the experiment")
-	cmd.PersistentFlags().StringSlice("hosts", []string{}, "list of hosts to run the experiment on")
-	cmd.PersistentFlags().String("project_name", "", "name of the project")
-  cmd.PersistentFlags().String("container_name", "", "name of the container, optional")
+	cmd.PersistentFlags().String("project_name", "", "name of the project, needed if the run is not recorded on this host")
+	cmd.PersistentFlags().String("run_name", "", "run to fetch, the recorded run or else every run of the experiment if empty")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to fetch from, the recorded hosts of the run or those of the project config if empty")
+	cmd.PersistentFlags().String("output", "results", "directory to write to, with a directory per host")
+	cmd.PersistentFlags().StringSlice("exclude", []string{}, "rsync patterns of files to leave on the hosts, like *.pt")
+	cmd.PersistentFlags().Bool("local", false, "only list the run directories of this host")
+	cmd.PersistentFlags().MarkHidden("local")
+
+	return cmd
+}
+
+func debugBundleCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "debug-bundle <experiment>",
+		Aliases: []string{"bundle-debug"},
+		Short:   "Collect the debug output of a run from all of its hosts into a tar.gz",
+		Args:    cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.DebugBundle(internal.DebugBundleArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
+				Output:         internal.ParseOrExit[string](cmd, "output"),
+				Local:          internal.ParseOrExit[bool](cmd, "local"),
+				LogLines:       internal.ParseOrExit[int](cmd, "log_lines"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project, needed if the run is not recorded on this host")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to collect from, the recorded hosts of the run if empty")
+	cmd.PersistentFlags().String("output", "", "file to write, - for stdout, <experiment>-debug-<time>.tar.gz if empty")
+	cmd.PersistentFlags().Bool("local", false, "only bundle this host")
+	cmd.PersistentFlags().Int("log_lines", 1000, "lines of container output to include")
+
+	return cmd
+}
+
+func failureReportCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "failure-report <experiment>",
+		Short: "Show which nodes of a run failed first, why, and their last lines of output",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.FailureReport(internal.FailureReportArgs{
+				ExperimentName: args[0],
+				ProjectName:    internal.ParseOrExit[string](cmd, "project_name"),
+				Hosts:          internal.ParseOrExit[[]string](cmd, "hosts"),
+				Local:          internal.ParseOrExit[bool](cmd, "local"),
+				LogLines:       internal.ParseOrExit[int](cmd, "log_lines"),
+				JSON:           internal.ParseOrExit[bool](cmd, "json"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("project_name", "", "name of the project, needed if the run is not recorded on this host")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to ask, the recorded hosts of the run if empty")
+	cmd.PersistentFlags().Bool("local", false, "only report this host, as json")
+	cmd.PersistentFlags().Int("log_lines", 20, "lines of output to show of every failed node")
+	cmd.PersistentFlags().Bool("json", false, "print the report as json")
+
+	return cmd
+}
+
+func selfUpdateCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "self-update",
+		Short: "Install a release of invoker on this host or on a list of hosts",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.SelfUpdate(internal.SelfUpdateArgs{
+				Version: internal.ParseOrExit[string](cmd, "version"),
+				Hosts:   internal.ParseOrExit[[]string](cmd, "hosts"),
+				Phase:   internal.ParseOrExit[string](cmd, "phase"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().String("version", "", "release to install, e.g. v0.3.0")
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to update over ssh instead of this one")
+	cmd.PersistentFlags().String("phase", "", "only stage or activate the release, used for updating hosts")
+	cmd.PersistentFlags().MarkHidden("phase")
+
+	return cmd
+}
+
+func versionCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the invoker version, or check that a list of hosts run the same one",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.PrintVersion(internal.VersionArgs{
+				Hosts: internal.ParseOrExit[[]string](cmd, "hosts"),
+			})
+		},
+	}
+
+	cmd.PersistentFlags().StringSlice("hosts", []string{}, "hosts to compare over ssh")
+
+	return cmd
+}
+
+func pluginsCmdFunc() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugins",
+		Short: "List launcher plugins and configured plugins",
+		Run: func(cmd *cobra.Command, args []string) {
+			internal.ListPlugins()
+		},
+	}
 
 	return cmd
 }
@@ -103,16 +1361,94 @@ func randomPort() *cobra.Command {
 }
 
 func main() {
+	rootCmd.PersistentFlags().Bool("no-color", false, "print plain text even to a terminal, like setting NO_COLOR")
+	rootCmd.PersistentFlags().String("cache-dir", "", "cache directory mounted into containers and holding the state, like setting INVOKER_CACHE_DIR, else $XDG_CACHE_HOME or ~/.cache")
+	rootCmd.PersistentFlags().String("checkpoint-dir", "", "directory of the run directories, say on a data disk, like setting INVOKER_CHECKPOINT_DIR, else higgsfield in the cache directory")
+	rootCmd.PersistentFlags().String("namespace", "", "prefix of container names and image tags, keeps users sharing a host apart, from ~/.config/higgsfield/user.json if empty")
+
 	experimentCmd.AddCommand(runCmdFunc())
 	experimentCmd.AddCommand(killCmdFunc())
+	experimentCmd.AddCommand(psCmdFunc())
+	experimentCmd.AddCommand(restartCmdFunc())
+	experimentCmd.AddCommand(resumeCmdFunc())
+	experimentCmd.AddCommand(attachCmdFunc())
+	experimentCmd.AddCommand(stopCmdFunc())
+	experimentCmd.AddCommand(stopSweepCmdFunc())
+	experimentCmd.AddCommand(sweepStandingsCmdFunc())
+	experimentCmd.AddCommand(protectCmdFunc(true))
+	experimentCmd.AddCommand(protectCmdFunc(false))
+	experimentCmd.AddCommand(watchCmdFunc())
+	experimentCmd.AddCommand(warmCmdFunc())
+	experimentCmd.AddCommand(canaryCmdFunc())
+	experimentCmd.AddCommand(rolloutCmdFunc())
+	experimentCmd.AddCommand(diffCmdFunc())
+	experimentCmd.AddCommand(experimentsListCmdFunc())
+	experimentCmd.AddCommand(failureReportCmdFunc())
 
 	rootCmd.AddCommand(decodeSecrets())
 	rootCmd.AddCommand(randomName())
 	rootCmd.AddCommand(randomPort())
+	rootCmd.AddCommand(costCmdFunc())
+	rootCmd.AddCommand(exportHistoryCmdFunc())
+	rootCmd.AddCommand(topCmdFunc())
+	rootCmd.AddCommand(envReportCmdFunc())
+	rootCmd.AddCommand(stopAllCmdFunc())
+	rootCmd.AddCommand(debugBundleCmdFunc())
+	rootCmd.AddCommand(pushCmdFunc())
+	rootCmd.AddCommand(pullResultsCmdFunc())
+	rootCmd.AddCommand(selfUpdateCmdFunc())
+	rootCmd.AddCommand(versionCmdFunc())
+	rootCmd.AddCommand(pluginsCmdFunc())
+
+	imageCmd.AddCommand(imageInspectCmdFunc())
+	imageCmd.AddCommand(imagePruneCmdFunc())
+	rootCmd.AddCommand(imageCmd)
+	cloudCmd.AddCommand(cloudStatusCmdFunc())
+	cloudCmd.AddCommand(cloudLogsCmdFunc())
+	rootCmd.AddCommand(cloudCmd)
+	hostsCmd.AddCommand(hostsListCmdFunc())
+	rootCmd.AddCommand(hostsCmd)
+	runsCmd.AddCommand(runsListCmdFunc())
+	rootCmd.AddCommand(runsCmd)
+	autoscaleCmd.AddCommand(autoscaleStatusCmdFunc())
+	rootCmd.AddCommand(autoscaleCmd)
+
+	metricsCmd := metricsCmdFunc()
+	metricsCmd.AddCommand(metricsServeCmdFunc())
+	rootCmd.AddCommand(metricsCmd)
+
+	stateCmd.AddCommand(stateShowCmdFunc())
+	stateCmd.AddCommand(stateServeCmdFunc())
+	stateCmd.AddCommand(stateSimulateCmdFunc())
+	stateCmd.AddCommand(stateExportCmdFunc())
+	stateCmd.AddCommand(stateImportCmdFunc())
+	rootCmd.AddCommand(stateCmd)
+	triggerCmd.AddCommand(triggerServeCmdFunc())
+	rootCmd.AddCommand(triggerCmd)
+
+	rootCmd.AddCommand(notebookCmdFunc())
+	rootCmd.AddCommand(serveModelCmdFunc())
+	rootCmd.AddCommand(exportCmdFunc())
+	rootCmd.AddCommand(gcCmdFunc())
+	rootCmd.AddCommand(cleanupCmdFunc())
+
+	benchCmd.AddCommand(benchNCCLCmdFunc())
+	rootCmd.AddCommand(benchCmd)
+
+	nodeCmd.AddCommand(nodeHealthCmdFunc())
+	nodeCmd.AddCommand(nodeClearCmdFunc())
+	rootCmd.AddCommand(nodeCmd)
 	rootCmd.AddCommand(experimentCmd)
 
+	// unknown commands may be launcher plugins
+	if len(os.Args) > 1 {
+		if cmd, _, err := rootCmd.Find(os.Args[1:]); err != nil || cmd == rootCmd {
+			internal.ExecLauncherPlugin(os.Args[1], os.Args[2:])
+		}
+	}
+
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(internal.ExitValidation)
 	}
 }